@@ -107,6 +107,13 @@ type ReadResult interface {
 type MountOptions struct {
 	AllowOther bool
 
+	// If set, the kernel checks file permissions against the mode,
+	// uid and gid of the file attributes itself, and never sends
+	// ACCESS. If unset, the kernel leaves permission checks to the
+	// file system: it sends ACCESS for access(2) and chdir(2), and
+	// otherwise relies on the operations failing with EACCES.
+	DefaultPermissions bool
+
 	// Options are passed as -o string to fusermount.
 	Options []string
 
@@ -154,6 +161,35 @@ type MountOptions struct {
 	// If set, ask kernel to forward file locks to FUSE. If using,
 	// you must implement the GetLk/SetLk/SetLkw methods.
 	EnableLocks bool
+
+	// If set, pass POLL requests to the file system. By default,
+	// polling is switched off when mounting, as a process polling
+	// files in its own mount can starve the threads that serve
+	// the POLL request. Only set this if the serving process does
+	// not access the mount itself.
+	EnablePoll bool
+
+	// If set, ask the kernel to use writeback caching. Writes are
+	// then buffered in the page cache, and the kernel maintains
+	// file size and modification time itself. The file size grows
+	// with the WRITE requests that flush the cache, and the
+	// timestamps are sent later as SETATTR requests that carry
+	// only FATTR_MTIME and FATTR_CTIME.
+	EnableWriteback bool
+
+	// If set, ask the kernel to pass O_TRUNC to OPEN, so the file
+	// system truncates the file as part of opening it. By
+	// default, the kernel removes O_TRUNC from the OPEN flags, and
+	// truncates the file with a SETATTR of size 0 on the new file
+	// handle once OPEN succeeded. Only set this if Open handles
+	// O_TRUNC.
+	EnableAtomicTrunc bool
+
+	// If set, don't ask the kernel for parallel directory
+	// operations, so it serializes LOOKUP and READDIR requests
+	// within a directory. Set this if the file system cannot
+	// handle several of them for one directory at the same time.
+	DisableParallelDirOps bool
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -268,3 +304,44 @@ type RawFileSystem interface {
 	// talk back to the kernel (through notify methods).
 	Init(*Server)
 }
+
+// RawOpcodeHandler can be implemented by a RawFileSystem to serve
+// opcodes that the Server does not implement, eg. ones added to the
+// protocol after this package was written. `data` is the request
+// following the InHeader, and is reused once HandleOpcode returns.
+// The returned bytes are sent as the reply, after the OutHeader.
+type RawOpcodeHandler interface {
+	HandleOpcode(cancel <-chan struct{}, header *InHeader, opcode uint32, data []byte) (out []byte, code Status)
+}
+
+// RawIoctlHandler can be implemented by a RawFileSystem to handle
+// ioctl(2); without it, IOCTL requests fail with ENOSYS. The input
+// buffer holds InSize bytes copied from the caller, and `buf` has
+// room for OutSize bytes. The returned data is copied back to the
+// caller. To get differently sized buffers for an unrestricted
+// ioctl, set FUSE_IOCTL_RETRY in out.Flags, and return the buffers
+// as IoctlIovec entries.
+type RawIoctlHandler interface {
+	Ioctl(cancel <-chan struct{}, input *IoctlIn, inData []byte, out *IoctlOut, buf []byte) (outData []byte, code Status)
+}
+
+// RawPollHandler can be implemented by a RawFileSystem to support
+// poll(2); without it, POLL requests fail with ENOSYS, which switches
+// off polling for the whole mount. Poll returns the events that are
+// ready on a file. If FUSE_POLL_SCHEDULE_NOTIFY is set in
+// input.Flags, the kernel should be told with
+// Server.PollWakeupNotify(input.Kh) once the ready events change.
+type RawPollHandler interface {
+	Poll(cancel <-chan struct{}, input *PollIn, out *PollOut) (code Status)
+}
+
+// RawEntryReplyHandler can be implemented by a RawFileSystem to act
+// once the reply to a request that returns entries (LOOKUP, MKNOD,
+// MKDIR, SYMLINK, LINK, CREATE and READDIRPLUS) has been written.
+// The kernel ignores notifications for nodes it does not know, so
+// this is the first point where they can be sent for new nodes.
+// `code` is not OK if the request failed or the reply could not be
+// written.
+type RawEntryReplyHandler interface {
+	EntryReplied(header *InHeader, code Status)
+}
@@ -27,6 +27,12 @@ type DirEntry struct {
 
 	// Ino is the inode number.
 	Ino uint64
+
+	// Off is the offset of this entry in the directory
+	// stream. The kernel passes it back to continue reading after
+	// this entry. If zero, the offset is one more than the offset
+	// of the previous entry.
+	Off uint64
 }
 
 func (d DirEntry) String() string {
@@ -54,12 +60,17 @@ func NewDirEntryList(data []byte, off uint64) *DirEntryList {
 // AddDirEntry tries to add an entry, and reports whether it
 // succeeded.
 func (l *DirEntryList) AddDirEntry(e DirEntry) bool {
-	return l.Add(0, e.Name, e.Ino, e.Mode)
+	return l.addEntry(0, e)
 }
 
 // Add adds a direntry to the DirEntryList, returning whether it
 // succeeded.
 func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) bool {
+	return l.addEntry(prefix, DirEntry{Name: name, Ino: inode, Mode: mode})
+}
+
+func (l *DirEntryList) addEntry(prefix int, e DirEntry) bool {
+	name, inode, mode := e.Name, e.Ino, e.Mode
 	if inode == 0 {
 		inode = FUSE_UNKNOWN_INO
 	}
@@ -75,6 +86,9 @@ func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) b
 	oldLen += prefix
 	dirent := (*_Dirent)(unsafe.Pointer(&l.buf[oldLen]))
 	dirent.Off = l.offset + 1
+	if e.Off != 0 {
+		dirent.Off = e.Off
+	}
 	dirent.Ino = inode
 	dirent.NameLen = uint32(len(name))
 	dirent.Typ = (mode & 0170000) >> 12
@@ -95,8 +109,7 @@ func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) b
 // pointer.
 func (l *DirEntryList) AddDirLookupEntry(e DirEntry) *EntryOut {
 	lastStart := len(l.buf)
-	ok := l.Add(int(unsafe.Sizeof(EntryOut{})), e.Name,
-		e.Ino, e.Mode)
+	ok := l.addEntry(int(unsafe.Sizeof(EntryOut{})), e)
 	if !ok {
 		return nil
 	}
@@ -5,9 +5,13 @@
 package fuse
 
 import (
+	"io/ioutil"
 	"os"
+	"reflect"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestToStatus(t *testing.T) {
@@ -28,3 +32,124 @@ func TestToStatus(t *testing.T) {
 		t.Errorf("Wrong conversion %v != %v", errNo, syscall.ENOENT)
 	}
 }
+
+func TestReadResultFdBytes(t *testing.T) {
+	f, err := ioutil.TempFile("", "readresult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := ReadResultFd(f.Fd(), 6, 100)
+	buf := make([]byte, 100)
+	data, st := r.Bytes(buf)
+	if !st.Ok() {
+		t.Fatalf("Bytes: %v", st)
+	}
+	if got := string(data); got != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+
+	// The fallback must not read more than the buffer holds.
+	data, st = r.Bytes(buf[:2])
+	if !st.Ok() || string(data) != "wo" {
+		t.Errorf("got %q %v, want %q", data, st, "wo")
+	}
+}
+
+func TestReadResultInto(t *testing.T) {
+	dest := make([]byte, 4)
+	r := ReadResultInto(dest, []byte("hello"))
+	data, st := r.Bytes(nil)
+	if !st.Ok() || string(data) != "hell" || r.Size() != 4 {
+		t.Errorf("got %q %v, size %d, want %q", data, st, r.Size(), "hell")
+	}
+	if &data[0] != &dest[0] {
+		t.Errorf("data was not copied into dest")
+	}
+	r.Done()
+
+	src := []byte("data")
+	if allocs := testing.AllocsPerRun(100, func() {
+		r := ReadResultInto(dest, src)
+		r.Bytes(nil)
+		r.Done()
+	}); allocs != 0 {
+		t.Errorf("got %v allocations per read, want 0", allocs)
+	}
+}
+
+func benchmarkReadResult(b *testing.B, newResult func(dest, src []byte) ReadResult) {
+	dest := make([]byte, 4096)
+	src := make([]byte, 512)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := newResult(dest, src)
+		r.Bytes(dest)
+		r.Done()
+	}
+}
+
+func BenchmarkReadResultData(b *testing.B) {
+	benchmarkReadResult(b, func(dest, src []byte) ReadResult {
+		n := copy(dest, src)
+		return ReadResultData(dest[:n])
+	})
+}
+
+func BenchmarkReadResultInto(b *testing.B) {
+	benchmarkReadResult(b, ReadResultInto)
+}
+
+func TestOptionsStrings(t *testing.T) {
+	o := MountOptions{
+		Options:            []string{"ro"},
+		AllowOther:         true,
+		DefaultPermissions: true,
+		Name:               "test",
+	}
+	want := []string{"ro", "allow_other", "default_permissions", "subtype=test"}
+	if got := o.optionsStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInodeRetrieveCacheTimeout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// The query goes into a pipe, so the kernel never answers.
+	ms := &Server{
+		opts:            &MountOptions{MaxWrite: 4096},
+		mountFd:         int(w.Fd()),
+		kernelSettings:  InitIn{Major: 7, Minor: 28},
+		retrieveTab:     make(map[uint64]*retrieveCacheRequest),
+		retrieveTimeout: time.Millisecond,
+	}
+	dest := make([]byte, 4)
+	if n, st := ms.InodeRetrieveCache(1, 0, dest); st != Status(syscall.ETIMEDOUT) {
+		t.Fatalf("got %d, %v, want ETIMEDOUT", n, st)
+	}
+	if len(ms.retrieveTab) != 0 {
+		t.Errorf("timed out query stays queued: %v", ms.retrieveTab)
+	}
+
+	// A late reply is dropped.
+	in := NotifyRetrieveIn{InHeader: InHeader{Unique: 0, NodeId: 1}}
+	doNotifyReply(ms, &request{
+		inData: unsafe.Pointer(&in),
+		arg:    []byte("data"),
+	})
+	if !reflect.DeepEqual(dest, make([]byte, 4)) {
+		t.Errorf("late reply was copied into dest: %q", dest)
+	}
+}
@@ -67,8 +67,9 @@ const (
 	_OP_NOTIFY_STORE_CACHE    = int32(102)
 	_OP_NOTIFY_RETRIEVE_CACHE = int32(103)
 	_OP_NOTIFY_DELETE         = int32(104) // protocol version 18
+	_OP_NOTIFY_POLL           = int32(105)
 
-	_OPCODE_COUNT = int32(105)
+	_OPCODE_COUNT = int32(106)
 )
 
 ////////////////////////////////////////////////////////////////
@@ -94,6 +95,15 @@ func doInit(server *Server, req *request) {
 	if server.opts.EnableLocks {
 		server.kernelSettings.Flags |= CAP_FLOCK_LOCKS | CAP_POSIX_LOCKS
 	}
+	if server.opts.EnableWriteback {
+		server.kernelSettings.Flags |= input.Flags & CAP_WRITEBACK_CACHE
+	}
+	if server.opts.EnableAtomicTrunc {
+		server.kernelSettings.Flags |= input.Flags & CAP_ATOMIC_O_TRUNC
+	}
+	if server.opts.DisableParallelDirOps {
+		server.kernelSettings.Flags &^= CAP_PARALLEL_DIROPS
+	}
 
 	if input.Minor >= 13 {
 		server.setSplice()
@@ -254,9 +264,14 @@ func doGetXAttr(server *Server, req *request) {
 		req.status = ENOSYS
 	}
 
-	if input.Size == 0 && req.status == ERANGE {
-		// For input.size==0, returning ERANGE is an error.
+	if input.Size == 0 && (req.status == ERANGE || req.status.Ok()) {
+		// For input.size==0, the kernel asks for the size
+		// only, which it expects in the structured reply. File
+		// systems may answer it with ERANGE, or like
+		// getxattr(2) with an empty buffer, with the size and
+		// no data.
 		req.status = OK
+		req.flatData = req.flatData[:0]
 		out.Size = n
 	} else if req.status.Ok() {
 		req.flatData = req.flatData[:n]
@@ -417,8 +432,27 @@ func doStatFs(server *Server, req *request) {
 	}
 }
 
+func doPoll(server *Server, req *request) {
+	h, ok := server.fileSystem.(RawPollHandler)
+	if !ok {
+		req.status = ENOSYS
+		return
+	}
+	in := (*PollIn)(req.inData)
+	out := (*PollOut)(req.outData())
+	req.status = h.Poll(req.cancel, in, out)
+}
+
 func doIoctl(server *Server, req *request) {
-	req.status = ENOSYS
+	h, ok := server.fileSystem.(RawIoctlHandler)
+	if !ok {
+		req.status = ENOSYS
+		return
+	}
+	in := (*IoctlIn)(req.inData)
+	out := (*IoctlOut)(req.outData())
+	buf := server.allocOut(req, in.OutSize)
+	req.flatData, req.status = h.Ioctl(req.cancel, in, req.arg, out, buf)
 }
 
 func doDestroy(server *Server, req *request) {
@@ -492,6 +526,17 @@ type operationHandler struct {
 
 var operationHandlers []*operationHandler
 
+// returnsEntries reports whether replies to the opcode introduce
+// nodes to the kernel.
+func returnsEntries(op int32) bool {
+	switch op {
+	case _OP_LOOKUP, _OP_MKNOD, _OP_MKDIR, _OP_SYMLINK, _OP_LINK,
+		_OP_CREATE, _OP_READDIRPLUS:
+		return true
+	}
+	return false
+}
+
 func operationName(op int32) string {
 	h := getHandler(op)
 	if h == nil {
@@ -548,8 +593,8 @@ func init() {
 		_OP_CREATE:          unsafe.Sizeof(CreateIn{}),
 		_OP_INTERRUPT:       unsafe.Sizeof(InterruptIn{}),
 		_OP_BMAP:            unsafe.Sizeof(_BmapIn{}),
-		_OP_IOCTL:           unsafe.Sizeof(_IoctlIn{}),
-		_OP_POLL:            unsafe.Sizeof(_PollIn{}),
+		_OP_IOCTL:           unsafe.Sizeof(IoctlIn{}),
+		_OP_POLL:            unsafe.Sizeof(PollIn{}),
 		_OP_NOTIFY_REPLY:    unsafe.Sizeof(NotifyRetrieveIn{}),
 		_OP_FALLOCATE:       unsafe.Sizeof(FallocateIn{}),
 		_OP_READDIRPLUS:     unsafe.Sizeof(ReadIn{}),
@@ -578,13 +623,14 @@ func init() {
 		_OP_GETLK:                 unsafe.Sizeof(LkOut{}),
 		_OP_CREATE:                unsafe.Sizeof(CreateOut{}),
 		_OP_BMAP:                  unsafe.Sizeof(_BmapOut{}),
-		_OP_IOCTL:                 unsafe.Sizeof(_IoctlOut{}),
-		_OP_POLL:                  unsafe.Sizeof(_PollOut{}),
+		_OP_IOCTL:                 unsafe.Sizeof(IoctlOut{}),
+		_OP_POLL:                  unsafe.Sizeof(PollOut{}),
 		_OP_NOTIFY_INVAL_ENTRY:    unsafe.Sizeof(NotifyInvalEntryOut{}),
 		_OP_NOTIFY_INVAL_INODE:    unsafe.Sizeof(NotifyInvalInodeOut{}),
 		_OP_NOTIFY_STORE_CACHE:    unsafe.Sizeof(NotifyStoreOut{}),
 		_OP_NOTIFY_RETRIEVE_CACHE: unsafe.Sizeof(NotifyRetrieveOut{}),
 		_OP_NOTIFY_DELETE:         unsafe.Sizeof(NotifyInvalDeleteOut{}),
+		_OP_NOTIFY_POLL:           unsafe.Sizeof(NotifyPollWakeupOut{}),
 		_OP_LSEEK:                 unsafe.Sizeof(LseekOut{}),
 		_OP_COPY_FILE_RANGE:       unsafe.Sizeof(WriteOut{}),
 	} {
@@ -637,6 +683,7 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    "NOTIFY_STORE",
 		_OP_NOTIFY_RETRIEVE_CACHE: "NOTIFY_RETRIEVE",
 		_OP_NOTIFY_DELETE:         "NOTIFY_DELETE",
+		_OP_NOTIFY_POLL:           "NOTIFY_POLL",
 		_OP_FALLOCATE:             "FALLOCATE",
 		_OP_READDIRPLUS:           "READDIRPLUS",
 		_OP_RENAME2:               "RENAME2",
@@ -682,6 +729,7 @@ func init() {
 		_OP_RENAME:          doRename,
 		_OP_STATFS:          doStatFs,
 		_OP_IOCTL:           doIoctl,
+		_OP_POLL:            doPoll,
 		_OP_DESTROY:         doDestroy,
 		_OP_NOTIFY_REPLY:    doNotifyReply,
 		_OP_FALLOCATE:       doFallocate,
@@ -715,6 +763,9 @@ func init() {
 		_OP_GETLK:                 func(ptr unsafe.Pointer) interface{} { return (*LkOut)(ptr) },
 		_OP_LSEEK:                 func(ptr unsafe.Pointer) interface{} { return (*LseekOut)(ptr) },
 		_OP_COPY_FILE_RANGE:       func(ptr unsafe.Pointer) interface{} { return (*WriteOut)(ptr) },
+		_OP_IOCTL:                 func(ptr unsafe.Pointer) interface{} { return (*IoctlOut)(ptr) },
+		_OP_POLL:                  func(ptr unsafe.Pointer) interface{} { return (*PollOut)(ptr) },
+		_OP_NOTIFY_POLL:           func(ptr unsafe.Pointer) interface{} { return (*NotifyPollWakeupOut)(ptr) },
 	} {
 		operationHandlers[op].DecodeOut = f
 	}
@@ -728,7 +779,8 @@ func init() {
 		_OP_LISTXATTR:       func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
 		_OP_SETATTR:         func(ptr unsafe.Pointer) interface{} { return (*SetAttrIn)(ptr) },
 		_OP_INIT:            func(ptr unsafe.Pointer) interface{} { return (*InitIn)(ptr) },
-		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*_IoctlIn)(ptr) },
+		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*IoctlIn)(ptr) },
+		_OP_POLL:            func(ptr unsafe.Pointer) interface{} { return (*PollIn)(ptr) },
 		_OP_OPEN:            func(ptr unsafe.Pointer) interface{} { return (*OpenIn)(ptr) },
 		_OP_MKNOD:           func(ptr unsafe.Pointer) interface{} { return (*MknodIn)(ptr) },
 		_OP_CREATE:          func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
@@ -8,17 +8,20 @@ package fuse
 const pollHackName = ".go-fuse-epoll-hack"
 const pollHackInode = ^uint64(0)
 
+// pollHackAttr is the attribute of the poll hack file.
+var pollHackAttr = Attr{
+	Ino:   pollHackInode,
+	Mode:  S_IFREG | 0644,
+	Nlink: 1,
+}
+
 func doPollHackLookup(ms *Server, req *request) {
 	switch req.inHeader.Opcode {
 	case _OP_CREATE:
 		out := (*CreateOut)(req.outData())
 		out.EntryOut = EntryOut{
 			NodeId: pollHackInode,
-			Attr: Attr{
-				Ino:   pollHackInode,
-				Mode:  S_IFREG | 0644,
-				Nlink: 1,
-			},
+			Attr:   pollHackAttr,
 		}
 		out.OpenOut = OpenOut{
 			Fh: pollHackInode,
@@ -32,3 +35,21 @@ func doPollHackLookup(ms *Server, req *request) {
 		req.status = EIO
 	}
 }
+
+// doPollHackNode answers requests for the poll hack file itself.
+func doPollHackNode(ms *Server, req *request) {
+	switch req.inHeader.Opcode {
+	case _OP_GETATTR:
+		// With default_permissions, the kernel asks for the
+		// attributes before checking access.
+		out := (*AttrOut)(req.outData())
+		*out = AttrOut{Attr: pollHackAttr}
+		req.status = OK
+	case _OP_POLL:
+		req.status = ENOSYS
+	default:
+		// We want to avoid switching off features through our
+		// poll hack, so don't use ENOSYS
+		req.status = EIO
+	}
+}
@@ -47,7 +47,8 @@ var (
 		CAP_NO_OPENDIR_SUPPORT: "NO_OPENDIR_SUPPORT",
 	}
 	releaseFlagNames = map[int64]string{
-		RELEASE_FLUSH: "FLUSH",
+		RELEASE_FLUSH:        "FLUSH",
+		RELEASE_FLOCK_UNLOCK: "FLOCK_UNLOCK",
 	}
 	openFlagNames = map[int64]string{
 		int64(os.O_WRONLY):        "WRONLY",
@@ -68,6 +69,7 @@ var (
 		FOPEN_DIRECT_IO:   "DIRECT",
 		FOPEN_KEEP_CACHE:  "CACHE",
 		FOPEN_NONSEEKABLE: "NONSEEK",
+		FOPEN_CACHE_DIR:   "CACHE_DIR",
 	}
 	accessFlagName = map[int64]string{
 		X_OK: "x",
@@ -290,6 +292,21 @@ func (o *LseekOut) string() string {
 	return fmt.Sprintf("{%d}", o.Offset)
 }
 
+func (in *PollIn) string() string {
+	return fmt.Sprintf("{Fh %d kh %d flags 0x%x events 0x%x}",
+		in.Fh, in.Kh, in.Flags, in.Events)
+}
+
+func (in *IoctlIn) string() string {
+	return fmt.Sprintf("{Fh %d cmd 0x%x arg 0x%x flags 0x%x in %db out %db}",
+		in.Fh, in.Cmd, in.Arg, in.Flags, in.InSize, in.OutSize)
+}
+
+func (o *IoctlOut) string() string {
+	return fmt.Sprintf("{result %d flags 0x%x iovs %d/%d}",
+		o.Result, o.Flags, o.InIovs, o.OutIovs)
+}
+
 // Print pretty prints FUSE data types for kernel communication
 func Print(obj interface{}) string {
 	t, ok := obj.(interface {
@@ -6,6 +6,7 @@ package fuse
 
 import (
 	"io"
+	"sync"
 	"syscall"
 )
 
@@ -13,6 +14,16 @@ import (
 type readResultData struct {
 	// Raw bytes for the read.
 	Data []byte
+
+	// pooled is set for results from ReadResultInto, which are
+	// recycled in Done.
+	pooled bool
+}
+
+var readResultDataPool = sync.Pool{
+	New: func() interface{} {
+		return &readResultData{pooled: true}
+	},
 }
 
 func (r *readResultData) Size() int {
@@ -20,6 +31,10 @@ func (r *readResultData) Size() int {
 }
 
 func (r *readResultData) Done() {
+	if r.pooled {
+		r.Data = nil
+		readResultDataPool.Put(r)
+	}
 }
 
 func (r *readResultData) Bytes(buf []byte) ([]byte, Status) {
@@ -27,9 +42,30 @@ func (r *readResultData) Bytes(buf []byte) ([]byte, Status) {
 }
 
 func ReadResultData(b []byte) ReadResult {
-	return &readResultData{b}
+	return &readResultData{Data: b}
+}
+
+// ReadResultInto copies src into dest, and returns a ReadResult for
+// the copied bytes. Unlike ReadResultData, it does not allocate: the
+// result is recycled once the server has sent the data to the
+// kernel. It is meant for file systems serving many small reads,
+// with `dest` the buffer passed to Read, so the copy is the only
+// one.
+//
+// The result may only be returned from Read, once. It must not be
+// kept, or used otherwise, as it is reused for other reads after
+// Done is called.
+func ReadResultInto(dest, src []byte) ReadResult {
+	n := copy(dest, src)
+	r := readResultDataPool.Get().(*readResultData)
+	r.Data = dest[:n]
+	return r
 }
 
+// ReadResultFd returns a ReadResult that reads sz bytes at offset
+// off from fd. If the kernel supports it, the data is spliced into
+// the FUSE device, avoiding a copy through user space. Otherwise, it
+// is read into a buffer using pread(2).
 func ReadResultFd(fd uintptr, off int64, sz int) ReadResult {
 	return &readResultFd{fd, off, sz}
 }
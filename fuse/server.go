@@ -15,6 +15,7 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -57,6 +58,10 @@ type Server struct {
 	retrieveNext uint64
 	retrieveTab  map[uint64]*retrieveCacheRequest // notifyUnique -> retrieve request
 
+	// retrieveTimeout bounds the wait for the kernel's reply to a
+	// retrieve query.
+	retrieveTimeout time.Duration
+
 	singleReader bool
 	canSplice    bool
 	loops        sync.WaitGroup
@@ -65,6 +70,9 @@ type Server struct {
 
 	// for implementing single threaded processing.
 	requestProcessingMu sync.Mutex
+
+	// unmountHooks run after a successful Unmount.
+	unmountHooks []func()
 }
 
 // SetDebug is deprecated. Use MountOptions.Debug instead.
@@ -124,11 +132,83 @@ func (ms *Server) Unmount() (err error) {
 	// Wait for event loops to exit.
 	ms.loops.Wait()
 	ms.mountPoint = ""
+	for _, fn := range ms.unmountHooks {
+		fn()
+	}
 	return err
 }
 
+// OnUnmount registers fn to be called once Unmount has succeeded,
+// eg. to clean up the mount point. It is not called if the file
+// system is unmounted by other means, such as fusermount -u. It
+// must not be called concurrently with Unmount.
+func (ms *Server) OnUnmount(fn func()) {
+	ms.unmountHooks = append(ms.unmountHooks, fn)
+}
+
 // NewServer creates a server and attaches it to the given directory.
 func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint = filepath.Clean(mountPoint)
+	if !filepath.IsAbs(mountPoint) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
+	}
+	fd, err := mount(mountPoint, ms.opts, ms.ready)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mountPoint = mountPoint
+	ms.mountFd = fd
+
+	if code := ms.handleInit(); !code.Ok() {
+		syscall.Close(fd)
+		// TODO - unmount as well?
+		return nil, fmt.Errorf("init: %s", code)
+	}
+	return ms, nil
+}
+
+// NewServerFd creates a server for a FUSE connection that is already
+// mounted, eg. by a privileged helper that opened /dev/fuse, called
+// mount(2) with the "fd=N" option and passed the descriptor on. The
+// server does not mount or unmount anything: Unmount only returns,
+// and the serve loop ends once the caller unmounts the file system.
+// NewServerFd returns an error if fd is not a character device, and
+// waits for the kernel's INIT request. Once it succeeds, the server
+// owns fd, and closes it when the loop ends.
+func NewServerFd(fs RawFileSystem, fd int, opts *MountOptions) (*Server, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, &os.SyscallError{Syscall: "fstat", Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return nil, fmt.Errorf("fd %d is not a FUSE device", fd)
+	}
+
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	ms.mountFd = fd
+	close(ms.ready)
+
+	if code := ms.handleInit(); !code.Ok() {
+		return nil, fmt.Errorf("init: %s", code)
+	}
+	return ms, nil
+}
+
+// newServer sets up a server that is not connected yet.
+func newServer(fs RawFileSystem, opts *MountOptions) (*Server, error) {
 	if opts == nil {
 		opts = &MountOptions{
 			MaxBackground: _DEFAULT_BACKGROUND_TASKS,
@@ -161,9 +241,10 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	}
 
 	ms := &Server{
-		fileSystem:  fs,
-		opts:        &o,
-		retrieveTab: make(map[uint64]*retrieveCacheRequest),
+		fileSystem:      fs,
+		opts:            &o,
+		retrieveTab:     make(map[uint64]*retrieveCacheRequest),
+		retrieveTimeout: defaultRetrieveTimeout,
 		// OSX has races when multiple routines read from the
 		// FUSE device: on unmount, sometime some reads do not
 		// error-out, meaning that unmount will hang.
@@ -176,28 +257,6 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		}
 	}
 	ms.readPool.New = func() interface{} { return make([]byte, o.MaxWrite+pageSize) }
-
-	mountPoint = filepath.Clean(mountPoint)
-	if !filepath.IsAbs(mountPoint) {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
-	}
-	fd, err := mount(mountPoint, &o, ms.ready)
-	if err != nil {
-		return nil, err
-	}
-
-	ms.mountPoint = mountPoint
-	ms.mountFd = fd
-
-	if code := ms.handleInit(); !code.Ok() {
-		syscall.Close(fd)
-		// TODO - unmount as well?
-		return nil, fmt.Errorf("init: %s", code)
-	}
 	return ms, nil
 }
 
@@ -208,6 +267,9 @@ func (o *MountOptions) optionsStrings() []string {
 	if o.AllowOther {
 		r = append(r, "allow_other")
 	}
+	if o.DefaultPermissions {
+		r = append(r, "default_permissions")
+	}
 
 	if o.FsName != "" {
 		r = append(r, "fsname="+o.FsName)
@@ -454,17 +516,17 @@ func (ms *Server) handleRequest(req *request) Status {
 	}
 
 	if req.inHeader.NodeId == pollHackInode {
-		// We want to avoid switching off features through our
-		// poll hack, so don't use ENOSYS
-		req.status = EIO
-		if req.inHeader.Opcode == _OP_POLL {
-			req.status = ENOSYS
-		}
+		doPollHackNode(ms, req)
 	} else if req.inHeader.NodeId == FUSE_ROOT_ID && len(req.filenames) > 0 && req.filenames[0] == pollHackName {
 		doPollHackLookup(ms, req)
-	} else if req.status.Ok() && req.handler.Func == nil {
-		log.Printf("Unimplemented opcode %v", operationName(req.inHeader.Opcode))
-		req.status = ENOSYS
+	} else if req.handler == nil || req.handler.Func == nil {
+		if h, ok := ms.fileSystem.(RawOpcodeHandler); ok {
+			data := req.inputBuf[unsafe.Sizeof(InHeader{}):]
+			req.flatData, req.status = h.HandleOpcode(req.cancel, req.inHeader, uint32(req.inHeader.Opcode), data)
+		} else if req.status.Ok() {
+			log.Printf("Unimplemented opcode %v", operationName(req.inHeader.Opcode))
+			req.status = ENOSYS
+		}
 	} else if req.status.Ok() {
 		req.handler.Func(ms, req)
 	}
@@ -474,6 +536,15 @@ func (ms *Server) handleRequest(req *request) Status {
 		log.Printf("writer: Write/Writev failed, err: %v. opcode: %v",
 			errNo, operationName(req.inHeader.Opcode))
 	}
+	if returnsEntries(req.inHeader.Opcode) {
+		if h, ok := ms.fileSystem.(RawEntryReplyHandler); ok {
+			code := req.status
+			if errNo != 0 {
+				code = Status(errNo)
+			}
+			h.EntryReplied(req.inHeader, code)
+		}
+	}
 	ms.returnRequest(req)
 	return Status(errNo)
 }
@@ -613,17 +684,22 @@ func (ms *Server) inodeNotifyStoreCache32(node uint64, offset int64, data []byte
 //
 // The kernel returns ENOENT if it does not currently have entry for this inode
 // in its dentry cache.
+//
+// If the kernel does not answer within 10 seconds, the query is dropped,
+// and ETIMEDOUT is returned; a late reply is then ignored, and does not
+// touch dest.
 func (ms *Server) InodeRetrieveCache(node uint64, offset int64, dest []byte) (n int, st Status) {
 	// the kernel won't send us in one go more then what we negotiated as MaxWrite.
 	// retrieve the data in chunks.
 	// TODO spawn some number of readahead retrievers in parallel.
+	deadline := time.Now().Add(ms.retrieveTimeout)
 	ntotal := 0
 	for {
 		chunkSize := len(dest)
 		if chunkSize > ms.opts.MaxWrite {
 			chunkSize = ms.opts.MaxWrite
 		}
-		n, st = ms.inodeRetrieveCache1(node, offset, dest[:chunkSize])
+		n, st = ms.inodeRetrieveCache1(node, offset, dest[:chunkSize], deadline)
 		if st != OK || n == 0 {
 			break
 		}
@@ -643,7 +719,7 @@ func (ms *Server) InodeRetrieveCache(node uint64, offset int64, dest []byte) (n
 
 // inodeRetrieveCache1 is internal worker for InodeRetrieveCache which
 // actually talks to kernel and retrieves chunks not larger than ms.opts.MaxWrite.
-func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n int, st Status) {
+func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte, deadline time.Time) (n int, st Status) {
 	if !ms.kernelSettings.SupportsNotify(NOTIFY_RETRIEVE_CACHE) {
 		return 0, ENOSYS
 	}
@@ -714,10 +790,35 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 	// NotifyRetrieveOut sent to the kernel successfully. Now the kernel
 	// have to return data in a separate write-style NotifyReply request.
 	// Wait for the result.
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-reading.ready:
+		return reading.n, reading.st
+	case <-t.C:
+	}
+
+	ms.retrieveMu.Lock()
+	if ms.retrieveTab[q.NotifyUnique] == reading {
+		// Dequeue, so a late reply is dropped instead of
+		// copied into dest.
+		delete(ms.retrieveTab, q.NotifyUnique)
+		ms.retrieveMu.Unlock()
+		return 0, Status(syscall.ETIMEDOUT)
+	}
+	ms.retrieveMu.Unlock()
+
+	// The reply or umount raced with the timeout, and has
+	// dequeued the request already. It finishes without waiting
+	// for the kernel.
 	<-reading.ready
 	return reading.n, reading.st
 }
 
+// defaultRetrieveTimeout is how long InodeRetrieveCache waits for the
+// kernel.
+const defaultRetrieveTimeout = 10 * time.Second
+
 // retrieveCacheRequest represents in-flight cache retrieve request.
 type retrieveCacheRequest struct {
 	nodeid uint64
@@ -771,6 +872,35 @@ func (ms *Server) DeleteNotify(parent uint64, child uint64, name string) Status
 	return result
 }
 
+// PollWakeupNotify tells the kernel that the ready events for the
+// poll handle `kh` (see PollIn.Kh) may have changed, so processes
+// waiting in poll(2) are woken up. You should not hold any FUSE
+// filesystem locks, as that can lead to deadlock.
+func (ms *Server) PollWakeupNotify(kh uint64) Status {
+	if !ms.kernelSettings.SupportsNotify(NOTIFY_POLL) {
+		return ENOSYS
+	}
+	req := request{
+		inHeader: &InHeader{
+			Opcode: _OP_NOTIFY_POLL,
+		},
+		handler: operationHandlers[_OP_NOTIFY_POLL],
+		status:  NOTIFY_POLL,
+	}
+	entry := (*NotifyPollWakeupOut)(req.outData())
+	entry.Kh = kh
+
+	// Protect against concurrent close.
+	ms.writeMu.Lock()
+	result := ms.write(&req)
+	ms.writeMu.Unlock()
+
+	if ms.opts.Debug {
+		log.Println("Response: POLL_NOTIFY", result)
+	}
+	return result
+}
+
 // EntryNotify should be used if the existence status of an entry
 // within a directory changes. You should not hold any FUSE filesystem
 // locks, as that can lead to deadlock.
@@ -817,6 +947,8 @@ func (in *InitIn) SupportsVersion(maj, min uint32) bool {
 // supported. Pass any of the NOTIFY_* types as argument.
 func (in *InitIn) SupportsNotify(notifyType int) bool {
 	switch notifyType {
+	case NOTIFY_POLL:
+		return in.SupportsVersion(7, 11)
 	case NOTIFY_INVAL_ENTRY:
 		return in.SupportsVersion(7, 12)
 	case NOTIFY_INVAL_INODE:
@@ -837,5 +969,8 @@ func (ms *Server) WaitMount() error {
 	if err != nil {
 		return err
 	}
+	if ms.opts.EnablePoll || ms.mountPoint == "" {
+		return nil
+	}
 	return pollHack(ms.mountPoint)
 }
@@ -232,7 +232,13 @@ func (s *SetAttrInCommon) GetCTime() (time.Time, bool) {
 	return t, false
 }
 
-const RELEASE_FLUSH = (1 << 0)
+const (
+	RELEASE_FLUSH = (1 << 0)
+
+	// RELEASE_FLOCK_UNLOCK is set if the file was flock(2)ed; the
+	// locks of ReleaseIn.LockOwner must be dropped.
+	RELEASE_FLOCK_UNLOCK = (1 << 1)
+)
 
 type ReleaseIn struct {
 	InHeader
@@ -253,6 +259,11 @@ const (
 	FOPEN_DIRECT_IO   = (1 << 0)
 	FOPEN_KEEP_CACHE  = (1 << 1)
 	FOPEN_NONSEEKABLE = (1 << 2)
+
+	// FOPEN_CACHE_DIR lets the kernel cache the entries of an
+	// opened directory. With FOPEN_KEEP_CACHE, the cache is kept
+	// across opens.
+	FOPEN_CACHE_DIR = (1 << 3)
 )
 
 type OpenOut struct {
@@ -353,9 +364,11 @@ const (
 	FUSE_IOCTL_COMPAT       = (1 << 0)
 	FUSE_IOCTL_UNRESTRICTED = (1 << 1)
 	FUSE_IOCTL_RETRY        = (1 << 2)
+	FUSE_IOCTL_32BIT        = (1 << 3)
+	FUSE_IOCTL_DIR          = (1 << 4)
 )
 
-type _IoctlIn struct {
+type IoctlIn struct {
 	InHeader
 	Fh      uint64
 	Flags   uint32
@@ -365,27 +378,38 @@ type _IoctlIn struct {
 	OutSize uint32
 }
 
-type _IoctlOut struct {
+type IoctlOut struct {
 	Result  int32
 	Flags   uint32
 	InIovs  uint32
 	OutIovs uint32
 }
 
-type _PollIn struct {
+// IoctlIovec describes a buffer in the memory of the calling
+// process. A reply with FUSE_IOCTL_RETRY carries InIovs input
+// buffers followed by OutIovs output buffers of this type.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+type PollIn struct {
 	InHeader
-	Fh      uint64
-	Kh      uint64
-	Flags   uint32
-	Padding uint32
+	Fh    uint64
+	Kh    uint64
+	Flags uint32
+
+	// Events holds the requested poll events, from protocol
+	// version 7.21.
+	Events uint32
 }
 
-type _PollOut struct {
+type PollOut struct {
 	Revents uint32
 	Padding uint32
 }
 
-type _NotifyPollWakeupOut struct {
+type NotifyPollWakeupOut struct {
 	Kh uint64
 }
 
@@ -491,7 +515,7 @@ type NotifyRetrieveIn struct {
 }
 
 const (
-	//	NOTIFY_POLL         = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
+	NOTIFY_POLL           = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
 	NOTIFY_INVAL_INODE    = -2 // notify kernel that an inode should be invalidated
 	NOTIFY_INVAL_ENTRY    = -3 // notify kernel that a directory entry should be invalidated
 	NOTIFY_STORE_CACHE    = -4 // store data into kernel cache of an inode
@@ -1,3 +1,5 @@
 module github.com/hanwen/go-fuse
 
+go 1.18
+
 require golang.org/x/sys v0.0.0-20180830151530-49385e6e1522
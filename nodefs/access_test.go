@@ -0,0 +1,86 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// aclFile grants read access and denies everything else, whatever
+// its mode.
+type aclFile struct {
+	MemRegularFile
+
+	mu    sync.Mutex
+	masks []uint32
+}
+
+func (f *aclFile) Access(ctx context.Context, mask uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.masks = append(f.masks, mask)
+	if mask&^unix.R_OK != 0 {
+		return syscall.EACCES
+	}
+	return OK
+}
+
+func TestCustomAccess(t *testing.T) {
+	for _, defaultPerms := range []bool{false, true} {
+		mntDir := testutil.TempDir()
+		defer os.RemoveAll(mntDir)
+
+		root := &MemDir{}
+		root.Attr.Mode = 0755
+		server, err := Mount(mntDir, root, &Options{
+			MountOptions: fuse.MountOptions{
+				Debug:              testutil.VerboseTest(),
+				DefaultPermissions: defaultPerms,
+			},
+		})
+		if err != nil {
+			t.Fatalf("default_permissions %v: %v", defaultPerms, err)
+		}
+		defer server.Unmount()
+
+		file := &aclFile{}
+		file.Attr.Mode = 0666
+		root.Inode().AddChild("file", root.Inode().NewPersistentInode(context.Background(), file, NodeAttr{Ino: 2}), false)
+
+		p := mntDir + "/file"
+		if err := unix.Access(p, unix.R_OK); err != nil {
+			t.Errorf("default_permissions %v: Access(R_OK): %v", defaultPerms, err)
+		}
+		err = unix.Access(p, unix.W_OK)
+
+		file.mu.Lock()
+		masks := file.masks
+		file.mu.Unlock()
+		if defaultPerms {
+			// The kernel checks the mode, 0666.
+			if err != nil {
+				t.Errorf("default_permissions: Access(W_OK): %v", err)
+			}
+			if len(masks) != 0 {
+				t.Errorf("default_permissions: got Access calls %v", masks)
+			}
+		} else {
+			if err != syscall.EACCES {
+				t.Errorf("Access(W_OK): got %v, want EACCES", err)
+			}
+			if len(masks) != 2 {
+				t.Errorf("got Access calls %v, want 2", masks)
+			}
+		}
+	}
+}
@@ -40,12 +40,15 @@
 //
 // The kernel can evict inode data to free up memory. It does so by
 // issuing FORGET calls. When a node has no children, and no kernel
-// references, it is removed from the file system trees.
+// references, it is removed from the file system trees. Nodes that
+// need to release resources at that point can implement
+// ForgetOperations.
 //
 // File system trees can also be constructed in advance. This is done
 // by instantiating "persistent" inodes from the Operations.OnAdd
-// method. Persistent inodes remain in memory even if the kernel has
-// forgotten them.  See zip_test.go for an example of how to do this.
+// method, eg. with Inode.NewPersistentChild. Persistent inodes remain
+// in memory even if the kernel has forgotten them.  See zip_test.go
+// for an example of how to do this.
 //
 // File systems whose tree structures are on backing storage typically
 // discover the file system tree on-demand, and if the kernel is tight
@@ -54,10 +57,20 @@
 // file system created by `NewLoopbackRoot` provides a straightforward
 // example.
 //
+// When the process that issued a system call is interrupted by a
+// signal, the kernel sends INTERRUPT for the pending request, and the
+// context passed to the operation is canceled. Operations that may
+// block, such as reads over a slow network, can select on ctx.Done()
+// to abort early. If Open, Read, Write, Flush, Fsync, Setlkw or
+// CopyFileRange fail after the context was canceled, the caller gets
+// EINTR.
+//
 package nodefs
 
 import (
 	"context"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 
@@ -82,11 +95,25 @@ type InodeLink interface {
 }
 
 // Operations is the interface that implements the filesystem inode.
-// Each Operations instance must embed OperationStubs. All error
+// Each Operations instance should embed OperationStubs; at least it
+// must embed InodeEmbed. Calls for optional interfaces that a node
+// does not implement fail with ENOTSUP. All error
 // reporting must use the syscall.Errno type. The value 0 (`OK`)
 // should be used to indicate success. The method names are inspired
 // on the system call names, so we have Listxattr rather than
 // ListXAttr.
+//
+// For some operations, returning ENOSYS tells the kernel that the
+// file system does not support them at all: the kernel stops sending
+// the request for the rest of the mount, and handles the system call
+// itself or fails it. This is the case for Access, Getxattr,
+// Setxattr, Removexattr, Listxattr, Create, Flush, Fsync,
+// Fsyncdir, Allocate, CopyFileRange, Lseek and Poll. The kernel has
+// no such switch for locks, so for Getlk, Setlk and Setlkw the bridge
+// remembers the first ENOSYS and answers later lock requests with
+// ENOSYS without calling the file system. Other operations just
+// return ENOSYS to the caller. ENOTSUP, which the defaults return,
+// never switches anything off.
 type Operations interface {
 	InodeLink
 
@@ -98,21 +125,60 @@ type Operations interface {
 	// the given mode. In this case, the context has data about
 	// the real UID. For example a root-SUID binary called by user
 	// susan gets the UID and GID for susan here.
+	//
+	// The bridge makes no permission decisions of its own. Unless
+	// fuse.MountOptions.DefaultPermissions is set, neither does
+	// the kernel: Access answers access(2) and chdir(2), and other
+	// operations must check permissions themselves if they need
+	// to. With DefaultPermissions, the kernel checks the
+	// attributes from Getattr, and Access is never called.
 	Access(ctx context.Context, mask uint32) syscall.Errno
 
 	// GetAttr reads attributes for an Inode. The library will
 	// ensure that Mode and Ino are set correctly. For regular
-	// files, Size should be set so it can be read correctly.
+	// files, Size should be set so it can be read correctly. A
+	// timeout set in `out` overrides Options.AttrTimeout and
+	// Inode.SetAttrTimeout for this reply only. The kernel caches
+	// all attributes for the same time, so if some fields are
+	// expensive and were left stale, a short timeout (down to
+	// time.Nanosecond, which the kernel treats as uncached) makes
+	// it ask again soon; GetattrFromHandle and
+	// LookupFromReaddirPlus tell where a request comes from. If
+	// Blocks is left zero, it is derived from Size; set it to
+	// report the actual space used, eg. for sparse files. The
+	// protocol has no device number: the kernel reports the
+	// st_dev of the mount for every file, so backends that should
+	// appear as separate file systems, eg. to `find -xdev`, need
+	// separate mounts.
 	Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
 
-	// SetAttr sets attributes for an Inode.
+	// SetAttr sets attributes for an Inode. With writeback
+	// caching, the kernel also sends SETATTR to flush the
+	// timestamps it computed for cached writes. It does not mark
+	// these requests, and they look like eg. a utimensat(2) call,
+	// so the bridge passes each of them on, without coalescing.
 	Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
 
 	// OnAdd is called once this Operations object is attached to
-	// an Inode.
+	// an Inode. It may create further Inodes, eg. to populate the
+	// children with Inode.NewPersistentChild.
 	OnAdd(ctx context.Context)
 }
 
+// ForgetOperations can be implemented by nodes that hold resources
+// which should be released when the node is dropped from the tree.
+type ForgetOperations interface {
+	Operations
+
+	// OnForget is called once the Inode has been removed from the
+	// tree, because the kernel has forgotten it and it has no
+	// children. It is called exactly once, and no other
+	// operations will be called on the node afterwards. It is not
+	// called for persistent Inodes, unless their persistence was
+	// dropped with Inode.ForgetPersistent.
+	OnForget()
+}
+
 // XAttrOperations is a collection of methods used to implement extended attributes.
 type XAttrOperations interface {
 	Operations
@@ -123,7 +189,8 @@ type XAttrOperations interface {
 	Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno)
 
 	// SetXAttr should store data for the given attribute.  See
-	// setxattr(2) for information about flags.
+	// setxattr(2) for information about flags; CheckXattrFlags
+	// implements XATTR_CREATE and XATTR_REPLACE.
 	Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno
 
 	// RemoveXAttr should delete the given attribute.
@@ -148,19 +215,47 @@ type FileOperations interface {
 	Operations
 
 	// Open opens an Inode (of regular file type) for reading. It
-	// is optional but recommended to return a FileHandle.
+	// is optional but recommended to return a FileHandle. The
+	// returned fuseFlags (eg. fuse.FOPEN_DIRECT_IO,
+	// fuse.FOPEN_KEEP_CACHE) are passed to the kernel, and
+	// control how it caches data for this open file. They are set
+	// per open, so files can have different policies: with
+	// fuse.MountOptions.EnableWriteback, the kernel collects
+	// writes in its page cache and sends them later, but writes
+	// through an open with FOPEN_DIRECT_IO reach Write before
+	// write(2) returns.
+	//
+	// For open(2) with O_TRUNC, the kernel by default removes
+	// O_TRUNC from `flags`. After Open succeeds, and before
+	// open(2) returns, it calls Setattr (Fsetattr with the new
+	// FileHandle) with size 0. With
+	// fuse.MountOptions.EnableAtomicTrunc, `flags` includes
+	// O_TRUNC, Open must truncate the file itself, and no Setattr
+	// follows.
 	Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 
 	// Reads data from a file. The data should be returned as
 	// ReadResult, which may be constructed from the incoming
-	// `dest` buffer. If the file was opened without FileHandle,
-	// the FileHandle argument here is nil. The default
-	// implementation forwards to the FileHandle.
+	// `dest` buffer, eg. with fuse.ReadResultInto, which avoids
+	// allocating for every read. If the file was opened without
+	// FileHandle, the FileHandle argument here is nil. The
+	// default implementation forwards to the FileHandle.
 	Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
 
 	// Writes the data into the file handle at given offset. After
 	// returning, the data will be reused and may not referenced.
-	// The default implementation forwards to the FileHandle.
+	// Writing fewer than len(data) bytes without an error, eg. to
+	// apply backpressure, is passed on to the application as a
+	// short write; returning more than len(data) makes the kernel
+	// fail the write with EIO.
+	//
+	// With writeback caching (fuse.MountOptions.EnableWriteback),
+	// which is needed for writes through shared writable mmap(2)
+	// mappings to reach the file system, the kernel flushes dirty
+	// pages itself: such writes span whole pages, regardless of
+	// what the application wrote, and may come without a
+	// FileHandle. WriteFromWriteback tells them apart. The
+	// default implementation forwards to the FileHandle.
 	Write(ctx context.Context, f FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno)
 
 	// Fsync is a signal to ensure writes to the Inode are flushed
@@ -178,7 +273,10 @@ type FileOperations interface {
 	// kernel ingores the return value of this method,
 	// so any cleanup that requires specific synchronization or
 	// could fail with I/O errors should happen in Flush instead.
-	// The default implementation forwards to the FileHandle.
+	// The default implementation forwards to the FileHandle. The
+	// bridge drops its reference to `f` once Release returns, so
+	// file systems that open many files may recycle their handle
+	// objects, eg. through Options.FileHandlePool.
 	Release(ctx context.Context, f FileHandle) syscall.Errno
 
 	// Allocate preallocates space for future writes, so they will
@@ -204,6 +302,22 @@ type FileOperations interface {
 }
 
 // LockOperations are operations for locking regions of regular files.
+// The kernel only forwards locks if fuse.MountOptions.EnableLocks is
+// set.
+//
+// Both POSIX record locks (fcntl(2)) and BSD whole-file locks
+// (flock(2)) arrive here. flock requests have fuse.FUSE_LK_FLOCK set
+// in `flags`, and are always issued with Setlk or Setlkw: a shared
+// lock (LOCK_SH) has type F_RDLCK, an exclusive one (LOCK_EX) F_WRLCK
+// and LOCK_UN is F_UNLCK; the range covers the whole file. For POSIX
+// locks, `owner` identifies the process's lock owner, so all file
+// descriptors of the process share the locks. For flock, it
+// identifies the open file, ie. the file descriptor and its dups, so
+// locks taken through different opens of the same file conflict.
+// When the last descriptor of a flock'ed file is closed, the bridge
+// calls Setlk with F_UNLCK for its owner, before Release.
+// If any of these methods returns ENOSYS, the bridge stops calling
+// them and fails all further lock requests with ENOSYS.
 type LockOperations interface {
 	FileOperations
 
@@ -221,6 +335,51 @@ type LockOperations interface {
 	Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno
 }
 
+// ReadAheadOperations can be implemented by files whose backing
+// store benefits from prefetching. The kernel does not mark its own
+// read-ahead, so the bridge guesses: when a Read continues where the
+// previous Read on the same FileHandle stopped, ReadAhead is called
+// in a separate goroutine for the range that a further sequential
+// Read would ask for. Files opened without a FileHandle get no
+// ReadAhead calls. This is a hint only. The call may come before,
+// after or concurrently with the Read for that range, or not at all.
+// Release of the FileHandle waits for it to return. Its context is
+// never canceled.
+type ReadAheadOperations interface {
+	FileOperations
+
+	// ReadAhead may start fetching `size` bytes at `off`, so a
+	// later Read can be served quickly.
+	ReadAhead(ctx context.Context, f FileHandle, off int64, size int)
+}
+
+// PollOperations can be implemented by files that support poll(2),
+// select(2) and epoll(7). The kernel only forwards POLL requests if
+// fuse.MountOptions.EnablePoll is set. Files that don't implement
+// it are always ready for reading and writing.
+type PollOperations interface {
+	FileOperations
+
+	// Poll returns which of the events in `mask` (eg. POLLIN)
+	// are ready. Once this changes, the file system should call
+	// Inode.NotifyPoll to wake up waiting processes.
+	Poll(ctx context.Context, f FileHandle, mask uint32) (revents uint32, errno syscall.Errno)
+}
+
+// IoctlOperations can be implemented by nodes that respond to
+// ioctl(2). On nodes that don't implement it, ioctls fail with
+// ENOTTY.
+type IoctlOperations interface {
+	Operations
+
+	// Ioctl executes command `cmd` with argument `arg`. If the
+	// node was opened, `f` is its FileHandle. The command number
+	// encodes the sizes of the data: `in` holds the data copied
+	// from the caller, and data written into `out` is copied back
+	// to the caller. The result is the return value of ioctl(2).
+	Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, in []byte, out []byte) (result int32, errno syscall.Errno)
+}
+
 // DirStream lists directory entries.
 type DirStream interface {
 	// HasNext indicates if there are further entries. HasNext
@@ -237,6 +396,45 @@ type DirStream interface {
 	Close()
 }
 
+// SeekableDirStream is a DirStream that can be repositioned. If a
+// directory is read from an offset other than where the previous read
+// stopped, for example after seekdir(3), the stream is repositioned
+// with Seekdir. Other streams simply continue where they left off.
+//
+// The offsets are the cookies the kernel, and NFS clients of a
+// re-exported mount, use to resume a listing. Streams that set
+// fuse.DirEntry.Off to a stable value, for example the position in
+// the backend's listing, can also be resumed from a new handle: the
+// first read on a fresh stream at a nonzero offset calls Seekdir.
+type SeekableDirStream interface {
+	DirStream
+
+	// Seekdir positions the stream so that the next entry is the
+	// one following the entry with offset `off` (see
+	// fuse.DirEntry.Off). Offset 0 denotes the start of the
+	// stream.
+	Seekdir(off uint64) syscall.Errno
+}
+
+// DirStreamPlus lists directory entries along with the result of
+// looking them up.
+type DirStreamPlus interface {
+	// HasNext indicates if there are further entries. HasNext
+	// might be called on already closed streams.
+	HasNext() bool
+
+	// Next retrieves the next entry, and the Inode for it. The
+	// attributes for the Inode should be returned in `out`, as in
+	// DirOperations.Lookup. If the returned Inode is nil, the
+	// entry is listed without lookup data. It is only called if
+	// HasNext has previously returned true.
+	Next(out *fuse.EntryOut) (fuse.DirEntry, *Inode, syscall.Errno)
+
+	// Close releases resources related to this directory
+	// stream.
+	Close()
+}
+
 // DirOperations are operations for directory nodes in the filesystem.
 type DirOperations interface {
 	Operations
@@ -253,11 +451,84 @@ type DirOperations interface {
 	// OpenDir opens a directory Inode for reading its
 	// contents. The actual reading is driven from ReadDir, so
 	// this method is just for performing sanity/permission
-	// checks.
+	// checks. Directories that need per-open state can implement
+	// DirHandleOperations instead.
 	Opendir(ctx context.Context) syscall.Errno
 
 	// ReadDir opens a stream of directory entries.
 	Readdir(ctx context.Context) (DirStream, syscall.Errno)
+
+	// Fsyncdir is called when an application fsyncs the
+	// directory, and should make its entries durable, eg. after
+	// creating a file in it. If bit 0 of `flags` is set, the
+	// caller used fdatasync(2), and only the entries need to be
+	// flushed, not the directory's own metadata.
+	Fsyncdir(ctx context.Context, flags uint32) syscall.Errno
+}
+
+// ReaddirPlusOperations can be implemented by directories that can
+// look up their entries while listing them. If the kernel negotiated
+// READDIRPLUS, Readdirplus is called instead of Readdir, and the
+// returned Inodes are added to the FS tree directly, without calling
+// Lookup for each entry.
+type ReaddirPlusOperations interface {
+	DirOperations
+
+	// Readdirplus opens a stream of directory entries with their
+	// lookup results.
+	Readdirplus(ctx context.Context) (DirStreamPlus, syscall.Errno)
+}
+
+// DirHandle holds the state of an opened directory. It is returned
+// from DirHandleOperations.OpendirHandle, and lives until the
+// directory is closed.
+type DirHandle interface {
+	// Readdir opens a stream of directory entries for this
+	// handle. It is called for the first read, and again when the
+	// directory is read from offset 0, eg. after rewinddir(3).
+	Readdir(ctx context.Context) (DirStream, syscall.Errno)
+
+	// Releasedir is called when the directory is closed.
+	Releasedir(ctx context.Context)
+}
+
+// DirHandleOperations can be implemented by directories that keep
+// state for each opened directory, for example to list a consistent
+// snapshot while entries are added and removed. OpendirHandle is
+// called instead of Opendir, and the listing for the opened directory
+// is read from the returned handle rather than from Readdir. The
+// handle is also used for READDIRPLUS, in which case entries are
+// looked up with Lookup, even if ReaddirPlusOperations is
+// implemented.
+type DirHandleOperations interface {
+	DirOperations
+
+	// OpendirHandle opens the directory. The `flags` are the
+	// open(2) flags. The returned `fuseFlags` are FOPEN_* flags
+	// (eg. fuse.FOPEN_CACHE_DIR|fuse.FOPEN_KEEP_CACHE to let the
+	// kernel cache the listing) for the opened directory.
+	OpendirHandle(ctx context.Context, flags uint32) (dh DirHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
+// BatchGetattrOperations can be implemented by directories whose
+// backing storage can fetch attributes for many entries in a single
+// call. While GETATTR requests are in flight, those for children of
+// such a directory are collected for a short while, and passed to
+// BatchGetattr together. A GETATTR that arrives alone is not
+// delayed. Requests that carry a file handle are not batched.
+//
+// BatchGetattr runs with the context of the first request in the
+// batch: its caller, deadline and cancellation apply to the whole
+// batch. A later request that is interrupted while it waits fails
+// with EINTR, without affecting the batch.
+type BatchGetattrOperations interface {
+	DirOperations
+
+	// BatchGetattr reads attributes for children of this
+	// directory. It should fill in out[i] for inodes[i], and
+	// return a slice with the result for each entry. The library
+	// will ensure that Mode and Ino are set correctly.
+	BatchGetattr(ctx context.Context, inodes []*Inode, out []fuse.AttrOut) []syscall.Errno
 }
 
 // MutableDirOperations are operations for directories that can add or
@@ -279,7 +550,14 @@ type MutableDirOperations interface {
 
 	// Create is similar to Lookup, but should create a new
 	// child. It typically also returns a FileHandle as a
-	// reference for future reads/writes
+	// reference for future reads/writes. As for Open, the
+	// fuseFlags control kernel caching for the new file handle.
+	//
+	// open(2) with O_CREAT is served by a single Create call,
+	// without a separate Open. If the kernel has no dentry for
+	// the name, it issues a Lookup first; a negative entry
+	// cached through Options.NegativeTimeout avoids that round
+	// trip.
 	Create(ctx context.Context, name string, flags uint32, mode uint32) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 
 	// Unlink should remove a child from this directory.  If the
@@ -292,10 +570,32 @@ type MutableDirOperations interface {
 
 	// Rename should move a child from one directory to a
 	// different one. The changes is effected in the FS tree if
-	// the return status is OK
+	// the return status is OK. The flags may contain
+	// RENAME_EXCHANGE, RENAME_NOREPLACE or RENAME_WHITEOUT, but
+	// only those declared through RenameFlagsOperations or
+	// Options.SupportedRenameFlags; the bridge answers others with
+	// EINVAL. For RENAME_NOREPLACE, the
+	// bridge returns EEXIST without calling Rename if the
+	// destination is already in the FS tree. On error, the FS
+	// tree is left unchanged. If the entry cannot be moved in
+	// place, eg. because the directories are on different
+	// backends, return EXDEV: mv(1) and similar tools then copy
+	// the file and unlink the source, as they do across mounts.
 	Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno
 }
 
+// RenameFlagsOperations can be implemented by directories whose
+// Rename handles renameat2(2) flags. The flags that RenameFlags
+// returns for the source directory are accepted in addition to
+// Options.SupportedRenameFlags.
+type RenameFlagsOperations interface {
+	MutableDirOperations
+
+	// RenameFlags returns the RENAME_* flags that Rename
+	// implements.
+	RenameFlags() uint32
+}
+
 // FileHandle is a resource identifier for opened files.  FileHandles
 // are useful in two cases: First, if the underlying storage systems
 // needs a handle for reading/writing. See the function
@@ -334,11 +634,25 @@ type FileHandle interface {
 
 // Options sets options for the entire filesystem
 type Options struct {
-	// MountOptions contain the options for mounting the fuse server
+	// MountOptions contain the options for mounting the fuse
+	// server. Among others, MountOptions.EnableWriteback turns on
+	// writeback caching, which shared writable mmap(2) needs.
+	// The kernel may send several LOOKUP and READDIR requests
+	// for one directory at once. The bridge only locks the Inodes
+	// it updates, so these reach the DirOperations concurrently;
+	// MountOptions.DisableParallelDirOps serializes them.
 	fuse.MountOptions
 
 	// If set to nonnil, this defines the overall entry timeout
 	// for the file system. See fuse.EntryOut for more information.
+	//
+	// The timeouts below are defaults: if an operation sets a
+	// timeout in its output itself (eg. with
+	// fuse.EntryOut.SetEntryTimeout or fuse.AttrOut.SetTimeout),
+	// that value is sent to the kernel instead. A zero timeout
+	// is taken to mean that the operation left it unset. Single
+	// nodes can override the defaults with Inode.SetEntryTimeout
+	// and Inode.SetAttrTimeout.
 	EntryTimeout *time.Duration
 
 	// If set to nonnil, this defines the overall attribute
@@ -354,4 +668,160 @@ type Options struct {
 	// Automatic inode numbers are handed out sequentially
 	// starting from this number. If unset, use 2^63.
 	FirstAutomaticIno uint64
+
+	// If set, InoAllocator hands out the automatic inode numbers
+	// instead, eg. to keep them apart from numbers derived from
+	// backend object IDs. It is called with the bridge lock held,
+	// so it needs no locking of its own, but must not call into
+	// the Inode API. Numbers that are reserved or still in use
+	// are skipped, and InoAllocator is called again.
+	InoAllocator func() uint64
+
+	// If set, the default Lookup matches names in the tree
+	// without regard to case, and the bridge records the looked
+	// up node under the name it already has, so Readdir returns
+	// the case as stored. If several children match, an exact
+	// match is preferred; otherwise the name that sorts first
+	// (byte-wise) wins. Inode.GetChild still compares names
+	// exactly.
+	CaseInsensitive bool
+
+	// If set to nonnil, the bridge keeps the result of Readlink
+	// for this long, and answers READLINK from memory. The kernel
+	// does not cache symlink targets itself. The cached target is
+	// dropped by Setattr on the link and by Inode.NotifyContent.
+	SymlinkCacheTimeout *time.Duration
+
+	// If positive, the bridge caps the number of Inodes that the
+	// kernel holds references to. Once more are referenced, it
+	// asks the kernel to drop the entries for the least recently
+	// used ones, and the Inodes are removed from the tree when
+	// the kernel forgets them. Persistent and pinned Inodes,
+	// open files and directories that still have children are
+	// not evicted, and entries that the kernel still uses, eg.
+	// a working directory, stay. The count can therefore exceed
+	// the cap, and it only shrinks after the kernel has sent
+	// FORGET.
+	MaxCachedInodes int
+
+	// If set, Logger is called after each Lookup, Getattr,
+	// Setattr, Open, Read, Write, Readdir and ReaddirPlus
+	// operation completes, with the operation name, the inode
+	// number it was issued against, the time it took and its
+	// result.
+	Logger func(op string, ino uint64, dur time.Duration, errno syscall.Errno)
+
+	// If set, the bridge sends an Event to EventChan when it
+	// starts serving a Lookup, Mkdir, Mknod, Create, Unlink,
+	// Rmdir, Rename, Link, Symlink, Setattr, Open, Read, Write,
+	// Fsync or Fsyncdir request. Sends never block: if the channel is full,
+	// the event is dropped and counted in Event.Dropped of the
+	// next event that is delivered.
+	EventChan chan<- Event
+
+	// If set, listings served from DirOperations.Readdir start
+	// with "." and ".." entries for the directory and its
+	// parent, and any "." or ".." that the stream lists itself
+	// is dropped. The parent of a directory with several
+	// parents is the one Inode.Path uses; the root is its own
+	// parent. The offsets of the stream's entries are shifted
+	// by 2 to make room, so a SeekableDirStream sees the
+	// offsets it handed out. Streams from
+	// ReaddirPlusOperations are passed through unchanged.
+	SynthesizeDotEntries bool
+
+	// If set, after a successful Unlink, Rmdir or Rename, the
+	// bridge tells the kernel to drop the entries involved from
+	// its dentry cache, so an immediate lookup of the name
+	// reaches the file system rather than a stale entry. The
+	// kernel holds the directory lock while the request runs, so
+	// the notifications are queued, and sent by a single
+	// goroutine once the replies are out. It is off by default:
+	// the kernel already drops these entries when the request
+	// succeeds, so this only helps when the names change behind
+	// its back, and a late notification may invalidate an entry
+	// created in the meantime.
+	NotifyEntries bool
+
+	// If set, the context of each operation has a deadline this
+	// far after the request arrived, so handlers for a slow or
+	// hung backend can give up, typically with EIO, once
+	// ctx.Err() returns context.DeadlineExceeded. The bridge
+	// does not abort handlers itself. An INTERRUPT from the
+	// kernel still cancels the context before the deadline, with
+	// ctx.Err() returning context.Canceled.
+	OperationTimeout time.Duration
+
+	// If set, and the kernel supports fuse.CAP_NO_OPEN_SUPPORT,
+	// OPEN is answered with ENOSYS without calling
+	// FileOperations.Open. The kernel then stops sending OPEN and
+	// RELEASE for regular files altogether, and Read, Write and
+	// the other file operations get a nil FileHandle. Files made
+	// by Create still get the handle that Create returns. This
+	// saves two round trips per open(2) for file systems that
+	// keep no per-open state.
+	NoOpenSupport bool
+
+	// If set, the bridge puts each FileHandle into this pool once
+	// FileOperations.Release returned and no request uses it
+	// anymore. Open can then take a handle with Get instead of
+	// allocating one, and must reset it before use.
+	FileHandlePool *sync.Pool
+
+	// If set, RawHandler serves the opcodes that the fuse.Server
+	// does not implement, instead of answering them with ENOSYS.
+	// `data` is the request following the header, and `out` the
+	// reply following the fuse.OutHeader. This is an escape hatch
+	// for protocol additions: it bypasses the Inode tree, and the
+	// handler must decode node IDs and file handles itself. The
+	// opcodes are those of the kernel's fuse.h.
+	RawHandler func(cancel <-chan struct{}, in *fuse.InHeader, opcode uint32, data []byte) (out []byte, errno syscall.Errno)
+
+	// SupportedRenameFlags are the renameat2(2) flags (eg.
+	// RENAME_NOREPLACE|RENAME_EXCHANGE) that the Rename methods
+	// of the file system implement. The bridge rejects RENAME
+	// requests with other flags with EINVAL, without calling
+	// Rename, so a file system that ignores flags cannot silently
+	// do a plain rename instead. These flags apply to all
+	// directories; a directory can declare its own with
+	// RenameFlagsOperations, as the loopback file system and
+	// MemDir do for RENAME_NOREPLACE and RENAME_EXCHANGE.
+	SupportedRenameFlags uint32
+
+	// If set, the file system has no hard links, and the bridge
+	// answers LINK with EMLINK without calling
+	// MutableDirOperations.Link. The tree keeps a single parent
+	// link inline in each Inode either way, and only allocates
+	// for further links.
+	SingleParent bool
+
+	// If set, Mount creates the mount point if it does not exist,
+	// with permissions MountpointMode (0755 if zero), and removes
+	// it again after Server.Unmount, or if mounting fails. Only
+	// the last path component is created. A mount point that
+	// already existed is left alone.
+	CreateMountpoint bool
+	MountpointMode   os.FileMode
+}
+
+// Event describes a request that the bridge serves, for
+// Options.EventChan.
+type Event struct {
+	// Op is the name of the operation, eg. "Mkdir".
+	Op string
+
+	// Ino is the inode number the request was issued against.
+	// For operations on a directory entry, it is the directory.
+	Ino uint64
+
+	// Name is the entry in directory Ino, for operations on a
+	// directory entry. For Rename, it is the old name.
+	Name string
+
+	// Pid is the process ID of the caller.
+	Pid uint32
+
+	// Dropped is the number of events dropped because the
+	// channel was full since the previous event was delivered.
+	Dropped uint64
 }
@@ -0,0 +1,210 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type batchRoot struct {
+	OperationStubs
+
+	// If gate is set, Getattr signals entered, and blocks until
+	// gate is closed.
+	gate    chan struct{}
+	entered chan struct{}
+
+	mu      sync.Mutex
+	calls   int
+	entries int
+}
+
+func (r *batchRoot) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	if r.gate != nil {
+		close(r.entered)
+		<-r.gate
+	}
+	out.Mode = 0755
+	return OK
+}
+
+func (r *batchRoot) OnAdd(ctx context.Context) {
+	for i := 0; i < 3; i++ {
+		ch := r.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: uint64(i + 2)})
+		r.Inode().AddChild(fmt.Sprintf("file%d", i), ch, false)
+	}
+}
+
+func (r *batchRoot) BatchGetattr(ctx context.Context, inodes []*Inode, out []fuse.AttrOut) []syscall.Errno {
+	r.mu.Lock()
+	r.calls++
+	r.entries += len(inodes)
+	r.mu.Unlock()
+
+	errnos := make([]syscall.Errno, len(inodes))
+	for i, n := range inodes {
+		out[i].Size = n.NodeAttr().Ino * 10
+		out[i].Mode = 0644
+	}
+	return errnos
+}
+
+func getattrIno(rawFS fuse.RawFileSystem, ino uint64, out *fuse.AttrOut) fuse.Status {
+	return rawFS.GetAttr(nil, &fuse.GetAttrIn{
+		InHeader: fuse.InHeader{NodeId: ino},
+	}, out)
+}
+
+func TestBatchGetattr(t *testing.T) {
+	root := &batchRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+	b := rawFS.(*rawBridge)
+	// Only the gate ends the wait.
+	b.batchDelay = time.Hour
+
+	// Without other requests in flight, a GETATTR does not wait.
+	done := make(chan fuse.Status, 1)
+	go func() {
+		var out fuse.AttrOut
+		done <- getattrIno(rawFS, 2, &out)
+	}()
+	select {
+	case st := <-done:
+		if !st.Ok() {
+			t.Fatalf("GetAttr: %v", st)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("lone GetAttr waited for a batch")
+	}
+
+	// Keep a GETATTR for the root in flight, so the batch waits
+	// until all children joined.
+	root.gate = make(chan struct{})
+	root.entered = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var out fuse.AttrOut
+		getattrIno(rawFS, 1, &out)
+	}()
+	<-root.entered
+
+	outs := make([]fuse.AttrOut, 3)
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if st := getattrIno(rawFS, uint64(i+2), &outs[i]); !st.Ok() {
+				t.Errorf("GetAttr(%d): %v", i+2, st)
+			}
+		}(i)
+	}
+	for {
+		b.batchMu.Lock()
+		batched := b.batched
+		b.batchMu.Unlock()
+		if batched == len(outs) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(root.gate)
+	wg.Wait()
+
+	for i, out := range outs {
+		ino := uint64(i + 2)
+		if out.Ino != ino {
+			t.Errorf("got ino %d, want %d", out.Ino, ino)
+		}
+		if out.Size != ino*10 {
+			t.Errorf("ino %d: got size %d, want %d", ino, out.Size, ino*10)
+		}
+		if want := uint32(fuse.S_IFREG | 0644); out.Mode != want {
+			t.Errorf("ino %d: got mode %o, want %o", ino, out.Mode, want)
+		}
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.entries != 4 {
+		t.Errorf("got %d batched entries, want 4", root.entries)
+	}
+	if root.calls != 2 {
+		t.Errorf("got %d BatchGetattr calls, want 2", root.calls)
+	}
+}
+
+func TestBatchGetattrInterrupt(t *testing.T) {
+	root := &batchRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+	b := rawFS.(*rawBridge)
+	b.batchDelay = time.Hour
+
+	// A GETATTR for the root keeps the batch waiting.
+	root.gate = make(chan struct{})
+	root.entered = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var out fuse.AttrOut
+		getattrIno(rawFS, 1, &out)
+	}()
+	<-root.entered
+
+	waitBatched := func(want int) {
+		for {
+			b.batchMu.Lock()
+			batched := b.batched
+			b.batchMu.Unlock()
+			if batched == want {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var out fuse.AttrOut
+		if st := getattrIno(rawFS, 2, &out); !st.Ok() {
+			t.Errorf("GetAttr(2): %v", st)
+		}
+	}()
+	waitBatched(1)
+
+	cancel := make(chan struct{})
+	done := make(chan fuse.Status, 1)
+	go func() {
+		var out fuse.AttrOut
+		done <- rawFS.GetAttr(cancel, &fuse.GetAttrIn{
+			InHeader: fuse.InHeader{NodeId: 3},
+		}, &out)
+	}()
+	waitBatched(2)
+
+	close(cancel)
+	select {
+	case st := <-done:
+		if st != fuse.EINTR {
+			t.Errorf("got %v, want EINTR", st)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("interrupted GetAttr kept waiting for the batch")
+	}
+	waitBatched(1)
+
+	close(root.gate)
+	wg.Wait()
+}
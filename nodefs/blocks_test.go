@@ -0,0 +1,88 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// sizeNode reports a fixed size and block count.
+type sizeNode struct {
+	OperationStubs
+	size, blocks uint64
+}
+
+func (n *sizeNode) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Size = n.size
+	out.Blocks = n.blocks
+	return OK
+}
+
+type blocksRoot struct {
+	OperationStubs
+}
+
+func (r *blocksRoot) OnAdd(ctx context.Context) {
+	// A sparse file: 1M in size, but only 8 blocks in use.
+	r.Inode().NewPersistentChild(ctx, "sparse", &sizeNode{size: 1 << 20, blocks: 8}, NodeAttr{Ino: 2})
+	r.Inode().NewPersistentChild(ctx, "dense", &sizeNode{size: 1000}, NodeAttr{Ino: 3})
+}
+
+func TestBlocks(t *testing.T) {
+	rawFS := NewNodeFS(&blocksRoot{}, &Options{})
+
+	for _, tc := range []struct {
+		name string
+		ino  uint64
+		want uint64
+	}{
+		{"sparse", 2, 8},
+		{"dense", 3, 2},
+	} {
+		var attrOut fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: tc.ino}}, &attrOut); !st.Ok() {
+			t.Fatalf("GetAttr(%s): %v", tc.name, st)
+		}
+		if attrOut.Blocks != tc.want {
+			t.Errorf("GetAttr(%s): got %d blocks, want %d", tc.name, attrOut.Blocks, tc.want)
+		}
+
+		var entryOut fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, tc.name, &entryOut); !st.Ok() {
+			t.Fatalf("Lookup(%s): %v", tc.name, st)
+		}
+		if entryOut.Blocks != tc.want {
+			t.Errorf("Lookup(%s): got %d blocks, want %d", tc.name, entryOut.Blocks, tc.want)
+		}
+	}
+}
+
+func TestBlocksStat(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	server, err := Mount(mntDir, &blocksRoot{}, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mntDir+"/sparse", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st.Size != 1<<20 || st.Blocks != 8 {
+		t.Errorf("got size %d, blocks %d; want %d, 8", st.Size, st.Blocks, 1<<20)
+	}
+}
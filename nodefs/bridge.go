@@ -5,11 +5,15 @@
 package nodefs
 
 import (
+	"container/list"
 	"context"
 	"log"
+	"math"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
@@ -18,17 +22,48 @@ func errnoToStatus(errno syscall.Errno) fuse.Status {
 	return fuse.Status(errno)
 }
 
+// interruptedStatus is errnoToStatus for operations that may block
+// for a long time. The server closes `cancel` when the kernel sends
+// INTERRUPT for the request; an operation that fails after that is
+// reported as EINTR, so the interrupted system call sees the error
+// it expects, whatever the error was that the abort produced.
+func interruptedStatus(cancel <-chan struct{}, errno syscall.Errno) fuse.Status {
+	if errno != 0 {
+		select {
+		case <-cancel:
+			return fuse.EINTR
+		default:
+		}
+	}
+	return errnoToStatus(errno)
+}
+
 type fileEntry struct {
 	file FileHandle
 
 	// index into Inode.openFiles
 	nodeIndex int
 
+	// readEnd is the offset after the last Read, for detecting
+	// sequential reads, or -1 before the first Read.
+	readEnd int64
+
 	// Directory
+	dirHandle   DirHandle
 	dirStream   DirStream
 	hasOverflow bool
 	overflow    fuse.DirEntry
 
+	// dirOffset is the offset of the last entry returned to
+	// the kernel.
+	dirOffset uint64
+
+	// Directory opened through ReaddirPlusOperations. The
+	// overflow entry also stores its lookup result.
+	dirStreamPlus DirStreamPlus
+	overflowChild *Inode
+	overflowOut   fuse.EntryOut
+
 	wg sync.WaitGroup
 }
 
@@ -43,12 +78,99 @@ type rawBridge struct {
 	nodes        map[uint64]*Inode
 	automaticIno uint64
 
+	// replyStores holds, for each request being answered, the
+	// Inodes with NotifyStore data to send once the reply has
+	// been written.
+	replyStores map[uint64][]*Inode
+
 	files     []*fileEntry
 	freeFiles []uint32
+
+	// pendingEntries holds the entries to invalidate for
+	// Options.NotifyEntries. notifyingEntries is set while a
+	// goroutine sends them.
+	pendingEntries   []parentData
+	notifyingEntries bool
+
+	// lru holds the Inodes that may be evicted for
+	// Options.MaxCachedInodes, most recently used first.
+	// evicting is set while evictInodes runs.
+	lru      list.List
+	evicting bool
+
+	// noLocks is set once a LockOperations method returned
+	// ENOSYS. The kernel does not remember that for locks, so
+	// the bridge answers further lock requests itself.
+	noLocks bool
+
+	// batchMu protects getattrBatches, which holds the pending
+	// GETATTR batch for each directory implementing
+	// BatchGetattrOperations, and batched, the number of requests
+	// in them.
+	batchMu        sync.Mutex
+	getattrBatches map[*Inode]*getattrBatch
+	batched        int
+
+	// getattrs is the number of GETATTR requests being served. A
+	// batch waits for requests that are not in a batch, for at
+	// most batchDelay.
+	getattrs   int32
+	batchDelay time.Duration
+
+	// eventMu protects droppedEvents, the number of events
+	// dropped since the last one sent to Options.EventChan.
+	eventMu       sync.Mutex
+	droppedEvents uint64
+}
+
+// getattrBatch collects GETATTR requests for children of a single
+// directory.
+type getattrBatch struct {
+	inodes []*Inode
+	out    []fuse.AttrOut
+	errnos []syscall.Errno
+
+	// dropped counts the inodes whose request was interrupted
+	// before the batch was issued.
+	dropped int
+
+	// done is closed once out and errnos are filled in.
+	done chan struct{}
+
+	// wake tells the waiting first request that the number of
+	// GETATTRs outside batches may have dropped.
+	wake chan struct{}
+}
+
+func (g *getattrBatch) notify() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
 }
 
-// newInode creates creates new inode pointing to ops.
+// _STATIC_ATTR_TIMEOUT is the attribute timeout for Inodes with
+// static attributes: about a century, which the kernel treats as
+// forever.
+const _STATIC_ATTR_TIMEOUT = 100 * 365 * 24 * time.Hour
+
+// _GETATTR_BATCH_DELAY is how long the first GETATTR of a batch
+// waits at most for other GETATTRs in flight to join.
+const _GETATTR_BATCH_DELAY = time.Millisecond
+
+// newInode creates creates new inode pointing to ops. OnAdd is called
+// without holding the lock, so it may create further inodes.
 func (b *rawBridge) newInode(ctx context.Context, ops Operations, id NodeAttr, persistent bool) *Inode {
+	n, added := b.addInode(ops, id, persistent)
+	if added {
+		ops.OnAdd(ctx)
+	}
+	return n
+}
+
+// addInode registers the inode for ops. It returns whether ops was
+// added, rather than an existing inode returned.
+func (b *rawBridge) addInode(ops Operations, id NodeAttr, persistent bool) (*Inode, bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -58,15 +180,19 @@ func (b *rawBridge) newInode(ctx context.Context, ops Operations, id NodeAttr, p
 
 	// This ops already was populated. Just return it.
 	if ops.inode().bridge != nil {
-		return ops.inode()
+		return ops.inode(), false
 	}
 
 	if id.Ino == 0 {
 		for {
-			id.Ino = b.automaticIno
-			b.automaticIno++
+			if b.options.InoAllocator != nil {
+				id.Ino = b.options.InoAllocator()
+			} else {
+				id.Ino = b.automaticIno
+				b.automaticIno++
+			}
 			_, ok := b.nodes[id.Ino]
-			if !ok {
+			if !ok && !id.Reserved() {
 				break
 			}
 		}
@@ -85,7 +211,7 @@ func (b *rawBridge) newInode(ctx context.Context, ops Operations, id NodeAttr, p
 	// same node.
 	old := b.nodes[id.Ino]
 	if old != nil {
-		return old
+		return old, false
 	}
 
 	id.Mode = id.Mode &^ 07777
@@ -93,36 +219,34 @@ func (b *rawBridge) newInode(ctx context.Context, ops Operations, id NodeAttr, p
 		id.Mode = fuse.S_IFREG
 	}
 
+	// Operations need not implement the interface for their
+	// type; see missingOps.
 	switch id.Mode {
-	case fuse.S_IFDIR:
-		_ = ops.(DirOperations)
-	case fuse.S_IFLNK:
-		_ = ops.(SymlinkOperations)
-	case fuse.S_IFREG:
-		_ = ops.(FileOperations)
-	case fuse.S_IFIFO, syscall.S_IFSOCK:
-		// no type check necessary: FIFO and SOCK don't go
-		// through FUSE for open/read etc.
-		break
+	case fuse.S_IFDIR, fuse.S_IFLNK, fuse.S_IFREG,
+		fuse.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
 	default:
-		// Remaining types are char and block devices.  Not
-		// sure how those would work in FUSE
 		log.Panicf("filetype %o unimplemented", id.Mode)
 	}
 
 	b.nodes[id.Ino] = ops.inode()
 	ops.init(ops, id, b, persistent)
-	ops.OnAdd(ctx)
-	return ops.inode()
+	return ops.inode(), true
 }
 
-// addNewChild inserts the child into the tree. Returns file handle if file != nil.
-func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file FileHandle, fileFlags uint32, out *fuse.EntryOut) uint32 {
+// addNewChild inserts the child into the tree, as part of answering
+// the request with the given unique ID. Returns file handle if file
+// != nil.
+func (b *rawBridge) addNewChild(unique uint64, parent *Inode, name string, child *Inode, file FileHandle, fileFlags uint32, out *fuse.EntryOut) uint32 {
 	lockNodes(parent, child)
 	parent.setEntry(name, child)
 	b.mu.Lock()
 
 	child.lookupCount++
+	if len(child.pendingStores) > 0 {
+		b.replyStores[unique] = append(b.replyStores[unique], child)
+	}
+	b.lruAdd(child)
+	b.lruTouch(child)
 
 	var fh uint32
 	if file != nil {
@@ -135,21 +259,73 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 
 	b.mu.Unlock()
 	unlockNodes(parent, child)
+	b.maybeEvict()
 	return fh
 }
 
-func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
-	if b.options.AttrTimeout != nil && out.AttrTimeout() == 0 {
-		out.SetAttrTimeout(*b.options.AttrTimeout)
+// setEntryOut fills in the defaults for fields that the file system
+// left unset.
+func (b *rawBridge) setEntryOut(n *Inode, out *fuse.EntryOut) {
+	attr, entry := n.timeouts(&b.options)
+	if attr != nil && out.AttrTimeout() == 0 {
+		out.SetAttrTimeout(*attr)
+	}
+	if entry != nil && out.EntryTimeout() == 0 {
+		out.SetEntryTimeout(*entry)
+	}
+	setBlocks(&out.Attr)
+	setNlink(n, &out.Attr)
+	setRdev(n, &out.Attr)
+}
+
+// setAttrOut is like setEntryOut, for attribute replies.
+func (b *rawBridge) setAttrOut(n *Inode, out *fuse.AttrOut) {
+	if attr, _ := n.timeouts(&b.options); attr != nil && out.Timeout() == 0 {
+		out.SetTimeout(*attr)
 	}
-	if b.options.EntryTimeout != nil && out.EntryTimeout() == 0 {
-		out.SetEntryTimeout(*b.options.EntryTimeout)
+	setBlocks(&out.Attr)
+	setNlink(n, &out.Attr)
+	setRdev(n, &out.Attr)
+}
+
+// setRdev fills in the device number from NodeAttr.Rdev, if the file
+// system didn't report one.
+func setRdev(n *Inode, out *fuse.Attr) {
+	if out.Rdev == 0 {
+		out.Rdev = n.nodeAttr.Rdev
+	}
+}
+
+// setBlocks derives the number of 512-byte blocks from the size, if
+// the file system didn't report it. File systems that store data
+// sparsely or compressed should set Blocks themselves.
+func setBlocks(out *fuse.Attr) {
+	if out.Blocks == 0 {
+		out.Blocks = (out.Size + 511) / 512
 	}
 }
 
-func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
-	if b.options.AttrTimeout != nil && out.Timeout() == 0 {
-		out.SetTimeout(*b.options.AttrTimeout)
+// setNlink derives the link count from the tree, if the file system
+// didn't report it. For files, it is the number of names the Inode
+// has in the tree. A directory is linked from its parent, from its
+// own "." entry, and from the ".." entry of each subdirectory. The
+// tree only holds the entries that were looked up or added, so file
+// systems that discover it on demand should report Nlink themselves.
+func setNlink(n *Inode, out *fuse.Attr) {
+	if out.Nlink != 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nodeAttr.Mode != fuse.S_IFDIR {
+		out.Nlink = uint32(n.parents.count())
+		return
+	}
+	out.Nlink = 2
+	for _, ch := range n.children {
+		if ch.nodeAttr.Mode == fuse.S_IFDIR {
+			out.Nlink++
+		}
 	}
 }
 
@@ -157,7 +333,10 @@ func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
 // instance for the root.
 func NewNodeFS(root DirOperations, opts *Options) fuse.RawFileSystem {
 	bridge := &rawBridge{
-		automaticIno: opts.FirstAutomaticIno,
+		automaticIno:   opts.FirstAutomaticIno,
+		replyStores:    make(map[uint64][]*Inode),
+		getattrBatches: make(map[*Inode]*getattrBatch),
+		batchDelay:     _GETATTR_BATCH_DELAY,
 	}
 	if bridge.automaticIno == 1 {
 		bridge.automaticIno++
@@ -203,18 +382,51 @@ func (b *rawBridge) String() string {
 
 func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
 	n, f := b.nodes[id], b.files[fh]
+	if n != nil {
+		b.lruTouch(n)
+	}
+	b.mu.Unlock()
 	if n == nil {
 		log.Panicf("unknown node %d", id)
 	}
 	return n, f
 }
 
-func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+// event sends an Event for a request to Options.EventChan, if set.
+func (b *rawBridge) event(op string, header *fuse.InHeader, name string) {
+	if b.options.EventChan == nil {
+		return
+	}
+	b.eventMu.Lock()
+	defer b.eventMu.Unlock()
+	select {
+	case b.options.EventChan <- Event{
+		Op:      op,
+		Ino:     header.NodeId,
+		Name:    name,
+		Pid:     header.Pid,
+		Dropped: b.droppedEvents,
+	}:
+		b.droppedEvents = 0
+	default:
+		b.droppedEvents++
+	}
+}
+
+// logOp reports a completed operation to Options.Logger.
+func (b *rawBridge) logOp(op string, ino uint64, start time.Time, status *fuse.Status) {
+	b.options.Logger(op, ino, time.Since(start), syscall.Errno(*status))
+}
+
+func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Lookup", header.NodeId, time.Now(), &status)
+	}
+	b.event("Lookup", header, name)
 	parent, _ := b.inode(header.NodeId, 0)
 
-	child, errno := parent.dirOps().Lookup(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name, out)
+	child, errno := parent.dirOps().Lookup(b.newContext(cancel, header), name, out)
 	if errno != 0 {
 		if b.options.NegativeTimeout != nil && out.EntryTimeout() == 0 {
 			out.SetEntryTimeout(*b.options.NegativeTimeout)
@@ -222,46 +434,66 @@ func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name s
 		return errnoToStatus(errno)
 	}
 
-	b.addNewChild(parent, name, child, nil, 0, out)
-	b.setEntryOutTimeout(out)
+	if b.options.CaseInsensitive {
+		// Keep the stored name rather than adding an entry
+		// that only differs in case.
+		if stored, ch := parent.caseFoldChild(name); ch == child {
+			name = stored
+		}
+	}
+	b.addNewChild(header.Unique, parent, name, child, nil, 0, out)
+	b.setEntryOut(child, out)
 
 	out.Mode = child.nodeAttr.Mode | (out.Mode & 07777)
 	return fuse.OK
 }
 
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	b.event("Rmdir", header, name)
 	parent, _ := b.inode(header.NodeId, 0)
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
-		errno = mops.Rmdir(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		errno = mops.Rmdir(b.newContext(cancel, header), name)
+	} else {
+		errno = syscall.ENOTSUP
 	}
 
 	if errno == 0 {
 		parent.RmChild(name)
+		b.notifyEntries(parent, name)
 	}
 	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	b.event("Unlink", header, name)
 	parent, _ := b.inode(header.NodeId, 0)
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
-		errno = mops.Unlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		errno = mops.Unlink(b.newContext(cancel, header), name)
+	} else {
+		errno = syscall.ENOTSUP
 	}
 
 	if errno == 0 {
 		parent.RmChild(name)
+		b.notifyEntries(parent, name)
 	}
 	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	b.event("Mkdir", &input.InHeader, name)
+	ctx := b.newContext(cancel, &input.InHeader)
+	ctx.umask, ctx.hasUmask = input.Umask, true
 	parent, _ := b.inode(input.NodeId, 0)
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
-		child, errno = mops.Mkdir(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, out)
+		child, errno = mops.Mkdir(ctx, name, input.Mode, out)
+	} else {
+		errno = syscall.ENOTSUP
 	}
 
 	if errno != 0 {
@@ -272,31 +504,39 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 		log.Panicf("Mkdir: mode must be S_IFDIR (%o), got %o", fuse.S_IFDIR, out.Attr.Mode)
 	}
 
-	b.addNewChild(parent, name, child, nil, 0, out)
-	b.setEntryOutTimeout(out)
+	b.addNewChild(input.Unique, parent, name, child, nil, 0, out)
+	b.setEntryOut(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	b.event("Mknod", &input.InHeader, name)
+	ctx := b.newContext(cancel, &input.InHeader)
+	ctx.umask, ctx.hasUmask = mknodUmask(input)
 	parent, _ := b.inode(input.NodeId, 0)
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
-		child, errno = mops.Mknod(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, input.Rdev, out)
+		child, errno = mops.Mknod(ctx, name, input.Mode, input.Rdev, out)
+	} else {
+		errno = syscall.ENOTSUP
 	}
 
 	if errno != 0 {
 		return errnoToStatus(errno)
 	}
 
-	b.addNewChild(parent, name, child, nil, 0, out)
-	b.setEntryOutTimeout(out)
+	b.addNewChild(input.Unique, parent, name, child, nil, 0, out)
+	b.setEntryOut(child, out)
+	out.Mode = child.nodeAttr.Mode | (out.Mode & 07777)
 	return fuse.OK
 }
 
 func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	b.event("Create", &input.InHeader, name)
+	ctx := b.newContext(cancel, &input.InHeader)
+	ctx.umask, ctx.hasUmask = createUmask(input)
 	parent, _ := b.inode(input.NodeId, 0)
 
 	var child *Inode
@@ -305,22 +545,30 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	var flags uint32
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
 		child, f, flags, errno = mops.Create(ctx, name, input.Flags, input.Mode)
+	} else {
+		// Not ENOSYS: that would switch off CREATE for the
+		// whole mount.
+		errno = syscall.EROFS
 	}
 
 	if errno != 0 {
-		if b.options.NegativeTimeout != nil {
+		if b.options.NegativeTimeout != nil && out.EntryTimeout() == 0 {
 			out.SetEntryTimeout(*b.options.NegativeTimeout)
 		}
 		return errnoToStatus(errno)
 	}
 
-	out.Fh = uint64(b.addNewChild(parent, name, child, f, input.Flags|syscall.O_CREAT, &out.EntryOut))
-	b.setEntryOutTimeout(&out.EntryOut)
+	out.Fh = uint64(b.addNewChild(input.Unique, parent, name, child, f, input.Flags|syscall.O_CREAT, &out.EntryOut))
+	b.setEntryOut(child, &out.EntryOut)
 
 	out.OpenFlags = flags
 
 	var temp fuse.AttrOut
-	f.Getattr(ctx, &temp)
+	if f != nil {
+		f.Getattr(ctx, &temp)
+	} else {
+		child.ops.Getattr(ctx, &temp)
+	}
 	out.Attr = temp.Attr
 	out.AttrValid = temp.AttrValid
 	out.AttrValidNsec = temp.AttrValidNsec
@@ -328,7 +576,7 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	out.Generation = child.nodeAttr.Gen
 	out.NodeId = child.nodeAttr.Ino
 
-	b.setEntryOutTimeout(&out.EntryOut)
+	b.setEntryOut(child, &out.EntryOut)
 	out.Mode = (out.Attr.Mode & 07777) | child.nodeAttr.Mode
 	return fuse.OK
 }
@@ -340,13 +588,40 @@ func (b *rawBridge) Forget(nodeid, nlookup uint64) {
 
 func (b *rawBridge) SetDebug(debug bool) {}
 
-func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) (status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Getattr", input.NodeId, time.Now(), &status)
+	}
+	atomic.AddInt32(&b.getattrs, 1)
+	defer b.getattrDone()
+
 	n, fEntry := b.inode(input.NodeId, input.Fh())
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if n.getStaticAttr(&out.Attr) {
+		out.SetTimeout(_STATIC_ATTR_TIMEOUT)
+		b.setAttrOut(n, out)
+		out.Ino = input.NodeId
+		out.Mode = (out.Attr.Mode & 07777) | n.nodeAttr.Mode
+		return fuse.OK
+	}
+
+	ctx := b.newContext(cancel, &input.InHeader)
+	ctx.getattrFH = input.Flags()&fuse.FUSE_GETATTR_FH != 0
+	if !ctx.getattrFH {
+		if _, parent := n.Parent(); parent != nil {
+			if bops, ok := parent.ops.(BatchGetattrOperations); ok {
+				errno := b.batchGetattr(ctx, cancel, parent, bops, n, out)
+				b.setAttrOut(n, out)
+				out.Ino = input.NodeId
+				out.Mode = (out.Attr.Mode & 07777) | n.nodeAttr.Mode
+				return errnoToStatus(errno)
+			}
+		}
+	}
+
 	if fops, ok := n.ops.(FileOperations); ok {
 
 		f := fEntry.file
-		if input.Flags()&fuse.FUSE_GETATTR_FH == 0 {
+		if !ctx.getattrFH {
 			// The linux kernel doesnt pass along the file
 			// descriptor, so we have to fake it here.
 			// See https://github.com/libfuse/libfuse/issues/62
@@ -361,77 +636,245 @@ func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *
 		}
 
 		errno := fops.Fgetattr(ctx, f, out)
-		b.setAttrTimeout(out)
+		b.setAttrOut(n, out)
 		out.Ino = input.NodeId
 		out.Mode = (out.Attr.Mode & 07777) | n.nodeAttr.Mode
 		return errnoToStatus(errno)
 	}
-	return errnoToStatus(n.ops.Getattr(ctx, out))
+	errno := n.ops.Getattr(ctx, out)
+	b.setAttrOut(n, out)
+	return errnoToStatus(errno)
+}
+
+// getattrDone wakes the batches that may be waiting for the GETATTR
+// that finished.
+func (b *rawBridge) getattrDone() {
+	if atomic.AddInt32(&b.getattrs, -1) == 0 {
+		return
+	}
+	b.batchMu.Lock()
+	defer b.batchMu.Unlock()
+	for _, batch := range b.getattrBatches {
+		batch.notify()
+	}
+}
+
+// unbatchedGetattrs returns the number of GETATTRs in flight that
+// are not in a batch, and so may still join one.
+func (b *rawBridge) unbatchedGetattrs() int {
+	b.batchMu.Lock()
+	defer b.batchMu.Unlock()
+	return int(atomic.LoadInt32(&b.getattrs)) - b.batched
+}
+
+// batchGetattr adds n to the pending GETATTR batch for dir. The
+// first caller for a batch waits while other GETATTRs are in flight,
+// so they can join, and then issues the BatchGetattr call on behalf
+// of all of them, with its own context. The others stop waiting if
+// their own request is interrupted.
+func (b *rawBridge) batchGetattr(ctx context.Context, cancel <-chan struct{}, dir *Inode, bops BatchGetattrOperations, n *Inode, out *fuse.AttrOut) syscall.Errno {
+	b.batchMu.Lock()
+	batch := b.getattrBatches[dir]
+	leader := batch == nil
+	if leader {
+		batch = &getattrBatch{
+			done: make(chan struct{}),
+			wake: make(chan struct{}, 1),
+		}
+		b.getattrBatches[dir] = batch
+	}
+	idx := len(batch.inodes)
+	batch.inodes = append(batch.inodes, n)
+	b.batched++
+	b.batchMu.Unlock()
+
+	if leader {
+		if b.unbatchedGetattrs() > 0 {
+			timer := time.NewTimer(b.batchDelay)
+		wait:
+			for b.unbatchedGetattrs() > 0 {
+				select {
+				case <-batch.wake:
+				case <-timer.C:
+					break wait
+				}
+			}
+			timer.Stop()
+		}
+
+		// After removing the batch from the map, no more
+		// requests can join it.
+		b.batchMu.Lock()
+		delete(b.getattrBatches, dir)
+		b.batched -= len(batch.inodes) - batch.dropped
+		b.batchMu.Unlock()
+
+		batch.out = make([]fuse.AttrOut, len(batch.inodes))
+		batch.errnos = bops.BatchGetattr(ctx, batch.inodes, batch.out)
+		close(batch.done)
+	} else {
+		batch.notify()
+		select {
+		case <-batch.done:
+		case <-cancel:
+			b.batchMu.Lock()
+			if b.getattrBatches[dir] == batch {
+				// Not issued yet, so the leader need not
+				// wait for us anymore.
+				batch.dropped++
+				b.batched--
+			}
+			b.batchMu.Unlock()
+			return syscall.EINTR
+		}
+	}
+
+	*out = batch.out[idx]
+	if idx >= len(batch.errnos) {
+		return syscall.EIO
+	}
+	return batch.errnos[idx]
 }
 
-func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
-	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) (status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Setattr", in.NodeId, time.Now(), &status)
+	}
+	b.event("Setattr", &in.InHeader, "")
+	ctx := b.newContext(cancel, &in.InHeader)
 
 	n, fEntry := b.inode(in.NodeId, in.Fh)
 	f := fEntry.file
 	if in.Valid&fuse.FATTR_FH == 0 {
 		f = nil
 	}
+	n.clearStaticAttr()
 
+	var errno syscall.Errno
 	if fops, ok := n.ops.(FileOperations); ok {
-		return errnoToStatus(fops.Fsetattr(ctx, f, in, out))
+		errno = fops.Fsetattr(ctx, f, in, out)
+	} else {
+		errno = n.ops.Setattr(ctx, in, out)
 	}
-
-	return errnoToStatus(n.ops.Setattr(ctx, in, out))
+	if b.options.SymlinkCacheTimeout != nil {
+		n.dropLinkTarget()
+	}
+	if errno == 0 {
+		b.setAttrOut(n, out)
+		out.Mode = (out.Mode & 07777) | n.nodeAttr.Mode
+	}
+	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	b.event("Rename", &input.InHeader, oldName)
 	p1, _ := b.inode(input.NodeId, 0)
 	p2, _ := b.inode(input.Newdir, 0)
 
+	supported := b.options.SupportedRenameFlags
+	if rops, ok := p1.ops.(RenameFlagsOperations); ok {
+		supported |= rops.RenameFlags()
+	}
+	if input.Flags&^supported != 0 {
+		return errnoToStatus(syscall.EINVAL)
+	}
+
 	if mops, ok := p1.ops.(MutableDirOperations); ok {
-		errno := mops.Rename(&fuse.Context{Caller: input.Caller, Cancel: cancel}, oldName, p2.ops, newName, input.Flags)
+		// The tree may not know all entries, so the file
+		// system must still check RENAME_NOREPLACE itself.
+		if input.Flags&RENAME_NOREPLACE != 0 && p2.GetChild(newName) != nil {
+			return errnoToStatus(syscall.EEXIST)
+		}
+		errno := mops.Rename(b.newContext(cancel, &input.InHeader), oldName, p2.ops, newName, input.Flags)
 		if errno == 0 {
 			if input.Flags&RENAME_EXCHANGE != 0 {
 				p1.ExchangeChild(oldName, p2, newName)
 			} else {
 				p1.MvChild(oldName, p2, newName, true)
 			}
-
-			return errnoToStatus(errno)
+			b.notifyEntries(p1, oldName)
+			b.notifyEntries(p2, newName)
 		}
+		return errnoToStatus(errno)
 	}
 	return fuse.ENOTSUP
 }
 
+// notifyEntries invalidates the kernel's entries for `names` in
+// `parent`, if Options.NotifyEntries is set. The kernel holds the
+// directory lock until the current request is answered, so the
+// notifications are queued for sendEntryNotifies.
+func (b *rawBridge) notifyEntries(parent *Inode, names ...string) {
+	if !b.options.NotifyEntries {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.server == nil {
+		return
+	}
+	for _, name := range names {
+		b.pendingEntries = append(b.pendingEntries, parentData{name, parent})
+	}
+	if !b.notifyingEntries {
+		b.notifyingEntries = true
+		go b.sendEntryNotifies()
+	}
+}
+
+// sendEntryNotifies sends the queued entry notifications, until the
+// queue is empty.
+func (b *rawBridge) sendEntryNotifies() {
+	for {
+		b.mu.Lock()
+		entries := b.pendingEntries
+		b.pendingEntries = nil
+		if len(entries) == 0 {
+			b.notifyingEntries = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		for _, e := range entries {
+			e.parent.NotifyEntry(e.name)
+		}
+	}
+}
+
 func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	b.event("Link", &input.InHeader, name)
+	if b.options.SingleParent {
+		return fuse.Status(syscall.EMLINK)
+	}
 	parent, _ := b.inode(input.NodeId, 0)
 	target, _ := b.inode(input.Oldnodeid, 0)
 
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
-		child, errno := mops.Link(&fuse.Context{Caller: input.Caller, Cancel: cancel}, target.ops, name, out)
+		child, errno := mops.Link(b.newContext(cancel, &input.InHeader), target.ops, name, out)
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
 
-		b.addNewChild(parent, name, child, nil, 0, out)
-		b.setEntryOutTimeout(out)
+		b.addNewChild(input.Unique, parent, name, child, nil, 0, out)
+		b.setEntryOut(child, out)
 		return fuse.OK
 	}
 	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
+	b.event("Symlink", header, name)
 	parent, _ := b.inode(header.NodeId, 0)
 
 	if mops, ok := parent.ops.(MutableDirOperations); ok {
-		child, status := mops.Symlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, target, name, out)
+		child, status := mops.Symlink(b.newContext(cancel, header), target, name, out)
 		if status != 0 {
 			return errnoToStatus(status)
 		}
 
-		b.addNewChild(parent, name, child, nil, 0, out)
-		b.setEntryOutTimeout(out)
+		b.addNewChild(header.Unique, parent, name, child, nil, 0, out)
+		b.setEntryOut(child, out)
 		return fuse.OK
 	}
 	return fuse.ENOTSUP
@@ -439,17 +882,33 @@ func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, targe
 
 func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
-	result, errno := n.linkOps().Readlink(&fuse.Context{Caller: header.Caller, Cancel: cancel})
+	if b.options.SymlinkCacheTimeout != nil {
+		n.mu.Lock()
+		result := n.linkTarget
+		valid := time.Now().Before(n.linkExpiry)
+		n.mu.Unlock()
+		if valid {
+			return result, fuse.OK
+		}
+	}
+
+	result, errno := n.linkOps().Readlink(b.newContext(cancel, header))
 	if errno != 0 {
 		return nil, errnoToStatus(errno)
 	}
 
+	if b.options.SymlinkCacheTimeout != nil {
+		n.mu.Lock()
+		n.linkTarget = result
+		n.linkExpiry = time.Now().Add(*b.options.SymlinkCacheTimeout)
+		n.mu.Unlock()
+	}
 	return result, fuse.OK
 }
 
 func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	return errnoToStatus(n.ops.Access(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Mask))
+	return errnoToStatus(n.ops.Access(b.newContext(cancel, &input.InHeader), input.Mask))
 }
 
 // Extended attributes.
@@ -458,7 +917,7 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 	n, _ := b.inode(header.NodeId, 0)
 
 	if xops, ok := n.ops.(XAttrOperations); ok {
-		nb, errno := xops.Getxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr, data)
+		nb, errno := xops.Getxattr(b.newContext(cancel, header), attr, data)
 		return nb, errnoToStatus(errno)
 	}
 
@@ -468,7 +927,7 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 	if xops, ok := n.ops.(XAttrOperations); ok {
-		sz, errno := xops.Listxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, dest)
+		sz, errno := xops.Listxattr(b.newContext(cancel, header), dest)
 		return sz, errnoToStatus(errno)
 	}
 	return 0, fuse.ENOTSUP
@@ -477,7 +936,7 @@ func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, des
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 	if xops, ok := n.ops.(XAttrOperations); ok {
-		return errnoToStatus(xops.Setxattr(&fuse.Context{Caller: input.Caller, Cancel: cancel}, attr, data, input.Flags))
+		return errnoToStatus(xops.Setxattr(b.newContext(cancel, &input.InHeader), attr, data, input.Flags))
 	}
 	return fuse.ENOTSUP
 }
@@ -485,16 +944,23 @@ func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, att
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
 	n, _ := b.inode(header.NodeId, 0)
 	if xops, ok := n.ops.(XAttrOperations); ok {
-		return errnoToStatus(xops.Removexattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr))
+		return errnoToStatus(xops.Removexattr(b.newContext(cancel, header), attr))
 	}
 	return fuse.ENOTSUP
 }
 
-func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Open", input.NodeId, time.Now(), &status)
+	}
+	b.event("Open", &input.InHeader, "")
+	if b.noOpenSupport() {
+		return fuse.ENOSYS
+	}
 	n, _ := b.inode(input.NodeId, 0)
-	f, flags, errno := n.fileOps().Open(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
+	f, flags, errno := n.fileOps().Open(b.newContext(cancel, &input.InHeader), input.Flags)
 	if errno != 0 {
-		return errnoToStatus(errno)
+		return interruptedStatus(cancel, errno)
 	}
 
 	if f != nil {
@@ -506,6 +972,51 @@ func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.O
 	return fuse.OK
 }
 
+// HandleOpcode implements fuse.RawOpcodeHandler, forwarding to
+// Options.RawHandler.
+func (b *rawBridge) HandleOpcode(cancel <-chan struct{}, in *fuse.InHeader, opcode uint32, data []byte) ([]byte, fuse.Status) {
+	if b.options.RawHandler == nil {
+		return nil, fuse.ENOSYS
+	}
+	out, errno := b.options.RawHandler(cancel, in, opcode, data)
+	return out, errnoToStatus(errno)
+}
+
+// EntryReplied implements fuse.RawEntryReplyHandler, sending the
+// NotifyStore data for the nodes that the request introduced to the
+// kernel. It runs after the reply and outside the tree locks.
+func (b *rawBridge) EntryReplied(header *fuse.InHeader, code fuse.Status) {
+	b.mu.Lock()
+	nodes, ok := b.replyStores[header.Unique]
+	if ok {
+		delete(b.replyStores, header.Unique)
+	}
+	b.mu.Unlock()
+	if !ok || !code.Ok() {
+		return
+	}
+	for _, n := range nodes {
+		n.mu.Lock()
+		stores := n.pendingStores
+		n.pendingStores = nil
+		n.mu.Unlock()
+		for _, s := range stores {
+			n.WriteCache(s.off, s.data)
+		}
+	}
+}
+
+// noOpenSupport returns true if OPEN should be answered with ENOSYS,
+// for Options.NoOpenSupport. Without a server, as in tests, the
+// kernel is assumed to support it.
+func (b *rawBridge) noOpenSupport() bool {
+	if !b.options.NoOpenSupport {
+		return false
+	}
+	server := b.Server()
+	return server == nil || server.KernelSettings().Flags&fuse.CAP_NO_OPEN_SUPPORT != 0
+}
+
 // registerFile hands out a file handle. Must have bridge.mu
 func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 	var fh uint32
@@ -521,53 +1032,126 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 	fileEntry := b.files[fh]
 	fileEntry.nodeIndex = len(n.openFiles)
 	fileEntry.file = f
+	fileEntry.readEnd = -1
 
 	n.openFiles = append(n.openFiles, fh)
 	return fh
 }
 
-func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (res fuse.ReadResult, status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Read", input.NodeId, time.Now(), &status)
+	}
+	b.event("Read", &input.InHeader, "")
 	n, f := b.inode(input.NodeId, input.Fh)
-	res, errno := n.fileOps().Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, buf, int64(input.Offset))
-	return res, errnoToStatus(errno)
+	off := int64(input.Offset)
+	if ra, ok := n.ops.(ReadAheadOperations); ok && input.Fh != 0 && b.sequentialRead(f, off, len(buf)) {
+		// Release waits for wg, so the FileHandle is not
+		// recycled under ReadAhead.
+		go func() {
+			defer f.wg.Done()
+			ra.ReadAhead(b.newContext(nil, &input.InHeader), f.file, off+int64(len(buf)), len(buf))
+		}()
+	}
+	res, errno := n.fileOps().Read(b.newContext(cancel, &input.InHeader), f.file, buf, off)
+	return res, interruptedStatus(cancel, errno)
+}
+
+// sequentialRead records a read of `sz` bytes at `off` on `f`, and
+// returns whether it continues the previous read. If so, it adds the
+// coming ReadAhead to f.wg.
+func (b *rawBridge) sequentialRead(f *fileEntry, off int64, sz int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seq := f.readEnd >= 0 && off == f.readEnd
+	f.readEnd = off + int64(sz)
+	if seq {
+		f.wg.Add(1)
+	}
+	return seq
+}
+
+// lockOps returns the LockOperations of `n`. It fails with ENOTSUP
+// if `n` does not implement them, and with ENOSYS once a lock
+// operation has returned ENOSYS.
+func (b *rawBridge) lockOps(n *Inode) (LockOperations, syscall.Errno) {
+	lops, ok := n.ops.(LockOperations)
+	if !ok {
+		return nil, syscall.ENOTSUP
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.noLocks {
+		return nil, syscall.ENOSYS
+	}
+	return lops, OK
+}
+
+// lockResult records an ENOSYS from a lock operation, so the bridge
+// stops calling the file system for locks.
+func (b *rawBridge) lockResult(errno syscall.Errno) syscall.Errno {
+	if errno == syscall.ENOSYS {
+		b.mu.Lock()
+		b.noLocks = true
+		b.mu.Unlock()
+	}
+	return errno
 }
 
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-
-	if lops, ok := n.ops.(LockOperations); ok {
-		return errnoToStatus(lops.Getlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk))
+	lops, errno := b.lockOps(n)
+	if errno != 0 {
+		return errnoToStatus(errno)
 	}
-	return fuse.ENOTSUP
+	return errnoToStatus(b.lockResult(lops.Getlk(b.newContext(cancel, &input.InHeader), f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk)))
 }
 
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if lops, ok := n.ops.(LockOperations); ok {
-		return errnoToStatus(lops.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
+	lops, errno := b.lockOps(n)
+	if errno != 0 {
+		return errnoToStatus(errno)
 	}
-	return fuse.ENOTSUP
+	return errnoToStatus(b.lockResult(lops.Setlk(b.newContext(cancel, &input.InHeader), f.file, input.Owner, &input.Lk, input.LkFlags)))
 }
+
 func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if lops, ok := n.ops.(LockOperations); ok {
-		return errnoToStatus(lops.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
+	lops, errno := b.lockOps(n)
+	if errno != 0 {
+		return errnoToStatus(errno)
 	}
-	return fuse.ENOTSUP
+	return interruptedStatus(cancel, b.lockResult(lops.Setlkw(b.newContext(cancel, &input.InHeader), f.file, input.Owner, &input.Lk, input.LkFlags)))
 }
 
 func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	n, f := b.releaseFileEntry(input.NodeId, input.Fh)
+	var fh FileHandle
+	if f != nil {
+		f.wg.Wait()
+		fh = f.file
+	}
+	if input.ReleaseFlags&fuse.RELEASE_FLOCK_UNLOCK != 0 {
+		// The kernel leaves it to us to drop the flock(2)
+		// locks taken through this file.
+		if lops, errno := b.lockOps(n); errno == 0 {
+			lk := fuse.FileLock{End: math.MaxInt64, Typ: syscall.F_UNLCK}
+			lops.Setlk(b.newContext(cancel, &input.InHeader), fh, input.LockOwner, &lk, fuse.FUSE_LK_FLOCK)
+		}
+	}
 	if f == nil {
 		return
 	}
 
-	f.wg.Wait()
-	n.fileOps().Release(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file)
+	n.fileOps().Release(b.newContext(cancel, &input.InHeader), fh)
+	if b.options.FileHandlePool != nil && fh != nil {
+		b.options.FileHandlePool.Put(fh)
+	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
+	b.freeFile(uint32(input.Fh))
 }
 
 func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
@@ -576,10 +1160,24 @@ func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 	if f.dirStream != nil {
 		f.dirStream.Close()
 	}
+	if f.dirStreamPlus != nil {
+		f.dirStreamPlus.Close()
+	}
+	if f.dirHandle != nil {
+		f.dirHandle.Releasedir(b.newContext(nil, &input.InHeader))
+	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
+	b.freeFile(uint32(input.Fh))
+}
+
+// freeFile resets the entry for `fh`, so it no longer references the
+// file handle or directory stream, and makes it available for reuse
+// by registerFile. Must have bridge.mu.
+func (b *rawBridge) freeFile(fh uint32) {
+	*b.files[fh] = fileEntry{}
+	b.freeFiles = append(b.freeFiles, fh)
 }
 
 func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry) {
@@ -602,36 +1200,56 @@ func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry)
 }
 
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Write", input.NodeId, time.Now(), &status)
+	}
+	b.event("Write", &input.InHeader, "")
+	ctx := b.newContext(cancel, &input.InHeader)
+	ctx.writeback = input.WriteFlags&fuse.WRITE_CACHE != 0
 	n, f := b.inode(input.NodeId, input.Fh)
 
-	w, errno := n.fileOps().Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, data, int64(input.Offset))
-	return w, errnoToStatus(errno)
+	w, errno := n.fileOps().Write(ctx, f.file, data, int64(input.Offset))
+	return w, interruptedStatus(cancel, errno)
 }
 
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	return errnoToStatus(n.fileOps().Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file))
+	return interruptedStatus(cancel, n.fileOps().Flush(b.newContext(cancel, &input.InHeader), f.file))
 }
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	b.event("Fsync", &input.InHeader, "")
 	n, f := b.inode(input.NodeId, input.Fh)
-	return errnoToStatus(n.fileOps().Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.FsyncFlags))
+	return interruptedStatus(cancel, n.fileOps().Fsync(b.newContext(cancel, &input.InHeader), f.file, input.FsyncFlags))
 }
 
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	return errnoToStatus(n.fileOps().Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Offset, input.Length, input.Mode))
+	return errnoToStatus(n.fileOps().Allocate(b.newContext(cancel, &input.InHeader), f.file, input.Offset, input.Length, input.Mode))
 }
 
 func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	errno := n.dirOps().Opendir(&fuse.Context{Caller: input.Caller, Cancel: cancel})
-	if errno != 0 {
+	ctx := b.newContext(cancel, &input.InHeader)
+
+	var dh DirHandle
+	if hops, ok := n.ops.(DirHandleOperations); ok {
+		var flags uint32
+		var errno syscall.Errno
+		dh, flags, errno = hops.OpendirHandle(ctx, input.Flags)
+		if errno != 0 {
+			return errnoToStatus(errno)
+		}
+		out.OpenFlags = flags
+	} else if errno := n.dirOps().Opendir(ctx); errno != 0 {
 		return errnoToStatus(errno)
 	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	out.Fh = uint64(b.registerFile(n, nil, 0))
+	fh := b.registerFile(n, nil, 0)
+	b.files[fh].dirHandle = dh
+	out.Fh = uint64(fh)
 	return fuse.OK
 }
 
@@ -641,19 +1259,46 @@ func (b *rawBridge) getStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 			f.dirStream.Close()
 			f.dirStream = nil
 		}
-		str, errno := inode.dirOps().Readdir(&fuse.Context{Caller: input.Caller, Cancel: cancel})
+		var str DirStream
+		var errno syscall.Errno
+		ctx := b.newContext(cancel, &input.InHeader)
+		if f.dirHandle != nil {
+			str, errno = f.dirHandle.Readdir(ctx)
+		} else {
+			str, errno = inode.dirOps().Readdir(ctx)
+		}
 		if errno != 0 {
 			return errno
 		}
 
+		if b.options.SynthesizeDotEntries {
+			str = newDotDirStream(inode, str)
+		}
+
 		f.hasOverflow = false
 		f.dirStream = str
+		f.dirOffset = 0
+	}
+
+	// A nonzero offset on a fresh stream resumes a listing from an
+	// earlier handle, eg. for an NFS client holding a cookie.
+	if input.Offset != f.dirOffset {
+		if str, ok := f.dirStream.(SeekableDirStream); ok {
+			if errno := str.Seekdir(input.Offset); errno != 0 {
+				return errno
+			}
+			f.hasOverflow = false
+			f.dirOffset = input.Offset
+		}
 	}
 
 	return 0
 }
 
-func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("Readdir", input.NodeId, time.Now(), &status)
+	}
 	n, f := b.inode(input.NodeId, input.Fh)
 
 	if errno := b.getStream(cancel, input, n, f); errno != 0 {
@@ -663,6 +1308,7 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 	if f.hasOverflow {
 		// always succeeds.
 		out.AddDirEntry(f.overflow)
+		f.dirOffset = dirEntryOffset(f.dirOffset, f.overflow)
 		f.hasOverflow = false
 	}
 
@@ -677,13 +1323,80 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 			f.hasOverflow = true
 			return errnoToStatus(errno)
 		}
+		f.dirOffset = dirEntryOffset(f.dirOffset, e)
+	}
+
+	return fuse.OK
+}
+
+func (b *rawBridge) getStreamPlus(cancel <-chan struct{}, input *fuse.ReadIn, pops ReaddirPlusOperations, f *fileEntry) syscall.Errno {
+	if f.dirStreamPlus == nil || input.Offset == 0 {
+		if f.dirStreamPlus != nil {
+			f.dirStreamPlus.Close()
+			f.dirStreamPlus = nil
+		}
+		str, errno := pops.Readdirplus(b.newContext(cancel, &input.InHeader))
+		if errno != 0 {
+			return errno
+		}
+
+		f.hasOverflow = false
+		f.overflowChild = nil
+		f.dirStreamPlus = str
+	}
+
+	return 0
+}
+
+// readDirPlusStream serves READDIRPLUS from a DirStreamPlus.
+func (b *rawBridge) readDirPlusStream(cancel <-chan struct{}, input *fuse.ReadIn, n *Inode, pops ReaddirPlusOperations, f *fileEntry, out *fuse.DirEntryList) fuse.Status {
+	if errno := b.getStreamPlus(cancel, input, pops, f); errno != 0 {
+		return errnoToStatus(errno)
+	}
+
+	for f.hasOverflow || f.dirStreamPlus.HasNext() {
+		var e fuse.DirEntry
+		var child *Inode
+		var childOut fuse.EntryOut
+		if f.hasOverflow {
+			e, child, childOut = f.overflow, f.overflowChild, f.overflowOut
+			f.hasOverflow = false
+			f.overflowChild = nil
+		} else {
+			var errno syscall.Errno
+			e, child, errno = f.dirStreamPlus.Next(&childOut)
+			if errno != 0 {
+				return errnoToStatus(errno)
+			}
+		}
+
+		entryOut := out.AddDirLookupEntry(e)
+		if entryOut == nil {
+			f.overflow, f.overflowChild, f.overflowOut = e, child, childOut
+			f.hasOverflow = true
+			return fuse.OK
+		}
+		if child == nil {
+			continue
+		}
+
+		*entryOut = childOut
+		b.addNewChild(input.Unique, n, e.Name, child, nil, 0, entryOut)
+		b.setEntryOut(child, entryOut)
+		entryOut.Mode = child.nodeAttr.Mode | (entryOut.Mode & 07777)
 	}
 
 	return fuse.OK
 }
 
-func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (status fuse.Status) {
+	if b.options.Logger != nil {
+		defer b.logOp("ReaddirPlus", input.NodeId, time.Now(), &status)
+	}
 	n, f := b.inode(input.NodeId, input.Fh)
+	if pops, ok := n.ops.(ReaddirPlusOperations); ok && f.dirHandle == nil {
+		return b.readDirPlusStream(cancel, input, n, pops, f, out)
+	}
 
 	if errno := b.getStream(cancel, input, n, f); errno != 0 {
 		return errnoToStatus(errno)
@@ -709,15 +1422,23 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 			f.hasOverflow = true
 			return fuse.OK
 		}
+		f.dirOffset = dirEntryOffset(f.dirOffset, e)
+		if e.Name == "." || e.Name == ".." {
+			// The kernel ignores lookup data for these, so
+			// it would never forget the reference.
+			continue
+		}
 
-		child, errno := n.dirOps().Lookup(&fuse.Context{Caller: input.Caller, Cancel: cancel}, e.Name, entryOut)
+		ctx := b.newContext(cancel, &input.InHeader)
+		ctx.readdirPlus = true
+		child, errno := n.dirOps().Lookup(ctx, e.Name, entryOut)
 		if errno != 0 {
-			if b.options.NegativeTimeout != nil {
+			if b.options.NegativeTimeout != nil && entryOut.EntryTimeout() == 0 {
 				entryOut.SetEntryTimeout(*b.options.NegativeTimeout)
 			}
 		} else {
-			b.addNewChild(n, e.Name, child, nil, 0, entryOut)
-			b.setEntryOutTimeout(entryOut)
+			b.addNewChild(input.Unique, n, e.Name, child, nil, 0, entryOut)
+			b.setEntryOut(child, entryOut)
 			if (e.Mode &^ 07777) != (child.nodeAttr.Mode &^ 07777) {
 				// should go back and change the
 				// already serialized entry
@@ -731,16 +1452,26 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 }
 
 func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	b.event("Fsyncdir", &input.InHeader, "")
 	n, _ := b.inode(input.NodeId, input.Fh)
-	return errnoToStatus(n.fileOps().Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, nil, input.FsyncFlags))
+	return errnoToStatus(n.dirOps().Fsyncdir(b.newContext(cancel, &input.InHeader), input.FsyncFlags))
 }
 
 func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	return errnoToStatus(n.ops.Statfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}, out))
+	return errnoToStatus(n.ops.Statfs(b.newContext(cancel, input), out))
+}
+
+// Server returns the server, or nil before Init.
+func (b *rawBridge) Server() *fuse.Server {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.server
 }
 
 func (b *rawBridge) Init(s *fuse.Server) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.server = s
 }
 
@@ -748,16 +1479,99 @@ func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRange
 	n1, f1 := b.inode(in.NodeId, in.FhIn)
 	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
 
-	sz, errno := n1.fileOps().CopyFileRange(&fuse.Context{Caller: in.Caller, Cancel: cancel},
+	sz, errno := n1.fileOps().CopyFileRange(b.newContext(cancel, &in.InHeader),
 		f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
-	return sz, errnoToStatus(errno)
+	return sz, interruptedStatus(cancel, errno)
 }
 
 func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	n, f := b.inode(in.NodeId, in.Fh)
 
-	off, errno := n.fileOps().Lseek(&fuse.Context{Caller: in.Caller, Cancel: cancel},
+	off, errno := n.fileOps().Lseek(b.newContext(cancel, &in.InHeader),
 		f.file, in.Offset, in.Whence)
 	out.Offset = off
 	return errnoToStatus(errno)
 }
+
+var _ = (fuse.RawIoctlHandler)((*rawBridge)(nil))
+
+// Ioctl implements fuse.RawIoctlHandler.
+func (b *rawBridge) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, inData []byte, out *fuse.IoctlOut, buf []byte) ([]byte, fuse.Status) {
+	n, f := b.inode(in.NodeId, in.Fh)
+	iops, ok := n.ops.(IoctlOperations)
+	if !ok {
+		return nil, errnoToStatus(syscall.ENOTTY)
+	}
+
+	if in.Flags&fuse.FUSE_IOCTL_UNRESTRICTED != 0 {
+		// For unrestricted ioctls, the kernel doesn't know the
+		// buffer sizes. Ask it to retry with the sizes encoded
+		// in the command.
+		inSize, outSize := ioctlSizes(in.Cmd)
+		if in.InSize < inSize || in.OutSize < outSize {
+			return ioctlRetry(in, out, inSize, outSize), fuse.OK
+		}
+	}
+
+	if uint32(len(inData)) > in.InSize {
+		inData = inData[:in.InSize]
+	}
+	res, errno := iops.Ioctl(b.newContext(cancel, &in.InHeader), f.file, in.Cmd, in.Arg, inData, buf)
+	if errno != 0 {
+		return nil, errnoToStatus(errno)
+	}
+	out.Result = res
+	return buf, fuse.OK
+}
+
+// ioctlRetry fills in a FUSE_IOCTL_RETRY reply, asking for the input
+// and output buffers at the ioctl argument.
+func ioctlRetry(in *fuse.IoctlIn, out *fuse.IoctlOut, inSize, outSize uint32) []byte {
+	var iovs []fuse.IoctlIovec
+	if inSize > 0 {
+		iovs = append(iovs, fuse.IoctlIovec{Base: in.Arg, Len: uint64(inSize)})
+		out.InIovs = 1
+	}
+	if outSize > 0 {
+		iovs = append(iovs, fuse.IoctlIovec{Base: in.Arg, Len: uint64(outSize)})
+		out.OutIovs = 1
+	}
+	out.Flags |= fuse.FUSE_IOCTL_RETRY
+
+	sz := int(unsafe.Sizeof(fuse.IoctlIovec{}))
+	data := make([]byte, len(iovs)*sz)
+	for i := range iovs {
+		copy(data[i*sz:], (*[unsafe.Sizeof(fuse.IoctlIovec{})]byte)(unsafe.Pointer(&iovs[i]))[:])
+	}
+	return data
+}
+
+// _DEFAULT_POLLMASK is reported for files that don't implement
+// PollOperations, as in the kernel: POLLIN | POLLOUT | POLLRDNORM |
+// POLLWRNORM.
+const _DEFAULT_POLLMASK = 0x1 | 0x4 | 0x40 | 0x100
+
+var _ = (fuse.RawPollHandler)((*rawBridge)(nil))
+
+// Poll implements fuse.RawPollHandler.
+func (b *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	n, f := b.inode(in.NodeId, in.Fh)
+	pops, ok := n.ops.(PollOperations)
+	if !ok {
+		out.Revents = _DEFAULT_POLLMASK
+		return fuse.OK
+	}
+
+	if in.Flags&fuse.FUSE_POLL_SCHEDULE_NOTIFY != 0 {
+		n.mu.Lock()
+		if n.pollHandles == nil {
+			n.pollHandles = map[uint64]struct{}{}
+		}
+		n.pollHandles[in.Kh] = struct{}{}
+		n.mu.Unlock()
+	}
+
+	revents, errno := pops.Poll(b.newContext(cancel, &in.InHeader), f.file, in.Events)
+	out.Revents = revents
+	return errnoToStatus(errno)
+}
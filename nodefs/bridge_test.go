@@ -0,0 +1,512 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// poolHandle is a file handle with some per-open state.
+type poolHandle struct {
+	FileHandleStubs
+	buf [64]byte
+}
+
+// pooledFile takes its file handles from pool, if set.
+type pooledFile struct {
+	OperationStubs
+	pool *sync.Pool
+}
+
+func (f *pooledFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if f.pool != nil {
+		if h, ok := f.pool.Get().(*poolHandle); ok {
+			*h = poolHandle{}
+			return h, 0, OK
+		}
+	}
+	return &poolHandle{}, 0, OK
+}
+
+func (f *pooledFile) Release(ctx context.Context, h FileHandle) syscall.Errno {
+	return OK
+}
+
+func TestReleaseDropsHandle(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().AddChild("file",
+		root.Inode().NewPersistentInode(context.Background(), &pooledFile{}, NodeAttr{Ino: 2}), false)
+
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 2}}, &out); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 2}, Fh: out.Fh})
+
+	b := rawFS.(*rawBridge)
+	if f := b.files[out.Fh].file; f != nil {
+		t.Errorf("released entry still references %v", f)
+	}
+
+	var out2 fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 2}}, &out2); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	if out2.Fh != out.Fh {
+		t.Errorf("got fh %d, want reused fh %d", out2.Fh, out.Fh)
+	}
+}
+
+func TestInoAllocator(t *testing.T) {
+	next := uint64(1)
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{
+		InoAllocator: func() uint64 {
+			next++
+			return next * 10
+		},
+	})
+
+	ctx := context.Background()
+	// Explicit numbers are left alone, and taken ones are skipped.
+	explicit := root.Inode().NewPersistentChild(ctx, "explicit", &OperationStubs{}, NodeAttr{Ino: 30})
+	if got := explicit.NodeAttr().Ino; got != 30 {
+		t.Errorf("got explicit ino %d, want 30", got)
+	}
+	for _, want := range []uint64{20, 40, 50} {
+		ch := root.Inode().NewInode(ctx, &OperationStubs{}, NodeAttr{})
+		if got := ch.NodeAttr().Ino; got != want {
+			t.Errorf("got ino %d, want %d", got, want)
+		}
+		root.Inode().AddChild(fmt.Sprint(want), ch, false)
+	}
+}
+
+// BenchmarkOpenRelease compares opens that allocate their file
+// handle with ones that recycle it through Options.FileHandlePool.
+// The bridge recycles its own file entries in both cases.
+func BenchmarkOpenRelease(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "alloc"
+		opts := &Options{}
+		if pooled {
+			name = "pool"
+			opts.FileHandlePool = &sync.Pool{}
+		}
+		b.Run(name, func(b *testing.B) {
+			root := &OperationStubs{}
+			rawFS := NewNodeFS(root, opts)
+			root.Inode().AddChild("file",
+				root.Inode().NewPersistentInode(context.Background(), &pooledFile{pool: opts.FileHandlePool}, NodeAttr{Ino: 2}), false)
+
+			in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 2}}
+			rel := &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 2}}
+			var out fuse.OpenOut
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if st := rawFS.Open(nil, in, &out); !st.Ok() {
+					b.Fatalf("Open: %v", st)
+				}
+				rel.Fh = out.Fh
+				rawFS.Release(nil, rel)
+			}
+		})
+	}
+}
+
+type statelessFile struct {
+	OperationStubs
+	opens int
+}
+
+func (f *statelessFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	f.opens++
+	return nil, 0, OK
+}
+
+func (f *statelessFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if fh != nil {
+		return nil, syscall.EBADF
+	}
+	return fuse.ReadResultData([]byte("hello")), OK
+}
+
+func TestNoOpenSupport(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{NoOpenSupport: true})
+	file := &statelessFile{}
+	root.Inode().NewPersistentChild(context.Background(), "file", file, NodeAttr{Ino: 2})
+
+	hdr := fuse.InHeader{NodeId: 2}
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr}, &out); st != fuse.ENOSYS {
+		t.Errorf("Open: got %v, want ENOSYS", st)
+	}
+
+	// The kernel now reads without a file handle.
+	buf := make([]byte, 10)
+	res, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: hdr, Size: uint32(len(buf))}, buf)
+	if !st.Ok() {
+		t.Fatalf("Read: %v", st)
+	}
+	if data, _ := res.Bytes(buf); string(data) != "hello" {
+		t.Errorf("got %q, want %q", data, "hello")
+	}
+	if file.opens != 0 {
+		t.Errorf("Open was called %d times", file.opens)
+	}
+}
+
+func TestRawHandler(t *testing.T) {
+	var gotOp uint32
+	var gotData string
+	rawFS := NewNodeFS(&OperationStubs{}, &Options{
+		RawHandler: func(cancel <-chan struct{}, in *fuse.InHeader, opcode uint32, data []byte) ([]byte, syscall.Errno) {
+			gotOp, gotData = opcode, string(data)
+			return []byte("reply"), OK
+		},
+	})
+
+	h, ok := rawFS.(fuse.RawOpcodeHandler)
+	if !ok {
+		t.Fatal("bridge does not implement fuse.RawOpcodeHandler")
+	}
+	out, st := h.HandleOpcode(nil, &fuse.InHeader{NodeId: 1, Opcode: 4711}, 4711, []byte("request"))
+	if !st.Ok() || string(out) != "reply" {
+		t.Errorf("got %q, %v, want %q, OK", out, st, "reply")
+	}
+	if gotOp != 4711 || gotData != "request" {
+		t.Errorf("handler got opcode %d, data %q", gotOp, gotData)
+	}
+
+	h = NewNodeFS(&OperationStubs{}, &Options{}).(fuse.RawOpcodeHandler)
+	if _, st := h.HandleOpcode(nil, &fuse.InHeader{NodeId: 1}, 4711, nil); st != fuse.ENOSYS {
+		t.Errorf("without handler: got %v, want ENOSYS", st)
+	}
+}
+
+// slowLookupDir is a directory whose lookups take a while, like a
+// network file system. If inFlight is set, each lookup waits until
+// that many are running.
+type slowLookupDir struct {
+	OperationStubs
+
+	delay    time.Duration
+	inFlight int
+
+	mu      sync.Mutex
+	running int
+}
+
+func (d *slowLookupDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.inFlight > 0 {
+		d.mu.Lock()
+		d.running++
+		deadline := time.Now().Add(5 * time.Second)
+		for d.running < d.inFlight && time.Now().Before(deadline) {
+			d.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			d.mu.Lock()
+		}
+		ok := d.running >= d.inFlight
+		d.mu.Unlock()
+		if !ok {
+			return nil, syscall.ETIMEDOUT
+		}
+	}
+	time.Sleep(d.delay)
+	if ch := d.Inode().GetChild(name); ch != nil {
+		return ch, OK
+	}
+	return d.Inode().NewInode(ctx, &OperationStubs{}, NodeAttr{}), OK
+}
+
+func TestParallelLookup(t *testing.T) {
+	const n = 8
+	root := &slowLookupDir{inFlight: n}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var wg sync.WaitGroup
+	errs := make(chan fuse.Status, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var out fuse.EntryOut
+			errs <- rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, fmt.Sprint("file", i), &out)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for st := range errs {
+		if !st.Ok() {
+			t.Errorf("Lookup: %v, want the bridge to run lookups in one directory concurrently", st)
+		}
+	}
+	if got := len(root.Inode().Children()); got != n {
+		t.Errorf("got %d children, want %d", got, n)
+	}
+}
+
+// BenchmarkParallelLookup compares lookups in one directory with and
+// without fuse.MountOptions.DisableParallelDirOps. With it, the kernel
+// holds the directory lock across the LOOKUP, which "serialized"
+// mimics with a mutex.
+func BenchmarkParallelLookup(b *testing.B) {
+	for _, serialized := range []bool{true, false} {
+		name := "parallel"
+		if serialized {
+			name = "serialized"
+		}
+		b.Run(name, func(b *testing.B) {
+			root := &slowLookupDir{delay: 50 * time.Microsecond}
+			rawFS := NewNodeFS(root, &Options{})
+			var dirLock sync.Mutex
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var out fuse.EntryOut
+				hdr := &fuse.InHeader{NodeId: 1}
+				i := 0
+				for pb.Next() {
+					if serialized {
+						dirLock.Lock()
+					}
+					st := rawFS.Lookup(nil, hdr, fmt.Sprint("file", i%64), &out)
+					if serialized {
+						dirLock.Unlock()
+					}
+					if !st.Ok() {
+						b.Fatalf("Lookup: %v", st)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// getattrCountFile counts Getattr calls, and looks up its attributes
+// in a table, as an archive file system might.
+type getattrCountFile struct {
+	OperationStubs
+
+	mu    sync.Mutex
+	calls int
+	table map[string]fuse.Attr
+}
+
+func (f *getattrCountFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	out.Attr = f.table["file"]
+	return OK
+}
+
+func (f *getattrCountFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return f.Getattr(ctx, out)
+}
+
+func newStaticAttrFS(static bool) (fuse.RawFileSystem, *getattrCountFile) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	f := &getattrCountFile{
+		table: map[string]fuse.Attr{"file": {Size: 42, Mode: 0644}},
+	}
+	ch := root.Inode().NewPersistentInode(context.Background(), f, NodeAttr{Ino: 2})
+	root.Inode().AddChild("file", ch, false)
+	if static {
+		ch.SetStaticAttr(fuse.Attr{Size: 42, Mode: 0644})
+	}
+	return rawFS, f
+}
+
+func TestStaticAttr(t *testing.T) {
+	rawFS, f := newStaticAttrFS(true)
+
+	in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 2}}
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, in, &out); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if f.calls != 0 {
+		t.Errorf("Getattr called %d times for static attributes", f.calls)
+	}
+	if out.Size != 42 || out.Mode != fuse.S_IFREG|0644 || out.Ino != 2 {
+		t.Errorf("got %v", &out.Attr)
+	}
+	if out.Timeout() < 24*time.Hour {
+		t.Errorf("got attribute timeout %v, want forever", out.Timeout())
+	}
+
+	// Setattr makes the attributes dynamic again.
+	sin := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader: fuse.InHeader{NodeId: 2},
+		Valid:    fuse.FATTR_MODE,
+		Mode:     0600,
+	}}
+	if st := rawFS.SetAttr(nil, sin, &out); !st.Ok() {
+		t.Fatalf("SetAttr: %v", st)
+	}
+	f.calls = 0
+	if st := rawFS.GetAttr(nil, in, &out); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if f.calls != 1 {
+		t.Errorf("got %d Getattr calls after Setattr, want 1", f.calls)
+	}
+}
+
+// BenchmarkStaticAttr compares GETATTR for nodes with and without
+// Inode.SetStaticAttr.
+func BenchmarkStaticAttr(b *testing.B) {
+	for _, static := range []bool{false, true} {
+		name := "dynamic"
+		if static {
+			name = "static"
+		}
+		b.Run(name, func(b *testing.B) {
+			rawFS, _ := newStaticAttrFS(static)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 2}}
+				var out fuse.AttrOut
+				for pb.Next() {
+					rawFS.GetAttr(nil, in, &out)
+				}
+			})
+		})
+	}
+}
+
+// renameFlagsDir records the flags of Rename calls, and declares
+// the flags in `declared`.
+type renameFlagsDir struct {
+	MemDir
+	declared uint32
+	flags    []uint32
+}
+
+func (d *renameFlagsDir) RenameFlags() uint32 {
+	return d.declared
+}
+
+func (d *renameFlagsDir) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	d.flags = append(d.flags, flags)
+	return d.MemDir.Rename(ctx, name, &d.MemDir, newName, flags)
+}
+
+func TestSupportedRenameFlags(t *testing.T) {
+	for _, tc := range []struct {
+		supported uint32
+		declared  uint32
+		flags     uint32
+		want      fuse.Status
+	}{
+		{0, 0, 0, fuse.OK},
+		{0, 0, RENAME_NOREPLACE, fuse.EINVAL},
+		{RENAME_NOREPLACE, 0, RENAME_NOREPLACE, fuse.OK},
+		{RENAME_NOREPLACE, 0, RENAME_WHITEOUT, fuse.EINVAL},
+		{RENAME_NOREPLACE, 0, RENAME_NOREPLACE | RENAME_WHITEOUT, fuse.EINVAL},
+		{RENAME_NOREPLACE | RENAME_WHITEOUT, 0, RENAME_WHITEOUT, fuse.OK},
+		{0, RENAME_NOREPLACE, RENAME_NOREPLACE, fuse.OK},
+		{0, RENAME_NOREPLACE, RENAME_WHITEOUT, fuse.EINVAL},
+		{RENAME_WHITEOUT, RENAME_NOREPLACE, RENAME_NOREPLACE | RENAME_WHITEOUT, fuse.OK},
+	} {
+		root := &renameFlagsDir{declared: tc.declared}
+		rawFS := NewNodeFS(root, &Options{SupportedRenameFlags: tc.supported})
+		var out fuse.CreateOut
+		if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0644}, "a", &out); !st.Ok() {
+			t.Fatalf("Create: %v", st)
+		}
+
+		in := &fuse.RenameIn{
+			InHeader: fuse.InHeader{NodeId: 1},
+			Newdir:   1,
+			Flags:    tc.flags,
+		}
+		if st := rawFS.Rename(nil, in, "a", "b"); st != tc.want {
+			t.Errorf("supported %x, declared %x, flags %x: got %v, want %v", tc.supported, tc.declared, tc.flags, st, tc.want)
+		}
+		if tc.want.Ok() {
+			if len(root.flags) != 1 || root.flags[0] != tc.flags {
+				t.Errorf("supported %x, declared %x, flags %x: Rename got flags %v", tc.supported, tc.declared, tc.flags, root.flags)
+			}
+		} else if len(root.flags) != 0 {
+			t.Errorf("supported %x, declared %x, flags %x: rejected flags reached Rename", tc.supported, tc.declared, tc.flags)
+		}
+	}
+}
+
+func TestNodeAttrRdev(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	dev := MakeDev(1, 3)
+	root.Inode().AddChild("null",
+		root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 2, Mode: syscall.S_IFCHR, Rdev: dev}), false)
+
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 2}}, &out); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if out.Rdev != dev {
+		t.Errorf("got rdev %x, want %x", out.Rdev, dev)
+	}
+}
+
+// lazySizeFile reports its size only once it has been computed, and
+// asks the kernel to check back soon until then.
+type lazySizeFile struct {
+	OperationStubs
+	size *uint64
+}
+
+func (f *lazySizeFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	if f.size == nil {
+		out.SetTimeout(time.Nanosecond)
+		return OK
+	}
+	out.Size = *f.size
+	return OK
+}
+
+func TestGetattrShortTimeout(t *testing.T) {
+	hour := time.Hour
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{AttrTimeout: &hour})
+	f := &lazySizeFile{}
+	root.Inode().AddChild("file",
+		root.Inode().NewPersistentInode(context.Background(), f, NodeAttr{Ino: 2}), false)
+
+	getattr := func() fuse.AttrOut {
+		var out fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 2}}, &out); !st.Ok() {
+			t.Fatalf("GetAttr: %v", st)
+		}
+		return out
+	}
+
+	if out := getattr(); out.AttrValid != 0 || out.AttrValidNsec != 1 {
+		t.Errorf("without size: got timeout %d.%09ds, want 1ns", out.AttrValid, out.AttrValidNsec)
+	}
+
+	size := uint64(42)
+	f.size = &size
+	if out := getattr(); out.Timeout() != hour || out.Size != size {
+		t.Errorf("with size: got timeout %v, size %d, want %v, %d", out.Timeout(), out.Size, hour, size)
+	}
+}
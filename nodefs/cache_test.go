@@ -11,8 +11,10 @@ import (
 	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/internal/testutil"
@@ -58,7 +60,7 @@ func (f *keepCacheFile) Read(ctx context.Context, fh FileHandle, dest []byte, of
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	return fuse.ReadResultData(f.content[off:]), OK
+	return fuse.ReadResultInto(dest, f.content[off:]), OK
 }
 
 type keepCacheRoot struct {
@@ -74,13 +76,13 @@ func (r *keepCacheRoot) OnAdd(ctx context.Context) {
 		keepCache: true,
 	}
 	r.keep.setContent(0)
-	i.AddChild("keep", i.NewInode(ctx, r.keep, NodeAttr{}), true)
+	i.NewChild(ctx, "keep", r.keep, NodeAttr{})
 
 	r.nokeep = &keepCacheFile{
 		keepCache: false,
 	}
 	r.nokeep.setContent(0)
-	i.AddChild("nokeep", i.NewInode(ctx, r.nokeep, NodeAttr{}), true)
+	i.NewChild(ctx, "nokeep", r.nokeep, NodeAttr{})
 }
 
 // Test FOPEN_KEEP_CACHE. This is a little subtle: the automatic cache
@@ -139,3 +141,266 @@ func TestKeepCache(t *testing.T) {
 		t.Errorf("nokeep read 2 got %q want read 1 %q", c2, c1)
 	}
 }
+
+// storeFile counts reads, and keeps the page cache on open.
+type storeFile struct {
+	OperationStubs
+	reads int32
+}
+
+func (f *storeFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_KEEP_CACHE, OK
+}
+
+func (f *storeFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	out.Size = uint64(len("stored content"))
+	return OK
+}
+
+func (f *storeFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	atomic.AddInt32(&f.reads, 1)
+	return fuse.ReadResultData([]byte("backend content")[off:]), OK
+}
+
+// storeRoot fills the page cache of its file from Lookup.
+type storeRoot struct {
+	OperationStubs
+	file storeFile
+}
+
+func (r *storeRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if name != "file" {
+		return nil, syscall.ENOENT
+	}
+	ch := r.Inode().NewInode(ctx, &r.file, NodeAttr{Ino: 2})
+	if errno := ch.NotifyStore(0, []byte("stored content")); errno != 0 {
+		return nil, errno
+	}
+	// A size different from the stored data's would make the
+	// kernel truncate its page cache.
+	var attr fuse.AttrOut
+	errno := r.file.Getattr(ctx, &attr)
+	out.Attr = attr.Attr
+	return ch, errno
+}
+
+func TestNotifyStore(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	root := &storeRoot{}
+	opts := &Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	// The data is stored right after the LOOKUP reply.
+	if _, err := os.Stat(mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "stored content" {
+		t.Errorf("got %q, want %q", got, "stored content")
+	}
+	if n := atomic.LoadInt32(&root.file.reads); n != 0 {
+		t.Errorf("Read was called %d times", n)
+	}
+}
+
+func TestRetrieveContent(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	root := &storeRoot{}
+	opts := &Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	if _, err := os.Stat(mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	ch := root.Inode().GetChild("file")
+	want := "stored content"
+	if errno := ch.WriteCache(0, []byte(want)); errno != 0 {
+		t.Fatalf("WriteCache: %v", errno)
+	}
+
+	got, errno := ch.RetrieveContent(0, 100)
+	if errno != 0 {
+		t.Fatalf("RetrieveContent: %v", errno)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRetrieveContentUnmounted(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+	if _, errno := root.Inode().RetrieveContent(0, 10); errno != syscall.ENOSYS {
+		t.Errorf("got %v, want ENOSYS", errno)
+	}
+}
+
+// attrFile has a mode that can change behind the kernel's back.
+type attrFile struct {
+	OperationStubs
+	mode  uint32
+	reads int32
+}
+
+func (f *attrFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_KEEP_CACHE, OK
+}
+
+func (f *attrFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = atomic.LoadUint32(&f.mode)
+	out.Size = 5
+	return OK
+}
+
+func (f *attrFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	atomic.AddInt32(&f.reads, 1)
+	return fuse.ReadResultData([]byte("hello")[off:]), OK
+}
+
+type attrRoot struct {
+	OperationStubs
+	file attrFile
+}
+
+func (r *attrRoot) OnAdd(ctx context.Context) {
+	r.Inode().NewPersistentChild(ctx, "file", &r.file, NodeAttr{})
+}
+
+func TestNotifyAttr(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	root := &attrRoot{file: attrFile{mode: 0644}}
+	hour := time.Hour
+	opts := &Options{AttrTimeout: &hour, EntryTimeout: &hour}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	fn := mntDir + "/file"
+	if _, err := ioutil.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	// Reading invalidates the cached atime, so the kernel
+	// refreshes the attributes once more.
+	if _, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreUint32(&root.file.mode, 0600)
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0644 {
+		t.Fatalf("before NotifyAttr: got %v, %v, want cached mode 0644", fi, err)
+	}
+
+	if errno := root.file.Inode().NotifyAttr(); errno != 0 {
+		t.Fatalf("NotifyAttr: %v", errno)
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("after NotifyAttr: got %v, %v, want mode 0600", fi, err)
+	}
+
+	// The content is still cached.
+	if _, err := ioutil.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&root.file.reads); n != 1 {
+		t.Errorf("got %d reads, want 1", n)
+	}
+}
+
+// backendFile serves content that can change behind the kernel's
+// back.
+type backendFile struct {
+	OperationStubs
+
+	mu      sync.Mutex
+	content []byte
+}
+
+func (f *backendFile) setContent(c string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.content = []byte(c)
+}
+
+func (f *backendFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_KEEP_CACHE, OK
+}
+
+func (f *backendFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Mode = 0644
+	out.Size = uint64(len(f.content))
+	return OK
+}
+
+func (f *backendFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off > int64(len(f.content)) {
+		off = int64(len(f.content))
+	}
+	return fuse.ReadResultData(append([]byte(nil), f.content[off:]...)), OK
+}
+
+type backendRoot struct {
+	OperationStubs
+	file backendFile
+}
+
+func (r *backendRoot) OnAdd(ctx context.Context) {
+	r.Inode().NewPersistentChild(ctx, "file", &r.file, NodeAttr{})
+}
+
+func TestDropCaches(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	root := &backendRoot{}
+	root.file.setContent("hello")
+	hour := time.Hour
+	opts := &Options{AttrTimeout: &hour, EntryTimeout: &hour}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	fn := mntDir + "/file"
+	if c, err := ioutil.ReadFile(fn); err != nil || string(c) != "hello" {
+		t.Fatalf("got %q, %v, want %q", c, err, "hello")
+	}
+
+	// Both the size and the content change.
+	want := "hello, changed in the backend"
+	root.file.setContent(want)
+	if errno := root.file.Inode().DropCaches(); errno != 0 {
+		t.Fatalf("DropCaches: %v", errno)
+	}
+
+	if fi, err := os.Stat(fn); err != nil || fi.Size() != int64(len(want)) {
+		t.Errorf("got %v, %v, want size %d", fi, err, len(want))
+	}
+	if c, err := ioutil.ReadFile(fn); err != nil || string(c) != want {
+		t.Errorf("got %q, %v, want %q", c, err, want)
+	}
+}
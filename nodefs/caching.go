@@ -0,0 +1,469 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// CachingOptions holds options for NewCachingNodeOpts.
+type CachingOptions struct {
+	// TTL is how long Getattr, Readdir and failed Lookup results
+	// are served from the cache.
+	TTL time.Duration
+
+	// If set, lookups that fail with ENOENT are not cached.
+	NoNegativeLookups bool
+}
+
+// cacheInvalidator is implemented by Operations that keep their own
+// cache of results, which must be dropped along with the kernel's
+// when the file system sends a notification.
+type cacheInvalidator interface {
+	invalidateContent()
+	invalidateEntry(name string)
+}
+
+// cachingNode wraps another Operations, and serves Getattr, Readdir
+// and failed Lookup from memory for a while. The Inode lives in the
+// delegate, so methods of the delegate that use Inode() keep working.
+type cachingNode struct {
+	delegate Operations
+	opts     CachingOptions
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// gen is incremented on each invalidation, so results
+	// fetched concurrently with a change are not stored.
+	gen uint64
+
+	attr        fuse.AttrOut
+	attrExpiry  time.Time
+	entries     []fuse.DirEntry
+	entryExpiry time.Time
+
+	// negative holds the expiry of names for which Lookup
+	// returned ENOENT.
+	negative map[string]time.Time
+}
+
+var _ = (MutableDirOperations)((*cachingNode)(nil))
+var _ = (RenameFlagsOperations)((*cachingNode)(nil))
+var _ = (LockOperations)((*cachingNode)(nil))
+var _ = (SymlinkOperations)((*cachingNode)(nil))
+var _ = (XAttrOperations)((*cachingNode)(nil))
+var _ = (cacheInvalidator)((*cachingNode)(nil))
+
+// NewCachingNode returns an Operations that serves Getattr, Readdir
+// and failed Lookup results of `delegate` from memory for `ttl`.
+func NewCachingNode(delegate Operations, ttl time.Duration) Operations {
+	return NewCachingNodeOpts(delegate, &CachingOptions{TTL: ttl})
+}
+
+// NewCachingNodeOpts is like NewCachingNode, but takes options.
+//
+// All other operations are passed to the delegate. Operations that
+// change the node, such as Setattr, Write or Create, drop the cached
+// data they affect, as do Inode.NotifyContent, Inode.NotifyEntry and
+// Inode.NotifyDelete. Only this node is cached: children returned by
+// the delegate should be wrapped separately if needed. The delegate
+// is called without ReaddirPlusOperations and BatchGetattrOperations.
+func NewCachingNodeOpts(delegate Operations, opts *CachingOptions) Operations {
+	n := &cachingNode{
+		delegate: delegate,
+		negative: map[string]time.Time{},
+	}
+	if opts != nil {
+		n.opts = *opts
+	}
+	return n
+}
+
+func (n *cachingNode) inode() *Inode {
+	return n.delegate.inode()
+}
+
+func (n *cachingNode) init(ops Operations, attr NodeAttr, bridge *rawBridge, persistent bool) {
+	n.delegate.init(ops, attr, bridge, persistent)
+}
+
+func (n *cachingNode) Inode() *Inode {
+	return n.delegate.Inode()
+}
+
+func (n *cachingNode) dirOps() DirOperations {
+	return dirOpsOf(n.delegate)
+}
+
+func (n *cachingNode) fileOps() FileOperations {
+	return fileOpsOf(n.delegate)
+}
+
+// unwrapCaching returns the delegate if ops is a cachingNode, after
+// dropping its directory data.
+func unwrapCaching(ops Operations, name string) Operations {
+	if c, ok := ops.(*cachingNode); ok {
+		c.invalidateEntry(name)
+		c.invalidateAttr()
+		return c.delegate
+	}
+	return ops
+}
+
+func (n *cachingNode) invalidateAttr() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.gen++
+	n.attrExpiry = time.Time{}
+}
+
+func (n *cachingNode) invalidateContent() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.gen++
+	n.attrExpiry = time.Time{}
+	n.entries = nil
+	n.entryExpiry = time.Time{}
+}
+
+func (n *cachingNode) invalidateEntry(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.gen++
+	delete(n.negative, name)
+	n.entries = nil
+	n.entryExpiry = time.Time{}
+}
+
+// invalidateChild drops the data affected by adding or removing the
+// entry `name`.
+func (n *cachingNode) invalidateChild(name string) {
+	n.invalidateEntry(name)
+	n.invalidateAttr()
+}
+
+func (n *cachingNode) OnAdd(ctx context.Context) {
+	n.delegate.OnAdd(ctx)
+}
+
+func (n *cachingNode) OnForget() {
+	if fops, ok := n.delegate.(ForgetOperations); ok {
+		fops.OnForget()
+	}
+}
+
+func (n *cachingNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return n.delegate.Statfs(ctx, out)
+}
+
+func (n *cachingNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return n.delegate.Access(ctx, mask)
+}
+
+// cachedAttr copies the cached attributes into out, if they have
+// not expired. Otherwise, it returns the generation to pass to
+// storeAttr.
+func (n *cachingNode) cachedAttr(out *fuse.AttrOut) (gen uint64, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !time.Now().Before(n.attrExpiry) {
+		return n.gen, false
+	}
+	*out = n.attr
+	return n.gen, true
+}
+
+func (n *cachingNode) storeAttr(gen uint64, out *fuse.AttrOut) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if gen != n.gen {
+		return
+	}
+	n.attr = *out
+	n.attrExpiry = time.Now().Add(n.opts.TTL)
+}
+
+func (n *cachingNode) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	gen, ok := n.cachedAttr(out)
+	if ok {
+		return OK
+	}
+	errno := n.delegate.Getattr(ctx, out)
+	if errno == 0 {
+		n.storeAttr(gen, out)
+	}
+	return errno
+}
+
+func (n *cachingNode) Fgetattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	gen, ok := n.cachedAttr(out)
+	if ok {
+		return OK
+	}
+	errno := n.fileOps().Fgetattr(ctx, f, out)
+	if errno == 0 {
+		n.storeAttr(gen, out)
+	}
+	return errno
+}
+
+func (n *cachingNode) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	defer n.invalidateAttr()
+	return n.delegate.Setattr(ctx, in, out)
+}
+
+func (n *cachingNode) Fsetattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	defer n.invalidateAttr()
+	return n.fileOps().Fsetattr(ctx, f, in, out)
+}
+
+func (n *cachingNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if n.opts.NoNegativeLookups {
+		return n.dirOps().Lookup(ctx, name, out)
+	}
+
+	n.mu.Lock()
+	expiry, ok := n.negative[name]
+	gen := n.gen
+	n.mu.Unlock()
+	if ok && time.Now().Before(expiry) {
+		return nil, syscall.ENOENT
+	}
+
+	ch, errno := n.dirOps().Lookup(ctx, name, out)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if errno == syscall.ENOENT && gen == n.gen {
+		n.negative[name] = time.Now().Add(n.opts.TTL)
+	} else if errno == 0 {
+		delete(n.negative, name)
+	}
+	return ch, errno
+}
+
+func (n *cachingNode) Opendir(ctx context.Context) syscall.Errno {
+	return n.dirOps().Opendir(ctx)
+}
+
+func (n *cachingNode) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
+	return n.dirOps().Fsyncdir(ctx, flags)
+}
+
+// Readdir reads the complete listing from the delegate, and serves
+// copies of it until it expires.
+func (n *cachingNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	n.mu.Lock()
+	if time.Now().Before(n.entryExpiry) {
+		entries := n.entries
+		n.mu.Unlock()
+		return NewListDirStream(entries), OK
+	}
+	gen := n.gen
+	n.mu.Unlock()
+
+	str, errno := n.dirOps().Readdir(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer str.Close()
+
+	entries := []fuse.DirEntry{}
+	for str.HasNext() {
+		e, errno := str.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		entries = append(entries, e)
+	}
+
+	n.mu.Lock()
+	if gen == n.gen {
+		n.entries = entries
+		n.entryExpiry = time.Now().Add(n.opts.TTL)
+	}
+	n.mu.Unlock()
+	return NewListDirStream(entries), OK
+}
+
+func (n *cachingNode) mutableDirOps() MutableDirOperations {
+	return mutableDirOpsOf(n.delegate)
+}
+
+func (n *cachingNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Mkdir(ctx, name, mode, out)
+}
+
+func (n *cachingNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Mknod(ctx, name, mode, dev, out)
+}
+
+func (n *cachingNode) Link(ctx context.Context, target Operations, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	defer n.invalidateChild(name)
+	if c, ok := target.(*cachingNode); ok {
+		// The link count changes.
+		c.invalidateAttr()
+		target = c.delegate
+	}
+	return n.mutableDirOps().Link(ctx, target, name, out)
+}
+
+func (n *cachingNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Symlink(ctx, target, name, out)
+}
+
+func (n *cachingNode) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Create(ctx, name, flags, mode)
+}
+
+func (n *cachingNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Unlink(ctx, name)
+}
+
+func (n *cachingNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Rmdir(ctx, name)
+}
+
+func (n *cachingNode) RenameFlags() uint32 {
+	if rops, ok := n.delegate.(RenameFlagsOperations); ok {
+		return rops.RenameFlags()
+	}
+	return 0
+}
+
+func (n *cachingNode) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	defer n.invalidateChild(name)
+	return n.mutableDirOps().Rename(ctx, name, unwrapCaching(newParent, newName), newName, flags)
+}
+
+func (n *cachingNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return linkOpsOf(n.delegate).Readlink(ctx)
+}
+
+func (n *cachingNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_TRUNC != 0 {
+		defer n.invalidateAttr()
+	}
+	return n.fileOps().Open(ctx, flags)
+}
+
+func (n *cachingNode) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return n.fileOps().Read(ctx, f, dest, off)
+}
+
+func (n *cachingNode) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	defer n.invalidateAttr()
+	return n.fileOps().Write(ctx, f, data, off)
+}
+
+func (n *cachingNode) Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	return n.fileOps().Fsync(ctx, f, flags)
+}
+
+func (n *cachingNode) Flush(ctx context.Context, f FileHandle) syscall.Errno {
+	return n.fileOps().Flush(ctx, f)
+}
+
+func (n *cachingNode) Release(ctx context.Context, f FileHandle) syscall.Errno {
+	return n.fileOps().Release(ctx, f)
+}
+
+func (n *cachingNode) Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	defer n.invalidateAttr()
+	return n.fileOps().Allocate(ctx, f, off, size, mode)
+}
+
+func (n *cachingNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
+	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	if c, ok := out.Operations().(*cachingNode); ok {
+		defer c.invalidateAttr()
+	}
+	return n.fileOps().CopyFileRange(ctx, fhIn, offIn, out, fhOut, offOut, len, flags)
+}
+
+func (n *cachingNode) Lseek(ctx context.Context, f FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	return n.fileOps().Lseek(ctx, f, off, whence)
+}
+
+func (n *cachingNode) Getlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	if lops, ok := n.delegate.(LockOperations); ok {
+		return lops.Getlk(ctx, f, owner, lk, flags, out)
+	}
+	return syscall.ENOTSUP
+}
+
+func (n *cachingNode) Setlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if lops, ok := n.delegate.(LockOperations); ok {
+		return lops.Setlk(ctx, f, owner, lk, flags)
+	}
+	return syscall.ENOTSUP
+}
+
+func (n *cachingNode) Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if lops, ok := n.delegate.(LockOperations); ok {
+		return lops.Setlkw(ctx, f, owner, lk, flags)
+	}
+	return syscall.ENOTSUP
+}
+
+func (n *cachingNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if xops, ok := n.delegate.(XAttrOperations); ok {
+		return xops.Getxattr(ctx, attr, dest)
+	}
+	return 0, syscall.ENOTSUP
+}
+
+func (n *cachingNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if xops, ok := n.delegate.(XAttrOperations); ok {
+		return xops.Setxattr(ctx, attr, data, flags)
+	}
+	return syscall.ENOTSUP
+}
+
+func (n *cachingNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if xops, ok := n.delegate.(XAttrOperations); ok {
+		return xops.Removexattr(ctx, attr)
+	}
+	return syscall.ENOTSUP
+}
+
+func (n *cachingNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if xops, ok := n.delegate.(XAttrOperations); ok {
+		return xops.Listxattr(ctx, dest)
+	}
+	return 0, syscall.ENOTSUP
+}
+
+func (n *cachingNode) Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, in []byte, out []byte) (int32, syscall.Errno) {
+	if iops, ok := n.delegate.(IoctlOperations); ok {
+		return iops.Ioctl(ctx, f, cmd, arg, in, out)
+	}
+	return 0, syscall.ENOTTY
+}
+
+func (n *cachingNode) Poll(ctx context.Context, f FileHandle, mask uint32) (uint32, syscall.Errno) {
+	if pops, ok := n.delegate.(PollOperations); ok {
+		return pops.Poll(ctx, f, mask)
+	}
+	return mask & _DEFAULT_POLLMASK, OK
+}
+
+func (n *cachingNode) ReadAhead(ctx context.Context, f FileHandle, off int64, size int) {
+	if rops, ok := n.delegate.(ReadAheadOperations); ok {
+		rops.ReadAhead(ctx, f, off, size)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// countingDir is a MemDir that counts the calls that cachingNode
+// should absorb.
+type countingDir struct {
+	MemDir
+
+	getattrs, readdirs, lookups int
+}
+
+func (d *countingDir) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	d.getattrs++
+	return d.MemDir.Getattr(ctx, out)
+}
+
+func (d *countingDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	d.readdirs++
+	return d.MemDir.Readdir(ctx)
+}
+
+func (d *countingDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	d.lookups++
+	return d.MemDir.Lookup(ctx, name, out)
+}
+
+func newCachingTestFS(opts *CachingOptions) (*countingDir, fuse.RawFileSystem) {
+	delegate := &countingDir{}
+	delegate.Attr.Mode = 0755
+	root := NewCachingNodeOpts(delegate, opts).(DirOperations)
+	return delegate, NewNodeFS(root, &Options{})
+}
+
+func cachingReadDir(t *testing.T, rawFS fuse.RawFileSystem) []string {
+	var openOut fuse.OpenOut
+	if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+	defer rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh})
+	return readDirAt(t, rawFS, openOut.Fh, 0)
+}
+
+func TestCachingNode(t *testing.T) {
+	delegate, rawFS := newCachingTestFS(&CachingOptions{TTL: time.Hour})
+	hdr := fuse.InHeader{NodeId: 1}
+
+	for i := 0; i < 3; i++ {
+		var attrOut fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut); !st.Ok() {
+			t.Fatalf("GetAttr: %v", st)
+		}
+		cachingReadDir(t, rawFS)
+
+		var entryOut fuse.EntryOut
+		if st := rawFS.Lookup(nil, &hdr, "dir", &entryOut); st != fuse.ENOENT {
+			t.Fatalf("Lookup: got %v, want ENOENT", st)
+		}
+	}
+	if delegate.getattrs != 1 || delegate.readdirs != 1 || delegate.lookups != 1 {
+		t.Errorf("got %d getattrs, %d readdirs, %d lookups, want 1 each",
+			delegate.getattrs, delegate.readdirs, delegate.lookups)
+	}
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: hdr, Mode: 0755}, "dir", &entryOut); !st.Ok() {
+		t.Fatalf("Mkdir: %v", st)
+	}
+
+	var attrOut fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if got, want := cachingReadDir(t, rawFS), []string{"dir"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir after Mkdir: got %v, want %v", got, want)
+	}
+	if st := rawFS.Lookup(nil, &hdr, "dir", &entryOut); !st.Ok() {
+		t.Errorf("Lookup after Mkdir: %v", st)
+	}
+	if delegate.getattrs != 2 || delegate.readdirs != 2 || delegate.lookups != 2 {
+		t.Errorf("after Mkdir: got %d getattrs, %d readdirs, %d lookups, want 2 each",
+			delegate.getattrs, delegate.readdirs, delegate.lookups)
+	}
+
+	// There is no kernel to notify, but the cache is dropped
+	// anyway.
+	delegate.Inode().NotifyContent(0, 0)
+	rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut)
+	cachingReadDir(t, rawFS)
+	if delegate.getattrs != 3 || delegate.readdirs != 3 {
+		t.Errorf("after NotifyContent: got %d getattrs, %d readdirs, want 3 each",
+			delegate.getattrs, delegate.readdirs)
+	}
+}
+
+func TestCachingNodeExpiry(t *testing.T) {
+	delegate, rawFS := newCachingTestFS(&CachingOptions{TTL: time.Millisecond})
+	hdr := fuse.InHeader{NodeId: 1}
+
+	var attrOut fuse.AttrOut
+	rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut)
+	time.Sleep(5 * time.Millisecond)
+	rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut)
+	if delegate.getattrs != 2 {
+		t.Errorf("got %d getattrs, want 2", delegate.getattrs)
+	}
+}
+
+func TestCachingNodeNoNegativeLookups(t *testing.T) {
+	delegate, rawFS := newCachingTestFS(&CachingOptions{TTL: time.Hour, NoNegativeLookups: true})
+	hdr := fuse.InHeader{NodeId: 1}
+
+	for i := 0; i < 2; i++ {
+		var entryOut fuse.EntryOut
+		if st := rawFS.Lookup(nil, &hdr, "missing", &entryOut); st != fuse.ENOENT {
+			t.Fatalf("Lookup: got %v, want ENOENT", st)
+		}
+	}
+	if delegate.lookups != 2 {
+		t.Errorf("got %d lookups, want 2", delegate.lookups)
+	}
+}
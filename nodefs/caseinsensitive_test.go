@@ -0,0 +1,75 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestCaseInsensitiveLookup(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{CaseInsensitive: true})
+	ctx := context.Background()
+
+	foo := root.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 2})
+	root.Inode().AddChild("foo", foo, false)
+	// "Bar" and "bar" collide; "Bar" sorts first.
+	upper := root.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 3})
+	root.Inode().AddChild("Bar", upper, false)
+	lower := root.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 4})
+	root.Inode().AddChild("bar", lower, false)
+
+	for _, tc := range []struct {
+		name string
+		ino  uint64
+	}{
+		{"FOO", 2},
+		{"foo", 2},
+		{"BAR", 3},
+		{"bar", 4},
+	} {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, tc.name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", tc.name, st)
+		}
+		if out.NodeId != tc.ino {
+			t.Errorf("Lookup(%q): got ino %d, want %d", tc.name, out.NodeId, tc.ino)
+		}
+	}
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "baz", &out); st != fuse.ENOENT {
+		t.Errorf("Lookup(baz): got %v, want ENOENT", st)
+	}
+
+	var names []string
+	for k := range root.Inode().Children() {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	if got, want := names, []string{"Bar", "bar", "foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got children %v, want %v", got, want)
+	}
+	if name, _ := foo.Parent(); name != "foo" {
+		t.Errorf("got name %q, want the stored case", name)
+	}
+}
+
+func TestCaseSensitiveLookup(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().AddChild("foo",
+		root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 2}), false)
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "FOO", &out); st != fuse.ENOENT {
+		t.Errorf("Lookup(FOO): got %v, want ENOENT", st)
+	}
+}
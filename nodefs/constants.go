@@ -5,25 +5,93 @@
 package nodefs
 
 import (
+	"errors"
+	"os"
 	"syscall"
-
-	"github.com/hanwen/go-fuse/fuse"
 )
 
 // OK is the Errno return value to indicate absense of errors.
 var OK = syscall.Errno(0)
 
-// ToErrno exhumes the syscall.Errno error from wrapped error values.
+// ToErrno exhumes the syscall.Errno error from wrapped error values,
+// such as *os.PathError, *os.LinkError and *os.SyscallError, or
+// errors wrapped with fmt.Errorf("%w"). The os.ErrNotExist family of
+// errors maps to the corresponding errno. A nil error yields OK, and
+// an error that carries no errno yields EIO.
 func ToErrno(err error) syscall.Errno {
-	s := fuse.ToStatus(err)
-	return syscall.Errno(s)
+	if err == nil {
+		return OK
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EPERM
+	case errors.Is(err, os.ErrInvalid):
+		return syscall.EINVAL
+	case errors.Is(err, os.ErrClosed):
+		return syscall.EBADF
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return syscall.ETIMEDOUT
+	}
+	return syscall.EIO
+}
+
+// Errno is a shorthand for ToErrno, for returning the result of a
+// library call from an operation:
+//
+//	return nodefs.Errno(os.Remove(p))
+func Errno(err error) syscall.Errno {
+	return ToErrno(err)
 }
 
+// RENAME_NOREPLACE is a flag argument for renameat2(): fail with
+// EEXIST rather than replace an existing destination.
+const RENAME_NOREPLACE = 0x1
+
 // RENAME_EXCHANGE is a flag argument for renameat2()
 const RENAME_EXCHANGE = 0x2
 
+// RENAME_WHITEOUT is a flag argument for renameat2(): leave a
+// whiteout (a 0/0 character device) at the source, for overlay
+// file systems.
+const RENAME_WHITEOUT = 0x4
+
 // seek to the next data
 const _SEEK_DATA = 3
 
 // seek to the next hole
 const _SEEK_HOLE = 4
+
+// FALLOC_FL_KEEP_SIZE is a mode flag for Allocate: do not change
+// the file size, even when allocating beyond the end of the file.
+const FALLOC_FL_KEEP_SIZE = 0x1
+
+// FALLOC_FL_PUNCH_HOLE is a mode flag for Allocate: deallocate the
+// range, so it reads back as zeros.
+const FALLOC_FL_PUNCH_HOLE = 0x2
+
+// FALLOC_FL_ZERO_RANGE is a mode flag for Allocate: zero the range,
+// allocating space for it.
+const FALLOC_FL_ZERO_RANGE = 0x10
+
+// CheckXattrFlags checks the XATTR_CREATE and XATTR_REPLACE flags of
+// a Setxattr call, given whether the attribute exists. It returns
+// EEXIST or ENOATTR if the flags forbid the call, and OK otherwise.
+// File systems that store attributes themselves should call it
+// before storing, under the same lock.
+func CheckXattrFlags(exists bool, flags uint32) syscall.Errno {
+	if exists && flags&XATTR_CREATE != 0 {
+		return syscall.EEXIST
+	}
+	if !exists && flags&XATTR_REPLACE != 0 {
+		return ENOATTR
+	}
+	return OK
+}
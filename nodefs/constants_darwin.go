@@ -8,3 +8,17 @@ import "syscall"
 
 // ENOATTR indicates that an extended attribute was not present.
 var ENOATTR = syscall.ENOATTR
+
+// XATTR_CREATE is a Setxattr flag: fail with EEXIST if the attribute
+// exists already.
+const XATTR_CREATE = 0x2
+
+// XATTR_REPLACE is a Setxattr flag: fail with ENOATTR if the
+// attribute does not exist.
+const XATTR_REPLACE = 0x4
+
+// MakeDev combines a major and minor device number into the form
+// that Mknod receives and fuse.Attr.Rdev holds.
+func MakeDev(major, minor uint32) uint32 {
+	return major<<24 | minor&0xffffff
+}
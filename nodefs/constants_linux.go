@@ -8,3 +8,17 @@ import "syscall"
 
 // ENOATTR indicates that an extended attribute was not present.
 var ENOATTR = syscall.ENODATA
+
+// XATTR_CREATE is a Setxattr flag: fail with EEXIST if the attribute
+// exists already.
+const XATTR_CREATE = 0x1
+
+// XATTR_REPLACE is a Setxattr flag: fail with ENOATTR if the
+// attribute does not exist.
+const XATTR_REPLACE = 0x2
+
+// MakeDev combines a major and minor device number into the form
+// that Mknod receives and fuse.Attr.Rdev holds.
+func MakeDev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestToErrno(t *testing.T) {
+	_, statErr := os.Stat("/this-file-surely-does-not-exist")
+	linkErr := os.Link("/this-file-surely-does-not-exist", "/also-not-there")
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want syscall.Errno
+	}{
+		{"nil", nil, OK},
+		{"errno", syscall.EROFS, syscall.EROFS},
+		{"PathError", statErr, syscall.ENOENT},
+		{"LinkError", linkErr, syscall.ENOENT},
+		{"SyscallError", os.NewSyscallError("fsync", syscall.EBADF), syscall.EBADF},
+		{"wrapped", fmt.Errorf("backend: %w", &os.PathError{Op: "open", Path: "x", Err: syscall.EACCES}), syscall.EACCES},
+		{"ErrNotExist", os.ErrNotExist, syscall.ENOENT},
+		{"wrapped ErrExist", fmt.Errorf("backend: %w", os.ErrExist), syscall.EEXIST},
+		{"ErrPermission", os.ErrPermission, syscall.EPERM},
+		{"ErrInvalid", os.ErrInvalid, syscall.EINVAL},
+		{"ErrClosed", os.ErrClosed, syscall.EBADF},
+		{"unknown", errors.New("something broke"), syscall.EIO},
+	} {
+		if got := ToErrno(tc.err); got != tc.want {
+			t.Errorf("%s: ToErrno(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+		if got := Errno(tc.err); got != tc.want {
+			t.Errorf("%s: Errno(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestCheckXattrFlags(t *testing.T) {
+	for _, tc := range []struct {
+		exists bool
+		flags  uint32
+		want   syscall.Errno
+	}{
+		{false, 0, OK},
+		{true, 0, OK},
+		{false, XATTR_CREATE, OK},
+		{true, XATTR_CREATE, syscall.EEXIST},
+		{false, XATTR_REPLACE, ENOATTR},
+		{true, XATTR_REPLACE, OK},
+	} {
+		if got := CheckXattrFlags(tc.exists, tc.flags); got != tc.want {
+			t.Errorf("CheckXattrFlags(%v, %d) = %v, want %v", tc.exists, tc.flags, got, tc.want)
+		}
+	}
+}
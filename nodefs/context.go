@@ -0,0 +1,215 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// nodeContext is the context passed to Operations methods. Besides
+// the caller and cancellation channel from fuse.Context, it carries
+// the header of the request being served.
+type nodeContext struct {
+	fuse.Context
+
+	header fuse.InHeader
+
+	// writeback is set for WRITE requests that flush the kernel's
+	// writeback cache.
+	writeback bool
+
+	// getattrFH is set for GETATTR requests that carry a file
+	// handle.
+	getattrFH bool
+
+	// readdirPlus is set for the Lookup calls that fill in the
+	// entries of a READDIRPLUS reply.
+	readdirPlus bool
+
+	// umask is the caller's umask, for CREATE, MKDIR and MKNOD.
+	umask    uint32
+	hasUmask bool
+
+	// deadline is set from Options.OperationTimeout. done is
+	// created on the first call to Done.
+	deadline time.Time
+	doneOnce sync.Once
+	done     chan struct{}
+}
+
+type headerKeyType struct{}
+
+var headerKey headerKeyType
+
+type writebackKeyType struct{}
+
+var writebackKey writebackKeyType
+
+type getattrFHKeyType struct{}
+
+var getattrFHKey getattrFHKeyType
+
+type readdirPlusKeyType struct{}
+
+var readdirPlusKey readdirPlusKeyType
+
+type umaskKeyType struct{}
+
+var umaskKey umaskKeyType
+
+// newContext returns the context for serving the request with the
+// given header. The header is copied, as the request buffer is
+// reused once the request finishes.
+func newContext(cancel <-chan struct{}, header *fuse.InHeader) *nodeContext {
+	return &nodeContext{
+		Context: fuse.Context{
+			Caller: header.Caller,
+			Cancel: cancel,
+		},
+		header: *header,
+	}
+}
+
+// newContext returns the context for a request, with the deadline
+// from Options.OperationTimeout.
+func (b *rawBridge) newContext(cancel <-chan struct{}, header *fuse.InHeader) *nodeContext {
+	ctx := newContext(cancel, header)
+	if b.options.OperationTimeout > 0 {
+		ctx.deadline = time.Now().Add(b.options.OperationTimeout)
+	}
+	return ctx
+}
+
+func (c *nodeContext) Deadline() (time.Time, bool) {
+	return c.deadline, !c.deadline.IsZero()
+}
+
+// Done returns a channel that is closed when the request is
+// interrupted or its deadline passes. Watching both takes a
+// goroutine, which is only started if a deadline is set and Done is
+// called, and which ends at the deadline at the latest.
+func (c *nodeContext) Done() <-chan struct{} {
+	if c.deadline.IsZero() {
+		return c.Cancel
+	}
+	c.doneOnce.Do(func() {
+		c.done = make(chan struct{})
+		go func() {
+			t := time.NewTimer(time.Until(c.deadline))
+			defer t.Stop()
+			select {
+			case <-c.Cancel:
+			case <-t.C:
+			}
+			close(c.done)
+		}()
+	})
+	return c.done
+}
+
+// Err returns context.Canceled once the request is interrupted, and
+// context.DeadlineExceeded once its deadline has passed.
+func (c *nodeContext) Err() error {
+	if err := c.Context.Err(); err != nil {
+		return err
+	}
+	if !c.deadline.IsZero() && !time.Now().Before(c.deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func (c *nodeContext) Value(key interface{}) interface{} {
+	if key == headerKey {
+		return &c.header
+	}
+	if key == writebackKey {
+		return c.writeback
+	}
+	if key == getattrFHKey {
+		return c.getattrFH
+	}
+	if key == readdirPlusKey {
+		return c.readdirPlus
+	}
+	if key == umaskKey && c.hasUmask {
+		return c.umask
+	}
+	return c.Context.Value(key)
+}
+
+// HeaderFromContext returns the header of the FUSE request that an
+// Operations method is serving. The header holds the opcode, the
+// unique ID of the request, and the PID, UID and GID of the calling
+// process. NodeId is the inode the request was addressed to; for
+// operations on a directory entry (eg. Lookup, Mkdir) that is the
+// parent directory.
+//
+// Calls that do not originate from a kernel request, such as OnAdd,
+// have no header. For requests issued by the kernel on its own
+// behalf, such as RELEASE after the last close or reads for
+// readahead, the caller fields may be zero or belong to an unrelated
+// process.
+func HeaderFromContext(ctx context.Context) (*fuse.InHeader, bool) {
+	h, ok := ctx.Value(headerKey).(*fuse.InHeader)
+	return h, ok
+}
+
+// WriteFromWriteback reports whether a Write call flushes dirty pages
+// from the kernel's writeback cache (see
+// fuse.MountOptions.EnableWriteback), eg. after an application wrote
+// to a shared mmap(2) mapping and called msync(2). The kernel may
+// send these without a file handle, so Write gets a nil FileHandle.
+func WriteFromWriteback(ctx context.Context) bool {
+	wb, _ := ctx.Value(writebackKey).(bool)
+	return wb
+}
+
+// GetattrFromHandle reports whether a Getattr or Fgetattr call serves
+// a GETATTR request for which the kernel named an open file, as for
+// fstat(2). Otherwise, the request was for the node itself, as for
+// stat(2) or ls -l, and Fgetattr may still get a FileHandle: the
+// bridge passes one of the node's open files, if there is any.
+//
+// The kernel does not say which attributes the caller needs, so this
+// and LookupFromReaddirPlus are the only hints about where a request
+// comes from.
+func GetattrFromHandle(ctx context.Context) bool {
+	fh, _ := ctx.Value(getattrFHKey).(bool)
+	return fh
+}
+
+// LookupFromReaddirPlus reports whether a Lookup call fills in an
+// entry of a READDIRPLUS listing, as issued for `ls -l` and similar
+// when fuse.CAP_READDIRPLUS is in effect, rather than resolving a
+// path. The flag carries over to methods that Lookup calls with the
+// same context, eg. Getattr. A file system may answer these with
+// cheaper, less exact attributes, for example with a short attribute
+// timeout, so that a later stat(2) asks again.
+func LookupFromReaddirPlus(ctx context.Context) bool {
+	plus, _ := ctx.Value(readdirPlusKey).(bool)
+	return plus
+}
+
+// ApplyUmask returns the mode that a file created with `mode` gets
+// under the umask of the calling process, for use in Create, Mkdir
+// and Mknod. The kernel clears the umask bits from the mode itself,
+// unless the file system asked for fuse.CAP_DONT_MASK (eg. to apply
+// default ACLs instead), so in the default case this is a no-op.
+// Outside these calls, or if the kernel did not send the umask,
+// `mode` is returned unchanged.
+func ApplyUmask(ctx context.Context, mode uint32) uint32 {
+	umask, ok := ctx.Value(umaskKey).(uint32)
+	if !ok {
+		return mode
+	}
+	return mode &^ (umask & 07777)
+}
+
+var _ = (context.Context)((*nodeContext)(nil))
@@ -0,0 +1,55 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type umaskDir struct {
+	OperationStubs
+	modes []uint32
+}
+
+func (d *umaskDir) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	d.modes = append(d.modes, ApplyUmask(ctx, mode))
+	ch := d.Inode().NewInode(ctx, &OperationStubs{}, NodeAttr{})
+	return ch, nil, 0, OK
+}
+
+func (d *umaskDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	mode = ApplyUmask(ctx, mode)
+	d.modes = append(d.modes, mode)
+	out.Mode = fuse.S_IFDIR | mode
+	ch := d.Inode().NewInode(ctx, &OperationStubs{}, NodeAttr{Mode: fuse.S_IFDIR})
+	return ch, OK
+}
+
+func TestApplyUmask(t *testing.T) {
+	root := &umaskDir{}
+	rawFS := NewNodeFS(root, &Options{})
+	hdr := fuse.InHeader{NodeId: 1}
+
+	var createOut fuse.CreateOut
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: hdr, Mode: fuse.S_IFREG | 0666, Umask: 022}, "file", &createOut); !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+	var entryOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: hdr, Mode: 0777, Umask: 027}, "dir", &entryOut); !st.Ok() {
+		t.Fatalf("Mkdir: %v", st)
+	}
+	if want := []uint32{fuse.S_IFREG | 0644, 0750}; !reflect.DeepEqual(root.modes, want) {
+		t.Errorf("got modes %o, want %o", root.modes, want)
+	}
+
+	if got := ApplyUmask(context.Background(), 0666); got != 0666 {
+		t.Errorf("got %o outside Create, want 0666", got)
+	}
+}
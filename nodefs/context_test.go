@@ -0,0 +1,105 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type headerNode struct {
+	OperationStubs
+
+	header *fuse.InHeader
+	caller *fuse.Caller
+}
+
+func (n *headerNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	n.header, _ = HeaderFromContext(ctx)
+	n.caller, _ = fuse.FromContext(ctx)
+	return nil, 0, OK
+}
+
+func TestHeaderFromContext(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	node := &headerNode{}
+	root.Inode().AddChild("file",
+		root.Inode().NewPersistentInode(context.Background(), node, NodeAttr{Ino: 2}), false)
+
+	in := &fuse.OpenIn{
+		InHeader: fuse.InHeader{
+			Opcode: 14,
+			Unique: 42,
+			NodeId: 2,
+			Caller: fuse.Caller{
+				Owner: fuse.Owner{Uid: 1000, Gid: 100},
+				Pid:   1234,
+			},
+		},
+	}
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, in, &out); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	if node.header == nil {
+		t.Fatal("no header in context")
+	}
+	if node.header.Unique != 42 || node.header.Opcode != 14 || node.header.Pid != 1234 || node.header.Uid != 1000 {
+		t.Errorf("got header %#v", node.header)
+	}
+	if node.caller == nil || node.caller.Gid != 100 {
+		t.Errorf("got caller %#v", node.caller)
+	}
+
+	if _, ok := HeaderFromContext(context.Background()); ok {
+		t.Errorf("got header for background context")
+	}
+}
+
+type slowNode struct {
+	OperationStubs
+	err error
+}
+
+func (n *slowNode) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	select {
+	case <-ctx.Done():
+		n.err = ctx.Err()
+		return syscall.EIO
+	case <-time.After(time.Minute):
+		return OK
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	root := &slowNode{}
+	rawFS := NewNodeFS(root, &Options{OperationTimeout: 10 * time.Millisecond})
+
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); st != fuse.EIO {
+		t.Errorf("got %v, want EIO", st)
+	}
+	if root.err != context.DeadlineExceeded {
+		t.Errorf("got context error %v, want DeadlineExceeded", root.err)
+	}
+
+	// An interrupt cancels the context before the deadline.
+	cancel := make(chan struct{})
+	close(cancel)
+	b := rawFS.(*rawBridge)
+	if st := b.GetAttr(cancel, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); st != fuse.EIO {
+		t.Errorf("got %v after interrupt, want EIO", st)
+	}
+	if root.err != context.Canceled {
+		t.Errorf("got context error %v after interrupt, want Canceled", root.err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// ControlHandler performs the action of a control file. Its output
+// is the content of the file.
+type ControlHandler func(ctx context.Context) ([]byte, syscall.Errno)
+
+// ControlDir is a read-only directory of control files, for
+// out-of-band control of a file system by its users. Each file runs
+// its ControlHandler when it is opened, and reads return what the
+// handler produced, so that eg. `cat .control/flush` triggers a
+// flush. It is added to the tree like any other directory:
+//
+//	ctl := &ControlDir{}
+//	ctl.Register("flush", flush)
+//	parent.NewPersistentChild(ctx, ".control", ctl, NodeAttr{Mode: fuse.S_IFDIR})
+//
+// The files are looked up on demand, so handlers can be registered
+// before or after the directory is added.
+type ControlDir struct {
+	OperationStubs
+
+	mu       sync.Mutex
+	handlers map[string]ControlHandler
+}
+
+var _ = (DirOperations)((*ControlDir)(nil))
+
+// Register adds the control file `name`, replacing any previous
+// handler for it.
+func (d *ControlDir) Register(name string, handler ControlHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.handlers == nil {
+		d.handlers = map[string]ControlHandler{}
+	}
+	d.handlers[name] = handler
+}
+
+func (d *ControlDir) handler(name string) ControlHandler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.handlers[name]
+}
+
+func (d *ControlDir) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555
+	return OK
+}
+
+func (d *ControlDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.handler(name) == nil {
+		return nil, syscall.ENOENT
+	}
+	ch := d.Inode().GetChild(name)
+	if ch == nil {
+		ch = d.Inode().NewInode(ctx, &controlFile{dir: d, name: name}, NodeAttr{Mode: fuse.S_IFREG})
+	}
+	var a fuse.AttrOut
+	errno := ch.Operations().Getattr(ctx, &a)
+	out.Attr = a.Attr
+	return ch, errno
+}
+
+func (d *ControlDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	d.mu.Lock()
+	names := make([]string, 0, len(d.handlers))
+	for name := range d.handlers {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	sort.Strings(names)
+	r := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		r = append(r, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	return NewListDirStream(r), OK
+}
+
+// controlFile is a file in a ControlDir.
+type controlFile struct {
+	OperationStubs
+
+	dir  *ControlDir
+	name string
+}
+
+func (f *controlFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	return OK
+}
+
+// Open runs the handler. The size of the output is not known
+// beforehand, so the file is read with direct I/O.
+func (f *controlFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, 0, syscall.EACCES
+	}
+	handler := f.dir.handler(f.name)
+	if handler == nil {
+		return nil, 0, syscall.ENOENT
+	}
+	data, errno := handler(ctx)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return &controlHandle{data: data}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+// controlHandle holds the output of a ControlHandler.
+type controlHandle struct {
+	FileHandleStubs
+	data []byte
+}
+
+func (h *controlHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData(nil), OK
+	}
+	return fuse.ReadResultInto(dest, h.data[off:]), OK
+}
+
+func (h *controlHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	return OK
+}
+
+func (h *controlHandle) Flush(ctx context.Context) syscall.Errno {
+	return OK
+}
+
+func (h *controlHandle) Release(ctx context.Context) syscall.Errno {
+	return OK
+}
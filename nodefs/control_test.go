@@ -0,0 +1,94 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestControlDir(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	ctl := &ControlDir{}
+	ctl.Register("fail", func(ctx context.Context) ([]byte, syscall.Errno) {
+		return nil, syscall.EIO
+	})
+	root.Inode().NewPersistentChild(ctx, ".control", ctl, NodeAttr{Mode: fuse.S_IFDIR, Ino: 2})
+
+	// Handlers may also be registered after adding the directory.
+	flushes := 0
+	ctl.Register("flush", func(ctx context.Context) ([]byte, syscall.Errno) {
+		flushes++
+		return []byte("flushed\n"), OK
+	})
+
+	var openOut fuse.OpenOut
+	if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 2}}, &openOut); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+	buf := make([]byte, 4096)
+	list := fuse.NewDirEntryList(buf, 0)
+	if st := rawFS.ReadDir(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 2}, Fh: openOut.Fh}, list); !st.Ok() {
+		t.Fatalf("ReadDir: %v", st)
+	}
+	var names []string
+	for _, nm := range parseDirents(buf) {
+		if nm == "" {
+			break
+		}
+		names = append(names, nm)
+	}
+	if want := []string{"fail", "flush"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 2}, "missing", &entryOut); st != fuse.ENOENT {
+		t.Errorf("Lookup(missing): got %v, want ENOENT", st)
+	}
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 2}, "fail", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup(fail): %v", st)
+	}
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}}, &openOut); st != fuse.EIO {
+		t.Errorf("Open(fail): got %v, want EIO", st)
+	}
+
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 2}, "flush", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup(flush): %v", st)
+	}
+	hdr := fuse.InHeader{NodeId: entryOut.NodeId}
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr, Flags: syscall.O_WRONLY}, &openOut); st != fuse.Status(syscall.EACCES) {
+		t.Errorf("Open(O_WRONLY): got %v, want EACCES", st)
+	}
+	if flushes != 0 {
+		t.Errorf("handler ran %d times before opening for read", flushes)
+	}
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	if flushes != 1 {
+		t.Errorf("handler ran %d times, want 1", flushes)
+	}
+	if openOut.OpenFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Errorf("got open flags %x, want FOPEN_DIRECT_IO", openOut.OpenFlags)
+	}
+
+	res, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: hdr, Fh: openOut.Fh, Size: 4096}, buf)
+	if !st.Ok() {
+		t.Fatalf("Read: %v", st)
+	}
+	data, _ := res.Bytes(buf)
+	if string(data) != "flushed\n" {
+		t.Errorf("got %q, want %q", data, "flushed\n")
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: hdr, Fh: openOut.Fh})
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// createCountDir counts the calls made to serve open(O_CREAT).
+type createCountDir struct {
+	MemDir
+
+	mu      sync.Mutex
+	lookups int
+	creates int
+	opens   int
+}
+
+func (d *createCountDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	d.mu.Lock()
+	d.lookups++
+	d.mu.Unlock()
+	return d.MemDir.Lookup(ctx, name, out)
+}
+
+func (d *createCountDir) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	d.mu.Lock()
+	d.creates++
+	d.mu.Unlock()
+	f := &createCountFile{dir: d}
+	ch := d.Inode().NewPersistentInode(ctx, f, NodeAttr{Mode: fuse.S_IFREG})
+	return ch, &memFileHandle{file: &f.MemRegularFile}, 0, OK
+}
+
+type createCountFile struct {
+	MemRegularFile
+	dir *createCountDir
+}
+
+func (f *createCountFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	f.dir.mu.Lock()
+	f.dir.opens++
+	f.dir.mu.Unlock()
+	return f.MemRegularFile.Open(ctx, flags)
+}
+
+func TestCreateCalls(t *testing.T) {
+	root := &createCountDir{}
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	oneSec := time.Second
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+		EntryTimeout:    &oneSec,
+		AttrTimeout:     &oneSec,
+		NegativeTimeout: &oneSec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	f, err := os.OpenFile(mntDir+"/file", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Close()
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.creates != 1 || root.opens != 0 {
+		t.Errorf("got %d Create and %d Open calls, want 1 and 0", root.creates, root.opens)
+	}
+	if root.lookups > 1 {
+		t.Errorf("got %d Lookup calls, want at most 1", root.lookups)
+	}
+}
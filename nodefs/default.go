@@ -31,7 +31,6 @@ func (n *InodeEmbed) init(ops Operations, attr NodeAttr, bridge *rawBridge, pers
 		nodeAttr:   attr,
 		bridge:     bridge,
 		persistent: persistent,
-		parents:    make(map[parentData]struct{}),
 	}
 	if attr.Mode == fuse.S_IFDIR {
 		n.inode_.children = make(map[string]*Inode)
@@ -60,9 +59,17 @@ var _ DirOperations = &OperationStubs{}
 var _ FileOperations = &OperationStubs{}
 var _ LockOperations = &OperationStubs{}
 
-// StatFs zeroes the out argument and returns OK.  This is because OSX
-// filesystems must define this, or the mount will not work.
+// Statfs asks the parent directory, so a file system that has
+// distinct backends at subdirectories only needs to implement Statfs
+// on the directories where a backend starts. At the root, or for an
+// unlinked node, Statfs zeroes the out argument and returns OK. This
+// is because OSX filesystems must define this, or the mount will not
+// work.
 func (n *OperationStubs) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	if _, parent := n.inode().Parent(); parent != nil {
+		return parent.Operations().Statfs(ctx, out)
+	}
+
 	// this should be defined on OSX, or the FS won't mount
 	*out = fuse.StatfsOut{}
 	return OK
@@ -112,9 +119,15 @@ func (n *OperationStubs) Fsetattr(ctx context.Context, f FileHandle, in *fuse.Se
 }
 
 // The Lookup method on the OperationStubs type looks for an
-// existing child with the given name, or returns ENOENT.
+// existing child with the given name, or returns ENOENT. With
+// Options.CaseInsensitive, names are matched ignoring case.
 func (n *OperationStubs) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
-	ch := n.inode().GetChild(name)
+	var ch *Inode
+	if n.inode().bridge.options.CaseInsensitive {
+		_, ch = n.inode().caseFoldChild(name)
+	} else {
+		ch = n.inode().GetChild(name)
+	}
 	if ch == nil {
 		return nil, syscall.ENOENT
 	}
@@ -153,14 +166,20 @@ func (n *OperationStubs) Opendir(ctx context.Context) syscall.Errno {
 // The default ReadDir returns the list of children from the tree
 func (n *OperationStubs) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
 	r := []fuse.DirEntry{}
-	for k, ch := range n.inode().Children() {
+	n.inode().ForEachChild(func(k string, ch *Inode) bool {
 		r = append(r, fuse.DirEntry{Mode: ch.Mode(),
 			Name: k,
 			Ino:  ch.NodeAttr().Ino})
-	}
+		return true
+	})
 	return NewListDirStream(r), 0
 }
 
+// The default Fsyncdir has nothing to flush, and succeeds
+func (n *OperationStubs) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
+	return OK
+}
+
 // Rename returns EROFS
 func (n *OperationStubs) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
 	return syscall.EROFS
@@ -371,3 +390,152 @@ func (f *FileHandleStubs) Fsync(ctx context.Context, flags uint32) (errno syscal
 func (f *FileHandleStubs) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
 	return 0, syscall.ENOTSUP
 }
+
+// missingOps completes an Operations that does not embed
+// OperationStubs. It provides the DirOperations, FileOperations,
+// SymlinkOperations and MutableDirOperations methods, which fail
+// with ENOTSUP rather than panicking.
+type missingOps struct {
+	Operations
+}
+
+var _ MutableDirOperations = missingOps{}
+var _ FileOperations = missingOps{}
+var _ SymlinkOperations = missingOps{}
+
+// dirOpsOf returns ops as DirOperations, completed with missingOps
+// if necessary. This is all or nothing: a node that implements only
+// some of the DirOperations methods gets ENOTSUP for all of them.
+func dirOpsOf(ops Operations) DirOperations {
+	if d, ok := ops.(DirOperations); ok {
+		return d
+	}
+	return missingOps{ops}
+}
+
+// fileOpsOf is the FileOperations version of dirOpsOf.
+func fileOpsOf(ops Operations) FileOperations {
+	if f, ok := ops.(FileOperations); ok {
+		return f
+	}
+	return missingOps{ops}
+}
+
+// linkOpsOf is the SymlinkOperations version of dirOpsOf.
+func linkOpsOf(ops Operations) SymlinkOperations {
+	if l, ok := ops.(SymlinkOperations); ok {
+		return l
+	}
+	return missingOps{ops}
+}
+
+// mutableDirOpsOf is the MutableDirOperations version of dirOpsOf.
+func mutableDirOpsOf(ops Operations) MutableDirOperations {
+	if d, ok := ops.(MutableDirOperations); ok {
+		return d
+	}
+	return missingOps{ops}
+}
+
+func (m missingOps) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Opendir(ctx context.Context) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m missingOps) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m missingOps) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, syscall.ENOTSUP
+}
+
+func (m missingOps) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	return 0, syscall.ENOTSUP
+}
+
+func (m missingOps) Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m missingOps) Flush(ctx context.Context, f FileHandle) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+// Release succeeds, as there is nothing to release.
+func (m missingOps) Release(ctx context.Context, f FileHandle) syscall.Errno {
+	return OK
+}
+
+func (m missingOps) Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+// Fgetattr falls back to Getattr, which every Operations has.
+func (m missingOps) Fgetattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return m.Getattr(ctx, out)
+}
+
+// Fsetattr falls back to Setattr, which every Operations has.
+func (m missingOps) Fsetattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return m.Setattr(ctx, in, out)
+}
+
+func (m missingOps) CopyFileRange(ctx context.Context, fhIn FileHandle,
+	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	return 0, syscall.ENOTSUP
+}
+
+func (m missingOps) Lseek(ctx context.Context, f FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	return 0, syscall.ENOTSUP
+}
+
+func (m missingOps) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Link(ctx context.Context, target Operations, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m missingOps) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+// Create returns ENOTSUP rather than ENOSYS, which would switch off
+// CREATE for the whole mount.
+func (m missingOps) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	return nil, nil, 0, syscall.ENOTSUP
+}
+
+func (m missingOps) Unlink(ctx context.Context, name string) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m missingOps) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m missingOps) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
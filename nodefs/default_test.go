@@ -0,0 +1,136 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// minimalNode implements Operations without embedding
+// OperationStubs.
+type minimalNode struct {
+	InodeEmbed
+}
+
+func (n *minimalNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return OK
+}
+
+func (n *minimalNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return OK
+}
+
+func (n *minimalNode) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return OK
+}
+
+func (n *minimalNode) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (n *minimalNode) OnAdd(ctx context.Context) {
+}
+
+func TestMinimalOperations(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	newNode := func(ino uint64, mode uint32) *Inode {
+		return root.Inode().NewPersistentInode(ctx, &minimalNode{}, NodeAttr{Ino: ino, Mode: mode})
+	}
+	dir := newNode(2, fuse.S_IFDIR)
+	root.Inode().AddChild("dir", dir, false)
+	dir.AddChild("file", newNode(3, fuse.S_IFREG), false)
+	dir.AddChild("link", newNode(4, fuse.S_IFLNK), false)
+
+	hdr := fuse.InHeader{NodeId: 2}
+	file := fuse.InHeader{NodeId: 3}
+	for _, tc := range []struct {
+		name string
+		call func() fuse.Status
+	}{
+		{"Lookup", func() fuse.Status { return rawFS.Lookup(nil, &hdr, "x", &fuse.EntryOut{}) }},
+		{"OpenDir", func() fuse.Status { return rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: hdr}, &fuse.OpenOut{}) }},
+		{"Mkdir", func() fuse.Status { return rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: hdr}, "x", &fuse.EntryOut{}) }},
+		{"Unlink", func() fuse.Status { return rawFS.Unlink(nil, &hdr, "file") }},
+		{"GetXAttr", func() fuse.Status {
+			_, st := rawFS.GetXAttr(nil, &hdr, "user.x", make([]byte, 10))
+			return st
+		}},
+		{"Open", func() fuse.Status { return rawFS.Open(nil, &fuse.OpenIn{InHeader: file}, &fuse.OpenOut{}) }},
+		{"Read", func() fuse.Status {
+			_, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: file}, make([]byte, 10))
+			return st
+		}},
+		{"GetLk", func() fuse.Status { return rawFS.GetLk(nil, &fuse.LkIn{InHeader: file}, &fuse.LkOut{}) }},
+		{"SetLk", func() fuse.Status { return rawFS.SetLk(nil, &fuse.LkIn{InHeader: file}) }},
+		{"Readlink", func() fuse.Status {
+			_, st := rawFS.Readlink(nil, &fuse.InHeader{NodeId: 4})
+			return st
+		}},
+	} {
+		if st := tc.call(); st != fuse.ENOTSUP {
+			t.Errorf("%s: got %v, want ENOTSUP", tc.name, st)
+		}
+	}
+
+	if dir.GetChild("file") == nil {
+		t.Errorf("failed Unlink removed the child")
+	}
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: file}, &out); !st.Ok() {
+		t.Errorf("GetAttr: %v", st)
+	}
+}
+
+type statfsDir struct {
+	OperationStubs
+	bavail uint64
+}
+
+func (d *statfsDir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	*out = fuse.StatfsOut{Bavail: d.bavail}
+	return OK
+}
+
+func TestStatfsSubtree(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+
+	ino := uint64(1)
+	add := func(parent *Inode, name string, ops Operations, mode uint32) *Inode {
+		ino++
+		ch := parent.NewPersistentInode(ctx, ops, NodeAttr{Ino: ino, Mode: mode})
+		parent.AddChild(name, ch, false)
+		return ch
+	}
+	a := add(root.Inode(), "a", &statfsDir{bavail: 10}, fuse.S_IFDIR)
+	b := add(root.Inode(), "b", &statfsDir{bavail: 20}, fuse.S_IFDIR)
+	sub := add(b, "sub", &OperationStubs{}, fuse.S_IFDIR)
+	for _, tc := range []struct {
+		node *Inode
+		want uint64
+	}{
+		{root.Inode(), 0},
+		{a, 10},
+		{add(a, "file", &OperationStubs{}, fuse.S_IFREG), 10},
+		{b, 20},
+		{sub, 20},
+		{add(sub, "file", &OperationStubs{}, fuse.S_IFREG), 20},
+	} {
+		var out fuse.StatfsOut
+		if st := rawFS.StatFs(nil, &fuse.InHeader{NodeId: tc.node.NodeAttr().Ino}, &out); !st.Ok() {
+			t.Fatalf("StatFs: %v", st)
+		}
+		if out.Bavail != tc.want {
+			t.Errorf("%q: got Bavail %d, want %d", tc.node.Path(nil), out.Bavail, tc.want)
+		}
+	}
+}
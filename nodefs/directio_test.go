@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"testing"
 
@@ -97,3 +98,148 @@ func TestDirectIO(t *testing.T) {
 		t.Errorf("got %q want %q", got, want)
 	}
 }
+
+// directIODir creates files that are opened with FOPEN_DIRECT_IO.
+type directIODir struct {
+	MemDir
+	noHandle bool
+	creates  int32
+}
+
+func (d *directIODir) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	atomic.AddInt32(&d.creates, 1)
+	ch, fh, _, errno := d.MemDir.Create(ctx, name, flags, mode)
+	if d.noHandle {
+		fh = nil
+	}
+	return ch, fh, fuse.FOPEN_DIRECT_IO, errno
+}
+
+type directIOFile struct {
+	MemRegularFile
+}
+
+func (f *directIOFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	fh, _, errno := f.MemRegularFile.Open(ctx, flags)
+	return fh, fuse.FOPEN_DIRECT_IO, errno
+}
+
+func TestCreateOpenFlags(t *testing.T) {
+	root := &directIODir{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	for _, noHandle := range []bool{false, true} {
+		root.noHandle = noHandle
+		name := "file"
+		if noHandle {
+			name = "nohandle"
+		}
+		in := &fuse.CreateIn{
+			InHeader: fuse.InHeader{NodeId: 1},
+			Flags:    syscall.O_RDWR,
+			Mode:     0644,
+		}
+		var out fuse.CreateOut
+		if st := rawFS.Create(nil, in, name, &out); !st.Ok() {
+			t.Fatalf("Create(%q): %v", name, st)
+		}
+		if out.OpenFlags&fuse.FOPEN_DIRECT_IO == 0 {
+			t.Errorf("Create(%q): got OpenFlags 0x%x, want FOPEN_DIRECT_IO", name, out.OpenFlags)
+		}
+		if out.Mode != fuse.S_IFREG|0644 {
+			t.Errorf("Create(%q): got mode %o", name, out.Mode)
+		}
+	}
+
+	ch := root.Inode().NewPersistentInode(context.Background(), &directIOFile{}, NodeAttr{Ino: 10})
+	root.Inode().AddChild("opened", ch, false)
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 10}}, &out); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	if out.OpenFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Errorf("Open: got OpenFlags 0x%x, want FOPEN_DIRECT_IO", out.OpenFlags)
+	}
+}
+
+func TestCreateDirectIO(t *testing.T) {
+	root := &directIODir{}
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	f, err := os.Create(mntDir + "/file")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+
+	// Change the data behind the kernel's back. With
+	// FOPEN_DIRECT_IO, the read must not be served from the page
+	// cache.
+	mf := root.Inode().GetChild("file").Operations().(*MemRegularFile)
+	mf.mu.Lock()
+	mf.Data = []byte("world")
+	mf.mu.Unlock()
+
+	var buf [5]byte
+	if _, err := f.ReadAt(buf[:], 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if got := string(buf[:]); got != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+}
+
+// readonlyDir is a directory without MutableDirOperations.
+type readonlyDir struct {
+	DirOperations
+}
+
+func TestCreateNonMutableDir(t *testing.T) {
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	ctx := context.Background()
+	ro := &readonlyDir{&OperationStubs{}}
+	root.Inode().NewPersistentChild(ctx, "ro", ro, NodeAttr{Mode: syscall.S_IFDIR})
+	rw := &directIODir{}
+	rw.Attr.Mode = 0755
+	root.Inode().NewPersistentChild(ctx, "rw", rw, NodeAttr{Mode: syscall.S_IFDIR})
+
+	if _, err := os.Create(mntDir + "/ro/file"); err == nil || err.(*os.PathError).Err != syscall.EROFS {
+		t.Errorf("Create in ro: got %v, want EROFS", err)
+	}
+
+	// The failure must not switch CREATE off for the mount.
+	f, err := os.Create(mntDir + "/rw/file")
+	if err != nil {
+		t.Fatalf("Create in rw: %v", err)
+	}
+	f.Close()
+	if n := atomic.LoadInt32(&rw.creates); n != 1 {
+		t.Errorf("got %d Create calls, want 1", n)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// snapshotDir lists the entries it had when it was opened.
+type snapshotDir struct {
+	MemDir
+
+	mu       sync.Mutex
+	released int
+}
+
+type snapshotHandle struct {
+	dir     *snapshotDir
+	entries []fuse.DirEntry
+}
+
+func (d *snapshotDir) OpendirHandle(ctx context.Context, flags uint32) (DirHandle, uint32, syscall.Errno) {
+	h := &snapshotHandle{dir: d}
+	for name, ch := range d.Inode().Children() {
+		h.entries = append(h.entries, fuse.DirEntry{Name: name, Mode: ch.Mode()})
+	}
+	return h, 0, OK
+}
+
+func (h *snapshotHandle) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return NewListDirStream(h.entries), OK
+}
+
+func (h *snapshotHandle) Releasedir(ctx context.Context) {
+	h.dir.mu.Lock()
+	defer h.dir.mu.Unlock()
+	h.dir.released++
+}
+
+func readNames(t *testing.T, f *os.File) []string {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatalf("Readdirnames: %v", err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDirHandleSnapshot(t *testing.T) {
+	root := &snapshotDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	for _, n := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(mntDir+"/"+n, nil, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	d1, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := ioutil.WriteFile(mntDir+"/c", nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	d2, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := os.Remove(mntDir + "/a"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// Reading twice rewinds the directory, which must produce
+	// the same snapshot.
+	for i := 0; i < 2; i++ {
+		if got, want := readNames(t, d1), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("first handle: got %v, want %v", got, want)
+		}
+		if got, want := readNames(t, d2), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("second handle: got %v, want %v", got, want)
+		}
+	}
+
+	d1.Close()
+	d2.Close()
+
+	// RELEASEDIR is asynchronous, so look at the count after a
+	// round trip through the mount.
+	if _, err := os.Lstat(mntDir + "/b"); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.released != 2 {
+		t.Errorf("got %d Releasedir calls, want 2", root.released)
+	}
+}
@@ -5,6 +5,7 @@
 package nodefs
 
 import (
+	"sort"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -12,23 +13,510 @@ import (
 
 type dirArray struct {
 	entries []fuse.DirEntry
+
+	// next is the index of the next entry to return.
+	next int
 }
 
 func (a *dirArray) HasNext() bool {
-	return len(a.entries) > 0
+	return a.next < len(a.entries)
 }
 
 func (a *dirArray) Next() (fuse.DirEntry, syscall.Errno) {
-	e := a.entries[0]
-	a.entries = a.entries[1:]
+	e := a.entries[a.next]
+	a.next++
 	return e, 0
 }
 
+func (a *dirArray) Seekdir(off uint64) syscall.Errno {
+	if off == 0 {
+		a.next = 0
+		return OK
+	}
+
+	var entryOff uint64
+	for i, e := range a.entries {
+		entryOff = dirEntryOffset(entryOff, e)
+		if entryOff == off {
+			a.next = i + 1
+			return OK
+		}
+	}
+	return syscall.EINVAL
+}
+
 func (a *dirArray) Close() {
 
 }
 
-// NewListDirStream wraps a slice of DirEntry as a DirStream.
+// NewListDirStream wraps a slice of DirEntry as a DirStream. The
+// returned stream implements SeekableDirStream.
 func NewListDirStream(list []fuse.DirEntry) DirStream {
-	return &dirArray{list}
+	return &dirArray{entries: list}
+}
+
+// DirStreamEntry is the element type for NewChanDirStream. If Errno
+// is set, Next returns it instead of Entry.
+type DirStreamEntry struct {
+	Entry fuse.DirEntry
+	Errno syscall.Errno
+}
+
+type chanDirStream struct {
+	ch   <-chan DirStreamEntry
+	done chan struct{}
+
+	next    DirStreamEntry
+	hasNext bool
+	closed  bool
+}
+
+// NewChanDirStream returns a DirStream that reads its entries from
+// `ch`, so they can be produced while the directory is being read,
+// eg. by a goroutine fetching pages from a backend. HasNext blocks
+// until the producer sends the next entry or closes `ch` to end the
+// listing.
+//
+// The returned channel is closed when the stream is closed. The
+// producer should select on it for each send and stop once it is
+// closed, as nothing receives from `ch` after Close.
+func NewChanDirStream(ch <-chan DirStreamEntry) (DirStream, <-chan struct{}) {
+	s := &chanDirStream{
+		ch:   ch,
+		done: make(chan struct{}),
+	}
+	return s, s.done
+}
+
+func (s *chanDirStream) HasNext() bool {
+	if s.hasNext {
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	e, ok := <-s.ch
+	if !ok {
+		return false
+	}
+	s.next = e
+	s.hasNext = true
+	return true
+}
+
+func (s *chanDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.hasNext = false
+	return s.next.Entry, s.next.Errno
+}
+
+func (s *chanDirStream) Close() {
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+type pagedDirStream struct {
+	fetch func(cookie uint64) ([]fuse.DirEntry, uint64, bool, syscall.Errno)
+
+	cookie uint64
+	page   []fuse.DirEntry
+	done   bool
+	errno  syscall.Errno
+	closed bool
+}
+
+// NewPagedDirStream returns a DirStream that fetches its entries
+// page by page, as directory listings are paginated by many network
+// backends. `fetch` is called with cookie 0 for the first page, and
+// with the `nextCookie` of the previous call for the following
+// pages, until it reports `done`. It is only called once the entries
+// fetched so far are consumed, and not at all after the stream is
+// closed. If it returns an error, Next returns it, and the listing
+// ends there.
+func NewPagedDirStream(fetch func(cookie uint64) (entries []fuse.DirEntry, nextCookie uint64, done bool, errno syscall.Errno)) DirStream {
+	return &pagedDirStream{fetch: fetch}
+}
+
+func (s *pagedDirStream) HasNext() bool {
+	for len(s.page) == 0 && s.errno == 0 {
+		if s.done || s.closed {
+			return false
+		}
+		s.page, s.cookie, s.done, s.errno = s.fetch(s.cookie)
+		if s.errno != 0 {
+			s.page = nil
+			s.done = true
+		}
+	}
+	return true
+}
+
+func (s *pagedDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if s.errno != 0 {
+		errno := s.errno
+		s.errno = 0
+		return fuse.DirEntry{}, errno
+	}
+	e := s.page[0]
+	s.page = s.page[1:]
+	return e, OK
+}
+
+func (s *pagedDirStream) Close() {
+	s.closed = true
+	s.page = nil
+	s.errno = 0
+}
+
+type mergedDirStream struct {
+	streams []DirStream
+
+	// cur is the index of the stream being read.
+	cur  int
+	seen map[string]struct{}
+
+	next    fuse.DirEntry
+	errno   syscall.Errno
+	hasNext bool
+}
+
+// NewMergedDirStream returns a DirStream that lists the entries of
+// `streams` one stream after the other, as for a union of
+// directories. A name that was already listed by an earlier entry is
+// skipped, so the first stream to list a name wins. If a stream
+// returns an error, Next returns it, and the listing ends there. The
+// offsets of the entries (fuse.DirEntry.Off) are cleared, as they are
+// only meaningful within their own stream.
+//
+// Close closes all the streams, also if closing one of them panics.
+func NewMergedDirStream(streams ...DirStream) DirStream {
+	return &mergedDirStream{
+		streams: streams,
+		seen:    map[string]struct{}{},
+	}
+}
+
+func (s *mergedDirStream) HasNext() bool {
+	if s.hasNext {
+		return true
+	}
+	for s.cur < len(s.streams) {
+		str := s.streams[s.cur]
+		if !str.HasNext() {
+			s.cur++
+			continue
+		}
+		e, errno := str.Next()
+		if errno != 0 {
+			s.errno = errno
+			s.hasNext = true
+			s.cur = len(s.streams)
+			return true
+		}
+		if _, ok := s.seen[e.Name]; ok {
+			continue
+		}
+		s.seen[e.Name] = struct{}{}
+		e.Off = 0
+		s.next = e
+		s.hasNext = true
+		return true
+	}
+	return false
+}
+
+func (s *mergedDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.hasNext = false
+	e, errno := s.next, s.errno
+	s.next, s.errno = fuse.DirEntry{}, 0
+	return e, errno
+}
+
+func (s *mergedDirStream) Close() {
+	s.cur = len(s.streams)
+	s.hasNext = false
+	s.closeFrom(0)
+}
+
+// closeFrom closes the streams starting at index i. The deferred
+// call closes the remaining streams if a Close panics.
+func (s *mergedDirStream) closeFrom(i int) {
+	if i >= len(s.streams) {
+		return
+	}
+	defer s.closeFrom(i + 1)
+	s.streams[i].Close()
+}
+
+type filteredDirStream struct {
+	inner DirStream
+	keep  func(fuse.DirEntry) bool
+
+	// innerOff is the offset of the last entry read from inner.
+	innerOff uint64
+
+	next    fuse.DirEntry
+	errno   syscall.Errno
+	hasNext bool
+}
+
+// NewFilteredDirStream returns a DirStream that lists the entries of
+// `inner` for which `keep` returns true, eg. to hide dot files.
+// Errors from `inner` are passed on. The entries keep the offsets
+// they have in `inner`, so if `inner` implements SeekableDirStream,
+// the returned stream can be seeked in the same way. Close closes
+// `inner`.
+func NewFilteredDirStream(inner DirStream, keep func(fuse.DirEntry) bool) DirStream {
+	return &filteredDirStream{inner: inner, keep: keep}
+}
+
+func (s *filteredDirStream) HasNext() bool {
+	if s.hasNext {
+		return true
+	}
+	for s.inner.HasNext() {
+		e, errno := s.inner.Next()
+		if errno != 0 {
+			s.errno = errno
+			s.hasNext = true
+			return true
+		}
+		s.innerOff = dirEntryOffset(s.innerOff, e)
+		if !s.keep(e) {
+			continue
+		}
+		e.Off = s.innerOff
+		s.next = e
+		s.hasNext = true
+		return true
+	}
+	return false
+}
+
+func (s *filteredDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.hasNext = false
+	e, errno := s.next, s.errno
+	s.next, s.errno = fuse.DirEntry{}, 0
+	return e, errno
+}
+
+// Seekdir forwards to the wrapped stream. If it is not seekable, the
+// listing continues where it left off, as it would without the
+// filter.
+func (s *filteredDirStream) Seekdir(off uint64) syscall.Errno {
+	inner, ok := s.inner.(SeekableDirStream)
+	if !ok {
+		return OK
+	}
+	if errno := inner.Seekdir(off); errno != 0 {
+		return errno
+	}
+	s.innerOff = off
+	s.hasNext = false
+	s.next, s.errno = fuse.DirEntry{}, 0
+	return OK
+}
+
+func (s *filteredDirStream) Close() {
+	s.inner.Close()
+}
+
+type overlayDirStream struct {
+	base   DirStream
+	extra  []fuse.DirEntry
+	names  map[string]struct{}
+	hidden map[string]bool
+
+	baseNext    fuse.DirEntry
+	baseErrno   syscall.Errno
+	baseHasNext bool
+
+	// failed is set once base returned an error.
+	failed bool
+}
+
+// NewOverlayDirStream returns a DirStream that lists the entries of
+// `base` together with the entries of `extra`, leaving out the names
+// for which `hidden` is true. This is useful for file systems that
+// buffer changes: `extra` holds the files created since the backend
+// listing was taken, and `hidden` the ones deleted. An entry of
+// `extra` replaces an entry of `base` with the same name. The
+// `extra` entries are sorted by name and merged into the listing
+// before the first base entry whose name sorts after them, so the
+// result is sorted if `base` is. If `base` returns an error, Next
+// returns it, and the listing ends there. The offsets of the entries
+// are cleared. Close closes `base`.
+func NewOverlayDirStream(base DirStream, extra []fuse.DirEntry, hidden map[string]bool) DirStream {
+	s := &overlayDirStream{
+		base:   base,
+		names:  make(map[string]struct{}, len(extra)),
+		hidden: hidden,
+	}
+	for _, e := range extra {
+		if hidden[e.Name] {
+			continue
+		}
+		if _, ok := s.names[e.Name]; ok {
+			continue
+		}
+		s.names[e.Name] = struct{}{}
+		e.Off = 0
+		s.extra = append(s.extra, e)
+	}
+	sort.Slice(s.extra, func(i, j int) bool {
+		return s.extra[i].Name < s.extra[j].Name
+	})
+	return s
+}
+
+// fillBase reads the next visible entry of base, if there is none
+// yet.
+func (s *overlayDirStream) fillBase() {
+	for !s.baseHasNext && !s.failed && s.base.HasNext() {
+		e, errno := s.base.Next()
+		if errno != 0 {
+			s.baseErrno = errno
+			s.baseHasNext = true
+			return
+		}
+		if _, ok := s.names[e.Name]; ok || s.hidden[e.Name] {
+			continue
+		}
+		e.Off = 0
+		s.baseNext = e
+		s.baseHasNext = true
+	}
+}
+
+func (s *overlayDirStream) HasNext() bool {
+	s.fillBase()
+	return s.baseHasNext || len(s.extra) > 0
+}
+
+func (s *overlayDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.fillBase()
+	if len(s.extra) > 0 && (!s.baseHasNext || s.baseErrno == 0 && s.extra[0].Name < s.baseNext.Name) {
+		e := s.extra[0]
+		s.extra = s.extra[1:]
+		return e, OK
+	}
+	s.baseHasNext = false
+	e, errno := s.baseNext, s.baseErrno
+	s.baseNext = fuse.DirEntry{}
+	if errno != 0 {
+		s.failed = true
+		s.extra = nil
+	}
+	return e, errno
+}
+
+func (s *overlayDirStream) Close() {
+	s.extra = nil
+	s.base.Close()
+}
+
+// dirEntryOffset returns the offset of e, given the offset of the
+// entry preceding it. This mirrors the offsets assigned by
+// fuse.DirEntryList.
+func dirEntryOffset(prev uint64, e fuse.DirEntry) uint64 {
+	if e.Off != 0 {
+		return e.Off
+	}
+	return prev + 1
+}
+
+// dotDirStream prepends "." and ".." to a DirStream, for
+// Options.SynthesizeDotEntries. The entries of the wrapped stream
+// are listed at their own offset plus 2.
+type dotDirStream struct {
+	dots    [2]fuse.DirEntry
+	nextDot int
+
+	inner DirStream
+	// innerOff is the offset of the last entry read from inner.
+	innerOff uint64
+
+	next    fuse.DirEntry
+	errno   syscall.Errno
+	hasNext bool
+}
+
+func newDotDirStream(n *Inode, inner DirStream) *dotDirStream {
+	n.mu.Lock()
+	parent := n.firstParentLocked().parent
+	n.mu.Unlock()
+	if parent == nil {
+		parent = n
+	}
+	return &dotDirStream{
+		dots: [2]fuse.DirEntry{
+			{Name: ".", Mode: fuse.S_IFDIR, Ino: n.nodeAttr.Ino, Off: 1},
+			{Name: "..", Mode: fuse.S_IFDIR, Ino: parent.nodeAttr.Ino, Off: 2},
+		},
+		inner: inner,
+	}
+}
+
+func (s *dotDirStream) HasNext() bool {
+	if s.nextDot < len(s.dots) || s.hasNext {
+		return true
+	}
+	for s.inner.HasNext() {
+		e, errno := s.inner.Next()
+		if errno != 0 {
+			s.errno = errno
+			s.hasNext = true
+			return true
+		}
+		s.innerOff = dirEntryOffset(s.innerOff, e)
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		e.Off = s.innerOff + 2
+		s.next = e
+		s.hasNext = true
+		return true
+	}
+	return false
+}
+
+func (s *dotDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if s.nextDot < len(s.dots) {
+		s.nextDot++
+		return s.dots[s.nextDot-1], OK
+	}
+	s.hasNext = false
+	e, errno := s.next, s.errno
+	s.next, s.errno = fuse.DirEntry{}, 0
+	return e, errno
+}
+
+// Seekdir repositions the wrapped stream. If it is not seekable,
+// the listing continues where it left off, as it would without the
+// wrapper.
+func (s *dotDirStream) Seekdir(off uint64) syscall.Errno {
+	inner, ok := s.inner.(SeekableDirStream)
+	if !ok {
+		return OK
+	}
+	innerOff := uint64(0)
+	if off > 2 {
+		innerOff = off - 2
+	}
+	if errno := inner.Seekdir(innerOff); errno != 0 {
+		return errno
+	}
+	s.nextDot = int(off)
+	if off > 2 {
+		s.nextDot = 2
+	}
+	s.innerOff = innerOff
+	s.hasNext = false
+	s.errno = 0
+	return OK
+}
+
+func (s *dotDirStream) Close() {
+	s.inner.Close()
 }
@@ -17,7 +17,9 @@ type loopbackDirStream struct {
 	fd   int
 }
 
-// NewLoopbackDirStream open a directory for reading as a DirStream
+// NewLoopbackDirStream open a directory for reading as a DirStream.
+// The entries carry the offsets of the underlying file system, so
+// the returned stream implements SeekableDirStream.
 func NewLoopbackDirStream(name string) (DirStream, syscall.Errno) {
 	fd, err := syscall.Open(name, syscall.O_DIRECTORY, 0755)
 	if err != nil {
@@ -60,10 +62,19 @@ func (ds *loopbackDirStream) Next() (fuse.DirEntry, syscall.Errno) {
 		Ino:  de.Ino,
 		Mode: (uint32(de.Type) << 12),
 		Name: string(nameBytes),
+		Off:  uint64(de.Off),
 	}
 	return result, ds.load()
 }
 
+func (ds *loopbackDirStream) Seekdir(off uint64) syscall.Errno {
+	if _, err := syscall.Seek(ds.fd, int64(off), 0); err != nil {
+		return ToErrno(err)
+	}
+	ds.todo = nil
+	return ds.load()
+}
+
 func (ds *loopbackDirStream) load() syscall.Errno {
 	if len(ds.todo) > 0 {
 		return OK
@@ -0,0 +1,587 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// parseDirents decodes the names from a READDIR reply.
+func parseDirents(buf []byte) []string {
+	var names []string
+	for len(buf) >= 24 {
+		nameLen := int(binary.LittleEndian.Uint32(buf[16:]))
+		names = append(names, string(buf[24:24+nameLen]))
+		l := 24 + (nameLen+7)&^7
+		buf = buf[l:]
+	}
+	return names
+}
+
+type listRoot struct {
+	OperationStubs
+	names []string
+}
+
+func (r *listRoot) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	var es []fuse.DirEntry
+	for _, nm := range r.names {
+		es = append(es, fuse.DirEntry{Name: nm, Mode: fuse.S_IFREG})
+	}
+	return NewListDirStream(es), OK
+}
+
+// readDirAt issues READDIR at the given offset, and returns the
+// names listed.
+func readDirAt(t *testing.T, rawFS fuse.RawFileSystem, fh uint64, off uint64) []string {
+	buf := make([]byte, 4096)
+	list := fuse.NewDirEntryList(buf, off)
+	in := &fuse.ReadIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Fh:       fh,
+		Offset:   off,
+	}
+	if st := rawFS.ReadDir(nil, in, list); !st.Ok() {
+		t.Fatalf("ReadDir: %v", st)
+	}
+
+	// The list only tracks its length internally; decode
+	// everything up to the first empty record.
+	var names []string
+	for _, nm := range parseDirents(buf) {
+		if nm == "" {
+			break
+		}
+		names = append(names, nm)
+	}
+	return names
+}
+
+func TestListDirStreamSeekdir(t *testing.T) {
+	root := &listRoot{}
+	for i := 0; i < 5; i++ {
+		root.names = append(root.names, fmt.Sprintf("file%d", i))
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var openOut fuse.OpenOut
+	if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+
+	if got := readDirAt(t, rawFS, openOut.Fh, 0); !reflect.DeepEqual(got, root.names) {
+		t.Errorf("got %v, want %v", got, root.names)
+	}
+
+	if got, want := readDirAt(t, rawFS, openOut.Fh, 2), root.names[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("after seek: got %v, want %v", got, want)
+	}
+}
+
+type cookieRoot struct {
+	OperationStubs
+	names []string
+}
+
+func (r *cookieRoot) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	var es []fuse.DirEntry
+	for i, nm := range r.names {
+		es = append(es, fuse.DirEntry{Name: nm, Mode: fuse.S_IFREG, Off: uint64(100 * (i + 1))})
+	}
+	return NewListDirStream(es), OK
+}
+
+func TestDirStreamResumeCookie(t *testing.T) {
+	root := &cookieRoot{names: []string{"a", "b", "c", "d"}}
+	rawFS := NewNodeFS(root, &Options{})
+
+	for _, tc := range []struct {
+		off  uint64
+		want []string
+	}{
+		{0, []string{"a", "b", "c", "d"}},
+		{200, []string{"c", "d"}},
+		{400, nil},
+	} {
+		// Each read is on a new handle, as for an NFS client
+		// continuing with a cookie.
+		var openOut fuse.OpenOut
+		if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+			t.Fatalf("OpenDir: %v", st)
+		}
+		if got := readDirAt(t, rawFS, openOut.Fh, tc.off); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("offset %d: got %v, want %v", tc.off, got, tc.want)
+		}
+		rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh})
+	}
+}
+
+func TestLoopbackDirStreamSeekdir(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/file%d", dir, i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(ds DirStream) (names []string, offs []uint64) {
+		var off uint64
+		for ds.HasNext() {
+			e, errno := ds.Next()
+			if errno != 0 {
+				t.Fatalf("Next: %v", errno)
+			}
+			off = dirEntryOffset(off, e)
+			names = append(names, e.Name)
+			offs = append(offs, off)
+		}
+		return names, offs
+	}
+
+	ds, errno := NewLoopbackDirStream(dir)
+	if errno != 0 {
+		t.Fatalf("NewLoopbackDirStream: %v", errno)
+	}
+	names, offs := list(ds)
+	ds.Close()
+
+	ds, errno = NewLoopbackDirStream(dir)
+	if errno != 0 {
+		t.Fatalf("NewLoopbackDirStream: %v", errno)
+	}
+	defer ds.Close()
+	sds, ok := ds.(SeekableDirStream)
+	if !ok {
+		t.Fatalf("%T is not seekable", ds)
+	}
+	if errno := sds.Seekdir(offs[4]); errno != 0 {
+		t.Fatalf("Seekdir: %v", errno)
+	}
+	if got, _ := list(ds); !reflect.DeepEqual(got, names[5:]) {
+		t.Errorf("after Seekdir: got %v, want %v", got, names[5:])
+	}
+}
+
+func TestChanDirStream(t *testing.T) {
+	ch := make(chan DirStreamEntry)
+	ds, done := NewChanDirStream(ch)
+	go func() {
+		defer close(ch)
+		for i := 0; i < 3; i++ {
+			select {
+			case ch <- DirStreamEntry{Entry: fuse.DirEntry{Name: fmt.Sprintf("e%d", i)}}:
+			case <-done:
+				return
+			}
+		}
+		select {
+		case ch <- DirStreamEntry{Errno: syscall.EIO}:
+		case <-done:
+		}
+	}()
+
+	var got []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno == syscall.EIO {
+			break
+		} else if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		got = append(got, e.Name)
+	}
+	if want := []string{"e0", "e1", "e2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	ds.Close()
+	if ds.HasNext() {
+		t.Errorf("HasNext after Close")
+	}
+
+	// A producer that never finishes must see the stream close.
+	endless := make(chan DirStreamEntry)
+	ds, done = NewChanDirStream(endless)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case endless <- DirStreamEntry{Entry: fuse.DirEntry{Name: "x"}}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	if !ds.HasNext() {
+		t.Fatalf("HasNext: got false")
+	}
+	ds.Next()
+	ds.Close()
+	<-stopped
+}
+
+type closeCountStream struct {
+	DirStream
+	closes *int
+	panics bool
+}
+
+func (s *closeCountStream) Close() {
+	*s.closes++
+	if s.panics {
+		panic("close")
+	}
+}
+
+func TestMergedDirStream(t *testing.T) {
+	list := func(names ...string) DirStream {
+		var es []fuse.DirEntry
+		for i, nm := range names {
+			es = append(es, fuse.DirEntry{Name: nm, Mode: fuse.S_IFREG, Off: uint64(i + 1)})
+		}
+		return NewListDirStream(es)
+	}
+
+	ds := NewMergedDirStream(list("a", "b", "c"), list("b", "d", "a", "e"))
+	var got []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		if e.Off != 0 {
+			t.Errorf("%s: got offset %d", e.Name, e.Off)
+		}
+		got = append(got, e.Name)
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ch := make(chan DirStreamEntry, 2)
+	ch <- DirStreamEntry{Entry: fuse.DirEntry{Name: "x"}}
+	ch <- DirStreamEntry{Errno: syscall.EIO}
+	close(ch)
+	failing, _ := NewChanDirStream(ch)
+	ds = NewMergedDirStream(failing, list("y"))
+	got = nil
+	var errno syscall.Errno
+	for ds.HasNext() {
+		var e fuse.DirEntry
+		e, errno = ds.Next()
+		if errno != 0 {
+			break
+		}
+		got = append(got, e.Name)
+	}
+	if errno != syscall.EIO || !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("got %v, %v, want [x], EIO", got, errno)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after error")
+	}
+
+	var closes int
+	ds = NewMergedDirStream(
+		&closeCountStream{list(), &closes, false},
+		&closeCountStream{list(), &closes, true},
+		&closeCountStream{list(), &closes, false})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Close did not panic")
+			}
+		}()
+		ds.Close()
+	}()
+	if closes != 3 {
+		t.Errorf("got %d closes, want 3", closes)
+	}
+}
+
+func TestPagedDirStream(t *testing.T) {
+	pages := map[uint64][]string{
+		0: {"a", "b"},
+		7: {"c"},
+	}
+	var cookies []uint64
+	ds := NewPagedDirStream(func(cookie uint64) ([]fuse.DirEntry, uint64, bool, syscall.Errno) {
+		cookies = append(cookies, cookie)
+		var es []fuse.DirEntry
+		for _, nm := range pages[cookie] {
+			es = append(es, fuse.DirEntry{Name: nm})
+		}
+		return es, 7, cookie == 7, OK
+	})
+	if len(cookies) != 0 {
+		t.Fatalf("fetched %v before reading", cookies)
+	}
+
+	var got []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		got = append(got, e.Name)
+		if e.Name == "a" && len(cookies) != 1 {
+			t.Errorf("fetched %v after the first entry", cookies)
+		}
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after the last page")
+	}
+	if want := []uint64{0, 7}; !reflect.DeepEqual(cookies, want) {
+		t.Errorf("got fetches %v, want %v", cookies, want)
+	}
+	ds.Close()
+
+	ds = NewPagedDirStream(func(cookie uint64) ([]fuse.DirEntry, uint64, bool, syscall.Errno) {
+		if cookie == 0 {
+			return []fuse.DirEntry{{Name: "a"}}, 1, false, OK
+		}
+		return nil, 0, false, syscall.EIO
+	})
+	got = nil
+	var errno syscall.Errno
+	for ds.HasNext() {
+		var e fuse.DirEntry
+		if e, errno = ds.Next(); errno != 0 {
+			break
+		}
+		got = append(got, e.Name)
+	}
+	if errno != syscall.EIO || !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got %v, %v, want [a], EIO", got, errno)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after error")
+	}
+}
+
+func TestSynthesizeDotEntries(t *testing.T) {
+	root := &listRoot{names: []string{".", "file"}}
+	rawFS := NewNodeFS(root, &Options{SynthesizeDotEntries: true})
+	sub := &listRoot{names: []string{"..", "x", "y"}}
+	root.Inode().NewPersistentChild(context.Background(), "sub", sub, NodeAttr{Mode: fuse.S_IFDIR, Ino: 5})
+
+	type entry struct {
+		name string
+		ino  uint64
+	}
+	list := func(ino uint64, off uint64) []entry {
+		var openOut fuse.OpenOut
+		if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: ino}}, &openOut); !st.Ok() {
+			t.Fatalf("OpenDir: %v", st)
+		}
+		defer rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: ino}, Fh: openOut.Fh})
+
+		buf := make([]byte, 4096)
+		in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: ino}, Fh: openOut.Fh, Offset: off}
+		if st := rawFS.ReadDir(nil, in, fuse.NewDirEntryList(buf, off)); !st.Ok() {
+			t.Fatalf("ReadDir: %v", st)
+		}
+		var r []entry
+		for _, nm := range parseDirents(buf) {
+			if nm == "" {
+				break
+			}
+			r = append(r, entry{nm, binary.LittleEndian.Uint64(buf)})
+			buf = buf[24+(len(nm)+7)&^7:]
+		}
+		return r
+	}
+
+	const unknown = fuse.FUSE_UNKNOWN_INO
+	if got, want := list(1, 0), []entry{{".", 1}, {"..", 1}, {"file", unknown}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("root: got %v, want %v", got, want)
+	}
+	if got, want := list(5, 0), []entry{{".", 5}, {"..", 1}, {"x", unknown}, {"y", unknown}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sub: got %v, want %v", got, want)
+	}
+
+	// The stream's own ".." has offset 1, so "x" is at 2+2.
+	if got, want := list(5, 4), []entry{{"y", unknown}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sub at 4: got %v, want %v", got, want)
+	}
+}
+
+// errOnceDirStream fails the first Next, and then lists its entries.
+type errOnceDirStream struct {
+	DirStream
+	failed bool
+}
+
+func (s *errOnceDirStream) HasNext() bool {
+	return !s.failed || s.DirStream.HasNext()
+}
+
+func (s *errOnceDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if !s.failed {
+		s.failed = true
+		return fuse.DirEntry{}, syscall.EIO
+	}
+	return s.DirStream.Next()
+}
+
+func TestDotDirStreamError(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+	ds := newDotDirStream(root.Inode(), &errOnceDirStream{
+		DirStream: NewListDirStream([]fuse.DirEntry{{Name: "a"}}),
+	})
+
+	type entry struct {
+		name  string
+		errno syscall.Errno
+	}
+	var got []entry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		got = append(got, entry{e.Name, errno})
+	}
+	// The error is reported once, and does not stick to later entries.
+	if want := []entry{{".", 0}, {"..", 0}, {"", syscall.EIO}, {"a", 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFilteredDirStream(t *testing.T) {
+	var es []fuse.DirEntry
+	for _, nm := range []string{".hidden", "a", ".git", "b", "c"} {
+		es = append(es, fuse.DirEntry{Name: nm, Mode: fuse.S_IFREG})
+	}
+	noDots := func(e fuse.DirEntry) bool { return !strings.HasPrefix(e.Name, ".") }
+	ds := NewFilteredDirStream(NewListDirStream(es), noDots)
+
+	type entry struct {
+		name string
+		off  uint64
+	}
+	var got []entry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		got = append(got, entry{e.Name, e.Off})
+	}
+	// The offsets are those of the unfiltered listing.
+	if want := []entry{{"a", 2}, {"b", 4}, {"c", 5}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if errno := ds.(SeekableDirStream).Seekdir(2); errno != 0 {
+		t.Fatalf("Seekdir: %v", errno)
+	}
+	if !ds.HasNext() {
+		t.Fatal("no entries after Seekdir")
+	}
+	if e, _ := ds.Next(); e.Name != "b" {
+		t.Errorf("after Seekdir: got %q, want b", e.Name)
+	}
+
+	ch := make(chan DirStreamEntry, 3)
+	ch <- DirStreamEntry{Entry: fuse.DirEntry{Name: ".x"}}
+	ch <- DirStreamEntry{Errno: syscall.EIO}
+	ch <- DirStreamEntry{Entry: fuse.DirEntry{Name: "y"}}
+	close(ch)
+	inner, done := NewChanDirStream(ch)
+	ds = NewFilteredDirStream(inner, noDots)
+	if !ds.HasNext() {
+		t.Fatal("no entries")
+	}
+	if _, errno := ds.Next(); errno != syscall.EIO {
+		t.Errorf("got %v, want EIO", errno)
+	}
+	if !ds.HasNext() {
+		t.Fatal("no entries after error")
+	}
+	if e, errno := ds.Next(); errno != 0 || e.Name != "y" {
+		t.Errorf("got %v, %v, want y", e, errno)
+	}
+	ds.Close()
+	select {
+	case <-done:
+	default:
+		t.Errorf("inner stream not closed")
+	}
+}
+
+func TestOverlayDirStream(t *testing.T) {
+	base := NewListDirStream([]fuse.DirEntry{
+		{Name: "a", Mode: fuse.S_IFREG, Off: 1},
+		{Name: "c", Mode: fuse.S_IFREG, Off: 2},
+		{Name: "e", Mode: fuse.S_IFREG, Off: 3},
+		{Name: "g", Mode: fuse.S_IFREG, Off: 4},
+	})
+	// Pending creates, one of which replaces "e" by a directory,
+	// and pending deletes.
+	extra := []fuse.DirEntry{
+		{Name: "h", Mode: fuse.S_IFREG},
+		{Name: "b", Mode: fuse.S_IFREG},
+		{Name: "e", Mode: fuse.S_IFDIR},
+		{Name: "x", Mode: fuse.S_IFREG},
+	}
+	hidden := map[string]bool{"c": true, "x": true}
+
+	ds := NewOverlayDirStream(base, extra, hidden)
+	var got []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		if e.Off != 0 {
+			t.Errorf("%s: got offset %d", e.Name, e.Off)
+		}
+		if e.Name == "e" && e.Mode != fuse.S_IFDIR {
+			t.Errorf("e: got mode %o, want the pending entry", e.Mode)
+		}
+		got = append(got, e.Name)
+	}
+	if want := []string{"a", "b", "e", "g", "h"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ch := make(chan DirStreamEntry, 2)
+	ch <- DirStreamEntry{Entry: fuse.DirEntry{Name: "m"}}
+	ch <- DirStreamEntry{Errno: syscall.EIO}
+	close(ch)
+	failing, _ := NewChanDirStream(ch)
+	ds = NewOverlayDirStream(failing, []fuse.DirEntry{{Name: "a"}, {Name: "z"}}, nil)
+	got = nil
+	var errno syscall.Errno
+	for ds.HasNext() {
+		var e fuse.DirEntry
+		e, errno = ds.Next()
+		if errno != 0 {
+			break
+		}
+		got = append(got, e.Name)
+	}
+	if errno != syscall.EIO || !reflect.DeepEqual(got, []string{"a", "m"}) {
+		t.Errorf("got %v, %v, want [a m], EIO", got, errno)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after error")
+	}
+	ds.Close()
+}
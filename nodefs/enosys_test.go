@@ -0,0 +1,114 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// enosysFile counts calls to operations that it does not support.
+type enosysFile struct {
+	MemRegularFile
+
+	mu        sync.Mutex
+	allocates int
+	setlks    int
+}
+
+func (f *enosysFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, OK
+}
+
+func (f *enosysFile) Allocate(ctx context.Context, fh FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allocates++
+	return syscall.ENOSYS
+}
+
+func (f *enosysFile) Setlk(ctx context.Context, fh FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setlks++
+	return syscall.ENOSYS
+}
+
+func TestAllocateENOSYS(t *testing.T) {
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	file := &enosysFile{}
+	root.Inode().AddChild("file",
+		root.Inode().NewPersistentInode(context.Background(), file, NodeAttr{}), false)
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	for i := 0; i < 2; i++ {
+		if err := unix.Fallocate(fd, 0, 0, 1024); err == nil {
+			t.Errorf("Fallocate %d succeeded", i)
+		}
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.allocates > 1 {
+		t.Errorf("got %d Allocate calls, want at most 1", file.allocates)
+	}
+}
+
+func TestLockENOSYS(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	file := &enosysFile{}
+	root.Inode().NewPersistentChild(context.Background(), "file", file, NodeAttr{Ino: 2})
+
+	hdr := fuse.InHeader{NodeId: 2}
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	for i := 0; i < 2; i++ {
+		st := rawFS.SetLk(nil, &fuse.LkIn{
+			InHeader: hdr,
+			Fh:       openOut.Fh,
+			Lk:       fuse.FileLock{End: math.MaxInt64, Typ: syscall.F_WRLCK},
+			LkFlags:  fuse.FUSE_LK_FLOCK,
+		})
+		if st != fuse.ENOSYS {
+			t.Errorf("SetLk %d: got %v, want ENOSYS", i, st)
+		}
+	}
+
+	// The flock unlock on release is skipped too.
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: hdr, Fh: openOut.Fh, ReleaseFlags: fuse.RELEASE_FLOCK_UNLOCK})
+	if file.setlks != 1 {
+		t.Errorf("got %d Setlk calls, want 1", file.setlks)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+func TestEventChan(t *testing.T) {
+	events := make(chan Event, 10)
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	rawFS := NewNodeFS(root, &Options{EventChan: events})
+
+	caller := fuse.Caller{Pid: 42}
+	var entryOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1, Caller: caller}, Mode: 0755}, "dir", &entryOut); !st.Ok() {
+		t.Fatalf("Mkdir: %v", st)
+	}
+	var createOut fuse.CreateOut
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId, Caller: caller}, Flags: syscall.O_RDWR, Mode: 0644}, "file", &createOut); !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+	if _, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: createOut.NodeId, Caller: caller}, Fh: createOut.Fh}, []byte("hello")); !st.Ok() {
+		t.Fatalf("Write: %v", st)
+	}
+
+	close(events)
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	want := []Event{
+		{Op: "Mkdir", Ino: 1, Name: "dir", Pid: 42},
+		{Op: "Create", Ino: entryOut.NodeId, Name: "file", Pid: 42},
+		{Op: "Write", Ino: createOut.NodeId, Pid: 42},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEventChanFull(t *testing.T) {
+	events := make(chan Event, 1)
+	rawFS := NewNodeFS(&OperationStubs{}, &Options{EventChan: events})
+
+	lookup := func() {
+		var out fuse.EntryOut
+		rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "x", &out)
+	}
+	for i := 0; i < 3; i++ {
+		lookup()
+	}
+	if e := <-events; e.Dropped != 0 {
+		t.Errorf("first event: got Dropped %d, want 0", e.Dropped)
+	}
+	lookup()
+	if e := <-events; e.Dropped != 2 {
+		t.Errorf("got Dropped %d, want 2", e.Dropped)
+	}
+}
+
+func TestEventChanMount(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	events := make(chan Event, 100)
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	opts := &Options{EventChan: events}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	if err := os.Mkdir(mntDir+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	f, err := os.Create(mntDir + "/dir/file")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+
+	seen := map[string]Event{}
+	for len(events) > 0 {
+		e := <-events
+		if _, ok := seen[e.Op]; !ok {
+			seen[e.Op] = e
+		}
+	}
+	if e, ok := seen["Mkdir"]; !ok || e.Ino != 1 || e.Name != "dir" || e.Pid == 0 {
+		t.Errorf("got Mkdir event %+v, ok %v", e, ok)
+	}
+	if _, ok := seen["Write"]; !ok {
+		t.Errorf("no Write event in %v", seen)
+	}
+}
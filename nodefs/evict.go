@@ -0,0 +1,101 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+// The bridge keeps the non-persistent Inodes that the kernel
+// references in an LRU list, if Options.MaxCachedInodes is set. The
+// list is protected by rawBridge.mu.
+
+// lruAdd puts n at the front of the LRU list, if it is eligible for
+// eviction. Must have n.mu and bridge.mu.
+func (b *rawBridge) lruAdd(n *Inode) {
+	if b.options.MaxCachedInodes <= 0 || n.lruElem != nil || n.persistent || n.lookupCount == 0 || n == b.root {
+		return
+	}
+	n.lruElem = b.lru.PushFront(n)
+}
+
+// lruTouch marks n as recently used. Must have bridge.mu.
+func (b *rawBridge) lruTouch(n *Inode) {
+	if n.lruElem != nil {
+		b.lru.MoveToFront(n.lruElem)
+	}
+}
+
+// lruRemove takes n off the LRU list. Must have bridge.mu.
+func (b *rawBridge) lruRemove(n *Inode) {
+	if n.lruElem != nil {
+		b.lru.Remove(n.lruElem)
+		n.lruElem = nil
+	}
+}
+
+// maybeEvict starts evicting Inodes if there are more than
+// Options.MaxCachedInodes. Must not have bridge.mu.
+func (b *rawBridge) maybeEvict() {
+	if b.options.MaxCachedInodes <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.evicting || b.lru.Len() <= b.options.MaxCachedInodes {
+		return
+	}
+	b.evicting = true
+
+	// The kernel may hold the directory lock while it waits for
+	// the reply to the request that triggered this, so notify
+	// asynchronously.
+	go b.evictInodes()
+}
+
+// evictInodes asks the kernel to forget the least recently used
+// Inodes until the LRU list is within bounds.
+func (b *rawBridge) evictInodes() {
+	for {
+		b.mu.Lock()
+		var victims []*Inode
+		for e := b.lru.Back(); e != nil && b.lru.Len()-len(victims) > b.options.MaxCachedInodes; e = e.Prev() {
+			n := e.Value.(*Inode)
+			if len(n.openFiles) > 0 {
+				continue
+			}
+			victims = append(victims, n)
+		}
+		// Taking the victims off the list ensures that the
+		// loop terminates, even if the kernel does not drop
+		// them. A later lookup puts them back.
+		for _, n := range victims {
+			b.lruRemove(n)
+		}
+		if len(victims) == 0 {
+			b.evicting = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		for _, n := range victims {
+			b.evict(n)
+		}
+	}
+}
+
+// evict invalidates the kernel's entries for n, so it sends FORGET
+// once they are unused.
+func (b *rawBridge) evict(n *Inode) {
+	var parents []parentData
+	n.mu.Lock()
+	if !n.persistent && n.pinCount == 0 && len(n.children) == 0 {
+		n.parents.each(func(p parentData) {
+			parents = append(parents, p)
+		})
+	}
+	n.mu.Unlock()
+
+	for _, p := range parents {
+		p.parent.NotifyEntry(p.name)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// manyFilesDir has a file for every name.
+type manyFilesDir struct {
+	MemDir
+}
+
+func (d *manyFilesDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	out.Mode = fuse.S_IFREG | 0644
+	return d.Inode().NewInode(ctx, &MemRegularFile{}, NodeAttr{Mode: fuse.S_IFREG}), OK
+}
+
+func TestMaxCachedInodes(t *testing.T) {
+	root := &manyFilesDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	const max = 10
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+		MaxCachedInodes: max,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	for i := 0; i < 10*max; i++ {
+		if _, err := os.Lstat(fmt.Sprintf("%s/file%d", mntDir, i)); err != nil {
+			t.Fatalf("Lstat: %v", err)
+		}
+	}
+
+	b := root.Inode().bridge
+	count := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// Don't count the root.
+		return len(b.nodes) - 1
+	}
+
+	// FORGET arrives asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for count() > max && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := count(); got > max {
+		t.Errorf("got %d inodes, want at most %d", got, max)
+	}
+	if got := len(root.Inode().Children()); got > max {
+		t.Errorf("root has %d children, want at most %d", got, max)
+	}
+
+	// Evicted entries are looked up again.
+	if _, err := os.Lstat(mntDir + "/file0"); err != nil {
+		t.Errorf("Lstat: %v", err)
+	}
+}
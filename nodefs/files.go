@@ -8,6 +8,7 @@ import (
 	"context"
 	//	"time"
 
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -20,26 +21,118 @@ func NewLoopbackFile(fd int) FileHandle {
 	return &loopbackFile{fd: fd}
 }
 
+// NewBufferedLoopbackFile is like NewLoopbackFile, but collects
+// sequential writes in memory, and writes them to `fd` together once
+// `flushThreshold` bytes are pending. This saves system calls when
+// the kernel sends many small writes, eg. with direct IO.
+//
+// Pending data is written before a write that does not continue
+// where the previous one ended, and before any operation that reads
+// or changes the file through `fd` (Read, Getattr, Setattr, Lseek,
+// etc.), so the buffering is invisible through the handle. An error
+// from writing pending data is returned by the operation that
+// triggered it, typically Flush or Fsync.
+func NewBufferedLoopbackFile(fd int, flushThreshold int) FileHandle {
+	return &loopbackFile{fd: fd, flushThreshold: flushThreshold}
+}
+
 type loopbackFile struct {
 	fd int
+
+	// flushThreshold is the size of the write buffer. Writes
+	// are not buffered if it is zero.
+	flushThreshold int
+
+	// mu protects the write buffer, which holds data to be
+	// written at offset bufOff.
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
 }
 
+// pwrite is syscall.Pwrite. Tests replace it to count calls.
+var pwrite = syscall.Pwrite
+
+// Read returns a ReadResult backed by the file descriptor, so the
+// server can splice the data into the kernel without copying it.
 func (f *loopbackFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
+	if errno := f.flushBuffer(); errno != 0 {
+		return nil, errno
+	}
 	r := fuse.ReadResultFd(uintptr(f.fd), off, len(buf))
 	return r, OK
 }
 
 func (f *loopbackFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
-	n, err := syscall.Pwrite(f.fd, data, off)
-	return uint32(n), ToErrno(err)
+	if f.flushThreshold == 0 {
+		n, err := pwrite(f.fd, data, off)
+		return uint32(n), ToErrno(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.buf) > 0 && off != f.bufOff+int64(len(f.buf)) {
+		if errno := f.flushBufferLocked(); errno != 0 {
+			return 0, errno
+		}
+	}
+	if len(f.buf) == 0 {
+		if len(data) >= f.flushThreshold {
+			n, err := pwrite(f.fd, data, off)
+			return uint32(n), ToErrno(err)
+		}
+		f.bufOff = off
+	}
+	f.buf = append(f.buf, data...)
+	if len(f.buf) >= f.flushThreshold {
+		if errno := f.flushBufferLocked(); errno != 0 {
+			return 0, errno
+		}
+	}
+	return uint32(len(data)), OK
+}
+
+// flushBuffer writes out pending buffered data.
+func (f *loopbackFile) flushBuffer() syscall.Errno {
+	if f.flushThreshold == 0 {
+		return OK
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flushBufferLocked()
+}
+
+// flushBufferLocked writes out the buffer. If that fails, the
+// pending data is dropped, and the error is reported once.
+func (f *loopbackFile) flushBufferLocked() syscall.Errno {
+	data := f.buf
+	off := f.bufOff
+	f.buf = f.buf[:0]
+	for len(data) > 0 {
+		n, err := pwrite(f.fd, data, off)
+		if err != nil {
+			return ToErrno(err)
+		}
+		data = data[n:]
+		off += int64(n)
+	}
+	return OK
 }
 
 func (f *loopbackFile) Release(ctx context.Context) syscall.Errno {
+	errno := f.flushBuffer()
 	err := syscall.Close(f.fd)
+	if errno != 0 {
+		return errno
+	}
 	return ToErrno(err)
 }
 
 func (f *loopbackFile) Flush(ctx context.Context) syscall.Errno {
+	if errno := f.flushBuffer(); errno != 0 {
+		return errno
+	}
+
 	// Since Flush() may be called for each dup'd fd, we don't
 	// want to really close the file, we just want to flush. This
 	// is achieved by closing a dup'd fd.
@@ -53,6 +146,9 @@ func (f *loopbackFile) Flush(ctx context.Context) syscall.Errno {
 }
 
 func (f *loopbackFile) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
+	if errno := f.flushBuffer(); errno != 0 {
+		return errno
+	}
 	r := ToErrno(syscall.Fsync(f.fd))
 
 	return r
@@ -111,6 +207,9 @@ func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileL
 }
 
 func (f *loopbackFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if errno := f.flushBuffer(); errno != 0 {
+		return errno
+	}
 	if errno := f.setAttr(ctx, in); errno != 0 {
 		return errno
 	}
@@ -145,19 +244,8 @@ func (f *loopbackFile) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.
 		}
 	}
 
-	mtime, mok := in.GetMTime()
-	atime, aok := in.GetATime()
-
-	if mok || aok {
-		ap := &atime
-		mp := &mtime
-		if !aok {
-			ap = nil
-		}
-		if !mok {
-			mp = nil
-		}
-		errno = f.utimens(ap, mp)
+	if in.Valid&(fuse.FATTR_ATIME|fuse.FATTR_MTIME) != 0 {
+		errno = f.setTimes(in)
 		if errno != 0 {
 			return errno
 		}
@@ -173,6 +261,9 @@ func (f *loopbackFile) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.
 }
 
 func (f *loopbackFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
+	if errno := f.flushBuffer(); errno != 0 {
+		return errno
+	}
 	st := syscall.Stat_t{}
 	err := syscall.Fstat(f.fd, &st)
 	if err != nil {
@@ -183,7 +274,16 @@ func (f *loopbackFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Err
 	return OK
 }
 
+// Lseek repositions the backing file descriptor. For SEEK_DATA and
+// SEEK_HOLE this finds the data and holes of the backing file, and
+// ENXIO for offsets at or beyond the end is returned as is.
 func (f *loopbackFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	if errno := f.flushBuffer(); errno != 0 {
+		return 0, errno
+	}
 	n, err := unix.Seek(f.fd, int64(off), int(whence))
-	return uint64(n), ToErrno(err)
+	if err != nil {
+		return 0, ToErrno(err)
+	}
+	return uint64(n), OK
 }
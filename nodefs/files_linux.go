@@ -7,12 +7,20 @@ package nodefs
 import (
 	"context"
 	"syscall"
-	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
 
 func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	if errno := f.flushBuffer(); errno != 0 {
+		return errno
+	}
+	// fallocate(2) only punches holes together with
+	// FALLOC_FL_KEEP_SIZE. A hole never changes the file size, so
+	// accept it without.
+	if mode&FALLOC_FL_PUNCH_HOLE != 0 {
+		mode |= FALLOC_FL_KEEP_SIZE
+	}
 	err := syscall.Fallocate(f.fd, mode, int64(off), int64(sz))
 	if err != nil {
 		return ToErrno(err)
@@ -20,11 +28,9 @@ func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode
 	return OK
 }
 
-// Utimens - file handle based version of loopbackFileSystem.Utimens()
-func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
-	var ts [2]syscall.Timespec
-	ts[0] = fuse.UtimeToTimespec(a)
-	ts[1] = fuse.UtimeToTimespec(m)
-	err := futimens(int(f.fd), &ts)
-	return ToErrno(err)
+// setTimes applies the timestamps of `in` to the file, passing the
+// requested nanoseconds and UTIME_NOW through to the kernel as is.
+func (f *loopbackFile) setTimes(in *fuse.SetAttrIn) syscall.Errno {
+	ts := utimeSpecs(in)
+	return ToErrno(futimens(int(f.fd), &ts))
 }
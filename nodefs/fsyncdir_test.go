@@ -0,0 +1,74 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// fsyncdirDir records the flags of Fsyncdir calls.
+type fsyncdirDir struct {
+	MemDir
+
+	mu    sync.Mutex
+	flags []uint32
+}
+
+func (d *fsyncdirDir) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flags = append(d.flags, flags)
+	return OK
+}
+
+func TestFsyncdir(t *testing.T) {
+	root := &fsyncdirDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	if err := ioutil.WriteFile(mntDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dir, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		t.Errorf("fsync: %v", err)
+	}
+	if err := syscall.Fdatasync(int(dir.Fd())); err != nil {
+		t.Errorf("fdatasync: %v", err)
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if len(root.flags) != 2 {
+		t.Fatalf("got Fsyncdir calls %v, want 2", root.flags)
+	}
+	if root.flags[0]&1 != 0 || root.flags[1]&1 == 0 {
+		t.Errorf("got flags %v, want datasync only for the second call", root.flags)
+	}
+}
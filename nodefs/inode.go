@@ -5,6 +5,7 @@
 package nodefs
 
 import (
+	"container/list"
 	"context"
 	"fmt"
 	"log"
@@ -12,7 +13,10 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 type parentData struct {
@@ -37,8 +41,15 @@ type NodeAttr struct {
 	// When reusing a previously used inode number for a new
 	// object, the new object must have a different Gen
 	// number. This is irrelevant if the FS is not exported over
-	// NFS
+	// NFS. The bridge cannot tell a new object from the old one
+	// being looked up again after the kernel forgot it, so it
+	// reports Gen to the kernel as given.
 	Gen uint64
+
+	// For character and block devices, Rdev is the device number,
+	// eg. from MakeDev. The bridge reports it in the attributes
+	// if the file system leaves fuse.Attr.Rdev unset.
+	Rdev uint32
 }
 
 // Reserved returns if the NodeAttr is using reserved Inode numbers.
@@ -75,7 +86,7 @@ type Inode struct {
 	persistent bool
 
 	// changeCounter increments every time the mutable state
-	// (lookupCount, persistent, children, parents) protected by
+	// (lookupCount, persistent, pinCount, children, parents) protected by
 	// mu is modified.
 	//
 	// This is used in places where we have to relock inode into inode
@@ -86,20 +97,55 @@ type Inode struct {
 	// Number of kernel refs to this node.
 	lookupCount uint64
 
+	// Number of Pin calls without matching Unpin.
+	pinCount uint32
+
 	children map[string]*Inode
-	parents  map[parentData]struct{}
+	parents  inodeParents
+
+	// pollHandles are the kernel's poll handles (fuse.PollIn.Kh)
+	// that wait for a wakeup notification.
+	pollHandles map[uint64]struct{}
+
+	// linkTarget is the cached result of Readlink, valid until
+	// linkExpiry. See Options.SymlinkCacheTimeout.
+	linkTarget []byte
+	linkExpiry time.Time
+
+	// attrTimeout and entryTimeout override Options.AttrTimeout
+	// and Options.EntryTimeout for this node, if set.
+	attrTimeout  *time.Duration
+	entryTimeout *time.Duration
+
+	// staticAttr, if set, answers GETATTR without calling the
+	// Operations. See SetStaticAttr.
+	staticAttr *fuse.Attr
+
+	// pendingStores holds NotifyStore calls made before the
+	// kernel knew the node. They are sent once the reply that
+	// introduces the node has been written.
+	pendingStores []pendingStore
+
+	// lruElem is the entry in the bridge's LRU list for
+	// Options.MaxCachedInodes. Protected by bridge.mu.
+	lruElem *list.Element
+}
+
+type pendingStore struct {
+	off  int64
+	data []byte
 }
 
 func (n *Inode) dirOps() DirOperations {
-	return n.ops.(DirOperations)
+	return dirOpsOf(n.ops)
 }
 
 func (n *Inode) fileOps() FileOperations {
-	return n.ops.(FileOperations)
+	return fileOpsOf(n.ops)
 }
 
 func (n *Inode) linkOps() SymlinkOperations {
-	return n.ops.(SymlinkOperations)
+	return linkOpsOf(n.ops)
 }
 
 // NodeAttr returns the (Ino, Gen) tuple for this node.
@@ -112,19 +158,83 @@ func (n *Inode) Mode() uint32 {
 	return n.nodeAttr.Mode
 }
 
+// IsDir returns true if this is a directory. The file type is fixed
+// when the Inode is created, so the type predicates never change
+// their answer for a given Inode.
+func (n *Inode) IsDir() bool {
+	return n.nodeAttr.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// IsRegular returns true if this is a regular file.
+func (n *Inode) IsRegular() bool {
+	return n.nodeAttr.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+// IsSymlink returns true if this is a symbolic link.
+func (n *Inode) IsSymlink() bool {
+	return n.nodeAttr.Mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
+// IsDevice returns true if this is a character or block device.
+func (n *Inode) IsDevice() bool {
+	t := n.nodeAttr.Mode & syscall.S_IFMT
+	return t == syscall.S_IFCHR || t == syscall.S_IFBLK
+}
+
 // Returns the root of the tree
 func (n *Inode) Root() *Inode {
 	return n.bridge.root
 }
 
-// debugString is used for debugging. Racy.
-func (n *Inode) debugString() string {
-	var ss []string
-	for nm, ch := range n.children {
-		ss = append(ss, fmt.Sprintf("%q=%d", nm, ch.nodeAttr.Ino))
+// ServerCaps returns the capabilities (fuse.CAP_* flags) that were
+// agreed with the kernel when mounting, eg. fuse.CAP_READDIRPLUS or
+// fuse.CAP_WRITEBACK_CACHE. It returns 0 before the file system is
+// mounted. In particular, the root's OnAdd cannot use it: OnAdd runs
+// in NewNodeFS, before the kernel is contacted, and moving it after
+// INIT would leave unmounted trees, as used in tests, unpopulated.
+// Check the flags when they are needed instead, eg. in Lookup or
+// Readdir; all requests from the kernel see the negotiated flags.
+func (n *Inode) ServerCaps() uint32 {
+	server := n.bridge.Server()
+	if server == nil {
+		return 0
 	}
+	return server.KernelSettings().Flags
+}
+
+// Server returns the fuse.Server serving this file system, or nil if
+// the mount has not completed yet. It may be called from any
+// goroutine.
+//
+// Server.Unmount waits for all requests to finish, so calling it
+// from within an operation deadlocks. A file system that wants to
+// unmount itself, eg. after a fatal backend error, should do so from
+// a new goroutine:
+//
+//	go n.Server().Unmount()
+func (n *Inode) Server() *fuse.Server {
+	return n.bridge.Server()
+}
+
+// LookupCount returns the number of references the kernel holds to
+// this Inode: the lookups it was answered with, minus the ones it
+// forgot. The root has one reference while mounted.
+func (n *Inode) LookupCount() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lookupCount
+}
 
-	return fmt.Sprintf("%d: %s", n.nodeAttr, strings.Join(ss, ","))
+// DebugString describes the reference state of the Inode, for
+// chasing leaks and premature forgets: the inode number, mode,
+// whether it is persistent, the kernel's lookup count, the pin
+// count, and the number of children and parents.
+func (n *Inode) DebugString() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return fmt.Sprintf("i%d mode=0%o persistent=%v lookups=%d pins=%d children=%d parents=%d",
+		n.nodeAttr.Ino, n.nodeAttr.Mode, n.persistent, n.lookupCount, n.pinCount,
+		len(n.children), n.parents.count())
 }
 
 // sortNodes rearranges inode group in consistent order.
@@ -209,7 +319,15 @@ func unlockNodes(ns ...*Inode) {
 func (n *Inode) Forgotten() bool {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	return n.lookupCount == 0 && len(n.parents) == 0 && !n.persistent
+	return n.lookupCount == 0 && n.parents.count() == 0 && !n.persistent && n.pinCount == 0
+}
+
+// isPersistent returns whether the Inode stays in the tree without
+// kernel references.
+func (n *Inode) isPersistent() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.persistent
 }
 
 // Operations returns the object implementing the file system
@@ -218,21 +336,58 @@ func (n *Inode) Operations() Operations {
 	return n.ops
 }
 
-// Path returns a path string to the inode relative to the root.
+// InodeOps returns the Operations of `n` as a T, for navigating
+// between nodes of known types, eg.
+//
+//	dir, ok := InodeOps[*MemDir](parent)
+//
+// It returns false if `n` is nil or its Operations are not a T.
+func InodeOps[T Operations](n *Inode) (T, bool) {
+	if n == nil {
+		var zero T
+		return zero, false
+	}
+	t, ok := n.ops.(T)
+	return t, ok
+}
+
+// MustInodeOps is like InodeOps, but panics if the Operations are
+// not a T.
+func MustInodeOps[T Operations](n *Inode) T {
+	t, ok := InodeOps[T](n)
+	if !ok {
+		var zero T
+		var ops Operations
+		if n != nil {
+			ops = n.ops
+		}
+		log.Panicf("got Operations %T, want %T", ops, zero)
+	}
+	return t
+}
+
+// Path returns a path string to the inode relative to `root`, or to
+// the file system root if `root` is nil. The root itself has an empty
+// path. If the inode is hard-linked, the link with the
+// lexicographically smallest name is followed at each level, so the
+// result is deterministic. If the inode is no longer reachable from
+// the root, for example because it was unlinked, the path starts
+// with ".deleted".
 func (n *Inode) Path(root *Inode) string {
+	if root == nil {
+		root = n.Root()
+	}
+
 	var segments []string
 	p := n
-	for p != nil && p != root {
-		var pd parentData
-
+	for p != root {
 		// We don't try to take all locks at the same time, because
 		// the caller won't use the "path" string under lock anyway.
 		p.mu.Lock()
-		for pd = range p.parents {
-			break
-		}
+		pd := p.firstParentLocked()
 		p.mu.Unlock()
 		if pd.parent == nil {
+			segments = append(segments, ".deleted")
 			break
 		}
 
@@ -240,11 +395,6 @@ func (n *Inode) Path(root *Inode) string {
 		p = pd.parent
 	}
 
-	if p == nil {
-		// NOSUBMIT - should replace rather than append?
-		segments = append(segments, ".deleted")
-	}
-
 	i := 0
 	j := len(segments) - 1
 
@@ -258,6 +408,77 @@ func (n *Inode) Path(root *Inode) string {
 	return path
 }
 
+// firstParentLocked returns the parent link with the smallest name,
+// breaking ties on the parent's inode number. It returns the zero
+// parentData if there are no parents.
+func (n *Inode) firstParentLocked() parentData {
+	var pd parentData
+	n.parents.each(func(k parentData) {
+		if pd.parent == nil || k.name < pd.name ||
+			(k.name == pd.name && k.parent.nodeAttr.Ino < pd.parent.nodeAttr.Ino) {
+			pd = k
+		}
+	})
+	return pd
+}
+
+// inodeParents is the set of parent links of an Inode. Most nodes
+// have a single parent, so one link is kept inline, and the map is
+// only allocated for hard links.
+type inodeParents struct {
+	// first is set whenever the set is nonempty.
+	first parentData
+	other map[parentData]struct{}
+}
+
+func (ps *inodeParents) add(p parentData) {
+	if ps.first.parent == nil {
+		ps.first = p
+		return
+	}
+	if ps.first == p {
+		return
+	}
+	if ps.other == nil {
+		ps.other = make(map[parentData]struct{})
+	}
+	ps.other[p] = struct{}{}
+}
+
+func (ps *inodeParents) delete(p parentData) {
+	if ps.first != p {
+		delete(ps.other, p)
+		return
+	}
+	ps.first = parentData{}
+	for k := range ps.other {
+		ps.first = k
+		delete(ps.other, k)
+		break
+	}
+}
+
+func (ps *inodeParents) count() int {
+	if ps.first.parent == nil {
+		return 0
+	}
+	return 1 + len(ps.other)
+}
+
+func (ps *inodeParents) each(fn func(parentData)) {
+	if ps.first.parent == nil {
+		return
+	}
+	fn(ps.first)
+	for k := range ps.other {
+		fn(k)
+	}
+}
+
+func (ps *inodeParents) clear() {
+	*ps = inodeParents{}
+}
+
 // setEntry does `iparent[name] = ichild` linking.
 //
 // setEntry must not be called simultaneously for any of iparent or ichild.
@@ -265,7 +486,7 @@ func (n *Inode) Path(root *Inode) string {
 // but it could be also valid if only iparent is locked and ichild was just
 // created and only one goroutine keeps referencing it.
 func (iparent *Inode) setEntry(name string, ichild *Inode) {
-	ichild.parents[parentData{name, iparent}] = struct{}{}
+	ichild.parents.add(parentData{name, iparent})
 	iparent.children[name] = ichild
 	ichild.changeCounter++
 	iparent.changeCounter++
@@ -284,6 +505,103 @@ func (n *Inode) ForgetPersistent() {
 	n.removeRef(0, true)
 }
 
+// Pin keeps the Inode in the tree, even after the kernel has
+// forgotten it, until a matching call to Unpin, for example while a
+// background upload of its data completes. Pins are counted, so
+// independent users can each hold one. Pin must be called while the
+// Inode is live, eg. from an operation on it; it cannot revive a
+// dropped Inode.
+func (n *Inode) Pin() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pinCount++
+	n.changeCounter++
+}
+
+// Unpin releases a pin taken with Pin. Once the last pin is
+// released, the Inode is dropped from the tree if the kernel has no
+// references and it is neither persistent nor has children.
+func (n *Inode) Unpin() {
+	n.mu.Lock()
+	if n.pinCount == 0 {
+		n.mu.Unlock()
+		log.Panic("Unpin without Pin")
+	}
+	n.pinCount--
+	n.changeCounter++
+	last := n.pinCount == 0
+	n.mu.Unlock()
+
+	if last {
+		n.removeRef(0, false)
+	}
+}
+
+// SetAttrTimeout sets how long the kernel may cache the attributes
+// of this Inode, overriding Options.AttrTimeout, eg. to never cache
+// a node whose contents change all the time. A zero duration
+// disables caching. A timeout that an operation sets in its output
+// still takes precedence.
+func (n *Inode) SetAttrTimeout(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.attrTimeout = &d
+}
+
+// SetStaticAttr marks the attributes of this Inode as fixed. The
+// bridge then answers GETATTR with `attr`, without calling Getattr
+// or Fgetattr, and lets the kernel cache the result forever. The file
+// type and inode number always come from the Inode. A Setattr on the
+// Inode clears the static attributes, as do NotifyAttr, NotifyContent
+// and DropCaches, so Getattr is called again afterwards.
+func (n *Inode) SetStaticAttr(attr fuse.Attr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.staticAttr = &attr
+}
+
+// clearStaticAttr drops the attributes set by SetStaticAttr.
+func (n *Inode) clearStaticAttr() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.staticAttr = nil
+}
+
+// getStaticAttr copies the static attributes into `out`, and
+// returns whether there were any.
+func (n *Inode) getStaticAttr(out *fuse.Attr) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.staticAttr == nil {
+		return false
+	}
+	*out = *n.staticAttr
+	return true
+}
+
+// SetEntryTimeout is like SetAttrTimeout, for the names of this
+// Inode, overriding Options.EntryTimeout.
+func (n *Inode) SetEntryTimeout(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entryTimeout = &d
+}
+
+// timeouts returns the attribute and entry timeouts for this node,
+// falling back to the defaults in `opts`.
+func (n *Inode) timeouts(opts *Options) (attr, entry *time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	attr, entry = opts.AttrTimeout, opts.EntryTimeout
+	if n.attrTimeout != nil {
+		attr = n.attrTimeout
+	}
+	if n.entryTimeout != nil {
+		entry = n.entryTimeout
+	}
+	return attr, entry
+}
+
 // NewInode returns an inode for the given Operations. The mode should
 // be standard mode argument (eg. S_IFDIR). The inode number in id.Ino
 // argument is used to implement hard-links.  If it is given, and
@@ -293,6 +611,24 @@ func (n *Inode) NewInode(ctx context.Context, ops Operations, id NodeAttr) *Inod
 	return n.newInode(ctx, ops, id, false)
 }
 
+// NewPersistentChild creates a persistent Inode for `ops`, and adds
+// it as child `name` of this directory, replacing any existing entry.
+// It is a shorthand for NewPersistentInode followed by AddChild, for
+// building static trees, eg. in OnAdd.
+func (n *Inode) NewPersistentChild(ctx context.Context, name string, ops Operations, id NodeAttr) *Inode {
+	ch := n.NewPersistentInode(ctx, ops, id)
+	n.AddChild(name, ch, true)
+	return ch
+}
+
+// NewChild is like NewPersistentChild, but the child may be dropped
+// from the tree once the kernel forgets about it.
+func (n *Inode) NewChild(ctx context.Context, name string, ops Operations, id NodeAttr) *Inode {
+	ch := n.NewInode(ctx, ops, id)
+	n.AddChild(name, ch, true)
+	return ch
+}
+
 func (n *Inode) newInode(ctx context.Context, ops Operations, id NodeAttr, persistent bool) *Inode {
 	return n.bridge.newInode(ctx, ops, id, persistent)
 }
@@ -311,6 +647,11 @@ func (n *Inode) removeRef(nlookup uint64, dropPersistence bool) (forgotten bool,
 
 		n.lookupCount -= nlookup
 		n.changeCounter++
+		if n.lookupCount == 0 {
+			n.bridge.mu.Lock()
+			n.bridge.lruRemove(n)
+			n.bridge.mu.Unlock()
+		}
 	} else if dropPersistence && n.persistent {
 		n.persistent = false
 		n.changeCounter++
@@ -321,12 +662,12 @@ retry:
 		lockme = append(lockme[:0], n)
 		parents = parents[:0]
 		nChange := n.changeCounter
-		live = n.lookupCount > 0 || len(n.children) > 0 || n.persistent
+		live = n.lookupCount > 0 || len(n.children) > 0 || n.persistent || n.pinCount > 0
 		forgotten = n.lookupCount == 0
-		for p := range n.parents {
+		n.parents.each(func(p parentData) {
 			parents = append(parents, p)
 			lockme = append(lockme, p.parent)
-		}
+		})
 		n.mu.Unlock()
 
 		if live {
@@ -345,18 +686,33 @@ retry:
 			delete(p.parent.children, p.name)
 			p.parent.changeCounter++
 		}
-		n.parents = map[parentData]struct{}{}
+		n.parents.clear()
 		n.changeCounter++
+		n.pendingStores = nil
 
 		if n.lookupCount != 0 {
 			panic("lookupCount changed")
 		}
 
 		n.bridge.mu.Lock()
-		delete(n.bridge.nodes, n.nodeAttr.Ino)
+		dropped := n.bridge.nodes[n.nodeAttr.Ino] == n
+		if dropped {
+			delete(n.bridge.nodes, n.nodeAttr.Ino)
+		}
+		n.bridge.lruRemove(n)
+		for _, p := range parents {
+			// Directories become evictable once their
+			// last child is gone.
+			if len(p.parent.children) == 0 {
+				n.bridge.lruAdd(p.parent)
+			}
+		}
 		n.bridge.mu.Unlock()
 
 		unlockNodes(lockme...)
+		if fops, ok := n.ops.(ForgetOperations); ok && dropped {
+			fops.OnForget()
+		}
 		break
 	}
 
@@ -376,6 +732,25 @@ func (n *Inode) GetChild(name string) *Inode {
 	return n.children[name]
 }
 
+// caseFoldChild returns the child whose name equals `name` ignoring
+// case, as described for Options.CaseInsensitive.
+func (n *Inode) caseFoldChild(name string) (string, *Inode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch := n.children[name]; ch != nil {
+		return name, ch
+	}
+
+	var found string
+	var ch *Inode
+	for k, v := range n.children {
+		if strings.EqualFold(k, name) && (ch == nil || k < found) {
+			found, ch = k, v
+		}
+	}
+	return found, ch
+}
+
 // AddChild adds a child to this node. If overwrite is false, fail if
 // the destination already exists.
 func (n *Inode) AddChild(name string, ch *Inode, overwrite bool) (success bool) {
@@ -390,7 +765,7 @@ retry:
 		parentCounter := n.changeCounter
 		if !ok {
 			n.children[name] = ch
-			ch.parents[parentData{name, n}] = struct{}{}
+			ch.parents.add(parentData{name, n})
 			n.changeCounter++
 			ch.changeCounter++
 			unlockNode2(n, ch)
@@ -408,9 +783,9 @@ retry:
 			continue retry
 		}
 
-		delete(prev.parents, parentData{name, n})
+		prev.parents.delete(parentData{name, n})
 		n.children[name] = ch
-		ch.parents[parentData{name, n}] = struct{}{}
+		ch.parents.add(parentData{name, n})
 		n.changeCounter++
 		ch.changeCounter++
 		prev.changeCounter++
@@ -420,6 +795,159 @@ retry:
 	}
 }
 
+// AddChildNotify adds `child` under `name`, replacing an existing
+// entry, and tells the kernel about it, so the name shows up
+// immediately rather than after cached entries and listings expire.
+// This is for entries that the backend creates out of band; it may
+// be called from any goroutine. If `persistent` is set, the child is
+// marked persistent, as if it was made by NewPersistentInode. The
+// child is added even if the notification fails; ENOSYS means the
+// file system is not served.
+func (n *Inode) AddChildNotify(name string, child *Inode, persistent bool) syscall.Errno {
+	if persistent {
+		child.mu.Lock()
+		if !child.persistent {
+			child.persistent = true
+			child.changeCounter++
+			child.bridge.mu.Lock()
+			child.bridge.lruRemove(child)
+			child.bridge.mu.Unlock()
+		}
+		child.mu.Unlock()
+	}
+	n.AddChild(name, child, true)
+
+	// The kernel may have a negative entry for the name, and the
+	// listing and attributes of the directory.
+	errno := n.NotifyEntry(name)
+	if errno == OK || errno == syscall.ENOENT {
+		errno = n.NotifyContent(0, 0)
+	}
+	if errno == syscall.ENOENT {
+		// The kernel does not know the directory, so it
+		// caches nothing for it.
+		errno = OK
+	}
+	return errno
+}
+
+// GetOrAddChild returns the child `name` of this directory. If there
+// is none, it creates an Inode for `ops` and adds it, as one atomic
+// step, so concurrent lookups of the same new name agree on a single
+// Inode. The returned `created` is true if `ops` was added; otherwise
+// `ops` is unused, and may be discarded. The new Inode's OnAdd runs
+// with this directory locked, so it must not access this directory.
+func (n *Inode) GetOrAddChild(ctx context.Context, name string, ops Operations, attr NodeAttr, persistent bool) (child *Inode, created bool) {
+	if len(name) == 0 {
+		log.Panic("empty name for inode")
+	}
+
+	n.mu.Lock()
+	if ch := n.children[name]; ch != nil {
+		n.mu.Unlock()
+		return ch, false
+	}
+	ch := n.newInode(ctx, ops, attr, persistent)
+	if !tryLockNode2(ch, nil, n) {
+		// The Ino was known already, and its Inode is busy.
+		n.mu.Unlock()
+		lockNode2(n, ch)
+		if prev := n.children[name]; prev != nil {
+			unlockNode2(n, ch)
+			return prev, false
+		}
+	}
+	n.children[name] = ch
+	ch.parents.add(parentData{name, n})
+	n.changeCounter++
+	ch.changeCounter++
+	unlockNode2(n, ch)
+	return ch, true
+}
+
+// AddChildren adds several children to this directory, for building
+// large trees in advance, eg. in OnAdd. Unlike a loop over AddChild,
+// it locks the directory once for all children. If overwrite is
+// false and any of the names exists, no child is added, and
+// AddChildren returns false. Children that another goroutine has
+// locked are added afterwards with AddChild, so if the directory
+// changes at the same time, some children may be added while others
+// fail; the result is then false as well. It is meant for bulk
+// construction; to change a tree that is being served, AddChild is
+// just as good.
+func (n *Inode) AddChildren(children map[string]*Inode, overwrite bool) (success bool) {
+	var busy []string
+
+	n.mu.Lock()
+	for name := range children {
+		if len(name) == 0 {
+			n.mu.Unlock()
+			log.Panic("empty name for inode")
+		}
+		if _, ok := n.children[name]; ok && !overwrite {
+			n.mu.Unlock()
+			return false
+		}
+	}
+	if len(n.children) == 0 {
+		n.children = make(map[string]*Inode, len(children))
+	}
+	for name, ch := range children {
+		// Holding n.mu, we may only lock other nodes without
+		// waiting, as they may come first in the lock order.
+		// Nodes that are busy are added after n.mu is released.
+		prev := n.children[name]
+		if !tryLockNode2(ch, prev, n) {
+			busy = append(busy, name)
+			continue
+		}
+		if prev != nil {
+			prev.parents.delete(parentData{name, n})
+			prev.changeCounter++
+		}
+		n.children[name] = ch
+		ch.parents.add(parentData{name, n})
+		ch.changeCounter++
+		unlockNode2Except(ch, prev, n)
+	}
+	n.changeCounter++
+	n.mu.Unlock()
+
+	success = true
+	for _, name := range busy {
+		if !n.AddChild(name, children[name], overwrite) {
+			success = false
+		}
+	}
+	return success
+}
+
+// tryLockNode2 locks a and b (which may be nil) without waiting,
+// skipping `locked`, which the caller holds already. It returns
+// false, with neither node locked, if one of them is busy.
+func tryLockNode2(a, b, locked *Inode) bool {
+	if a != locked && !a.mu.TryLock() {
+		return false
+	}
+	if b != nil && b != a && b != locked && !b.mu.TryLock() {
+		if a != locked {
+			a.mu.Unlock()
+		}
+		return false
+	}
+	return true
+}
+
+// unlockNode2Except releases the locks taken by tryLockNode2.
+func unlockNode2Except(a, b, locked *Inode) {
+	if a != locked {
+		a.mu.Unlock()
+	}
+	if b != nil && b != a && b != locked {
+		b.mu.Unlock()
+	}
+}
+
 // Children returns the list of children of this directory Inode.
 func (n *Inode) Children() map[string]*Inode {
 	n.mu.Lock()
@@ -431,27 +959,79 @@ func (n *Inode) Children() map[string]*Inode {
 	return r
 }
 
+// ForEachChild calls fn for each child of this directory Inode, in
+// unspecified order, until fn returns false. Unlike Children, it does
+// not copy the set of children. fn is called with the Inode lock
+// held, so it must not modify the tree (eg. AddChild, RmChild) or
+// call methods that take the lock, such as Children or GetChild, on
+// this Inode.
+func (n *Inode) ForEachChild(fn func(name string, child *Inode) bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, v := range n.children {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+// WalkTree calls fn for this Inode and everything below it, depth
+// first, with the path relative to this Inode; the Inode itself has
+// an empty path. Children are visited in name order, and a node that
+// is hard-linked is only visited under the first path found, eg. for
+// dumping the tree when looking for leaked persistent Inodes.
+//
+// No locks are held while fn runs, so it may call any Inode method.
+// The walk does not see a consistent snapshot: on a live mount, the
+// tree may change while it is being walked.
+func (n *Inode) WalkTree(fn func(path string, ino *Inode)) {
+	n.walkTree("", map[*Inode]struct{}{}, fn)
+}
+
+func (n *Inode) walkTree(path string, seen map[*Inode]struct{}, fn func(path string, ino *Inode)) {
+	if _, ok := seen[n]; ok {
+		return
+	}
+	seen[n] = struct{}{}
+	fn(path, n)
+
+	children := n.Children()
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := name
+		if path != "" {
+			p = path + "/" + name
+		}
+		children[name].walkTree(p, seen, fn)
+	}
+}
+
 // Parents returns the parents of this Inode, along with the name
 // with which they're are a child
 func (n *Inode) Parents() map[string]*Inode {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	r := make(map[string]*Inode, len(n.parents))
-	for k := range n.parents {
+	r := make(map[string]*Inode, n.parents.count())
+	n.parents.each(func(k parentData) {
 		r[k.name] = k.parent
-	}
+	})
 	return r
 }
 
-// Parents returns a parent of this Inode, or nil if this Inode is
-// deleted or is the root
+// Parent returns a parent of this Inode and the name under which it
+// is a child of it, or a nil parent if this Inode is deleted or is
+// the root. The name comes first, as it always has for this method.
+// For hard-linked nodes, it picks the link with the smallest name,
+// like Path does.
 func (n *Inode) Parent() (string, *Inode) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	for k := range n.parents {
-		return k.name, k.parent
-	}
-	return "", nil
+	p := n.firstParentLocked()
+	return p.name, p.parent
 }
 
 // RmChild removes multiple children.  Returns whether the removal
@@ -481,19 +1061,18 @@ retry:
 		lockNodes(lockme...)
 		if n.changeCounter != nChange {
 			unlockNodes(lockme...)
-			// could avoid unlocking and relocking n here.
-			n.mu.Lock()
 			continue retry
 		}
 
 		for _, nm := range names {
 			ch := n.children[nm]
 			delete(n.children, nm)
+			ch.parents.delete(parentData{nm, n})
 			ch.changeCounter++
 		}
 		n.changeCounter++
 
-		live = n.lookupCount > 0 || len(n.children) > 0 || n.persistent
+		live = n.lookupCount > 0 || len(n.children) > 0 || n.persistent || n.pinCount > 0
 		unlockNodes(lockme...)
 
 		// removal successful
@@ -508,8 +1087,42 @@ retry:
 	return true, true
 }
 
-// MvChild executes a rename. If overwrite is set, a child at the
-// destination will be overwritten, should it exist.
+// RmAllChildren removes the whole subtree below this directory from
+// the FS tree, for example when the backing directory was deleted
+// remotely. Children are also removed from their own children, and
+// lose their persistence unless they are still linked elsewhere.
+// Nodes that the kernel still references stay known until it forgets
+// them. If the file system is mounted, the kernel is notified of each
+// removed entry, so this should be called from a goroutine that is
+// not serving a request on this directory.
+func (n *Inode) RmAllChildren() {
+	for {
+		chs := n.Children()
+		if len(chs) == 0 {
+			return
+		}
+		for nm, ch := range chs {
+			ch.RmAllChildren()
+			if ok, _ := n.RmChild(nm); !ok {
+				continue
+			}
+			n.NotifyDelete(nm, ch)
+			if len(ch.Parents()) == 0 {
+				ch.removeRef(0, true)
+			}
+		}
+	}
+}
+
+// MvChild executes a rename: the child at `old` is detached from n
+// and attached to newParent as `newName`, keeping its identity.
+// Other names of a hard-linked child are not affected. If overwrite
+// is set, a child at the destination will be overwritten, should it
+// exist; otherwise MvChild returns false if the destination exists.
+// If `old` is not known, the destination entry is only removed.
+//
+// The bridge calls this when Rename succeeds, so file systems only
+// need it for changes made outside of a Rename call.
 func (n *Inode) MvChild(old string, newParent *Inode, newName string, overwrite bool) bool {
 	if len(newName) == 0 {
 		log.Panicf("empty newName for MvChild")
@@ -528,6 +1141,11 @@ retry:
 		if destChild != nil && !overwrite {
 			return false
 		}
+		if destChild == oldChild && destChild != nil {
+			// Both names are links to the same node, and
+			// rename(2) leaves them in place.
+			return true
+		}
 
 		lockNodes(n, newParent, oldChild, destChild)
 		if counter2 != newParent.changeCounter || counter1 != n.changeCounter {
@@ -537,7 +1155,7 @@ retry:
 
 		if oldChild != nil {
 			delete(n.children, old)
-			delete(oldChild.parents, parentData{old, n})
+			oldChild.parents.delete(parentData{old, n})
 			n.changeCounter++
 			oldChild.changeCounter++
 		}
@@ -546,7 +1164,7 @@ retry:
 			// This can cause the child to be slated for
 			// removal; see below
 			delete(newParent.children, newName)
-			delete(destChild.parents, parentData{newName, newParent})
+			destChild.parents.delete(parentData{newName, newParent})
 			destChild.changeCounter++
 			newParent.changeCounter++
 		}
@@ -555,7 +1173,7 @@ retry:
 			newParent.children[newName] = oldChild
 			newParent.changeCounter++
 
-			oldChild.parents[parentData{newName, newParent}] = struct{}{}
+			oldChild.parents.add(parentData{newName, newParent})
 			oldChild.changeCounter++
 		}
 
@@ -569,7 +1187,11 @@ retry:
 }
 
 // ExchangeChild swaps the entries at (n, oldName) and (newParent,
-// newName).
+// newName). Both Inodes keep their identity; only the names under
+// which they are reachable change. If one of the entries does not
+// exist, the other is moved. The bridge calls this when Rename with
+// RENAME_EXCHANGE succeeds, so file systems only need it for changes
+// made outside of a Rename call.
 func (n *Inode) ExchangeChild(oldName string, newParent *Inode, newName string) {
 	oldParent := n
 retry:
@@ -595,14 +1217,14 @@ retry:
 		// Detach
 		if oldChild != nil {
 			delete(oldParent.children, oldName)
-			delete(oldChild.parents, parentData{oldName, oldParent})
+			oldChild.parents.delete(parentData{oldName, oldParent})
 			oldParent.changeCounter++
 			oldChild.changeCounter++
 		}
 
 		if destChild != nil {
 			delete(newParent.children, newName)
-			delete(destChild.parents, parentData{newName, newParent})
+			destChild.parents.delete(parentData{newName, newParent})
 			destChild.changeCounter++
 			newParent.changeCounter++
 		}
@@ -612,15 +1234,15 @@ retry:
 			newParent.children[newName] = oldChild
 			newParent.changeCounter++
 
-			oldChild.parents[parentData{newName, newParent}] = struct{}{}
+			oldChild.parents.add(parentData{newName, newParent})
 			oldChild.changeCounter++
 		}
 
 		if destChild != nil {
-			oldParent.children[oldName] = oldChild
+			oldParent.children[oldName] = destChild
 			oldParent.changeCounter++
 
-			destChild.parents[parentData{oldName, oldParent}] = struct{}{}
+			destChild.parents.add(parentData{oldName, oldParent})
 			destChild.changeCounter++
 		}
 		unlockNodes(oldParent, newParent, oldChild, destChild)
@@ -630,35 +1252,169 @@ retry:
 
 // NotifyEntry notifies the kernel that data for a (directory, name)
 // tuple should be invalidated. On next access, a LOOKUP operation
-// will be started.
+// will be started. The notify methods may be called from any
+// goroutine; they return ENOSYS if the file system is not served,
+// or if the kernel does not support the notification.
 func (n *Inode) NotifyEntry(name string) syscall.Errno {
-	status := n.bridge.server.EntryNotify(n.nodeAttr.Ino, name)
-	return syscall.Errno(status)
+	if c, ok := n.ops.(cacheInvalidator); ok {
+		c.invalidateEntry(name)
+	}
+	server := n.bridge.Server()
+	if server == nil {
+		return syscall.ENOSYS
+	}
+	return syscall.Errno(server.EntryNotify(n.nodeAttr.Ino, name))
 }
 
 // NotifyDelete notifies the kernel that the given inode was removed
 // from this directory as entry under the given name. It is equivalent
-// to NotifyEntry, but also sends an event to inotify watchers.
+// to NotifyEntry, but also sends an event to inotify watchers. If
+// child is nil, only the entry is invalidated.
 func (n *Inode) NotifyDelete(name string, child *Inode) syscall.Errno {
-	// XXX arg ordering?
-	return syscall.Errno(n.bridge.server.DeleteNotify(n.nodeAttr.Ino, child.nodeAttr.Ino, name))
+	if c, ok := n.ops.(cacheInvalidator); ok {
+		c.invalidateEntry(name)
+	}
+	server := n.bridge.Server()
+	if server == nil {
+		return syscall.ENOSYS
+	}
+	if child == nil {
+		return syscall.Errno(server.EntryNotify(n.nodeAttr.Ino, name))
+	}
+	return syscall.Errno(server.DeleteNotify(n.nodeAttr.Ino, child.nodeAttr.Ino, name))
+}
+
+// NotifyPoll wakes up processes polling this inode, so they poll
+// for the ready events again.
+func (n *Inode) NotifyPoll() syscall.Errno {
+	server := n.bridge.Server()
+	if server == nil {
+		return syscall.ENOSYS
+	}
 
+	n.mu.Lock()
+	khs := n.pollHandles
+	n.pollHandles = nil
+	n.mu.Unlock()
+
+	var errno syscall.Errno
+	for kh := range khs {
+		if e := syscall.Errno(server.PollWakeupNotify(kh)); e != 0 {
+			errno = e
+		}
+	}
+	return errno
 }
 
 // NotifyContent notifies the kernel that content under the given
 // inode should be flushed from buffers.
 func (n *Inode) NotifyContent(off, sz int64) syscall.Errno {
 	// XXX how does this work for directories?
-	return syscall.Errno(n.bridge.server.InodeNotify(n.nodeAttr.Ino, off, sz))
+	n.dropLinkTarget()
+	n.clearStaticAttr()
+	if c, ok := n.ops.(cacheInvalidator); ok {
+		c.invalidateContent()
+	}
+	server := n.bridge.Server()
+	if server == nil {
+		return syscall.ENOSYS
+	}
+	return syscall.Errno(server.InodeNotify(n.nodeAttr.Ino, off, sz))
+}
+
+// NotifyAttr notifies the kernel that the attributes of this inode
+// changed, so the next stat(2) calls Getattr. Unlike NotifyContent,
+// it leaves the page cache alone.
+func (n *Inode) NotifyAttr() syscall.Errno {
+	n.clearStaticAttr()
+	server := n.bridge.Server()
+	if server == nil {
+		return syscall.ENOSYS
+	}
+	// A negative offset invalidates the attributes only.
+	return syscall.Errno(server.InodeNotify(n.nodeAttr.Ino, -1, 0))
+}
+
+// DropCaches drops everything that is cached for this inode: the
+// kernel's attributes and page cache, the cached symlink target, and
+// NotifyStore data that was not yet delivered. The next access
+// reaches the file system, so this is a coarse way to switch a file
+// that turned out to be shared to uncached behavior; opens that
+// should stay uncached must also return fuse.FOPEN_DIRECT_IO. The
+// kernel waits for pages under I/O, so it should not be called from
+// Read or Write on the same file.
+func (n *Inode) DropCaches() syscall.Errno {
+	n.mu.Lock()
+	n.pendingStores = nil
+	n.mu.Unlock()
+
+	// A nonnegative offset invalidates the attributes along with
+	// the content; length 0 extends to the end of the file.
+	return n.NotifyContent(0, 0)
+}
+
+// dropLinkTarget forgets the cached symlink target.
+func (n *Inode) dropLinkTarget() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.linkTarget = nil
+	n.linkExpiry = time.Time{}
 }
 
 // WriteCache stores data in the kernel cache.
 func (n *Inode) WriteCache(offset int64, data []byte) syscall.Errno {
-	return syscall.Errno(n.bridge.server.InodeNotifyStoreCache(n.nodeAttr.Ino, offset, data))
+	server := n.bridge.Server()
+	if server == nil {
+		return syscall.ENOSYS
+	}
+	return syscall.Errno(server.InodeNotifyStoreCache(n.nodeAttr.Ino, offset, data))
+}
+
+// NotifyStore stores data in the kernel's page cache for this node,
+// so reads of it are answered without calling Read. Unlike
+// WriteCache, it may be called for a node that the kernel does not
+// know yet, eg. from Lookup or Create: the data is then kept, and
+// sent right after the reply that introduces the node to the
+// kernel. Data for a node that is never returned to the kernel is
+// kept until the node is dropped or DropCaches is called. As the
+// kernel drops the cached pages of a file when it is opened, Open
+// should return fuse.FOPEN_KEEP_CACHE for the stored data to be
+// used.
+func (n *Inode) NotifyStore(off int64, data []byte) syscall.Errno {
+	if n.bridge.Server() == nil {
+		return syscall.ENOSYS
+	}
+	n.mu.Lock()
+	if n.lookupCount == 0 && n.nodeAttr.Ino != fuse.FUSE_ROOT_ID {
+		n.pendingStores = append(n.pendingStores, pendingStore{off, append([]byte(nil), data...)})
+		n.mu.Unlock()
+		return OK
+	}
+	n.mu.Unlock()
+	return n.WriteCache(off, data)
 }
 
 // ReadCache reads data from the kernel cache.
 func (n *Inode) ReadCache(offset int64, dest []byte) (count int, errno syscall.Errno) {
-	c, s := n.bridge.server.InodeRetrieveCache(n.nodeAttr.Ino, offset, dest)
+	server := n.bridge.Server()
+	if server == nil {
+		return 0, syscall.ENOSYS
+	}
+	c, s := server.InodeRetrieveCache(n.nodeAttr.Ino, offset, dest)
 	return c, syscall.Errno(s)
 }
+
+// RetrieveContent returns up to `size` bytes that the kernel holds in
+// its page cache for this node, starting at `off`, eg. to check
+// what writeback will flush. The kernel only returns pages that are
+// cached, so the result ends at the first missing page, or at the
+// file size. It is ReadCache with a buffer of its own, and gives up
+// with ETIMEDOUT if the kernel does not answer in time.
+func (n *Inode) RetrieveContent(off int64, size int) ([]byte, syscall.Errno) {
+	buf := make([]byte, size)
+	c, errno := n.ReadCache(off, buf)
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:c], OK
+}
@@ -0,0 +1,857 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+func TestInodePath(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	rootIno := root.Inode()
+	dir := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 2, Mode: fuse.S_IFDIR})
+	rootIno.AddChild("dir", dir, false)
+	file := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 3})
+	dir.AddChild("zz", file, false)
+	dir.AddChild("aa", file, false)
+
+	if got := rootIno.Path(nil); got != "" {
+		t.Errorf("root: got %q, want empty", got)
+	}
+	if got, want := file.Path(nil), "dir/aa"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := file.Path(dir), "aa"; got != want {
+		t.Errorf("relative: got %q, want %q", got, want)
+	}
+
+	dir.RmChild("aa", "zz")
+	if got, want := file.Path(nil), ".deleted"; got != want {
+		t.Errorf("unlinked: got %q, want %q", got, want)
+	}
+}
+
+func TestNotifyUnmounted(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	ch := root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 2})
+	root.Inode().AddChild("file", ch, false)
+
+	if errno := root.Inode().NotifyEntry("file"); errno != syscall.ENOSYS {
+		t.Errorf("NotifyEntry: got %v, want ENOSYS", errno)
+	}
+	if errno := root.Inode().NotifyDelete("file", ch); errno != syscall.ENOSYS {
+		t.Errorf("NotifyDelete: got %v, want ENOSYS", errno)
+	}
+}
+
+type forgetNode struct {
+	OperationStubs
+	forgets int
+}
+
+func (n *forgetNode) OnForget() {
+	n.forgets++
+}
+
+type forgetRoot struct {
+	OperationStubs
+	child *forgetNode
+}
+
+func (r *forgetRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if name == "persistent" {
+		return r.OperationStubs.Lookup(ctx, name, out)
+	}
+	if r.child == nil {
+		r.child = &forgetNode{}
+	}
+	return r.Inode().NewInode(ctx, r.child, NodeAttr{Ino: 2}), OK
+}
+
+func TestOnForget(t *testing.T) {
+	root := &forgetRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	persistent := &forgetNode{}
+	root.Inode().AddChild("persistent",
+		root.Inode().NewPersistentInode(context.Background(), persistent, NodeAttr{Ino: 3}), false)
+
+	var out fuse.EntryOut
+	for _, nm := range []string{"file", "persistent"} {
+		for i := 0; i < 2; i++ {
+			if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, nm, &out); !st.Ok() {
+				t.Fatalf("Lookup(%s): %v", nm, st)
+			}
+		}
+	}
+
+	rawFS.Forget(2, 1)
+	if root.child.forgets != 0 {
+		t.Fatalf("OnForget called with remaining kernel references")
+	}
+	rawFS.Forget(2, 1)
+	if root.child.forgets != 1 {
+		t.Errorf("got %d OnForget calls, want 1", root.child.forgets)
+	}
+	if root.Inode().GetChild("file") != nil {
+		t.Errorf("forgotten node still in tree")
+	}
+
+	rawFS.Forget(3, 2)
+	if persistent.forgets != 0 {
+		t.Errorf("OnForget called for persistent node")
+	}
+}
+
+func TestPin(t *testing.T) {
+	root := &forgetRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	ch := root.Inode().GetChild("file")
+	ch.Pin()
+	ch.Pin()
+
+	rawFS.Forget(2, 1)
+	if root.child.forgets != 0 || root.Inode().GetChild("file") != ch {
+		t.Fatalf("pinned node was dropped")
+	}
+	if ch.Forgotten() {
+		t.Errorf("pinned node is Forgotten")
+	}
+
+	ch.Unpin()
+	if root.child.forgets != 0 || root.Inode().GetChild("file") != ch {
+		t.Fatalf("node dropped with a remaining pin")
+	}
+	ch.Unpin()
+	if root.child.forgets != 1 {
+		t.Errorf("got %d OnForget calls after Unpin, want 1", root.child.forgets)
+	}
+	if root.Inode().GetChild("file") != nil {
+		t.Errorf("unpinned node still in tree")
+	}
+}
+
+// reuseRoot hands out the same inode number for every name, like a
+// backing file system that recycles the number of a deleted file. It
+// bumps the generation on every delete.
+type reuseRoot struct {
+	OperationStubs
+	gen uint64
+}
+
+func (r *reuseRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return r.Inode().NewInode(ctx, &OperationStubs{}, NodeAttr{Ino: 7, Gen: r.gen}), OK
+}
+
+func (r *reuseRoot) Unlink(ctx context.Context, name string) syscall.Errno {
+	r.gen++
+	return OK
+}
+
+func TestInoReuseGeneration(t *testing.T) {
+	root := &reuseRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+	hdr := &fuse.InHeader{NodeId: 1}
+
+	var first fuse.EntryOut
+	if st := rawFS.Lookup(nil, hdr, "old", &first); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if st := rawFS.Unlink(nil, hdr, "old"); !st.Ok() {
+		t.Fatalf("Unlink: %v", st)
+	}
+	rawFS.Forget(7, 1)
+
+	var second fuse.EntryOut
+	if st := rawFS.Lookup(nil, hdr, "new", &second); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if second.NodeId != first.NodeId {
+		t.Fatalf("got ino %d, want reused ino %d", second.NodeId, first.NodeId)
+	}
+	if second.Generation == first.Generation {
+		t.Errorf("reused ino %d has the same generation %d", second.NodeId, second.Generation)
+	}
+	if got := root.Inode().GetChild("new").NodeAttr().Gen; got != second.Generation {
+		t.Errorf("NodeAttr: got gen %d, want %d", got, second.Generation)
+	}
+
+	// Looking up the live node again keeps its generation.
+	var again fuse.EntryOut
+	rawFS.Lookup(nil, hdr, "new", &again)
+	if again.Generation != second.Generation {
+		t.Errorf("live node: got gen %d, want %d", again.Generation, second.Generation)
+	}
+
+	// So does looking up the same object after a FORGET.
+	rawFS.Forget(7, 2)
+	var forgotten fuse.EntryOut
+	rawFS.Lookup(nil, hdr, "new", &forgotten)
+	if forgotten.Generation != second.Generation {
+		t.Errorf("after FORGET: got gen %d, want %d", forgotten.Generation, second.Generation)
+	}
+}
+
+func TestForEachChild(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	for i, nm := range []string{"a", "b", "c"} {
+		root.Inode().AddChild(nm,
+			root.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: uint64(i + 2)}), false)
+	}
+
+	got := map[string]uint64{}
+	root.Inode().ForEachChild(func(name string, ch *Inode) bool {
+		got[name] = ch.NodeAttr().Ino
+		return true
+	})
+	if len(got) != 3 || got["a"] != 2 || got["b"] != 3 || got["c"] != 4 {
+		t.Errorf("got children %v", got)
+	}
+
+	calls := 0
+	root.Inode().ForEachChild(func(name string, ch *Inode) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("got %d calls after stopping, want 1", calls)
+	}
+
+	ds, errno := root.Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	n := 0
+	for ds.HasNext() {
+		if _, errno := ds.Next(); errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("got %d entries, want 3", n)
+	}
+}
+
+func TestInodeOps(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	dir := &MemDir{}
+	ch := root.Inode().NewPersistentChild(context.Background(), "dir", dir, NodeAttr{Mode: fuse.S_IFDIR})
+	if got, ok := InodeOps[*MemDir](ch); !ok || got != dir {
+		t.Errorf("InodeOps[*MemDir]: got %v, %v", got, ok)
+	}
+	if got, ok := InodeOps[MutableDirOperations](ch); !ok || got != dir {
+		t.Errorf("InodeOps[MutableDirOperations]: got %v, %v", got, ok)
+	}
+	if got, ok := InodeOps[*MemRegularFile](ch); ok || got != nil {
+		t.Errorf("InodeOps[*MemRegularFile]: got %v, %v", got, ok)
+	}
+	if _, ok := InodeOps[*MemDir](nil); ok {
+		t.Errorf("InodeOps on nil Inode succeeded")
+	}
+
+	if got := MustInodeOps[*MemDir](ch); got != dir {
+		t.Errorf("MustInodeOps: got %v", got)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("MustInodeOps with the wrong type did not panic")
+			}
+		}()
+		MustInodeOps[*MemSymlink](ch)
+	}()
+}
+
+func TestWalkTree(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	rootIno := root.Inode()
+	dir1 := rootIno.NewPersistentChild(ctx, "dir1", &OperationStubs{}, NodeAttr{Mode: fuse.S_IFDIR})
+	dir2 := rootIno.NewPersistentChild(ctx, "dir2", &OperationStubs{}, NodeAttr{Mode: fuse.S_IFDIR})
+	sub := dir1.NewPersistentChild(ctx, "sub", &OperationStubs{}, NodeAttr{Mode: fuse.S_IFDIR})
+	file := dir1.NewPersistentChild(ctx, "file", &OperationStubs{}, NodeAttr{})
+	dir2.AddChild("link", file, false)
+	sub.NewPersistentChild(ctx, "x", &OperationStubs{}, NodeAttr{})
+
+	var paths []string
+	visits := map[*Inode]int{}
+	rootIno.WalkTree(func(path string, ino *Inode) {
+		// Read-only methods must not deadlock.
+		if got := ino.Path(nil); got != path {
+			t.Errorf("got Path %q, want %q", got, path)
+		}
+		ino.Children()
+		paths = append(paths, path)
+		visits[ino]++
+	})
+
+	want := []string{"", "dir1", "dir1/file", "dir1/sub", "dir1/sub/x", "dir2"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got paths %q, want %q", paths, want)
+	}
+	for ino, n := range visits {
+		if n != 1 {
+			t.Errorf("%q visited %d times", ino.Path(nil), n)
+		}
+	}
+
+	paths = nil
+	dir1.WalkTree(func(path string, ino *Inode) {
+		paths = append(paths, path)
+	})
+	if want := []string{"", "file", "sub", "sub/x"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("from dir1: got paths %q, want %q", paths, want)
+	}
+}
+
+func TestServerCapsUnmounted(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+	if caps := root.Inode().ServerCaps(); caps != 0 {
+		t.Errorf("got caps 0x%x before mounting", caps)
+	}
+}
+
+func TestServer(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	if srv := root.Inode().Server(); srv != nil {
+		t.Errorf("got server %p before mounting", srv)
+	}
+
+	srv := &fuse.Server{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		root.Inode().Server()
+	}()
+	rawFS.Init(srv)
+	<-done
+	if got := root.Inode().Server(); got != srv {
+		t.Errorf("got server %p, want %p", got, srv)
+	}
+}
+
+func TestNewPersistentChild(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+
+	dir := root.Inode().NewPersistentChild(ctx, "dir", &OperationStubs{}, NodeAttr{Mode: fuse.S_IFDIR})
+	file := dir.NewChild(ctx, "file", &OperationStubs{}, NodeAttr{})
+	if got := root.Inode().GetChild("dir"); got != dir {
+		t.Fatalf("got %v, want %v", got, dir)
+	}
+	if got := dir.GetChild("file"); got != file {
+		t.Fatalf("got %v, want %v", got, file)
+	}
+
+	var out fuse.EntryOut
+	for _, step := range []struct {
+		parent uint64
+		name   string
+	}{{1, "dir"}, {dir.NodeAttr().Ino, "file"}} {
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: step.parent}, step.name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%s): %v", step.name, st)
+		}
+	}
+	rawFS.Forget(file.NodeAttr().Ino, 1)
+	rawFS.Forget(dir.NodeAttr().Ino, 1)
+
+	if dir.GetChild("file") != nil {
+		t.Errorf("non-persistent child survived forget")
+	}
+	if root.Inode().GetChild("dir") != dir {
+		t.Errorf("persistent child dropped on forget")
+	}
+}
+
+func TestRmAllChildren(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+
+	dir := root.Inode().NewPersistentChild(ctx, "dir", &OperationStubs{}, NodeAttr{Ino: 2, Mode: fuse.S_IFDIR})
+	sub := dir.NewPersistentChild(ctx, "sub", &OperationStubs{}, NodeAttr{Ino: 3, Mode: fuse.S_IFDIR})
+	leaf := &forgetNode{}
+	sub.NewPersistentChild(ctx, "leaf", leaf, NodeAttr{Ino: 4})
+	dir.NewPersistentChild(ctx, "file", &OperationStubs{}, NodeAttr{Ino: 5})
+
+	// The kernel holds a reference to "dir".
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "dir", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+
+	root.Inode().RmAllChildren()
+
+	for _, n := range []*Inode{root.Inode(), dir, sub} {
+		if chs := n.Children(); len(chs) != 0 {
+			t.Errorf("node %d has children %v", n.NodeAttr().Ino, chs)
+		}
+	}
+	if leaf.forgets != 1 {
+		t.Errorf("got %d OnForget calls for the leaf, want 1", leaf.forgets)
+	}
+
+	b := rawFS.(*rawBridge)
+	b.mu.Lock()
+	known := len(b.nodes)
+	b.mu.Unlock()
+	if known != 2 {
+		t.Errorf("got %d known nodes, want root and dir", known)
+	}
+
+	rawFS.Forget(2, 1)
+	b.mu.Lock()
+	known = len(b.nodes)
+	b.mu.Unlock()
+	if known != 1 {
+		t.Errorf("got %d known nodes after forget, want 1", known)
+	}
+}
+
+func TestInodeTypePredicates(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	type preds struct {
+		dir, regular, symlink, device bool
+	}
+	for _, tc := range []struct {
+		mode uint32
+		want preds
+	}{
+		{fuse.S_IFDIR, preds{dir: true}},
+		{0, preds{regular: true}},
+		{fuse.S_IFREG, preds{regular: true}},
+		{fuse.S_IFLNK, preds{symlink: true}},
+		{syscall.S_IFCHR, preds{device: true}},
+		{syscall.S_IFBLK, preds{device: true}},
+		{syscall.S_IFIFO, preds{}},
+		{syscall.S_IFSOCK, preds{}},
+	} {
+		n := root.Inode().NewInode(context.Background(), &OperationStubs{}, NodeAttr{Mode: tc.mode | 0644})
+		got := preds{n.IsDir(), n.IsRegular(), n.IsSymlink(), n.IsDevice()}
+		if got != tc.want {
+			t.Errorf("mode %o: got %+v, want %+v", tc.mode, got, tc.want)
+		}
+	}
+	if !root.Inode().IsDir() {
+		t.Errorf("root is not a directory")
+	}
+}
+
+func TestMvChild(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	rootIno := root.Inode()
+	newNode := func(ino uint64, mode uint32) *Inode {
+		return rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: ino, Mode: mode})
+	}
+	dir1 := newNode(2, fuse.S_IFDIR)
+	dir2 := newNode(3, fuse.S_IFDIR)
+	file := newNode(4, fuse.S_IFREG)
+	other := newNode(5, fuse.S_IFREG)
+	rootIno.AddChild("dir1", dir1, false)
+	rootIno.AddChild("dir2", dir2, false)
+	dir1.AddChild("file", file, false)
+	dir1.AddChild("link", file, false)
+	dir2.AddChild("other", other, false)
+
+	// Across directories; the hard link stays.
+	if !dir1.MvChild("file", dir2, "moved", false) {
+		t.Fatalf("MvChild to new name failed")
+	}
+	if dir1.GetChild("file") != nil || dir2.GetChild("moved") != file {
+		t.Errorf("got children %v and %v", dir1.Children(), dir2.Children())
+	}
+	if got := file.Parents(); len(got) != 2 || got["link"] != dir1 || got["moved"] != dir2 {
+		t.Errorf("got parents %v", got)
+	}
+
+	if dir2.MvChild("moved", dir2, "other", false) {
+		t.Errorf("MvChild without overwrite replaced the destination")
+	}
+	if dir2.GetChild("moved") != file || dir2.GetChild("other") != other {
+		t.Errorf("failed MvChild changed the tree: %v", dir2.Children())
+	}
+
+	if !dir2.MvChild("moved", dir2, "other", true) {
+		t.Fatalf("MvChild with overwrite failed")
+	}
+	if got := dir2.Children(); len(got) != 1 || got["other"] != file {
+		t.Errorf("got children %v, want only other", got)
+	}
+	if len(other.Parents()) != 0 {
+		t.Errorf("overwritten node still has parents %v", other.Parents())
+	}
+
+	// Renaming one hard link onto another is a no-op.
+	if !dir1.MvChild("link", dir2, "other", true) {
+		t.Fatalf("MvChild between hard links failed")
+	}
+	if dir1.GetChild("link") != file || dir2.GetChild("other") != file {
+		t.Errorf("got children %v and %v", dir1.Children(), dir2.Children())
+	}
+}
+
+func TestNlink(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	rootIno := root.Inode()
+	newNode := func(ino uint64, mode uint32) *Inode {
+		return rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: ino, Mode: mode})
+	}
+	dir1 := newNode(2, fuse.S_IFDIR)
+	dir2 := newNode(3, fuse.S_IFDIR)
+	file := newNode(4, fuse.S_IFREG)
+	rootIno.AddChild("dir1", dir1, false)
+	rootIno.AddChild("dir2", dir2, false)
+	dir1.AddChild("file", file, false)
+	dir2.AddChild("link", file, false)
+
+	nlink := func(ino uint64) uint32 {
+		var out fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: ino}}, &out); !st.Ok() {
+			t.Fatalf("GetAttr(%d): %v", ino, st)
+		}
+		return out.Nlink
+	}
+	if got := nlink(4); got != 2 {
+		t.Errorf("file: got Nlink %d, want 2", got)
+	}
+	if got := nlink(1); got != 4 {
+		t.Errorf("root: got Nlink %d, want 4", got)
+	}
+	if got := nlink(2); got != 2 {
+		t.Errorf("dir1: got Nlink %d, want 2", got)
+	}
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 2}, "file", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if out.Nlink != 2 {
+		t.Errorf("Lookup: got Nlink %d, want 2", out.Nlink)
+	}
+
+	dir2.RmChild("link")
+	if got := nlink(4); got != 1 {
+		t.Errorf("after RmChild: got Nlink %d, want 1", got)
+	}
+}
+
+type addCountNode struct {
+	OperationStubs
+	adds *int32
+}
+
+func (n *addCountNode) OnAdd(ctx context.Context) {
+	atomic.AddInt32(n.adds, 1)
+}
+
+func TestGetOrAddChild(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	var adds, creates int32
+	const N = 100
+	children := make(chan *Inode, N)
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, created := root.Inode().GetOrAddChild(ctx, "file", &addCountNode{adds: &adds}, NodeAttr{}, false)
+			if created {
+				atomic.AddInt32(&creates, 1)
+			}
+			children <- ch
+		}()
+	}
+	wg.Wait()
+	close(children)
+
+	if creates != 1 || adds != 1 {
+		t.Errorf("got %d creates, %d OnAdd calls, want 1 each", creates, adds)
+	}
+	want := root.Inode().GetChild("file")
+	for ch := range children {
+		if ch != want {
+			t.Fatalf("got child %v, want %v", ch, want)
+		}
+	}
+	if got := want.Parents(); len(got) != 1 || got["file"] != root.Inode() {
+		t.Errorf("got parents %v", got)
+	}
+}
+
+func TestAddChildren(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	rootIno := root.Inode()
+
+	a := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 2})
+	b := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 3})
+	if !rootIno.AddChildren(map[string]*Inode{"a": a, "b": b, "link": b}, false) {
+		t.Fatalf("AddChildren failed")
+	}
+	if got := b.Parents(); len(got) != 2 || got["b"] != rootIno || got["link"] != rootIno {
+		t.Errorf("got parents %v", got)
+	}
+
+	c := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 4})
+	if rootIno.AddChildren(map[string]*Inode{"a": c, "c": c}, false) {
+		t.Errorf("AddChildren replaced an existing child")
+	}
+	if len(rootIno.Children()) != 3 || len(c.Parents()) != 0 {
+		t.Errorf("failed AddChildren changed the tree: %v", rootIno.Children())
+	}
+
+	if !rootIno.AddChildren(map[string]*Inode{"a": c, "c": c}, true) {
+		t.Fatalf("AddChildren with overwrite failed")
+	}
+	if rootIno.GetChild("a") != c || rootIno.GetChild("c") != c || len(a.Parents()) != 0 {
+		t.Errorf("got children %v, parents of a %v", rootIno.Children(), a.Parents())
+	}
+}
+
+func benchmarkAddChildren(b *testing.B, bulk bool) {
+	const n = 1000
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%d", i)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		root := &OperationStubs{}
+		NewNodeFS(root, &Options{})
+		ctx := context.Background()
+		children := make(map[string]*Inode, n)
+		for j, nm := range names {
+			children[nm] = root.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: uint64(j + 2)})
+		}
+		b.StartTimer()
+
+		if bulk {
+			root.Inode().AddChildren(children, false)
+		} else {
+			for nm, ch := range children {
+				root.Inode().AddChild(nm, ch, false)
+			}
+		}
+	}
+}
+
+func BenchmarkAddChild(b *testing.B) {
+	benchmarkAddChildren(b, false)
+}
+
+func BenchmarkAddChildren(b *testing.B) {
+	benchmarkAddChildren(b, true)
+}
+
+func TestSingleParentLink(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{SingleParent: true})
+	root.Inode().NewPersistentChild(context.Background(), "file", &OperationStubs{}, NodeAttr{Ino: 2})
+
+	var out fuse.EntryOut
+	in := &fuse.LinkIn{InHeader: fuse.InHeader{NodeId: 1}, Oldnodeid: 2}
+	if st := rawFS.Link(nil, in, "link", &out); st != fuse.Status(syscall.EMLINK) {
+		t.Errorf("got %v, want EMLINK", st)
+	}
+	if ch := root.Inode().GetChild("link"); ch != nil {
+		t.Errorf("link was added to the tree")
+	}
+}
+
+func BenchmarkNewChild(b *testing.B) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		root.Inode().NewChild(ctx, "file", &OperationStubs{}, NodeAttr{})
+	}
+}
+
+var parentsSink interface{}
+
+// BenchmarkParentLinks compares the inline parent link of
+// inodeParents with the map that each Inode used to allocate.
+func BenchmarkParentLinks(b *testing.B) {
+	p := parentData{name: "file", parent: &Inode{}}
+	b.Run("inline", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n := &struct{ parents inodeParents }{}
+			n.parents.add(p)
+			parentsSink = n
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n := &struct{ parents map[parentData]struct{} }{
+				parents: make(map[parentData]struct{}),
+			}
+			n.parents[p] = struct{}{}
+			parentsSink = n
+		}
+	})
+}
+
+func TestAddChildNotify(t *testing.T) {
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	hour := time.Hour
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+		EntryTimeout:    &hour,
+		AttrTimeout:     &hour,
+		NegativeTimeout: &hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	// Have the kernel cache the listing and the missing name.
+	if got := readDirNames(t, mntDir); len(got) != 0 {
+		t.Fatalf("got %v, want empty directory", got)
+	}
+	if _, err := os.Lstat(mntDir + "/file"); !os.IsNotExist(err) {
+		t.Fatalf("Lstat: got %v, want ENOENT", err)
+	}
+
+	errc := make(chan syscall.Errno, 1)
+	go func() {
+		ch := root.Inode().NewInode(context.Background(), &MemRegularFile{Data: []byte("hello")}, NodeAttr{})
+		errc <- root.Inode().AddChildNotify("file", ch, true)
+	}()
+	if errno := <-errc; errno != 0 {
+		t.Fatalf("AddChildNotify: %v", errno)
+	}
+
+	if got, want := readDirNames(t, mntDir), []string{"file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Lstat(mntDir + "/file"); err != nil {
+		t.Errorf("Lstat: %v", err)
+	}
+}
+
+func TestParent(t *testing.T) {
+	root := &OperationStubs{}
+	NewNodeFS(root, &Options{})
+
+	ctx := context.Background()
+	rootIno := root.Inode()
+	if name, p := rootIno.Parent(); p != nil || name != "" {
+		t.Errorf("root: got %q, %p, want no parent", name, p)
+	}
+
+	dir := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 2, Mode: fuse.S_IFDIR})
+	rootIno.AddChild("dir", dir, false)
+	if name, p := dir.Parent(); p != rootIno || name != "dir" {
+		t.Errorf("dir: got %q, %p, want \"dir\", %p", name, p, rootIno)
+	}
+
+	// Hard links: the smallest remaining name wins, whatever the
+	// map order, and Path agrees.
+	file := rootIno.NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 3})
+	for _, nm := range []string{"m", "z", "a", "q", "b"} {
+		dir.AddChild(nm, file, false)
+	}
+	for i, nm := range []string{"a", "b", "m", "q", "z"} {
+		if name, p := file.Parent(); p != dir || name != nm {
+			t.Fatalf("link %d: got %q, %p, want %q, %p", i, name, p, nm, dir)
+		}
+		if got, want := file.Path(nil), "dir/"+nm; got != want {
+			t.Errorf("link %d: got path %q, want %q", i, got, want)
+		}
+		dir.RmChild(nm)
+	}
+	if name, p := file.Parent(); p != nil {
+		t.Errorf("unlinked: got %q, %p, want no parent", name, p)
+	}
+}
+
+func TestLookupCount(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	ch := root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 2})
+	root.Inode().AddChild("file", ch, false)
+
+	if got := ch.LookupCount(); got != 0 {
+		t.Errorf("before lookup: got %d, want 0", got)
+	}
+	var out fuse.EntryOut
+	for i := 0; i < 2; i++ {
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !st.Ok() {
+			t.Fatalf("Lookup: %v", st)
+		}
+	}
+	if got := ch.LookupCount(); got != 2 {
+		t.Errorf("after lookups: got %d, want 2", got)
+	}
+
+	rawFS.Forget(2, 1)
+	if got := ch.LookupCount(); got != 1 {
+		t.Errorf("after forget: got %d, want 1", got)
+	}
+	want := "i2 mode=0100000 persistent=true lookups=1 pins=0 children=0 parents=1"
+	if got := ch.DebugString(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	rawFS.Forget(2, 1)
+	if got := ch.LookupCount(); got != 0 {
+		t.Errorf("after last forget: got %d, want 0", got)
+	}
+}
@@ -82,3 +82,41 @@ func TestInterrupt(t *testing.T) {
 		t.Errorf("open request was not interrupted")
 	}
 }
+
+type blockingReadOps struct {
+	OperationStubs
+	started chan struct{}
+	errno   syscall.Errno
+}
+
+func (o *blockingReadOps) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	close(o.started)
+	<-ctx.Done()
+	if ctx.Err() != context.Canceled {
+		return nil, syscall.EIO
+	}
+	return nil, o.errno
+}
+
+func TestReadInterrupt(t *testing.T) {
+	// Operations may return EINTR themselves, or whatever error
+	// the abort caused.
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.ECONNRESET} {
+		root := &blockingReadOps{
+			started: make(chan struct{}),
+			errno:   errno,
+		}
+		rawFS := NewNodeFS(root, &Options{})
+
+		cancel := make(chan struct{})
+		go func() {
+			<-root.started
+			close(cancel)
+		}()
+
+		_, st := rawFS.Read(cancel, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}}, make([]byte, 10))
+		if st != fuse.EINTR {
+			t.Errorf("%v: got %v, want EINTR", errno, st)
+		}
+	}
+}
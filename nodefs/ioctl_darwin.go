@@ -0,0 +1,26 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+// Directions for ioctl command numbers, see <sys/ioccom.h>.
+const (
+	_IOC_OUT = 0x40000000
+	_IOC_IN  = 0x80000000
+
+	_IOCPARM_MASK = 0x1fff
+)
+
+// ioctlSizes returns the sizes of the input and output data encoded
+// in an ioctl command number.
+func ioctlSizes(cmd uint32) (in, out uint32) {
+	size := (cmd >> 16) & _IOCPARM_MASK
+	if cmd&_IOC_IN != 0 {
+		in = size
+	}
+	if cmd&_IOC_OUT != 0 {
+		out = size
+	}
+	return in, out
+}
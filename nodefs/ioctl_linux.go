@@ -0,0 +1,25 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+// Directions for ioctl command numbers, see <asm-generic/ioctl.h>.
+const (
+	_IOC_WRITE = 1
+	_IOC_READ  = 2
+)
+
+// ioctlSizes returns the sizes of the input and output data encoded
+// in an ioctl command number.
+func ioctlSizes(cmd uint32) (in, out uint32) {
+	size := (cmd >> 16) & (1<<14 - 1)
+	dir := cmd >> 30
+	if dir&_IOC_WRITE != 0 {
+		in = size
+	}
+	if dir&_IOC_READ != 0 {
+		out = size
+	}
+	return in, out
+}
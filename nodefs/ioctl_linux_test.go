@@ -0,0 +1,92 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// _IOWR('f', 1, 8 bytes)
+const testIoctlCmd = (_IOC_READ|_IOC_WRITE)<<30 | 8<<16 | 'f'<<8 | 1
+
+type ioctlNode struct {
+	OperationStubs
+}
+
+func (n *ioctlNode) Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, in []byte, out []byte) (int32, syscall.Errno) {
+	if cmd != testIoctlCmd {
+		return 0, syscall.ENOTTY
+	}
+	for i := range in {
+		out[len(in)-1-i] = in[i]
+	}
+	return 7, OK
+}
+
+func TestIoctl(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().AddChild("dev",
+		root.Inode().NewPersistentInode(context.Background(), &ioctlNode{}, NodeAttr{Ino: 2}), false)
+	root.Inode().AddChild("plain",
+		root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 3}), false)
+
+	in := &fuse.IoctlIn{
+		InHeader: fuse.InHeader{NodeId: 2},
+		Cmd:      testIoctlCmd,
+		InSize:   8,
+		OutSize:  8,
+	}
+	var out fuse.IoctlOut
+	data, st := rawFS.(fuse.RawIoctlHandler).Ioctl(nil, in, []byte("12345678"), &out, make([]byte, 8))
+	if !st.Ok() {
+		t.Fatalf("Ioctl: %v", st)
+	}
+	if want := []byte("87654321"); !bytes.Equal(data, want) || out.Result != 7 {
+		t.Errorf("got %q result %d, want %q result 7", data, out.Result, want)
+	}
+
+	in.NodeId = 3
+	if _, st := rawFS.(fuse.RawIoctlHandler).Ioctl(nil, in, []byte("12345678"), &out, make([]byte, 8)); st != fuse.Status(syscall.ENOTTY) {
+		t.Errorf("got %v, want ENOTTY", st)
+	}
+}
+
+func TestIoctlUnrestrictedRetry(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().AddChild("dev",
+		root.Inode().NewPersistentInode(context.Background(), &ioctlNode{}, NodeAttr{Ino: 2}), false)
+
+	in := &fuse.IoctlIn{
+		InHeader: fuse.InHeader{NodeId: 2},
+		Cmd:      testIoctlCmd,
+		Arg:      0x1000,
+		Flags:    fuse.FUSE_IOCTL_UNRESTRICTED,
+	}
+	var out fuse.IoctlOut
+	data, st := rawFS.(fuse.RawIoctlHandler).Ioctl(nil, in, nil, &out, nil)
+	if !st.Ok() {
+		t.Fatalf("Ioctl: %v", st)
+	}
+	if out.Flags&fuse.FUSE_IOCTL_RETRY == 0 || out.InIovs != 1 || out.OutIovs != 1 {
+		t.Fatalf("got %#v, want retry with 1+1 iovecs", out)
+	}
+	if len(data) != 2*int(unsafe.Sizeof(fuse.IoctlIovec{})) {
+		t.Fatalf("got %d bytes of iovecs", len(data))
+	}
+	iov := (*[2]fuse.IoctlIovec)(unsafe.Pointer(&data[0]))
+	for _, v := range iov {
+		if v.Base != 0x1000 || v.Len != 8 {
+			t.Errorf("got iovec %#v", v)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+func TestLoopbackFlock(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	hdr := fuse.InHeader{NodeId: entryOut.NodeId}
+
+	// Two opens of the file, as by two processes; for flock, the
+	// kernel uses the open file as the owner.
+	var fhs [2]uint64
+	for i := range fhs {
+		var openOut fuse.OpenOut
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr, Flags: syscall.O_RDWR}, &openOut); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+		fhs[i] = openOut.Fh
+	}
+	flock := func(i int, typ uint32) fuse.Status {
+		return rawFS.SetLk(nil, &fuse.LkIn{
+			InHeader: hdr,
+			Fh:       fhs[i],
+			Owner:    uint64(100 + i),
+			Lk:       fuse.FileLock{End: math.MaxInt64, Typ: typ},
+			LkFlags:  fuse.FUSE_LK_FLOCK,
+		})
+	}
+
+	if st := flock(0, syscall.F_RDLCK); !st.Ok() {
+		t.Fatalf("LOCK_SH 0: %v", st)
+	}
+	if st := flock(1, syscall.F_RDLCK); !st.Ok() {
+		t.Fatalf("LOCK_SH 1: %v", st)
+	}
+	if st := flock(1, syscall.F_WRLCK); st != fuse.Status(syscall.EWOULDBLOCK) {
+		t.Errorf("LOCK_EX while shared: got %v, want EWOULDBLOCK", st)
+	}
+
+	// Closing the first file drops its lock.
+	rawFS.Release(nil, &fuse.ReleaseIn{
+		InHeader:     hdr,
+		Fh:           fhs[0],
+		ReleaseFlags: fuse.RELEASE_FLOCK_UNLOCK,
+		LockOwner:    100,
+	})
+	if st := flock(1, syscall.F_WRLCK); !st.Ok() {
+		t.Errorf("LOCK_EX after release: %v", st)
+	}
+}
+
+type flockRecorder struct {
+	OperationStubs
+	unlocks []uint64
+}
+
+func (f *flockRecorder) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, OK
+}
+
+func (f *flockRecorder) Setlk(ctx context.Context, fh FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if flags&fuse.FUSE_LK_FLOCK != 0 && lk.Typ == syscall.F_UNLCK {
+		f.unlocks = append(f.unlocks, owner)
+	}
+	return OK
+}
+
+func TestReleaseFlockUnlock(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	file := &flockRecorder{}
+	root.Inode().NewPersistentChild(context.Background(), "file", file, NodeAttr{Ino: 2})
+
+	hdr := fuse.InHeader{NodeId: 2}
+	for _, flags := range []uint32{0, fuse.RELEASE_FLOCK_UNLOCK} {
+		var openOut fuse.OpenOut
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr}, &openOut); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+		rawFS.Release(nil, &fuse.ReleaseIn{InHeader: hdr, Fh: openOut.Fh, ReleaseFlags: flags, LockOwner: 42})
+	}
+	if len(file.unlocks) != 1 || file.unlocks[0] != 42 {
+		t.Errorf("got flock unlocks for %v, want [42]", file.unlocks)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+type loggedOp struct {
+	ino   uint64
+	dur   time.Duration
+	errno syscall.Errno
+}
+
+func TestLogger(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	origDir := dir + "/orig"
+	mntDir := dir + "/mnt"
+	if err := os.Mkdir(origDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mntDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	ops := map[string][]loggedOp{}
+	opts := &Options{
+		Logger: func(op string, ino uint64, dur time.Duration, errno syscall.Errno) {
+			mu.Lock()
+			defer mu.Unlock()
+			ops[op] = append(ops[op], loggedOp{ino, dur, errno})
+		},
+	}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	fn := mntDir + "/file"
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chmod(fn, 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if _, err := ioutil.ReadFile(fn); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if _, err := ioutil.ReadDir(mntDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if _, err := os.Lstat(mntDir + "/missing"); !os.IsNotExist(err) {
+		t.Fatalf("Lstat: got %v, want ENOENT", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, op := range []string{"Lookup", "Getattr", "Setattr", "Open", "Read", "Write"} {
+		if len(ops[op]) == 0 {
+			t.Errorf("no %s logged", op)
+		}
+	}
+	if len(ops["Readdir"])+len(ops["ReaddirPlus"]) == 0 {
+		t.Errorf("no Readdir logged")
+	}
+
+	var enoent bool
+	for op, l := range ops {
+		for _, o := range l {
+			if o.ino == 0 {
+				t.Errorf("%s: got ino 0", op)
+			}
+			if o.dur < 0 {
+				t.Errorf("%s: got negative duration %v", op, o.dur)
+			}
+			if op == "Lookup" && o.ino == 1 && o.errno == syscall.ENOENT {
+				enoent = true
+			}
+		}
+	}
+	if !enoent {
+		t.Errorf("failed Lookup not logged: %v", ops["Lookup"])
+	}
+}
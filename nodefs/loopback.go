@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -19,6 +20,28 @@ type loopbackRoot struct {
 
 	rootPath string
 	rootDev  uint64
+	opts     LoopbackOptions
+}
+
+// LoopbackOptions holds options for the loopback file system.
+type LoopbackOptions struct {
+	// ReadOnly makes all operations that would modify the
+	// backing directory fail with EROFS.
+	ReadOnly bool
+
+	// RelativeSymlinks rewrites absolute symlink targets inside
+	// the backing directory into relative ones, so they resolve
+	// within the mount instead of leaking the backing path. It
+	// applies to links read with Readlink, and to links created
+	// with Symlink.
+	RelativeSymlinks bool
+
+	// NoEscapingSymlinks makes Readlink and Symlink fail with
+	// EACCES for links whose target is outside the backing
+	// directory, eg. when the mount is used as a sandbox.
+	// Targets are resolved lexically, without following the
+	// symlinks along the way.
+	NoEscapingSymlinks bool
 }
 
 func (n *loopbackNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
@@ -50,6 +73,11 @@ func (n *loopbackNode) root() *loopbackRoot {
 	return n.Inode().Root().Operations().(*loopbackRoot)
 }
 
+// readOnly returns whether mutations should be refused.
+func (n *loopbackNode) readOnly() bool {
+	return n.root().opts.ReadOnly
+}
+
 func (n *loopbackNode) path() string {
 	path := n.Inode().Path(nil)
 	return filepath.Join(n.root().rootPath, path)
@@ -71,6 +99,9 @@ func (n *loopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryO
 }
 
 func (n *loopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if n.readOnly() {
+		return nil, syscall.EROFS
+	}
 	p := filepath.Join(n.path(), name)
 	err := syscall.Mknod(p, mode, int(rdev))
 	if err != nil {
@@ -91,6 +122,9 @@ func (n *loopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32
 }
 
 func (n *loopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if n.readOnly() {
+		return nil, syscall.EROFS
+	}
 	p := filepath.Join(n.path(), name)
 	err := os.Mkdir(p, os.FileMode(mode))
 	if err != nil {
@@ -111,12 +145,18 @@ func (n *loopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out
 }
 
 func (n *loopbackNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if n.readOnly() {
+		return syscall.EROFS
+	}
 	p := filepath.Join(n.path(), name)
 	err := syscall.Rmdir(p)
 	return ToErrno(err)
 }
 
 func (n *loopbackNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if n.readOnly() {
+		return syscall.EROFS
+	}
 	p := filepath.Join(n.path(), name)
 	err := syscall.Unlink(p)
 	return ToErrno(err)
@@ -129,7 +169,14 @@ func toLoopbackNode(op Operations) *loopbackNode {
 	return op.(*loopbackNode)
 }
 
+func (n *loopbackNode) RenameFlags() uint32 {
+	return RENAME_NOREPLACE | RENAME_EXCHANGE
+}
+
 func (n *loopbackNode) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	if n.readOnly() {
+		return syscall.EROFS
+	}
 	newParentLoopback := toLoopbackNode(newParent)
 	if flags&RENAME_EXCHANGE != 0 {
 		return n.renameExchange(name, newParentLoopback, newName)
@@ -162,6 +209,9 @@ func (r *loopbackRoot) idFromStat(st *syscall.Stat_t) NodeAttr {
 }
 
 func (n *loopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.readOnly() {
+		return nil, nil, 0, syscall.EROFS
+	}
 	p := filepath.Join(n.path(), name)
 
 	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
@@ -181,8 +231,50 @@ func (n *loopbackNode) Create(ctx context.Context, name string, flags uint32, mo
 	return ch, lf, 0, 0
 }
 
+// symlinkTarget applies the symlink options to `target`, the target
+// of a link at backing path `linkPath`.
+func (r *loopbackRoot) symlinkTarget(linkPath, target string) (string, syscall.Errno) {
+	if !r.opts.RelativeSymlinks && !r.opts.NoEscapingSymlinks {
+		return target, OK
+	}
+	root, err := filepath.Abs(r.rootPath)
+	if err != nil {
+		return "", ToErrno(err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(linkPath))
+	if err != nil {
+		return "", ToErrno(err)
+	}
+
+	abs := target
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(dir, abs)
+	}
+	abs = filepath.Clean(abs)
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		if r.opts.NoEscapingSymlinks {
+			return "", syscall.EACCES
+		}
+		return target, OK
+	}
+	if r.opts.RelativeSymlinks && filepath.IsAbs(target) {
+		if rel, err := filepath.Rel(dir, abs); err == nil {
+			return rel, OK
+		}
+	}
+	return target, OK
+}
+
 func (n *loopbackNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if n.readOnly() {
+		return nil, syscall.EROFS
+	}
 	p := filepath.Join(n.path(), name)
+	target, errno := n.root().symlinkTarget(p, target)
+	if errno != 0 {
+		return nil, errno
+	}
 	err := syscall.Symlink(target, p)
 	if err != nil {
 		return nil, ToErrno(err)
@@ -200,6 +292,9 @@ func (n *loopbackNode) Symlink(ctx context.Context, target, name string, out *fu
 }
 
 func (n *loopbackNode) Link(ctx context.Context, target Operations, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if n.readOnly() {
+		return nil, syscall.EROFS
+	}
 
 	p := filepath.Join(n.path(), name)
 	targetNode := toLoopbackNode(target)
@@ -230,12 +325,19 @@ func (n *loopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 		}
 
 		if sz < len(buf) {
-			return buf[:sz], 0
+			target, errno := n.root().symlinkTarget(p, string(buf[:sz]))
+			if errno != 0 {
+				return nil, errno
+			}
+			return []byte(target), 0
 		}
 	}
 }
 
 func (n *loopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.readOnly() && (flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0) {
+		return nil, 0, syscall.EROFS
+	}
 	p := n.path()
 	f, err := syscall.Open(p, int(flags), 0)
 	if err != nil {
@@ -258,6 +360,91 @@ func (n *loopbackNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
 	return NewLoopbackDirStream(n.path())
 }
 
+func (n *loopbackNode) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
+	fd, err := syscall.Open(n.path(), syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		return ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return ToErrno(syscall.Fsync(fd))
+}
+
+func (n *loopbackNode) Fsetattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if n.readOnly() {
+		return syscall.EROFS
+	}
+	return n.OperationStubs.Fsetattr(ctx, f, in, out)
+}
+
+// Setattr changes the backing file by path. The kernel issues it
+// without a file handle, eg. for utimensat(2) or truncate(2) on a file
+// that is not open.
+func (n *loopbackNode) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if n.readOnly() {
+		return syscall.EROFS
+	}
+	p := n.path()
+	if mode, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, mode); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	uid32, uOk := in.GetUID()
+	gid32, gOk := in.GetGID()
+	if uOk || gOk {
+		uid := -1
+		gid := -1
+		if uOk {
+			uid = int(uid32)
+		}
+		if gOk {
+			gid = int(gid32)
+		}
+		if err := syscall.Lchown(p, uid, gid); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	if in.Valid&(fuse.FATTR_ATIME|fuse.FATTR_MTIME) != 0 {
+		if errno := n.setTimes(in); errno != 0 {
+			return errno
+		}
+	}
+
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
+			return ToErrno(err)
+		}
+	}
+	return n.Fgetattr(ctx, nil, out)
+}
+
+func (n *loopbackNode) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	if n.readOnly() {
+		return 0, syscall.EROFS
+	}
+	if f == nil {
+		// A flush from the writeback cache that names no
+		// handle.
+		fd, err := syscall.Open(n.path(), syscall.O_WRONLY, 0)
+		if err != nil {
+			return 0, ToErrno(err)
+		}
+		defer syscall.Close(fd)
+		w, err := pwrite(fd, data, off)
+		return uint32(w), ToErrno(err)
+	}
+	return n.OperationStubs.Write(ctx, f, data, off)
+}
+
+func (n *loopbackNode) Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	if n.readOnly() {
+		return syscall.EROFS
+	}
+	return n.OperationStubs.Allocate(ctx, f, off, size, mode)
+}
+
 func (n *loopbackNode) Fgetattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
 	if f != nil {
 		return f.Getattr(ctx, out)
@@ -278,6 +465,12 @@ func (n *loopbackNode) Fgetattr(ctx context.Context, f FileHandle, out *fuse.Att
 // NewLoopback returns a root node for a loopback file system whose
 // root is at the given root.
 func NewLoopbackRoot(root string) (DirOperations, error) {
+	return NewLoopbackRootOpts(root, nil)
+}
+
+// NewLoopbackRootOpts is like NewLoopbackRoot, but takes options. A
+// nil options pointer selects the defaults.
+func NewLoopbackRootOpts(root string, opts *LoopbackOptions) (DirOperations, error) {
 	var st syscall.Stat_t
 	err := syscall.Stat(root, &st)
 	if err != nil {
@@ -288,5 +481,8 @@ func NewLoopbackRoot(root string) (DirOperations, error) {
 		rootPath: root,
 		rootDev:  uint64(st.Dev),
 	}
+	if opts != nil {
+		n.opts = *opts
+	}
 	return n, nil
 }
@@ -35,6 +35,9 @@ func (n *loopbackNode) renameExchange(name string, newparent *loopbackNode, newN
 }
 
 func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	if errno := f.flushBuffer(); errno != 0 {
+		return errno
+	}
 	// TODO: Handle `mode` parameter.
 
 	// From `man fcntl` on OSX:
@@ -99,7 +102,7 @@ func timeToTimeval(t *time.Time) syscall.Timeval {
 func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	var attr fuse.AttrOut
 	if a == nil || m == nil {
-		errno := f.GetAttr(context.Background(), &attr)
+		errno := f.Getattr(context.Background(), &attr)
 		if errno != 0 {
 			return errno
 		}
@@ -108,3 +111,31 @@ func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	err := syscall.Futimes(int(f.fd), tv)
 	return ToErrno(err)
 }
+
+// setTimesArgs converts the timestamps in `in` for utimens.
+func setTimesArgs(in *fuse.SetAttrIn) (a *time.Time, m *time.Time) {
+	if atime, ok := in.GetATime(); ok {
+		a = &atime
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		m = &mtime
+	}
+	return a, m
+}
+
+func (f *loopbackFile) setTimes(in *fuse.SetAttrIn) syscall.Errno {
+	return f.utimens(setTimesArgs(in))
+}
+
+// setTimes is the path based version of loopbackFile.setTimes.
+func (n *loopbackNode) setTimes(in *fuse.SetAttrIn) syscall.Errno {
+	a, m := setTimesArgs(in)
+	var attr fuse.AttrOut
+	if a == nil || m == nil {
+		if errno := n.Fgetattr(context.Background(), nil, &attr); errno != 0 {
+			return errno
+		}
+	}
+	tv := utimens.Fill(a, m, &attr.Attr)
+	return ToErrno(syscall.Utimes(n.path(), tv))
+}
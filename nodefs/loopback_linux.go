@@ -8,26 +8,45 @@ import (
 	"context"
 	"syscall"
 
+	"github.com/hanwen/go-fuse/fuse"
 	"golang.org/x/sys/unix"
 )
 
+// setTimes applies the timestamps of `in` to the backing file by
+// path.
+func (n *loopbackNode) setTimes(in *fuse.SetAttrIn) syscall.Errno {
+	ts := utimeSpecs(in)
+	return ToErrno(utimensat(n.path(), &ts))
+}
+
+// The xattr methods operate on the backing path without following
+// symlinks, and pass all namespaces through, so eg.
+// security.capability on the backing file is honored for executables
+// in the mount.
+
 func (n *loopbackNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	sz, err := syscall.Getxattr(n.path(), attr, dest)
+	sz, err := unix.Lgetxattr(n.path(), attr, dest)
 	return uint32(sz), ToErrno(err)
 }
 
 func (n *loopbackNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
-	err := syscall.Setxattr(n.path(), attr, data, int(flags))
+	if n.readOnly() {
+		return syscall.EROFS
+	}
+	err := unix.Lsetxattr(n.path(), attr, data, int(flags))
 	return ToErrno(err)
 }
 
 func (n *loopbackNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
-	err := syscall.Removexattr(n.path(), attr)
+	if n.readOnly() {
+		return syscall.EROFS
+	}
+	err := unix.Lremovexattr(n.path(), attr)
 	return ToErrno(err)
 }
 
 func (n *loopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	sz, err := syscall.Listxattr(n.path(), dest)
+	sz, err := unix.Llistxattr(n.path(), dest)
 	return uint32(sz), ToErrno(err)
 }
 
@@ -65,20 +84,38 @@ func (n *loopbackNode) renameExchange(name string, newparent *loopbackNode, newN
 	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE))
 }
 
+// CopyFileRange copies between the backing files with
+// copy_file_range(2), so the backing file system can clone or copy
+// server-side. If either side is not a loopback file, it returns
+// ENOSYS; the kernel then stops sending COPY_FILE_RANGE for this
+// mount, and copies through reads and writes.
 func (n *loopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
+	if n.readOnly() {
+		return 0, syscall.EROFS
+	}
 	lfIn, ok := fhIn.(*loopbackFile)
 	if !ok {
-		return 0, syscall.ENOTSUP
+		return 0, syscall.ENOSYS
 	}
 	lfOut, ok := fhOut.(*loopbackFile)
 	if !ok {
-		return 0, syscall.ENOTSUP
+		return 0, syscall.ENOSYS
+	}
+
+	if errno := lfIn.flushBuffer(); errno != 0 {
+		return 0, errno
+	}
+	if errno := lfOut.flushBuffer(); errno != 0 {
+		return 0, errno
 	}
 
 	signedOffIn := int64(offIn)
 	signedOffOut := int64(offOut)
 	count, err := unix.CopyFileRange(lfIn.fd, &signedOffIn, lfOut.fd, &signedOffOut, int(len), int(flags))
-	return uint32(count), ToErrno(err)
+	if err != nil {
+		return 0, ToErrno(err)
+	}
+	return uint32(count), OK
 }
@@ -6,12 +6,15 @@ package nodefs
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"syscall"
 	"testing"
 
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
 	"github.com/kylelemons/godebug/pretty"
 	"golang.org/x/sys/unix"
 )
@@ -136,6 +139,88 @@ func TestXAttr(t *testing.T) {
 	}
 }
 
+func TestXAttrCapability(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("setting security.capability needs root")
+	}
+	tc := newTestCase(t, true, true)
+	defer tc.Clean()
+
+	tc.writeOrig("file", "", 0755)
+
+	// VFS_CAP_REVISION_2 with CAP_NET_BIND_SERVICE permitted and
+	// effective.
+	const attr = "security.capability"
+	value := []byte{
+		1, 0, 0, 2,
+		0, 4, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	if err := unix.Setxattr(tc.origDir+"/file", attr, value, 0); err != nil {
+		t.Skipf("Setxattr on backing file: %v", err)
+	}
+
+	fn := tc.mntDir + "/file"
+	sz, err := unix.Getxattr(fn, attr, nil)
+	if err != nil || sz != len(value) {
+		t.Fatalf("size probe: got %d, %v, want %d", sz, err, len(value))
+	}
+	if _, err := unix.Getxattr(fn, attr, make([]byte, 1)); err != syscall.ERANGE {
+		t.Errorf("short buffer: got %v, want ERANGE", err)
+	}
+
+	buf := make([]byte, sz)
+	if sz, err := unix.Getxattr(fn, attr, buf); err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	} else if !bytes.Equal(buf[:sz], value) {
+		t.Errorf("got %v, want %v", buf[:sz], value)
+	}
+
+	names := make([]byte, 1024)
+	sz, err = unix.Listxattr(fn, names)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	if !bytes.Contains(names[:sz], []byte(attr+"\x00")) {
+		t.Errorf("Listxattr got %q, want %s", names[:sz], attr)
+	}
+
+	if err := unix.Removexattr(fn, attr); err != nil {
+		t.Fatalf("Removexattr: %v", err)
+	}
+	if _, err := unix.Getxattr(tc.origDir+"/file", attr, buf); err != syscall.ENODATA {
+		t.Errorf("backing file: got %v, want ENODATA", err)
+	}
+}
+
+func TestXAttrFlags(t *testing.T) {
+	tc := newTestCase(t, true, true)
+	defer tc.Clean()
+
+	tc.writeOrig("file", "", 0644)
+	fn := tc.mntDir + "/file"
+	attr := "user.xattrtest"
+	if err := unix.Setxattr(fn, attr, []byte("v1"), unix.XATTR_REPLACE); err == syscall.ENOTSUP {
+		t.Skip("$TMP does not support xattrs. Rerun this test with a $TMPDIR override")
+	} else if err != syscall.ENODATA {
+		t.Errorf("XATTR_REPLACE of missing attribute: got %v, want ENODATA", err)
+	}
+	if err := unix.Setxattr(fn, attr, []byte("v1"), unix.XATTR_CREATE); err != nil {
+		t.Fatalf("XATTR_CREATE: %v", err)
+	}
+	if err := unix.Setxattr(fn, attr, []byte("v2"), unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Errorf("XATTR_CREATE of existing attribute: got %v, want EEXIST", err)
+	}
+	if err := unix.Setxattr(fn, attr, []byte("v3"), unix.XATTR_REPLACE); err != nil {
+		t.Errorf("XATTR_REPLACE: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	if sz, err := unix.Getxattr(tc.origDir+"/file", attr, buf); err != nil || string(buf[:sz]) != "v3" {
+		t.Errorf("got %q, %v, want \"v3\"", buf[:sz], err)
+	}
+}
+
 func TestCopyFileRange(t *testing.T) {
 	tc := newTestCase(t, true, true)
 	defer tc.Clean()
@@ -194,3 +279,209 @@ func TestCopyFileRange(t *testing.T) {
 	}
 
 }
+
+func TestLoopbackLseek(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	// A file with a hole of 1M followed by data.
+	fn := dir + "/sparse"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "sparse", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	// Whether holes are reported depends on the backing file
+	// system, so compare against lseek on the backing file.
+	for _, tc := range []struct {
+		off    int64
+		whence int
+	}{
+		{0, _SEEK_DATA},
+		{0, _SEEK_HOLE},
+		{1 << 20, _SEEK_HOLE},
+		{1<<20 + 10, _SEEK_DATA},
+	} {
+		want, wantErr := unix.Seek(int(f.Fd()), tc.off, tc.whence)
+
+		var out fuse.LseekOut
+		st := rawFS.Lseek(nil, &fuse.LseekIn{
+			InHeader: fuse.InHeader{NodeId: entryOut.NodeId},
+			Fh:       openOut.Fh,
+			Offset:   uint64(tc.off),
+			Whence:   uint32(tc.whence),
+		}, &out)
+		if wantErr != nil {
+			if st != fuse.ToStatus(wantErr) {
+				t.Errorf("lseek(%d, %d): got %v, want %v", tc.off, tc.whence, st, wantErr)
+			}
+			continue
+		}
+		if !st.Ok() || out.Offset != uint64(want) {
+			t.Errorf("lseek(%d, %d): got %d (%v), want %d", tc.off, tc.whence, out.Offset, st, want)
+		}
+	}
+
+	var out fuse.LseekOut
+	if st := rawFS.Lseek(nil, &fuse.LseekIn{
+		InHeader: fuse.InHeader{NodeId: entryOut.NodeId},
+		Fh:       openOut.Fh,
+		Offset:   1<<20 + 10,
+		Whence:   _SEEK_DATA,
+	}, &out); st != fuse.Status(syscall.ENXIO) {
+		t.Errorf("SEEK_DATA beyond EOF: got %v, want ENXIO", st)
+	}
+}
+
+func TestLoopbackLseekMount(t *testing.T) {
+	tc := newTestCase(t, true, true)
+	defer tc.Clean()
+
+	orig, err := os.Create(tc.origDir + "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	if _, err := orig.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(tc.mntDir + "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, whence := range []int{_SEEK_DATA, _SEEK_HOLE} {
+		want, _ := unix.Seek(int(orig.Fd()), 0, whence)
+		got, err := unix.Seek(int(f.Fd()), 0, whence)
+		if err != nil || got != want {
+			t.Errorf("lseek(0, %d): got %d, %v, want %d", whence, got, err, want)
+		}
+	}
+}
+
+func TestLoopbackCopyFileRange(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/src", []byte("01234567890123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/dst", []byte("abcdefghijabcdefghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	open := func(name string, flags uint32) (uint64, uint64) {
+		var entryOut fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entryOut); !st.Ok() {
+			t.Fatalf("Lookup(%s): %v", name, st)
+		}
+		var openOut fuse.OpenOut
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}, Flags: flags}, &openOut); !st.Ok() {
+			t.Fatalf("Open(%s): %v", name, st)
+		}
+		return entryOut.NodeId, openOut.Fh
+	}
+	srcIno, srcFh := open("src", syscall.O_RDONLY)
+	dstIno, dstFh := open("dst", syscall.O_RDWR)
+
+	sz, st := rawFS.CopyFileRange(nil, &fuse.CopyFileRangeIn{
+		InHeader:  fuse.InHeader{NodeId: srcIno},
+		FhIn:      srcFh,
+		OffIn:     5,
+		NodeIdOut: dstIno,
+		FhOut:     dstFh,
+		OffOut:    7,
+		Len:       3,
+	})
+	if !st.Ok() || sz != 3 {
+		t.Fatalf("CopyFileRange: %d, %v", sz, st)
+	}
+
+	c, err := ioutil.ReadFile(dir + "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(c), "abcdefg567abcdefghij"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLoopbackAllocate(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	fd, err := syscall.Open(dir+"/file", syscall.O_RDWR|syscall.O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	f := NewLoopbackFile(fd)
+	defer f.Release(ctx)
+
+	const size = 1 << 20
+	if errno := f.Allocate(ctx, 0, size, 0); errno != 0 {
+		t.Skipf("Allocate: %v", errno)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != size {
+		t.Errorf("got size %d after preallocating, want %d", st.Size, size)
+	}
+
+	// Some file systems report preallocated blocks as holes, so
+	// fill them first.
+	if _, errno := f.Write(ctx, bytes.Repeat([]byte{'x'}, size), 0); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	if hole, err := unix.Seek(fd, 0, _SEEK_HOLE); err != nil || hole != size {
+		t.Fatalf("SEEK_HOLE before punching: got %d, %v, want %d", hole, err, size)
+	}
+
+	// Without FALLOC_FL_KEEP_SIZE, which fallocate(2) requires.
+	if errno := f.Allocate(ctx, 0, size/2, FALLOC_FL_PUNCH_HOLE); errno == syscall.EOPNOTSUPP {
+		t.Skip("file system does not support punching holes")
+	} else if errno != 0 {
+		t.Fatalf("Allocate(PUNCH_HOLE): %v", errno)
+	}
+	if hole, err := unix.Seek(fd, 0, _SEEK_HOLE); err != nil || hole != 0 {
+		t.Errorf("SEEK_HOLE after punching: got %d, %v, want 0", hole, err)
+	}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != size {
+		t.Errorf("got size %d after punching, want %d", st.Size, size)
+	}
+
+	if errno := f.Allocate(ctx, size, 10, 0xff); errno != syscall.EOPNOTSUPP && errno != syscall.EINVAL {
+		t.Errorf("Allocate(bogus mode): got %v, want EOPNOTSUPP or EINVAL", errno)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+func TestLoopbackReadOnly(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRootOpts(dir, &LoopbackOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if entryOut.Size != 5 {
+		t.Errorf("got size %d, want 5", entryOut.Size)
+	}
+
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}, Flags: syscall.O_RDONLY}, &openOut); !st.Ok() {
+		t.Errorf("Open(O_RDONLY): %v", st)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}, Fh: openOut.Fh})
+
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}, Flags: syscall.O_RDWR}, &openOut); st != fuse.Status(syscall.EROFS) {
+		t.Errorf("Open(O_RDWR): got %v, want EROFS", st)
+	}
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0755}, "dir", &entryOut); st != fuse.Status(syscall.EROFS) {
+		t.Errorf("Mkdir: got %v, want EROFS", st)
+	}
+	if st := rawFS.Unlink(nil, &fuse.InHeader{NodeId: 1}, "file"); st != fuse.Status(syscall.EROFS) {
+		t.Errorf("Unlink: got %v, want EROFS", st)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file")); err != nil {
+		t.Errorf("backing file: %v", err)
+	}
+}
+
+func TestLoopbackSetattrNsec(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	hdr := fuse.InHeader{NodeId: entryOut.NodeId}
+
+	// No FATTR_FH, as for utimensat(2) on a file that is not open.
+	in := &fuse.SetAttrIn{
+		SetAttrInCommon: fuse.SetAttrInCommon{
+			InHeader:  hdr,
+			Valid:     fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+			Atime:     1000000000,
+			Atimensec: 123456789,
+			Mtime:     1500000000,
+			Mtimensec: 123456789,
+		},
+	}
+	var attrOut fuse.AttrOut
+	if st := rawFS.SetAttr(nil, in, &attrOut); !st.Ok() {
+		t.Fatalf("SetAttr: %v", st)
+	}
+	if attrOut.Atime != 1000000000 || attrOut.Atimensec != 123456789 ||
+		attrOut.Mtime != 1500000000 || attrOut.Mtimensec != 123456789 {
+		t.Errorf("SetAttr: got atime %d.%09d mtime %d.%09d", attrOut.Atime, attrOut.Atimensec, attrOut.Mtime, attrOut.Mtimensec)
+	}
+
+	// Only change mtime; atime is omitted and must stay.
+	in.Valid = fuse.FATTR_MTIME
+	in.Mtime = 1600000000
+	in.Mtimensec = 987654321
+	if st := rawFS.SetAttr(nil, in, &attrOut); !st.Ok() {
+		t.Fatalf("SetAttr: %v", st)
+	}
+
+	attrOut = fuse.AttrOut{}
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if attrOut.Atime != 1000000000 || attrOut.Atimensec != 123456789 {
+		t.Errorf("GetAttr: got atime %d.%09d, want 1000000000.123456789", attrOut.Atime, attrOut.Atimensec)
+	}
+	if attrOut.Mtime != 1600000000 || attrOut.Mtimensec != 987654321 {
+		t.Errorf("GetAttr: got mtime %d.%09d, want 1600000000.987654321", attrOut.Mtime, attrOut.Mtimensec)
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.ModTime().UnixNano(); got != 1600000000987654321 {
+		t.Errorf("backing file: got mtime %d", got)
+	}
+}
+
+func TestBufferedLoopbackFile(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "file")
+	fd, err := syscall.Open(fn, syscall.O_RDWR|syscall.O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pwrites int
+	defer func(orig func(int, []byte, int64) (int, error)) { pwrite = orig }(pwrite)
+	pwrite = func(fd int, p []byte, off int64) (int, error) {
+		pwrites++
+		return syscall.Pwrite(fd, p, off)
+	}
+
+	ctx := context.Background()
+	f := NewBufferedLoopbackFile(fd, 64*1024)
+	var want []byte
+	for i := 0; i < 200; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 512)
+		if n, errno := f.Write(ctx, data, int64(len(want))); errno != 0 || n != 512 {
+			t.Fatalf("Write: %d, %v", n, errno)
+		}
+		want = append(want, data...)
+	}
+	if pwrites != 1 {
+		t.Errorf("got %d pwrites for %d bytes, want 1", pwrites, len(want))
+	}
+
+	// Reads through the handle see the buffered data.
+	buf := make([]byte, len(want))
+	res, errno := f.Read(ctx, buf, 0)
+	if errno != 0 {
+		t.Fatalf("Read: %v", errno)
+	}
+	got, _ := res.Bytes(buf)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Read: got %d bytes, want %d", len(got), len(want))
+	}
+
+	// A write elsewhere flushes what was buffered before it.
+	f.Write(ctx, []byte("hello"), 0)
+	f.Write(ctx, []byte("world"), 1024)
+	if pwrites != 3 {
+		t.Errorf("got %d pwrites, want 3", pwrites)
+	}
+	if errno := f.Flush(ctx); errno != 0 {
+		t.Fatalf("Flush: %v", errno)
+	}
+	f.Release(ctx)
+
+	copy(want, "hello")
+	copy(want[1024:], "world")
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, want) {
+		t.Errorf("backing file differs")
+	}
+}
+
+func TestLoopbackSymlinkTargets(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"abs":    filepath.Join(dir, "file"),
+		"rel":    "../file",
+		"escape": "/etc/passwd",
+		"up":     "../../outside",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, "sub", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := NewLoopbackRootOpts(dir, &LoopbackOptions{RelativeSymlinks: true, NoEscapingSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "sub", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup(sub): %v", st)
+	}
+	sub := fuse.InHeader{NodeId: entryOut.NodeId}
+
+	for _, tc := range []struct {
+		name string
+		want string
+		st   fuse.Status
+	}{
+		{"abs", "../file", fuse.OK},
+		{"rel", "../file", fuse.OK},
+		{"escape", "", fuse.Status(syscall.EACCES)},
+		{"up", "", fuse.Status(syscall.EACCES)},
+	} {
+		if st := rawFS.Lookup(nil, &sub, tc.name, &entryOut); !st.Ok() {
+			t.Fatalf("Lookup(%s): %v", tc.name, st)
+		}
+		got, st := rawFS.Readlink(nil, &fuse.InHeader{NodeId: entryOut.NodeId})
+		if st != tc.st || string(got) != tc.want {
+			t.Errorf("Readlink(%s): got %q, %v, want %q, %v", tc.name, got, st, tc.want, tc.st)
+		}
+	}
+
+	if st := rawFS.Symlink(nil, &sub, filepath.Join(dir, "sub", "file"), "new", &entryOut); !st.Ok() {
+		t.Fatalf("Symlink: %v", st)
+	}
+	if got, err := os.Readlink(filepath.Join(dir, "sub", "new")); err != nil || got != "file" {
+		t.Errorf("backing link: got %q, %v, want %q", got, err, "file")
+	}
+	if st := rawFS.Symlink(nil, &sub, "/etc/passwd", "bad", &entryOut); st != fuse.Status(syscall.EACCES) {
+		t.Errorf("Symlink(/etc/passwd): got %v, want EACCES", st)
+	}
+}
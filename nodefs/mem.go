@@ -0,0 +1,413 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// MemDir is a directory whose contents only live in memory. The
+// entries are stored as persistent Inodes in the FS tree, so a MemDir
+// can be used as the root of a scratch file system. New files are
+// MemRegularFile, new symlinks are MemSymlink, and device nodes,
+// FIFOs and sockets are MemSpecialFile.
+type MemDir struct {
+	OperationStubs
+
+	mu   sync.Mutex
+	Attr fuse.Attr
+}
+
+var _ = (MutableDirOperations)((*MemDir)(nil))
+var _ = (RenameFlagsOperations)((*MemDir)(nil))
+
+func (d *MemDir) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out.Attr = d.Attr
+	return OK
+}
+
+func (d *MemDir) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	setMemAttr(&d.Attr, in)
+	out.Attr = d.Attr
+	return OK
+}
+
+// touch updates the modification time, after the directory changed.
+func (d *MemDir) touch() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.Attr.SetTimes(nil, &now, &now)
+}
+
+func (d *MemDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.Inode().GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	ch := &MemDir{}
+	ch.Attr.Mode = mode & 07777
+	now := time.Now()
+	ch.Attr.SetTimes(&now, &now, &now)
+
+	d.touch()
+	out.Attr = ch.Attr
+	out.Mode |= fuse.S_IFDIR
+	return d.Inode().NewPersistentInode(ctx, ch, NodeAttr{Mode: fuse.S_IFDIR}), OK
+}
+
+func (d *MemDir) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		return d.newSpecial(ctx, name, mode, dev, out)
+	default:
+		return nil, syscall.ENOTSUP
+	}
+	ch, errno := d.newFile(ctx, name, mode)
+	if errno != 0 {
+		return nil, errno
+	}
+	out.Attr = ch.Operations().(*MemRegularFile).Attr
+	return ch, OK
+}
+
+func (d *MemDir) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	ch, errno := d.newFile(ctx, name, mode)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	return ch, &memFileHandle{file: ch.Operations().(*MemRegularFile)}, 0, OK
+}
+
+func (d *MemDir) newFile(ctx context.Context, name string, mode uint32) (*Inode, syscall.Errno) {
+	if d.Inode().GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	f := &MemRegularFile{}
+	f.Attr.Mode = mode & 07777
+	now := time.Now()
+	f.Attr.SetTimes(&now, &now, &now)
+
+	d.touch()
+	return d.Inode().NewPersistentInode(ctx, f, NodeAttr{Mode: fuse.S_IFREG}), OK
+}
+
+// newSpecial makes a MemSpecialFile for Mknod.
+func (d *MemDir) newSpecial(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.Inode().GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	f := &MemSpecialFile{}
+	f.Attr.Mode = mode & 07777
+	f.Attr.Rdev = dev
+	now := time.Now()
+	f.Attr.SetTimes(&now, &now, &now)
+
+	d.touch()
+	out.Attr = f.Attr
+	return d.Inode().NewPersistentInode(ctx, f, NodeAttr{Mode: mode &^ 07777, Rdev: dev}), OK
+}
+
+func (d *MemDir) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.Inode().GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	l := &MemSymlink{Data: []byte(target)}
+	l.Attr.Mode = 0777
+	l.Attr.Size = uint64(len(target))
+
+	d.touch()
+	out.Attr = l.Attr
+	return d.Inode().NewPersistentInode(ctx, l, NodeAttr{Mode: fuse.S_IFLNK}), OK
+}
+
+func (d *MemDir) Link(ctx context.Context, target Operations, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.Inode().GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	if target.Inode().Mode() == fuse.S_IFDIR {
+		return nil, syscall.EPERM
+	}
+
+	var a fuse.AttrOut
+	if errno := target.Getattr(ctx, &a); errno != 0 {
+		return nil, errno
+	}
+	d.touch()
+	out.Attr = a.Attr
+	return target.Inode(), OK
+}
+
+func (d *MemDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	ch := d.Inode().GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	d.removeChild(name, ch)
+	return OK
+}
+
+func (d *MemDir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	ch := d.Inode().GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	if ch.Mode() != fuse.S_IFDIR {
+		return syscall.ENOTDIR
+	}
+	if len(ch.Children()) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	d.removeChild(name, ch)
+	return OK
+}
+
+func (d *MemDir) RenameFlags() uint32 {
+	return RENAME_NOREPLACE | RENAME_EXCHANGE
+}
+
+func (d *MemDir) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	ch := d.Inode().GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	newDir, ok := newParent.(*MemDir)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	dest := newDir.Inode().GetChild(newName)
+	if flags&RENAME_EXCHANGE != 0 {
+		if dest == nil {
+			return syscall.ENOENT
+		}
+	} else if dest != nil {
+		if flags&RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		if dest.Mode() != ch.Mode() && (dest.Mode() == fuse.S_IFDIR || ch.Mode() == fuse.S_IFDIR) {
+			if dest.Mode() == fuse.S_IFDIR {
+				return syscall.EISDIR
+			}
+			return syscall.ENOTDIR
+		}
+		if len(dest.Children()) > 0 {
+			return syscall.ENOTEMPTY
+		}
+		newDir.removeChild(newName, dest)
+	}
+
+	d.touch()
+	if newDir != d {
+		newDir.touch()
+	}
+	return OK
+}
+
+// removeChild unlinks `ch` from the tree. Once the last link is
+// gone, the node is no longer kept alive on behalf of this
+// directory.
+func (d *MemDir) removeChild(name string, ch *Inode) {
+	d.Inode().RmChild(name)
+	if len(ch.Parents()) == 0 {
+		ch.ForgetPersistent()
+	}
+	d.touch()
+}
+
+// MemRegularFile is a regular file whose contents are kept in
+// memory.
+type MemRegularFile struct {
+	OperationStubs
+
+	mu   sync.Mutex
+	Data []byte
+	Attr fuse.Attr
+
+	// OpenFlags are the fuse.FOPEN_* flags returned from Open. For
+	// example, fuse.FOPEN_DIRECT_IO makes writes reach the file
+	// synchronously even if the mount uses a write-back cache.
+	OpenFlags uint32
+}
+
+var _ = (FileOperations)((*MemRegularFile)(nil))
+
+func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_TRUNC != 0 {
+		f.mu.Lock()
+		f.truncateLocked(0)
+		f.mu.Unlock()
+	}
+	return &memFileHandle{file: f}, f.OpenFlags, OK
+}
+
+func (f *MemRegularFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Attr = f.Attr
+	out.Size = uint64(len(f.Data))
+	return OK
+}
+
+func (f *MemRegularFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sz, ok := in.GetSize(); ok {
+		f.truncateLocked(sz)
+	}
+	setMemAttr(&f.Attr, in)
+	out.Attr = f.Attr
+	out.Size = uint64(len(f.Data))
+	return OK
+}
+
+func (f *MemRegularFile) truncateLocked(sz uint64) {
+	if sz > uint64(len(f.Data)) {
+		f.Data = append(f.Data, make([]byte, sz-uint64(len(f.Data)))...)
+	} else {
+		f.Data = f.Data[:sz]
+	}
+	now := time.Now()
+	f.Attr.SetTimes(nil, &now, &now)
+}
+
+func (f *MemRegularFile) read(dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.Data)) {
+		return fuse.ReadResultData(nil), OK
+	}
+	return fuse.ReadResultInto(dest, f.Data[off:]), OK
+}
+
+func (f *MemRegularFile) write(data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := off + int64(len(data))
+	if end > int64(len(f.Data)) {
+		f.Data = append(f.Data, make([]byte, end-int64(len(f.Data)))...)
+	}
+	copy(f.Data[off:], data)
+	now := time.Now()
+	f.Attr.SetTimes(nil, &now, &now)
+	return uint32(len(data)), OK
+}
+
+// memFileHandle is the FileHandle for an opened MemRegularFile.
+type memFileHandle struct {
+	FileHandleStubs
+	file *MemRegularFile
+}
+
+func (h *memFileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return h.file.read(dest, off)
+}
+
+func (h *memFileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	return h.file.write(data, off)
+}
+
+func (h *memFileHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return h.file.Getattr(ctx, out)
+}
+
+func (h *memFileHandle) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return h.file.Setattr(ctx, in, out)
+}
+
+func (h *memFileHandle) Flush(ctx context.Context) syscall.Errno {
+	return OK
+}
+
+func (h *memFileHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return OK
+}
+
+func (h *memFileHandle) Release(ctx context.Context) syscall.Errno {
+	return OK
+}
+
+// MemSymlink is a symbolic link whose target is kept in memory.
+type MemSymlink struct {
+	OperationStubs
+
+	Attr fuse.Attr
+	Data []byte
+}
+
+var _ = (SymlinkOperations)((*MemSymlink)(nil))
+
+func (l *MemSymlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return l.Data, OK
+}
+
+func (l *MemSymlink) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = l.Attr
+	return OK
+}
+
+// MemSpecialFile is a device node, FIFO or socket that only lives
+// in memory. The file type and device number are those of its
+// NodeAttr.
+type MemSpecialFile struct {
+	OperationStubs
+
+	mu   sync.Mutex
+	Attr fuse.Attr
+}
+
+func (f *MemSpecialFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Attr = f.Attr
+	return OK
+}
+
+func (f *MemSpecialFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	setMemAttr(&f.Attr, in)
+	out.Attr = f.Attr
+	return OK
+}
+
+// setMemAttr applies the mode, owner and timestamp changes from `in`
+// to `attr`.
+func setMemAttr(attr *fuse.Attr, in *fuse.SetAttrIn) {
+	if m, ok := in.GetMode(); ok {
+		attr.Mode = m & 07777
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok {
+		attr.Owner.Uid = uid
+	}
+	if gok {
+		attr.Owner.Gid = gid
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		var ap, mp *time.Time
+		if aok {
+			ap = &atime
+		}
+		if mok {
+			mp = &mtime
+		}
+		attr.SetTimes(ap, mp, nil)
+	}
+	now := time.Now()
+	attr.SetTimes(nil, nil, &now)
+}
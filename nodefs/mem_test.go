@@ -0,0 +1,429 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestMemDir(t *testing.T) {
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	rawFS := NewNodeFS(root, &Options{})
+
+	var createOut fuse.CreateOut
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDWR, Mode: 0644}, "file", &createOut); !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+	ino := createOut.NodeId
+	hdr := fuse.InHeader{NodeId: ino}
+
+	data := []byte("hello")
+	if n, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: hdr, Fh: createOut.Fh, Offset: 2}, data); !st.Ok() || n != uint32(len(data)) {
+		t.Fatalf("Write: %d, %v", n, st)
+	}
+
+	buf := make([]byte, 100)
+	res, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: hdr, Fh: createOut.Fh, Size: 100}, buf)
+	if !st.Ok() {
+		t.Fatalf("Read: %v", st)
+	}
+	got, _ := res.Bytes(buf)
+	if want := "\x00\x00hello"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var attrOut fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if attrOut.Size != 7 || attrOut.Mode != fuse.S_IFREG|0644 {
+		t.Errorf("got size %d mode %o, want 7 %o", attrOut.Size, attrOut.Mode, fuse.S_IFREG|0644)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: hdr, Fh: createOut.Fh})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0755}, "dir", &entryOut); !st.Ok() {
+		t.Fatalf("Mkdir: %v", st)
+	}
+	dirIno := entryOut.NodeId
+
+	if st := rawFS.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: dirIno}, "file", "moved"); !st.Ok() {
+		t.Fatalf("Rename: %v", st)
+	}
+	if root.Inode().GetChild("file") != nil {
+		t.Errorf("file still present after rename")
+	}
+	if ch := root.Inode().GetChild("dir").GetChild("moved"); ch == nil || ch.NodeAttr().Ino != ino {
+		t.Errorf("rename destination: got %v", ch)
+	}
+
+	if st := rawFS.Rmdir(nil, &fuse.InHeader{NodeId: 1}, "dir"); st != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir non-empty: got %v, want ENOTEMPTY", st)
+	}
+	if st := rawFS.Unlink(nil, &fuse.InHeader{NodeId: dirIno}, "moved"); !st.Ok() {
+		t.Errorf("Unlink: %v", st)
+	}
+	if st := rawFS.Rmdir(nil, &fuse.InHeader{NodeId: 1}, "dir"); !st.Ok() {
+		t.Errorf("Rmdir: %v", st)
+	}
+	if len(root.Inode().Children()) != 0 {
+		t.Errorf("got children %v, want none", root.Inode().Children())
+	}
+}
+
+func TestMemDirRenameExchange(t *testing.T) {
+	root := &MemDir{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var dirOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0755}, "dir", &dirOut); !st.Ok() {
+		t.Fatalf("Mkdir: %v", st)
+	}
+	var out fuse.CreateOut
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0644}, "a", &out); !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Mode: 0644}, "b", &out); !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+
+	dir := root.Inode().GetChild("dir")
+	a := root.Inode().GetChild("a")
+	b := dir.GetChild("b")
+
+	if st := rawFS.Rename(nil, &fuse.RenameIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Newdir:   dirOut.NodeId,
+		Flags:    RENAME_EXCHANGE,
+	}, "a", "b"); !st.Ok() {
+		t.Fatalf("Rename: %v", st)
+	}
+
+	if got := root.Inode().GetChild("a"); got != b {
+		t.Errorf("root/a: got %v, want %v", got, b)
+	}
+	if got := dir.GetChild("b"); got != a {
+		t.Errorf("dir/b: got %v, want %v", got, a)
+	}
+	if name, p := a.Parent(); p != dir || name != "b" {
+		t.Errorf("parent of a: got %q %v", name, p)
+	}
+	if name, p := b.Parent(); p != root.Inode() || name != "a" {
+		t.Errorf("parent of b: got %q %v", name, p)
+	}
+	if len(a.Parents()) != 1 || len(b.Parents()) != 1 {
+		t.Errorf("got parents %v, %v; want one each", a.Parents(), b.Parents())
+	}
+}
+
+type renameCountDir struct {
+	MemDir
+	renames int
+}
+
+func (d *renameCountDir) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	d.renames++
+	if newParent == Operations(d) {
+		newParent = &d.MemDir
+	}
+	return d.MemDir.Rename(ctx, name, newParent, newName, flags)
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	root := &renameCountDir{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var out fuse.CreateOut
+	for _, nm := range []string{"a", "b"} {
+		if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0644}, nm, &out); !st.Ok() {
+			t.Fatalf("Create(%s): %v", nm, st)
+		}
+	}
+	b := root.Inode().GetChild("b")
+
+	in := &fuse.RenameIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Newdir:   1,
+		Flags:    RENAME_NOREPLACE,
+	}
+	if st := rawFS.Rename(nil, in, "a", "b"); st != fuse.Status(syscall.EEXIST) {
+		t.Errorf("Rename over existing: got %v, want EEXIST", st)
+	}
+	if root.renames != 0 {
+		t.Errorf("file system Rename called %d times", root.renames)
+	}
+	if root.Inode().GetChild("b") != b {
+		t.Errorf("destination replaced")
+	}
+
+	if st := rawFS.Rename(nil, in, "a", "c"); !st.Ok() {
+		t.Errorf("Rename to new name: %v", st)
+	}
+	if root.Inode().GetChild("c") == nil || root.Inode().GetChild("a") != nil {
+		t.Errorf("rename not reflected in tree: %v", root.Inode().Children())
+	}
+}
+
+func TestMemSetattrNsec(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().AddChild("file",
+		root.Inode().NewPersistentInode(context.Background(), &MemRegularFile{}, NodeAttr{Ino: 2}), false)
+
+	hdr := fuse.InHeader{NodeId: 2}
+	in := &fuse.SetAttrIn{
+		SetAttrInCommon: fuse.SetAttrInCommon{
+			InHeader:  hdr,
+			Valid:     fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+			Atime:     1000000000,
+			Atimensec: 123456789,
+			Mtime:     1500000000,
+			Mtimensec: 123456789,
+		},
+	}
+	var attrOut fuse.AttrOut
+	if st := rawFS.SetAttr(nil, in, &attrOut); !st.Ok() {
+		t.Fatalf("SetAttr: %v", st)
+	}
+	// The kernel fails the call with EIO if the file type changes.
+	if attrOut.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("SetAttr: got mode %o, want a regular file", attrOut.Mode)
+	}
+
+	attrOut = fuse.AttrOut{}
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr}, &attrOut); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if attrOut.Atime != 1000000000 || attrOut.Atimensec != 123456789 ||
+		attrOut.Mtime != 1500000000 || attrOut.Mtimensec != 123456789 {
+		t.Errorf("got atime %d.%09d mtime %d.%09d", attrOut.Atime, attrOut.Atimensec, attrOut.Mtime, attrOut.Mtimensec)
+	}
+}
+
+// truncFile records how the kernel truncates it on open(O_TRUNC).
+type truncFile struct {
+	MemRegularFile
+
+	mu        sync.Mutex
+	openFlags []uint32
+	setSizes  []uint64
+}
+
+func (f *truncFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	f.mu.Lock()
+	f.openFlags = append(f.openFlags, flags)
+	f.mu.Unlock()
+	return f.MemRegularFile.Open(ctx, flags)
+}
+
+func (f *truncFile) Fsetattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if sz, ok := in.GetSize(); ok {
+		f.mu.Lock()
+		f.setSizes = append(f.setSizes, sz)
+		f.mu.Unlock()
+	}
+	return f.MemRegularFile.Fsetattr(ctx, fh, in, out)
+}
+
+func TestMemOpenTrunc(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		mntDir := testutil.TempDir()
+		defer os.RemoveAll(mntDir)
+
+		root := &MemDir{}
+		root.Attr.Mode = 0755
+		server, err := Mount(mntDir, root, &Options{
+			MountOptions: fuse.MountOptions{
+				Debug:             testutil.VerboseTest(),
+				EnableAtomicTrunc: atomic,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Unmount()
+
+		file := &truncFile{}
+		file.Data = []byte("hello")
+		file.Attr.Mode = 0644
+		root.Inode().AddChild("file", root.Inode().NewPersistentInode(context.Background(), file, NodeAttr{Ino: 2}), false)
+
+		f, err := os.OpenFile(mntDir+"/file", os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		f.Close()
+
+		if got, err := ioutil.ReadFile(mntDir + "/file"); err != nil || len(got) != 0 {
+			t.Errorf("atomic %v: got %q, %v after O_TRUNC, want empty", atomic, got, err)
+		}
+
+		file.mu.Lock()
+		if len(file.openFlags) == 0 {
+			t.Fatalf("atomic %v: no Open", atomic)
+		}
+		gotTrunc := file.openFlags[0]&syscall.O_TRUNC != 0
+		if gotTrunc != atomic {
+			t.Errorf("atomic %v: got O_TRUNC %v in Open", atomic, gotTrunc)
+		}
+		if atomic && len(file.setSizes) != 0 {
+			t.Errorf("atomic: got Setattr sizes %v, want none", file.setSizes)
+		} else if !atomic && (len(file.setSizes) != 1 || file.setSizes[0] != 0) {
+			t.Errorf("got Setattr sizes %v, want [0]", file.setSizes)
+		}
+		file.mu.Unlock()
+	}
+}
+
+func TestMemOpenFlagsWriteThrough(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug:           testutil.VerboseTest(),
+			EnableWriteback: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	ctx := context.Background()
+	log := &MemRegularFile{OpenFlags: fuse.FOPEN_DIRECT_IO}
+	log.Attr.Mode = 0644
+	tmp := &MemRegularFile{OpenFlags: fuse.FOPEN_KEEP_CACHE}
+	tmp.Attr.Mode = 0644
+	root.Inode().AddChild("log", root.Inode().NewPersistentInode(ctx, log, NodeAttr{Ino: 2}), false)
+	root.Inode().AddChild("tmp", root.Inode().NewPersistentInode(ctx, tmp, NodeAttr{Ino: 3}), false)
+
+	data := func(f *MemRegularFile) string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return string(f.Data)
+	}
+
+	for _, name := range []string{"log", "tmp"} {
+		f, err := os.OpenFile(mntDir+"/"+name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write %s: %v", name, err)
+		}
+	}
+
+	// Direct I/O writes through, even with the write-back cache.
+	if got := data(log); got != "hello" {
+		t.Errorf("log: got %q before close, want written through", got)
+	}
+	if root.Inode().ServerCaps()&fuse.CAP_WRITEBACK_CACHE == 0 {
+		t.Log("kernel does not support write-back caching")
+	} else if got := data(tmp); got != "" {
+		t.Errorf("tmp: got %q before flush, want write-back", got)
+	}
+}
+
+// otherBackendDir is a MemDir that MemDir.Rename does not move
+// entries into.
+type otherBackendDir struct {
+	MemDir
+}
+
+func TestRenameEXDEV(t *testing.T) {
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	rawFS := NewNodeFS(root, &Options{})
+	other := &otherBackendDir{}
+	other.Attr.Mode = 0755
+	root.Inode().NewPersistentChild(context.Background(), "other", other, NodeAttr{Mode: fuse.S_IFDIR, Ino: 10})
+
+	var createOut fuse.CreateOut
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDWR, Mode: 0644}, "file", &createOut); !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: createOut.NodeId}, Fh: createOut.Fh})
+
+	in := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 10}
+	if st := rawFS.Rename(nil, in, "file", "moved"); st != fuse.Status(syscall.EXDEV) {
+		t.Fatalf("Rename: got %v, want EXDEV", st)
+	}
+	if ch := root.Inode().GetChild("file"); ch == nil || ch.NodeAttr().Ino != createOut.NodeId {
+		t.Errorf("source entry changed: %v", ch)
+	}
+	if ch := other.Inode().GetChild("moved"); ch != nil {
+		t.Errorf("destination entry created: %v", ch)
+	}
+
+	// The fallback that mv(1) does: copy, then unlink.
+	if st := rawFS.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 10}, Flags: syscall.O_RDWR, Mode: 0644}, "moved", &createOut); !st.Ok() {
+		t.Fatalf("Create copy: %v", st)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: createOut.NodeId}, Fh: createOut.Fh})
+	if st := rawFS.Unlink(nil, &fuse.InHeader{NodeId: 1}, "file"); !st.Ok() {
+		t.Fatalf("Unlink: %v", st)
+	}
+	if root.Inode().GetChild("file") != nil || other.Inode().GetChild("moved") == nil {
+		t.Errorf("got root %v, other %v after copy", root.Inode().Children(), other.Inode().Children())
+	}
+}
+
+func TestMemMknodDevice(t *testing.T) {
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	server, err := Mount(mntDir, root, &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	for _, dev := range []struct {
+		name         string
+		mode         uint32
+		major, minor uint32
+	}{
+		{"null", syscall.S_IFCHR, 1, 3},
+		{"sdq", syscall.S_IFBLK, 65, 0},
+		{"bigminor", syscall.S_IFCHR, 240, 300},
+	} {
+		p := mntDir + "/" + dev.name
+		if err := syscall.Mknod(p, dev.mode|0644, int(MakeDev(dev.major, dev.minor))); err == syscall.EPERM {
+			t.Skip("creating device nodes needs CAP_MKNOD")
+		} else if err != nil {
+			t.Fatalf("Mknod(%s): %v", dev.name, err)
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			t.Fatalf("Lstat(%s): %v", dev.name, err)
+		}
+		if st.Mode&syscall.S_IFMT != dev.mode {
+			t.Errorf("%s: got mode %o, want type %o", dev.name, st.Mode, dev.mode)
+		}
+		if major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)); major != dev.major || minor != dev.minor {
+			t.Errorf("%s: got device %d:%d, want %d:%d", dev.name, major, minor, dev.major, dev.minor)
+		}
+	}
+}
@@ -5,6 +5,10 @@
 package nodefs
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -23,9 +27,20 @@ func Mount(dir string, root DirOperations, options *Options) (*fuse.Server, erro
 		}
 	}
 
+	created, err := createMountpoint(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	removeCreated := func() {
+		if created {
+			os.Remove(dir)
+		}
+	}
+
 	rawFS := NewNodeFS(root, options)
 	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
 	if err != nil {
+		removeCreated()
 		return nil, err
 	}
 
@@ -33,8 +48,152 @@ func Mount(dir string, root DirOperations, options *Options) (*fuse.Server, erro
 	if err := server.WaitMount(); err != nil {
 		// we don't shutdown the serve loop. If the mount does
 		// not succeed, the loop won't work and exit.
+		removeCreated()
 		return nil, err
 	}
 
+	server.OnUnmount(removeCreated)
 	return server, nil
 }
+
+// MountFile mounts a directory on `dir` that holds a single file,
+// served by `file`. The file is named after the last component of
+// `dir`, so mounting on /tmp/status serves /tmp/status/status. The
+// directory is read-only. This saves writing a root directory for
+// tools that expose one virtual file. Options are as for Mount.
+func MountFile(dir string, file FileOperations, options *Options) (*fuse.Server, error) {
+	root := &singleFileRoot{
+		name: filepath.Base(filepath.Clean(dir)),
+		file: file,
+	}
+	return Mount(dir, root, options)
+}
+
+// singleFileRoot is the root directory for MountFile.
+type singleFileRoot struct {
+	OperationStubs
+	name string
+	file FileOperations
+}
+
+func (r *singleFileRoot) OnAdd(ctx context.Context) {
+	ch := r.Inode().NewPersistentInode(ctx, r.file, NodeAttr{})
+	r.Inode().AddChild(r.name, ch, false)
+}
+
+// createMountpoint creates dir for Options.CreateMountpoint, and
+// returns whether it did.
+func createMountpoint(dir string, options *Options) (bool, error) {
+	if !options.CreateMountpoint {
+		return false, nil
+	}
+	mode := options.MountpointMode
+	if mode == 0 {
+		mode = 0755
+	}
+	err := os.Mkdir(dir, mode)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MountFd is like Mount, but serves a FUSE connection that is
+// already mounted, given as the /dev/fuse descriptor `fd`. This is
+// for sandboxed setups, where a privileged helper opens /dev/fuse,
+// mounts it with mount(2) and the "fd=N" option, and passes the
+// descriptor on. The caller is responsible for the mount and the
+// unmount: Server.Unmount does nothing, and the serve loop ends when
+// the file system is unmounted. Options.CreateMountpoint has no
+// effect. Since there is no mount point to poll, the process serving
+// the file system should not access it through os.File, which can
+// deadlock on the kernel's POLL request (see fuse.Server.WaitMount).
+func MountFd(fd int, root DirOperations, options *Options) (*fuse.Server, error) {
+	if options == nil {
+		oneSec := time.Second
+		options = &Options{
+			EntryTimeout: &oneSec,
+			AttrTimeout:  &oneSec,
+		}
+	}
+
+	rawFS := NewNodeFS(root, options)
+	server, err := fuse.NewServerFd(rawFS, fd, &options.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	return server, nil
+}
+
+// MountWithRetry is like Mount, but if the mount point is
+// temporarily busy, for example because a previous file system on it
+// is still being unmounted, it tries again up to `attempts` times in
+// total. The wait before each retry starts at `backoff`, and doubles
+// every time. Errors that won't go away by waiting, such as a
+// missing mount point (ENOENT) or lacking permissions (EPERM,
+// EACCES), are returned immediately; otherwise, the error of the
+// last attempt is returned. With Options.CreateMountpoint, a
+// missing mount point is created by Mount, as usual.
+//
+// A directory that is itself a mount point is considered busy, as is
+// one that returns EBUSY, EAGAIN, or ENOTCONN (a FUSE mount whose
+// server went away).
+func MountWithRetry(dir string, root DirOperations, options *Options, attempts int, backoff time.Duration) (*fuse.Server, error) {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = checkMountPoint(dir)
+		if os.IsNotExist(err) && options != nil && options.CreateMountpoint {
+			// Mount creates it.
+			err = nil
+		}
+		if err == nil {
+			var server *fuse.Server
+			server, err = Mount(dir, root, options)
+			if err == nil {
+				return server, nil
+			}
+		}
+
+		switch mountErrno(err) {
+		case syscall.EBUSY, syscall.EAGAIN, syscall.ENOTCONN:
+		default:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// checkMountPoint returns EBUSY if something is mounted on dir.
+func checkMountPoint(dir string) error {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: dir, Err: err}
+	}
+	if err := syscall.Stat(filepath.Dir(filepath.Clean(dir)), &parent); err != nil {
+		return &os.PathError{Op: "stat", Path: filepath.Dir(dir), Err: err}
+	}
+	if st.Dev != parent.Dev {
+		return &os.PathError{Op: "mount", Path: dir, Err: syscall.EBUSY}
+	}
+	return nil
+}
+
+// mountErrno returns the Errno underlying err, or 0 if there is
+// none. fusermount failures don't carry one.
+func mountErrno(err error) syscall.Errno {
+	switch t := err.(type) {
+	case syscall.Errno:
+		return t
+	case *os.PathError:
+		return mountErrno(t.Err)
+	case *os.SyscallError:
+		return mountErrno(t.Err)
+	}
+	return 0
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+func TestMountWithRetry(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	opts := &Options{}
+	opts.Debug = testutil.VerboseTest()
+	first, err := Mount(dir, &OperationStubs{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mount point is busy until the first server goes away.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Unmount()
+	}()
+
+	server, err := MountWithRetry(dir, &OperationStubs{}, opts, 10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("MountWithRetry: %v", err)
+	}
+	server.Unmount()
+}
+
+func TestMountWithRetryPermanent(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	_, err := MountWithRetry(filepath.Join(dir, "missing"), &OperationStubs{}, nil, 5, time.Hour)
+	if mountErrno(err) != syscall.ENOENT {
+		t.Errorf("got %v, want ENOENT", err)
+	}
+	if d := time.Since(start); d > time.Minute {
+		t.Errorf("ENOENT was retried, took %v", d)
+	}
+}
+
+func TestMountWithRetryBusy(t *testing.T) {
+	var busy string
+	for _, d := range []string{"/proc", "/dev"} {
+		if checkMountPoint(d) != nil {
+			busy = d
+			break
+		}
+	}
+	if busy == "" {
+		t.Skip("no mount point found")
+	}
+
+	start := time.Now()
+	_, err := MountWithRetry(busy, &OperationStubs{}, nil, 3, 10*time.Millisecond)
+	if mountErrno(err) != syscall.EBUSY {
+		t.Errorf("got %v, want EBUSY", err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("returned after %v, want 2 retries", d)
+	}
+}
+
+func TestMountCreateMountpoint(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	mnt := filepath.Join(dir, "mnt")
+	opts := &Options{CreateMountpoint: true}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mnt, &OperationStubs{}, opts)
+	if err != nil {
+		if _, statErr := os.Stat(mnt); !os.IsNotExist(statErr) {
+			t.Errorf("mount point left behind after failure: %v", statErr)
+		}
+		t.Fatal(err)
+	}
+	if err := checkMountPoint(mnt); mountErrno(err) != syscall.EBUSY {
+		t.Errorf("not mounted: %v", err)
+	}
+	if err := server.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mnt); !os.IsNotExist(err) {
+		t.Errorf("mount point not removed: %v", err)
+	}
+}
+
+func TestMountWithRetryCreateMountpoint(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	mnt := filepath.Join(dir, "mnt")
+	opts := &Options{CreateMountpoint: true}
+	opts.Debug = testutil.VerboseTest()
+	server, err := MountWithRetry(mnt, &OperationStubs{}, opts, 3, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("MountWithRetry: %v", err)
+	}
+	if err := checkMountPoint(mnt); mountErrno(err) != syscall.EBUSY {
+		t.Errorf("not mounted: %v", err)
+	}
+	if err := server.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mnt); !os.IsNotExist(err) {
+		t.Errorf("mount point not removed: %v", err)
+	}
+}
+
+func TestMountFile(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	mnt := filepath.Join(dir, "status")
+	file := &MemRegularFile{Data: []byte("hello")}
+	file.Attr.Mode = 0444
+	opts := &Options{CreateMountpoint: true}
+	opts.Debug = testutil.VerboseTest()
+	server, err := MountFile(mnt, file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	if got, err := ioutil.ReadFile(filepath.Join(mnt, "status")); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v, want \"hello\"", got, err)
+	}
+	if names, err := ioutil.ReadDir(mnt); err != nil || len(names) != 1 {
+		t.Errorf("got %d entries, %v, want 1", len(names), err)
+	}
+}
+
+func TestCreateMountpoint(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	opts := &Options{CreateMountpoint: true, MountpointMode: 0700}
+	mnt := filepath.Join(dir, "mnt")
+	if created, err := createMountpoint(mnt, opts); err != nil || !created {
+		t.Fatalf("got %v, %v, want true, nil", created, err)
+	}
+	if fi, err := os.Stat(mnt); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("got %v, %v, want a directory with mode 0700", fi, err)
+	}
+
+	// An existing directory is not ours to remove.
+	if created, err := createMountpoint(mnt, opts); err != nil || created {
+		t.Errorf("existing: got %v, %v, want false, nil", created, err)
+	}
+	if _, err := createMountpoint(filepath.Join(dir, "a/b"), opts); !os.IsNotExist(err) {
+		t.Errorf("missing parent: got %v, want ENOENT", err)
+	}
+	if created, err := createMountpoint(filepath.Join(dir, "other"), &Options{}); err != nil || created {
+		t.Errorf("without option: got %v, %v", created, err)
+	}
+}
+
+func TestMountFd(t *testing.T) {
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("open /dev/fuse: %v", err)
+	}
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	// This is what a privileged helper would do.
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d", fd, os.Getuid(), os.Getgid())
+	if err := syscall.Mount("mountfd", dir, "fuse", 0, data); err != nil {
+		syscall.Close(fd)
+		t.Skipf("mount: %v", err)
+	}
+
+	root := &MemDir{}
+	root.Attr.Mode = 0755
+	server, err := MountFd(fd, root, nil)
+	if err != nil {
+		syscall.Unmount(dir, 0)
+		t.Fatalf("MountFd: %v", err)
+	}
+
+	// Use raw syscalls: os.File would register the FUSE file with
+	// the runtime poller, and there is no mount point for the
+	// WaitMount poll hack.
+	wfd, err := syscall.Open(filepath.Join(dir, "file"), syscall.O_CREAT|syscall.O_WRONLY, 0644)
+	if err != nil {
+		t.Errorf("Open: %v", err)
+	} else {
+		if _, err := syscall.Write(wfd, []byte("hello")); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+		syscall.Close(wfd)
+	}
+	if root.Inode().GetChild("file") == nil {
+		t.Errorf("file not created in the tree")
+	}
+
+	if err := server.Unmount(); err != nil {
+		t.Errorf("Unmount: %v", err)
+	}
+	if err := syscall.Unmount(dir, 0); err != nil {
+		t.Fatalf("unmount: %v", err)
+	}
+	server.Wait()
+}
+
+func TestMountFdNotDevice(t *testing.T) {
+	f, err := ioutil.TempFile("", "mountfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := MountFd(int(f.Fd()), &OperationStubs{}, nil); err == nil {
+		t.Errorf("MountFd succeeded on a regular file")
+	}
+}
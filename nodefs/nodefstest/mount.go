@@ -0,0 +1,77 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nodefstest provides helpers for testing file systems built
+// with nodefs, by mounting them in the test process.
+package nodefstest
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+	"github.com/hanwen/go-fuse/nodefs"
+)
+
+// unmountAttempts is how often the cleanup of TestMount tries to
+// unmount, on top of the retries of fuse.Server.Unmount.
+const unmountAttempts = 10
+
+// TestMount mounts `root` on a new temporary directory, and returns
+// the directory and the server. Mount only returns once the kernel
+// serves the mount. If mounting fails, the test fails immediately.
+// When the test and its subtests are done, the file system is
+// unmounted, retrying while the mount is still busy, eg. because
+// the kernel has not yet processed the release of all files, and the
+// directory is removed.
+//
+// If `opts` is nil, entry and attribute timeouts of 1 second are
+// used, like for nodefs.Mount. With `go test -v`, the FUSE traffic
+// is logged.
+func TestMount(t *testing.T, root nodefs.DirOperations, opts *nodefs.Options) (mntDir string, server *fuse.Server) {
+	t.Helper()
+	if opts == nil {
+		oneSec := time.Second
+		opts = &nodefs.Options{
+			EntryTimeout: &oneSec,
+			AttrTimeout:  &oneSec,
+		}
+		opts.Debug = testutil.VerboseTest()
+	}
+
+	mntDir, err := ioutil.TempDir("", strings.Replace(t.Name(), "/", "_", -1))
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	server, err = nodefs.Mount(mntDir, root, opts)
+	if err != nil {
+		os.Remove(mntDir)
+		t.Fatalf("Mount: %v", err)
+	}
+
+	t.Cleanup(func() {
+		for i := 0; ; i++ {
+			err := server.Unmount()
+			if err == nil {
+				break
+			}
+			if i == unmountAttempts-1 {
+				// Removing the directory would fail, or
+				// worse, delete files in the mount.
+				t.Errorf("Unmount(%q): %v", mntDir, err)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := os.Remove(mntDir); err != nil {
+			t.Errorf("Remove(%q): %v", mntDir, err)
+		}
+	})
+	return mntDir, server
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefstest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/nodefs"
+)
+
+type helloRoot struct {
+	nodefs.MemDir
+}
+
+func (r *helloRoot) OnAdd(ctx context.Context) {
+	ch := r.Inode().NewPersistentInode(ctx, &nodefs.MemRegularFile{Data: []byte("hello")}, nodefs.NodeAttr{})
+	r.Inode().AddChild("file", ch, false)
+}
+
+func TestTestMount(t *testing.T) {
+	var mntDir string
+	t.Run("mounted", func(t *testing.T) {
+		root := &helloRoot{}
+		root.Attr.Mode = 0755
+		mntDir, _ = TestMount(t, root, nil)
+
+		// Keep a file open, so the first unmount attempt may
+		// find the mount busy.
+		f, err := os.Open(mntDir + "/file")
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer f.Close()
+
+		c, err := ioutil.ReadAll(f)
+		if err != nil || string(c) != "hello" {
+			t.Errorf("got %q, %v, want %q", c, err, "hello")
+		}
+	})
+
+	if _, err := os.Lstat(mntDir); !os.IsNotExist(err) {
+		t.Errorf("mount point %q still exists after cleanup: %v", mntDir, err)
+	}
+}
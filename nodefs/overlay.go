@@ -0,0 +1,844 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// whiteoutPrefix marks an entry in the upper layer that hides the
+// lower entry with the rest of the name.
+const whiteoutPrefix = ".wh."
+
+// opaqueMarker is created in an upper directory that replaces a
+// deleted lower directory, so the lower contents stay hidden.
+const opaqueMarker = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// copyUpTempPrefix is prepended to the name of a file while it is
+// copied up. As a whiteout name, it is hidden in the overlay.
+const copyUpTempPrefix = whiteoutPrefix + whiteoutPrefix + "copyup."
+
+// overlayFS holds the state shared by the nodes of an overlay.
+type overlayFS struct {
+	// mu protects the layers of all overlayNodes. It is not held
+	// during copy-ups, which can take long.
+	mu sync.Mutex
+
+	lowerRoot DirOperations
+	upperRoot MutableDirOperations
+	attached  bool
+}
+
+// overlayNode is a node of the overlay. It presents the upper layer
+// node if there is one, and the lower one otherwise. Directories
+// present in both layers are merged.
+type overlayNode struct {
+	OperationStubs
+	fs *overlayFS
+
+	// The layer nodes live in trees of their own, which are not
+	// reachable by the kernel.
+	upper *Inode
+	lower *Inode
+
+	// copyMu serializes copy-ups of this node.
+	copyMu sync.Mutex
+}
+
+var _ = (MutableDirOperations)((*overlayNode)(nil))
+var _ = (FileOperations)((*overlayNode)(nil))
+var _ = (ForgetOperations)((*overlayNode)(nil))
+
+// overlayHandle is the FileHandle for a file opened in one of the
+// layers.
+type overlayHandle struct {
+	FileHandleStubs
+	layer *Inode
+	fh    FileHandle
+}
+
+// NewOverlayRoot returns the root of a file system that overlays a
+// writable `upper` directory over a read-only `lower` one, as
+// overlayfs does. Files are read from the upper layer if they exist
+// there, and from the lower one otherwise; directories that exist in
+// both are merged. A lower file or symlink is copied to the upper
+// layer before it is opened for writing or its attributes are
+// changed. Deleting a lower entry leaves a whiteout in the upper
+// layer: an entry named ".wh." followed by the deleted name, which
+// hides it. Names with the ".wh." prefix are not shown in the
+// overlay, and cannot be created in it.
+//
+// The lower layer is never modified. The layers are attached to the
+// bridge as separate trees when the root is added, so `lower` and
+// `upper` must not be used elsewhere. Renaming a directory that
+// exists in the lower layer fails with EXDEV.
+func NewOverlayRoot(lower DirOperations, upper MutableDirOperations) DirOperations {
+	return &overlayNode{
+		fs: &overlayFS{
+			lowerRoot: lower,
+			upperRoot: upper,
+		},
+	}
+}
+
+func (n *overlayNode) OnAdd(ctx context.Context) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	if n.fs.attached {
+		return
+	}
+	n.fs.attached = true
+	n.lower = n.Inode().NewPersistentInode(ctx, n.fs.lowerRoot, NodeAttr{Mode: fuse.S_IFDIR})
+	n.upper = n.Inode().NewPersistentInode(ctx, n.fs.upperRoot, NodeAttr{Mode: fuse.S_IFDIR})
+}
+
+// layers returns the upper and lower layer nodes.
+func (n *overlayNode) layers() (upper, lower *Inode) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.upper, n.lower
+}
+
+// top returns the node that is presented for n.
+func (n *overlayNode) top() *Inode {
+	upper, lower := n.layers()
+	if upper != nil {
+		return upper
+	}
+	return lower
+}
+
+// lookupLayer looks up `name` in the layer directory `dir`, and adds
+// it to the layer's tree, as the bridge would. It returns nil if the
+// entry does not exist. Nodes that are not kept by an overlayNode
+// must be given to releaseLayer.
+func lookupLayer(ctx context.Context, dir *Inode, name string) (*Inode, syscall.Errno) {
+	if dir == nil || !dir.IsDir() {
+		return nil, OK
+	}
+	var out fuse.EntryOut
+	ch, errno := dir.dirOps().Lookup(ctx, name, &out)
+	if errno == syscall.ENOENT {
+		return nil, OK
+	} else if errno != 0 {
+		return nil, errno
+	}
+	if dir.GetChild(name) != ch {
+		dir.AddChild(name, ch, true)
+	}
+	return ch, OK
+}
+
+// releaseLayer drops a layer node that lookupLayer attached, along
+// with the entries left below it, as the bridge drops nodes that the
+// kernel forgot. Persistent nodes belong to the layer's file system,
+// eg. a MemDir, and are kept.
+func releaseLayer(l *Inode) {
+	if l == nil || l.isPersistent() {
+		return
+	}
+	for name, ch := range l.Children() {
+		if ch.isPersistent() {
+			continue
+		}
+		if ok, _ := l.RmChild(name); ok {
+			ch.removeRef(0, false)
+		}
+	}
+	for {
+		name, parent := l.Parent()
+		if parent == nil || parent.GetChild(name) != l {
+			break
+		}
+		if ok, _ := parent.RmChild(name); !ok {
+			break
+		}
+	}
+	l.removeRef(0, false)
+}
+
+// OnForget releases the layer nodes once the kernel has forgotten n.
+func (n *overlayNode) OnForget() {
+	upper, lower := n.layers()
+	releaseLayer(upper)
+	releaseLayer(lower)
+}
+
+// lookupLayers finds the layer nodes for the entry `name`. The lower
+// node is returned even if the upper one hides it, but not if it was
+// deleted.
+func (n *overlayNode) lookupLayers(ctx context.Context, name string) (upper, lower *Inode, errno syscall.Errno) {
+	dirUpper, dirLower := n.layers()
+	upper, errno = lookupLayer(ctx, dirUpper, name)
+	if errno != 0 {
+		return nil, nil, errno
+	}
+	if upper == nil && dirUpper != nil {
+		wh, errno := lookupLayer(ctx, dirUpper, whiteoutPrefix+name)
+		releaseLayer(wh)
+		if errno != 0 || wh != nil {
+			return nil, nil, errno
+		}
+	}
+	lower, errno = lookupLayer(ctx, dirLower, name)
+	if errno != 0 {
+		return nil, nil, errno
+	}
+	return upper, lower, OK
+}
+
+// mergedLower returns the lower node that is presented together with
+// `upper`: the lower node itself if there is no upper one, and the
+// lower directory if both are directories, unless the upper one is
+// opaque.
+func mergedLower(ctx context.Context, upper, lower *Inode) (*Inode, syscall.Errno) {
+	if upper == nil || lower == nil {
+		return lower, OK
+	}
+	if !upper.IsDir() || !lower.IsDir() {
+		return nil, OK
+	}
+	opaque, errno := lookupLayer(ctx, upper, opaqueMarker)
+	releaseLayer(opaque)
+	if errno != 0 || opaque != nil {
+		return nil, errno
+	}
+	return lower, OK
+}
+
+func (n *overlayNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return nil, syscall.ENOENT
+	}
+	upper, found, errno := n.lookupLayers(ctx, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	lower, errno := mergedLower(ctx, upper, found)
+	if lower != found {
+		// Hidden by the upper node.
+		releaseLayer(found)
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	top := upper
+	if top == nil {
+		top = lower
+	}
+	if top == nil {
+		return nil, syscall.ENOENT
+	}
+
+	var attr fuse.AttrOut
+	if errno := top.Operations().Getattr(ctx, &attr); errno != 0 {
+		return nil, errno
+	}
+	out.Attr = attr.Attr
+
+	if ch := n.Inode().GetChild(name); ch != nil && ch.Mode() == top.Mode() {
+		if on, ok := ch.Operations().(*overlayNode); ok {
+			n.fs.mu.Lock()
+			on.upper, on.lower = upper, lower
+			n.fs.mu.Unlock()
+			return ch, OK
+		}
+	}
+	return n.newChild(ctx, upper, lower), OK
+}
+
+// newChild creates an overlay Inode for the given layer nodes.
+func (n *overlayNode) newChild(ctx context.Context, upper, lower *Inode) *Inode {
+	top := upper
+	if top == nil {
+		top = lower
+	}
+	return n.Inode().NewInode(ctx, &overlayNode{
+		fs:    n.fs,
+		upper: upper,
+		lower: lower,
+	}, NodeAttr{Mode: top.Mode()})
+}
+
+// copyUp makes sure n has an upper layer node, and returns it. The
+// parent directories are copied up first. Only copy-ups of the same
+// node wait for each other; the rest of the overlay stays usable
+// while a large file is copied.
+func (n *overlayNode) copyUp(ctx context.Context) (*Inode, syscall.Errno) {
+	n.copyMu.Lock()
+	defer n.copyMu.Unlock()
+
+	upper, lower := n.layers()
+	if upper != nil {
+		return upper, OK
+	}
+	name, parent := n.Inode().Parent()
+	if parent == nil {
+		return nil, syscall.ENOENT
+	}
+	dir, errno := parent.Operations().(*overlayNode).copyUp(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	var attr fuse.AttrOut
+	if errno := lower.Operations().Getattr(ctx, &attr); errno != 0 {
+		return nil, errno
+	}
+	mode := attr.Mode & 07777
+	dirOps := mutableDirOpsOf(dir.Operations())
+
+	var out fuse.EntryOut
+	var ch *Inode
+	created := name
+	switch lower.Mode() {
+	case fuse.S_IFDIR:
+		ch, errno = dirOps.Mkdir(ctx, name, mode, &out)
+	case fuse.S_IFLNK:
+		var target []byte
+		target, errno = lower.linkOps().Readlink(ctx)
+		if errno == 0 {
+			ch, errno = dirOps.Symlink(ctx, string(target), name, &out)
+		}
+	case fuse.S_IFREG:
+		// The data is copied under a hidden name, so lookups
+		// do not find a partial file while the lower one is
+		// still presented.
+		created = copyUpTempPrefix + name
+		var fh FileHandle
+		ch, fh, _, errno = dirOps.Create(ctx, created, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, mode)
+		if errno == 0 {
+			errno = copyData(ctx, lower, ch, fh)
+			ch.fileOps().Release(ctx, fh)
+			if errno != 0 {
+				dirOps.Unlink(ctx, created)
+				dir.RmChild(created)
+			}
+		}
+	default:
+		errno = syscall.ENOTSUP
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	dir.AddChild(created, ch, true)
+
+	in := fuse.SetAttrIn{
+		SetAttrInCommon: fuse.SetAttrInCommon{
+			Valid:     fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+			Atime:     attr.Atime,
+			Atimensec: attr.Atimensec,
+			Mtime:     attr.Mtime,
+			Mtimensec: attr.Mtimensec,
+		},
+	}
+	if ch.Mode() != fuse.S_IFLNK {
+		ch.Operations().Setattr(ctx, &in, &fuse.AttrOut{})
+	}
+	if created != name {
+		if errno := dirOps.Rename(ctx, created, dir.Operations(), name, 0); errno != 0 {
+			dirOps.Unlink(ctx, created)
+			dir.RmChild(created)
+			return nil, errno
+		}
+		dir.MvChild(created, dir, name, true)
+	}
+	n.fs.mu.Lock()
+	n.upper = ch
+	n.fs.mu.Unlock()
+	return ch, OK
+}
+
+// copyData copies the contents of the lower file to the upper file,
+// which was opened as `fh`.
+func copyData(ctx context.Context, lower, upper *Inode, fh FileHandle) syscall.Errno {
+	lowerOps := lower.fileOps()
+	src, _, errno := lowerOps.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		return errno
+	}
+	defer lowerOps.Release(ctx, src)
+
+	buf := make([]byte, 128*1024)
+	var off int64
+	for {
+		res, errno := lowerOps.Read(ctx, src, buf, off)
+		if errno != 0 {
+			return errno
+		}
+		data, st := res.Bytes(buf)
+		if !st.Ok() {
+			res.Done()
+			return syscall.Errno(st)
+		}
+		if len(data) == 0 {
+			res.Done()
+			return OK
+		}
+		_, errno = upper.fileOps().Write(ctx, fh, data, off)
+		off += int64(len(data))
+		res.Done()
+		if errno != 0 {
+			return errno
+		}
+	}
+}
+
+// addWhiteout hides the lower entry `name` below the upper directory
+// `dir`.
+func addWhiteout(ctx context.Context, dir *Inode, name string) syscall.Errno {
+	var out fuse.EntryOut
+	ch, errno := mutableDirOpsOf(dir.Operations()).Mknod(ctx, whiteoutPrefix+name, fuse.S_IFREG, 0, &out)
+	if errno != 0 {
+		return errno
+	}
+	dir.AddChild(whiteoutPrefix+name, ch, true)
+	return OK
+}
+
+// removeWhiteout removes the whiteout for `name` below the upper
+// directory `dir`, if there is one. It returns whether there was.
+func removeWhiteout(ctx context.Context, dir *Inode, name string) (bool, syscall.Errno) {
+	wh, errno := lookupLayer(ctx, dir, whiteoutPrefix+name)
+	if errno != 0 || wh == nil {
+		return false, errno
+	}
+	if errno := mutableDirOpsOf(dir.Operations()).Unlink(ctx, whiteoutPrefix+name); errno != 0 {
+		return false, errno
+	}
+	dir.RmChild(whiteoutPrefix + name)
+	return true, OK
+}
+
+// prepareCreate checks that `name` can be created in n, and returns
+// the upper directory to create it in. If the name was deleted from
+// the lower layer before, `opaque` is set.
+func (n *overlayNode) prepareCreate(ctx context.Context, name string) (dir *Inode, opaque bool, errno syscall.Errno) {
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return nil, false, syscall.EINVAL
+	}
+	upper, lower, errno := n.lookupLayers(ctx, name)
+	if errno != 0 {
+		return nil, false, errno
+	}
+	if upper != nil || lower != nil {
+		return nil, false, syscall.EEXIST
+	}
+	dir, errno = n.copyUp(ctx)
+	if errno != 0 {
+		return nil, false, errno
+	}
+	opaque, errno = removeWhiteout(ctx, dir, name)
+	return dir, opaque, errno
+}
+
+func (n *overlayNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	dir, opaque, errno := n.prepareCreate(ctx, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := mutableDirOpsOf(dir.Operations()).Mkdir(ctx, name, mode, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	dir.AddChild(name, ch, true)
+	if opaque {
+		var markerOut fuse.EntryOut
+		marker, errno := mutableDirOpsOf(ch.Operations()).Mknod(ctx, opaqueMarker, fuse.S_IFREG, 0, &markerOut)
+		if errno != 0 {
+			return nil, errno
+		}
+		ch.AddChild(opaqueMarker, marker, true)
+	}
+	return n.newChild(ctx, ch, nil), OK
+}
+
+func (n *overlayNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	dir, _, errno := n.prepareCreate(ctx, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := mutableDirOpsOf(dir.Operations()).Mknod(ctx, name, mode, dev, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	dir.AddChild(name, ch, true)
+	return n.newChild(ctx, ch, nil), OK
+}
+
+func (n *overlayNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	dir, _, errno := n.prepareCreate(ctx, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := mutableDirOpsOf(dir.Operations()).Symlink(ctx, target, name, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	dir.AddChild(name, ch, true)
+	return n.newChild(ctx, ch, nil), OK
+}
+
+func (n *overlayNode) Create(ctx context.Context, name string, flags uint32, mode uint32) (*Inode, FileHandle, uint32, syscall.Errno) {
+	dir, _, errno := n.prepareCreate(ctx, name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	ch, fh, fuseFlags, errno := mutableDirOpsOf(dir.Operations()).Create(ctx, name, flags, mode)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	dir.AddChild(name, ch, true)
+	return n.newChild(ctx, ch, nil), &overlayHandle{layer: ch, fh: fh}, fuseFlags, OK
+}
+
+func (n *overlayNode) Link(ctx context.Context, target Operations, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	t, ok := target.(*overlayNode)
+	if !ok {
+		return nil, syscall.EXDEV
+	}
+	dir, _, errno := n.prepareCreate(ctx, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	targetUpper, errno := t.copyUp(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	ch, errno := mutableDirOpsOf(dir.Operations()).Link(ctx, targetUpper.Operations(), name, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	dir.AddChild(name, ch, true)
+	return t.Inode(), OK
+}
+
+// remove deletes `name` from the upper layer, and hides it in the
+// lower one.
+func (n *overlayNode) remove(ctx context.Context, name string, rmdir bool) syscall.Errno {
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return syscall.ENOENT
+	}
+	upper, lower, errno := n.lookupLayers(ctx, name)
+	if errno != 0 {
+		return errno
+	}
+	if upper == nil && lower == nil {
+		return syscall.ENOENT
+	}
+	top := upper
+	if top == nil {
+		top = lower
+	}
+	if rmdir && !top.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if !rmdir && top.IsDir() {
+		return syscall.EISDIR
+	}
+	if rmdir {
+		merged, errno := mergedLower(ctx, upper, lower)
+		if errno != 0 {
+			return errno
+		}
+		if errno := clearDir(ctx, upper, merged); errno != 0 {
+			return errno
+		}
+	}
+
+	dir, errno := n.copyUp(ctx)
+	if errno != 0 {
+		return errno
+	}
+	if upper != nil {
+		dirOps := mutableDirOpsOf(dir.Operations())
+		if rmdir {
+			errno = dirOps.Rmdir(ctx, name)
+		} else {
+			errno = dirOps.Unlink(ctx, name)
+		}
+		if errno != 0 {
+			return errno
+		}
+		dir.RmChild(name)
+	}
+	if lower != nil {
+		return addWhiteout(ctx, dir, name)
+	}
+	return OK
+}
+
+// clearDir checks that the merged directory of `upper` and `lower` is
+// empty, and removes the whiteouts from `upper`, so it can be
+// removed.
+func clearDir(ctx context.Context, upper, lower *Inode) syscall.Errno {
+	hidden := map[string]bool{}
+	var whiteouts []string
+	if upper != nil {
+		names, errno := listLayer(ctx, upper)
+		if errno != 0 {
+			return errno
+		}
+		for _, name := range names {
+			if name == opaqueMarker {
+				lower = nil
+				whiteouts = append(whiteouts, name)
+			} else if strings.HasPrefix(name, whiteoutPrefix) {
+				hidden[strings.TrimPrefix(name, whiteoutPrefix)] = true
+				whiteouts = append(whiteouts, name)
+			} else {
+				return syscall.ENOTEMPTY
+			}
+		}
+	}
+	if lower != nil {
+		names, errno := listLayer(ctx, lower)
+		if errno != 0 {
+			return errno
+		}
+		for _, name := range names {
+			if !hidden[name] {
+				return syscall.ENOTEMPTY
+			}
+		}
+	}
+	for _, name := range whiteouts {
+		if errno := mutableDirOpsOf(upper.Operations()).Unlink(ctx, name); errno != 0 {
+			return errno
+		}
+		upper.RmChild(name)
+	}
+	return OK
+}
+
+// listLayer returns the names in the layer directory `dir`, except
+// for "." and "..".
+func listLayer(ctx context.Context, dir *Inode) ([]string, syscall.Errno) {
+	str, errno := dir.dirOps().Readdir(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer str.Close()
+	var names []string
+	for str.HasNext() {
+		e, errno := str.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		if e.Name != "." && e.Name != ".." {
+			names = append(names, e.Name)
+		}
+	}
+	return names, OK
+}
+
+func (n *overlayNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.remove(ctx, name, false)
+}
+
+func (n *overlayNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.remove(ctx, name, true)
+}
+
+func (n *overlayNode) Rename(ctx context.Context, name string, newParent Operations, newName string, flags uint32) syscall.Errno {
+	np, ok := newParent.(*overlayNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if flags&RENAME_EXCHANGE != 0 {
+		return syscall.EINVAL
+	}
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return syscall.ENOENT
+	}
+	if strings.HasPrefix(newName, whiteoutPrefix) {
+		return syscall.EINVAL
+	}
+	upper, lower, errno := n.lookupLayers(ctx, name)
+	if errno != 0 {
+		return errno
+	}
+	if merged, errno := mergedLower(ctx, upper, lower); errno != 0 {
+		return errno
+	} else if merged != nil && merged.IsDir() {
+		return syscall.EXDEV
+	}
+	destUpper, destLower, errno := np.lookupLayers(ctx, newName)
+	if errno != 0 {
+		return errno
+	}
+	if merged, errno := mergedLower(ctx, destUpper, destLower); errno != 0 {
+		return errno
+	} else if merged != nil && merged.IsDir() {
+		return syscall.EXDEV
+	}
+
+	var out fuse.EntryOut
+	ch, errno := n.Lookup(ctx, name, &out)
+	if errno != 0 {
+		return errno
+	}
+	if n.Inode().GetChild(name) != ch {
+		n.Inode().AddChild(name, ch, true)
+	}
+	if _, errno := ch.Operations().(*overlayNode).copyUp(ctx); errno != 0 {
+		return errno
+	}
+	dir, errno := n.copyUp(ctx)
+	if errno != 0 {
+		return errno
+	}
+	newDir, errno := np.copyUp(ctx)
+	if errno != 0 {
+		return errno
+	}
+	if _, errno := removeWhiteout(ctx, newDir, newName); errno != 0 {
+		return errno
+	}
+	if errno := mutableDirOpsOf(dir.Operations()).Rename(ctx, name, newDir.Operations(), newName, flags); errno != 0 {
+		return errno
+	}
+	dir.MvChild(name, newDir, newName, true)
+	if lower != nil {
+		return addWhiteout(ctx, dir, name)
+	}
+	return OK
+}
+
+// Readdir lists the upper directory, followed by the lower entries
+// that are not hidden by it.
+func (n *overlayNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	upper, lower := n.layers()
+	hidden := map[string]bool{}
+	var entries []fuse.DirEntry
+	if upper != nil {
+		str, errno := upper.dirOps().Readdir(ctx)
+		if errno != 0 {
+			return nil, errno
+		}
+		for str.HasNext() {
+			e, errno := str.Next()
+			if errno != 0 {
+				str.Close()
+				return nil, errno
+			}
+			if e.Name == opaqueMarker {
+				lower = nil
+			} else if strings.HasPrefix(e.Name, whiteoutPrefix) {
+				hidden[strings.TrimPrefix(e.Name, whiteoutPrefix)] = true
+			} else {
+				entries = append(entries, e)
+			}
+		}
+		str.Close()
+	}
+	if lower == nil {
+		return NewListDirStream(entries), OK
+	}
+
+	str, errno := lower.dirOps().Readdir(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	return NewMergedDirStream(NewListDirStream(entries),
+		NewFilteredDirStream(str, func(e fuse.DirEntry) bool {
+			return !hidden[e.Name]
+		})), OK
+}
+
+func (n *overlayNode) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return n.top().Operations().Getattr(ctx, out)
+}
+
+func (n *overlayNode) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	upper, errno := n.copyUp(ctx)
+	if errno != 0 {
+		return errno
+	}
+	return upper.Operations().Setattr(ctx, in, out)
+}
+
+func (n *overlayNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return n.top().linkOps().Readlink(ctx)
+}
+
+// Open copies the file up if it is opened for writing.
+func (n *overlayNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	layer := n.top()
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		var errno syscall.Errno
+		layer, errno = n.copyUp(ctx)
+		if errno != 0 {
+			return nil, 0, errno
+		}
+	}
+	fh, fuseFlags, errno := layer.fileOps().Open(ctx, flags)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return &overlayHandle{layer: layer, fh: fh}, fuseFlags, OK
+}
+
+// handle unwraps the FileHandle passed in by the bridge. Without a
+// handle, the call goes to the presented layer.
+func (n *overlayNode) handle(f FileHandle) (FileOperations, FileHandle) {
+	if h, ok := f.(*overlayHandle); ok {
+		return h.layer.fileOps(), h.fh
+	}
+	return n.top().fileOps(), nil
+}
+
+func (n *overlayNode) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	ops, fh := n.handle(f)
+	return ops.Read(ctx, fh, dest, off)
+}
+
+func (n *overlayNode) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	ops, fh := n.handle(f)
+	return ops.Write(ctx, fh, data, off)
+}
+
+func (n *overlayNode) Flush(ctx context.Context, f FileHandle) syscall.Errno {
+	ops, fh := n.handle(f)
+	return ops.Flush(ctx, fh)
+}
+
+func (n *overlayNode) Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	ops, fh := n.handle(f)
+	return ops.Fsync(ctx, fh, flags)
+}
+
+func (n *overlayNode) Release(ctx context.Context, f FileHandle) syscall.Errno {
+	ops, fh := n.handle(f)
+	return ops.Release(ctx, fh)
+}
+
+func (n *overlayNode) Fgetattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	ops, fh := n.handle(f)
+	return ops.Fgetattr(ctx, fh, out)
+}
+
+func (n *overlayNode) Fsetattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	upper, _ := n.layers()
+	if h, ok := f.(*overlayHandle); ok && upper != nil && h.layer == upper {
+		return h.layer.fileOps().Fsetattr(ctx, h.fh, in, out)
+	}
+	return n.Setattr(ctx, in, out)
+}
+
+func (n *overlayNode) Lseek(ctx context.Context, f FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	ops, fh := n.handle(f)
+	return ops.Lseek(ctx, fh, off, whence)
+}
+
+func (n *overlayNode) Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	ops, fh := n.handle(f)
+	return ops.Allocate(ctx, fh, off, size, mode)
+}
@@ -0,0 +1,324 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// overlayTestCase mounts an overlay of a MemDir over the zip file
+// system holding testData.
+type overlayTestCase struct {
+	mntDir string
+	lower  *zipRoot
+	upper  *MemDir
+	server *fuse.Server
+}
+
+func newOverlayTestCase(t *testing.T) *overlayTestCase {
+	zipBytes := createZip(testData)
+	r, err := zip.NewReader(&byteReaderAt{zipBytes}, int64(len(zipBytes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &overlayTestCase{
+		mntDir: testutil.TempDir(),
+		lower:  &zipRoot{r: r},
+		upper:  &MemDir{},
+	}
+	tc.upper.Attr.Mode = 0755
+	tc.server, err = Mount(tc.mntDir, NewOverlayRoot(tc.lower, tc.upper), &Options{
+		MountOptions: fuse.MountOptions{
+			Debug: testutil.VerboseTest(),
+		},
+	})
+	if err != nil {
+		os.Remove(tc.mntDir)
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func (tc *overlayTestCase) Clean() {
+	tc.server.Unmount()
+	os.Remove(tc.mntDir)
+}
+
+func readDirNames(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestOverlayReadThrough(t *testing.T) {
+	tc := newOverlayTestCase(t)
+	defer tc.Clean()
+
+	for k, v := range testData {
+		c, err := ioutil.ReadFile(filepath.Join(tc.mntDir, k))
+		if err != nil {
+			t.Fatalf("ReadFile(%q): %v", k, err)
+		}
+		if string(c) != v {
+			t.Errorf("%s: got %q, want %q", k, c, v)
+		}
+	}
+	if got, want := readDirNames(t, filepath.Join(tc.mntDir, "dir")), []string{"subdir", "subfile1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := tc.upper.Inode().Children(); len(got) != 0 {
+		t.Errorf("reading populated the upper layer: %v", got)
+	}
+}
+
+func TestOverlayCopyUp(t *testing.T) {
+	tc := newOverlayTestCase(t)
+	defer tc.Clean()
+
+	p := filepath.Join(tc.mntDir, "dir/subfile1")
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte(" changed")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	f.Close()
+
+	if c, err := ioutil.ReadFile(p); err != nil || string(c) != "content2 changed" {
+		t.Errorf("got %q, %v, want the changed content", c, err)
+	}
+
+	dir := tc.upper.Inode().GetChild("dir")
+	if dir == nil {
+		t.Fatal("parent directory not copied up")
+	}
+	ch := dir.GetChild("subfile1")
+	if ch == nil {
+		t.Fatal("file not copied up")
+	}
+	if got := string(ch.Operations().(*MemRegularFile).Data); got != "content2 changed" {
+		t.Errorf("upper file has %q", got)
+	}
+
+	lower := tc.lower.Inode().GetChild("dir").GetChild("subfile1").Operations().(*zipFile)
+	if got := string(lower.data); got != "content2" {
+		t.Errorf("lower file changed to %q", got)
+	}
+
+	// The other entries of the directory are still listed.
+	if got, want := readDirNames(t, filepath.Join(tc.mntDir, "dir")), []string{"subdir", "subfile1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tc.mntDir, "dir/new"), []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if dir.GetChild("new") == nil {
+		t.Errorf("new file not created in the upper layer")
+	}
+}
+
+func TestOverlayWhiteout(t *testing.T) {
+	tc := newOverlayTestCase(t)
+	defer tc.Clean()
+
+	if err := os.Remove(filepath.Join(tc.mntDir, "file.txt")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tc.mntDir, "file.txt")); !os.IsNotExist(err) {
+		t.Errorf("Lstat after remove: got %v, want ENOENT", err)
+	}
+	if got, want := readDirNames(t, tc.mntDir), []string{"dir"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if tc.upper.Inode().GetChild(whiteoutPrefix+"file.txt") == nil {
+		t.Errorf("no whiteout in the upper layer")
+	}
+	if tc.lower.Inode().GetChild("file.txt") == nil {
+		t.Errorf("file removed from the lower layer")
+	}
+
+	// Recreating the name hides the whiteout again.
+	if err := ioutil.WriteFile(filepath.Join(tc.mntDir, "file.txt"), []byte("again"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(tc.mntDir, "file.txt")); err != nil || string(c) != "again" {
+		t.Errorf("got %q, %v, want the new content", c, err)
+	}
+
+	// A lower directory can be removed once it looks empty.
+	sub := filepath.Join(tc.mntDir, "dir/subdir")
+	if err := os.Remove(sub); err == nil {
+		t.Fatalf("removed non-empty directory")
+	}
+	if err := os.Remove(filepath.Join(sub, "subfile")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := os.Remove(sub); err != nil {
+		t.Fatalf("Remove(subdir): %v", err)
+	}
+	if got, want := readDirNames(t, filepath.Join(tc.mntDir, "dir")), []string{"subfile1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A new directory in its place does not show the lower contents.
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if got := readDirNames(t, sub); len(got) != 0 {
+		t.Errorf("new directory lists %v", got)
+	}
+}
+
+// volatileDir is a layer whose entries are not persistent, like a
+// loopback directory: Lookup makes a new Inode for each name in
+// files.
+type volatileDir struct {
+	MemDir
+	files map[string]bool
+}
+
+func (d *volatileDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if !d.files[name] {
+		return nil, syscall.ENOENT
+	}
+	return d.Inode().NewInode(ctx, &MemRegularFile{}, NodeAttr{}), OK
+}
+
+func TestOverlayForgetReleasesLayers(t *testing.T) {
+	lower := &volatileDir{files: map[string]bool{"file": true}}
+	upper := &volatileDir{files: map[string]bool{"file": true}}
+	rawFS := NewNodeFS(NewOverlayRoot(lower, upper), &Options{})
+	b := rawFS.(*rawBridge)
+	b.mu.Lock()
+	before := len(b.nodes)
+	b.mu.Unlock()
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if upper.Inode().GetChild("file") == nil {
+		t.Fatalf("upper layer node not attached")
+	}
+	if lower.Inode().GetChild("file") != nil {
+		t.Errorf("hidden lower layer node stays attached")
+	}
+
+	rawFS.Forget(out.NodeId, 1)
+	if upper.Inode().GetChild("file") != nil {
+		t.Errorf("upper layer node stays attached after FORGET")
+	}
+	b.mu.Lock()
+	after := len(b.nodes)
+	b.mu.Unlock()
+	if after != before {
+		t.Errorf("got %d nodes after FORGET, want %d", after, before)
+	}
+}
+
+// gatedFile blocks reads until gate is closed.
+type gatedFile struct {
+	MemRegularFile
+	once    sync.Once
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (f *gatedFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.once.Do(func() { close(f.entered) })
+	<-f.gate
+	return f.MemRegularFile.Read(ctx, fh, dest, off)
+}
+
+func TestOverlayCopyUpConcurrent(t *testing.T) {
+	lower := &MemDir{}
+	upper := &MemDir{}
+	rawFS := NewNodeFS(NewOverlayRoot(lower, upper), &Options{})
+
+	ctx := context.Background()
+	slow := &gatedFile{entered: make(chan struct{}), gate: make(chan struct{})}
+	slow.Data = []byte("lower data")
+	lower.Inode().AddChild("slow", lower.Inode().NewPersistentInode(ctx, slow, NodeAttr{}), false)
+	other := &MemRegularFile{Data: []byte("other")}
+	lower.Inode().AddChild("other", lower.Inode().NewPersistentInode(ctx, other, NodeAttr{}), false)
+
+	lookup := func(name string) fuse.EntryOut {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		return out
+	}
+	slowOut := lookup("slow")
+	otherOut := lookup("other")
+
+	opened := make(chan fuse.Status, 1)
+	go func() {
+		var out fuse.OpenOut
+		opened <- rawFS.Open(nil, &fuse.OpenIn{
+			InHeader: fuse.InHeader{NodeId: slowOut.NodeId},
+			Flags:    syscall.O_WRONLY,
+		}, &out)
+	}()
+	<-slow.entered
+
+	// The copy-up does not hold up the rest of the overlay.
+	done := make(chan fuse.Status, 1)
+	go func() {
+		var out fuse.AttrOut
+		done <- getattrIno(rawFS, otherOut.NodeId, &out)
+	}()
+	select {
+	case st := <-done:
+		if !st.Ok() {
+			t.Errorf("GetAttr: %v", st)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("GetAttr waited for the copy-up")
+	}
+
+	// The partial copy is not visible.
+	if out := lookup("slow"); out.Size != uint64(len(slow.Data)) {
+		t.Errorf("got size %d during copy-up, want %d", out.Size, len(slow.Data))
+	}
+
+	close(slow.gate)
+	if st := <-opened; !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	ch := upper.Inode().GetChild("slow")
+	if ch == nil {
+		t.Fatalf("file not copied up: %v", upper.Inode().Children())
+	}
+	if got := string(ch.Operations().(*MemRegularFile).Data); got != "lower data" {
+		t.Errorf("upper file has %q", got)
+	}
+	if got := len(upper.Inode().Children()); got != 1 {
+		t.Errorf("got upper entries %v, want only the copy", upper.Inode().Children())
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type pollNode struct {
+	OperationStubs
+	ready uint32
+}
+
+func (n *pollNode) Poll(ctx context.Context, f FileHandle, mask uint32) (uint32, syscall.Errno) {
+	return n.ready & mask, OK
+}
+
+func TestPoll(t *testing.T) {
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	event := &pollNode{ready: 0x4}
+	ch := root.Inode().NewPersistentInode(context.Background(), event, NodeAttr{Ino: 2})
+	root.Inode().AddChild("event", ch, false)
+	root.Inode().AddChild("plain",
+		root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 3}), false)
+
+	in := &fuse.PollIn{
+		InHeader: fuse.InHeader{NodeId: 2},
+		Kh:       77,
+		Flags:    fuse.FUSE_POLL_SCHEDULE_NOTIFY,
+		Events:   0x1 | 0x4,
+	}
+	var out fuse.PollOut
+	if st := rawFS.(fuse.RawPollHandler).Poll(nil, in, &out); !st.Ok() {
+		t.Fatalf("Poll: %v", st)
+	}
+	if out.Revents != 0x4 {
+		t.Errorf("got revents 0x%x, want 0x4", out.Revents)
+	}
+	if _, ok := ch.pollHandles[77]; !ok {
+		t.Errorf("poll handle not registered: %v", ch.pollHandles)
+	}
+
+	in.NodeId = 3
+	if st := rawFS.(fuse.RawPollHandler).Poll(nil, in, &out); !st.Ok() {
+		t.Fatalf("Poll: %v", st)
+	}
+	if out.Revents != _DEFAULT_POLLMASK {
+		t.Errorf("got revents 0x%x for plain file, want 0x%x", out.Revents, _DEFAULT_POLLMASK)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type readAheadFile struct {
+	MemRegularFile
+	hints chan int64
+
+	// gate, if set, holds up ReadAhead.
+	gate chan struct{}
+}
+
+func (f *readAheadFile) ReadAhead(ctx context.Context, fh FileHandle, off int64, size int) {
+	gate := f.gate
+	f.hints <- off
+	if gate != nil {
+		<-gate
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	root := &readAheadFile{hints: make(chan int64, 10)}
+	root.Data = make([]byte, 1<<16)
+	rawFS := NewNodeFS(root, &Options{})
+
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	read := func(off uint64) {
+		in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh, Offset: off}
+		if _, st := rawFS.Read(nil, in, make([]byte, 4096)); !st.Ok() {
+			t.Fatalf("Read(%d): %v", off, st)
+		}
+	}
+	hint := func() int64 {
+		select {
+		case off := <-root.hints:
+			return off
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no ReadAhead call")
+		}
+		return 0
+	}
+
+	noHint := func(what string) {
+		select {
+		case off := <-root.hints:
+			t.Errorf("got ReadAhead at %d for %s", off, what)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The first read does not continue anything.
+	read(0)
+	noHint("the first read")
+
+	// A streaming read.
+	for i := uint64(1); i < 4; i++ {
+		read(i * 4096)
+		if got, want := hint(), int64(i+1)*4096; got != want {
+			t.Errorf("read %d: got ReadAhead at %d, want %d", i, got, want)
+		}
+	}
+
+	// A seek breaks the sequence.
+	read(40960)
+	read(8192)
+	noHint("random reads")
+
+	// Release waits for a running ReadAhead.
+	root.gate = make(chan struct{})
+	read(12288)
+	hint()
+	released := make(chan struct{})
+	go func() {
+		rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh})
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Errorf("Release returned during ReadAhead")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(root.gate)
+	<-released
+}
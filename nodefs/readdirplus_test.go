@@ -0,0 +1,130 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type plusRoot struct {
+	OperationStubs
+
+	lookups int
+}
+
+func (r *plusRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	r.lookups++
+	return nil, syscall.ENOENT
+}
+
+type plusStream struct {
+	ctx  context.Context
+	root *plusRoot
+	todo int
+}
+
+func (s *plusStream) HasNext() bool {
+	return s.todo > 0
+}
+
+func (s *plusStream) Next(out *fuse.EntryOut) (fuse.DirEntry, *Inode, syscall.Errno) {
+	s.todo--
+	ino := uint64(10 + s.todo)
+	out.Size = ino
+	ch := s.root.Inode().NewInode(s.ctx, &OperationStubs{}, NodeAttr{Ino: ino})
+	return fuse.DirEntry{
+		Name: fmt.Sprintf("file%d", s.todo),
+		Mode: fuse.S_IFREG,
+		Ino:  ino,
+	}, ch, OK
+}
+
+func (s *plusStream) Close() {}
+
+func (r *plusRoot) Readdirplus(ctx context.Context) (DirStreamPlus, syscall.Errno) {
+	return &plusStream{ctx: ctx, root: r, todo: 3}, OK
+}
+
+func TestReaddirplus(t *testing.T) {
+	root := &plusRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var openOut fuse.OpenOut
+	if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+
+	buf := make([]byte, 4096)
+	in := &fuse.ReadIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Fh:       openOut.Fh,
+	}
+	if st := rawFS.ReadDirPlus(nil, in, fuse.NewDirEntryList(buf, 0)); !st.Ok() {
+		t.Fatalf("ReadDirPlus: %v", st)
+	}
+
+	if root.lookups != 0 {
+		t.Errorf("got %d Lookup calls, want 0", root.lookups)
+	}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("file%d", i)
+		ch := root.Inode().GetChild(name)
+		if ch == nil {
+			t.Errorf("child %q not added to tree", name)
+		} else if got, want := ch.NodeAttr().Ino, uint64(10+i); got != want {
+			t.Errorf("child %q: got ino %d, want %d", name, got, want)
+		}
+	}
+	rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh})
+}
+
+// sourceDir lists its children, and records for every Lookup whether
+// it came from READDIRPLUS.
+type sourceDir struct {
+	OperationStubs
+
+	fromPlus []bool
+}
+
+func (d *sourceDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	d.fromPlus = append(d.fromPlus, LookupFromReaddirPlus(ctx))
+	ch := d.Inode().GetChild(name)
+	if ch == nil {
+		return nil, syscall.ENOENT
+	}
+	return ch, OK
+}
+
+func TestLookupFromReaddirPlus(t *testing.T) {
+	root := &sourceDir{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().AddChild("file",
+		root.Inode().NewPersistentInode(context.Background(), &OperationStubs{}, NodeAttr{Ino: 2}), false)
+
+	var openOut fuse.OpenOut
+	if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+	in := &fuse.ReadIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Fh:       openOut.Fh,
+	}
+	if st := rawFS.ReadDirPlus(nil, in, fuse.NewDirEntryList(make([]byte, 4096), 0)); !st.Ok() {
+		t.Fatalf("ReadDirPlus: %v", st)
+	}
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if want := []bool{true, false}; fmt.Sprint(root.fromPlus) != fmt.Sprint(want) {
+		t.Errorf("got LookupFromReaddirPlus %v, want %v", root.fromPlus, want)
+	}
+}
@@ -49,6 +49,25 @@ func (tc *testCase) Clean() {
 }
 
 func newTestCase(t *testing.T, entryCache bool, attrCache bool) *testCase {
+	oneSec := time.Second
+
+	attrDT := &oneSec
+	if !attrCache {
+		attrDT = nil
+	}
+	entryDT := &oneSec
+	if !entryCache {
+		entryDT = nil
+	}
+	return newTestCaseOptions(t, &Options{
+		EntryTimeout: entryDT,
+		AttrTimeout:  attrDT,
+	})
+}
+
+// newTestCaseOptions mounts a loopback file system with the given
+// options.
+func newTestCaseOptions(t *testing.T, opts *Options) *testCase {
 	tc := &testCase{
 		dir: testutil.TempDir(),
 		T:   t,
@@ -68,20 +87,7 @@ func newTestCase(t *testing.T, entryCache bool, attrCache bool) *testCase {
 		t.Fatalf("NewLoopback: %v", err)
 	}
 
-	oneSec := time.Second
-
-	attrDT := &oneSec
-	if !attrCache {
-		attrDT = nil
-	}
-	entryDT := &oneSec
-	if !entryCache {
-		entryDT = nil
-	}
-	tc.rawFS = NewNodeFS(tc.loopback, &Options{
-		EntryTimeout: entryDT,
-		AttrTimeout:  attrDT,
-	})
+	tc.rawFS = NewNodeFS(tc.loopback, opts)
 
 	tc.server, err = fuse.NewServer(tc.rawFS, tc.mntDir,
 		&fuse.MountOptions{
@@ -446,6 +452,46 @@ func TestNotifyEntry(t *testing.T) {
 	}
 }
 
+func TestMutationNotify(t *testing.T) {
+	oneSec := time.Second
+	tc := newTestCaseOptions(t, &Options{
+		EntryTimeout:  &oneSec,
+		AttrTimeout:   &oneSec,
+		NotifyEntries: true,
+	})
+	defer tc.Clean()
+
+	fn := tc.mntDir + "/file"
+	tc.writeOrig("file", "hello", 0644)
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(fn, &st); err != nil {
+		t.Fatalf("Lstat before: %v", err)
+	}
+	if err := syscall.Unlink(fn); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+	if err := syscall.Lstat(fn, &st); err != syscall.ENOENT {
+		t.Fatalf("Lstat after Unlink: got %v, want ENOENT", err)
+	}
+
+	// Recreated behind the kernel's back, and visible right away.
+	tc.writeOrig("file", "again", 0644)
+	if err := syscall.Lstat(fn, &st); err != nil {
+		t.Fatalf("Lstat after recreate: %v", err)
+	}
+
+	if err := syscall.Rename(fn, tc.mntDir+"/other"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := syscall.Lstat(fn, &st); err != syscall.ENOENT {
+		t.Fatalf("Lstat after Rename: got %v, want ENOENT", err)
+	}
+	if err := syscall.Lstat(tc.mntDir+"/other", &st); err != nil {
+		t.Fatalf("Lstat of new name: %v", err)
+	}
+}
+
 func TestReadDir(t *testing.T) {
 	tc := newTestCase(t, true, true)
 	defer tc.Clean()
@@ -484,6 +530,15 @@ func TestReadDir(t *testing.T) {
 	}
 }
 
+func TestServerCaps(t *testing.T) {
+	tc := newTestCase(t, true, true)
+	defer tc.Clean()
+
+	if caps := tc.loopback.Inode().ServerCaps(); caps == 0 {
+		t.Errorf("got no capabilities after mounting")
+	}
+}
+
 // This test is racy. If an external process consumes space while this
 // runs, we may see spurious differences between the two statfs() calls.
 func TestStatFs(t *testing.T) {
@@ -0,0 +1,76 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+type countingLink struct {
+	MemSymlink
+	readlinks int
+}
+
+func (l *countingLink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	l.readlinks++
+	return l.MemSymlink.Readlink(ctx)
+}
+
+func (l *countingLink) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return OK
+}
+
+func TestSymlinkCache(t *testing.T) {
+	hour := time.Hour
+	for _, tc := range []struct {
+		timeout *time.Duration
+		want    int
+	}{
+		{nil, 10},
+		{&hour, 1},
+	} {
+		root := &OperationStubs{}
+		rawFS := NewNodeFS(root, &Options{SymlinkCacheTimeout: tc.timeout})
+
+		link := &countingLink{}
+		link.Data = []byte("target")
+		root.Inode().AddChild("link",
+			root.Inode().NewPersistentInode(context.Background(), link, NodeAttr{Ino: 2, Mode: fuse.S_IFLNK}), false)
+
+		hdr := &fuse.InHeader{NodeId: 2}
+		for i := 0; i < 10; i++ {
+			got, st := rawFS.Readlink(nil, hdr)
+			if !st.Ok() || string(got) != "target" {
+				t.Fatalf("Readlink: got %q, %v", got, st)
+			}
+		}
+		if link.readlinks != tc.want {
+			t.Errorf("timeout %v: got %d Readlink calls, want %d", tc.timeout, link.readlinks, tc.want)
+		}
+		if tc.timeout == nil {
+			continue
+		}
+
+		var attrOut fuse.AttrOut
+		if st := rawFS.SetAttr(nil, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: *hdr}}, &attrOut); !st.Ok() {
+			t.Fatalf("SetAttr: %v", st)
+		}
+		rawFS.Readlink(nil, hdr)
+		if link.readlinks != 2 {
+			t.Errorf("after Setattr: got %d Readlink calls, want 2", link.readlinks)
+		}
+
+		link.Inode().NotifyContent(0, 0)
+		rawFS.Readlink(nil, hdr)
+		if link.readlinks != 3 {
+			t.Errorf("after NotifyContent: got %d Readlink calls, want 3", link.readlinks)
+		}
+	}
+}
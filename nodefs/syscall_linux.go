@@ -7,6 +7,9 @@ package nodefs
 import (
 	"syscall"
 	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
 )
 
 // futimens - futimens(3) calls utimensat(2) with "pathname" set to null and
@@ -18,3 +21,33 @@ func futimens(fd int, times *[2]syscall.Timespec) (err error) {
 	}
 	return
 }
+
+// utimensat is like futimens, but for a path. Symlinks are not
+// followed.
+func utimensat(path string, times *[2]syscall.Timespec) error {
+	ts := []unix.Timespec{
+		{Sec: times[0].Sec, Nsec: times[0].Nsec},
+		{Sec: times[1].Sec, Nsec: times[1].Nsec},
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// utimeSpecs converts the atime and mtime of `in` into arguments for
+// utimensat(2). Timestamps missing from the valid mask are
+// UTIME_OMIT, and FATTR_ATIME_NOW/FATTR_MTIME_NOW become UTIME_NOW,
+// so the kernel applies its own permission rules for "now".
+func utimeSpecs(in *fuse.SetAttrIn) (ts [2]syscall.Timespec) {
+	ts[0] = utimeSpec(in.Valid, fuse.FATTR_ATIME, fuse.FATTR_ATIME_NOW, in.Atime, in.Atimensec)
+	ts[1] = utimeSpec(in.Valid, fuse.FATTR_MTIME, fuse.FATTR_MTIME_NOW, in.Mtime, in.Mtimensec)
+	return ts
+}
+
+func utimeSpec(valid, set, now uint32, sec uint64, nsec uint32) syscall.Timespec {
+	switch {
+	case valid&set == 0:
+		return syscall.Timespec{Nsec: unix.UTIME_OMIT}
+	case valid&now != 0:
+		return syscall.Timespec{Nsec: unix.UTIME_NOW}
+	}
+	return syscall.Timespec{Sec: int64(sec), Nsec: int64(nsec)}
+}
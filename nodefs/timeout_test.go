@@ -0,0 +1,122 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// volatileNode sets its own attribute timeout.
+type volatileNode struct {
+	OperationStubs
+}
+
+func (n *volatileNode) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.SetTimeout(5 * time.Millisecond)
+	return OK
+}
+
+type timeoutRoot struct {
+	OperationStubs
+}
+
+func (r *timeoutRoot) OnAdd(ctx context.Context) {
+	r.Inode().AddChild("volatile",
+		r.Inode().NewPersistentInode(ctx, &volatileNode{}, NodeAttr{Ino: 2}), false)
+	r.Inode().AddChild("stable",
+		r.Inode().NewPersistentInode(ctx, &OperationStubs{}, NodeAttr{Ino: 3}), false)
+}
+
+func (r *timeoutRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	ch, errno := r.OperationStubs.Lookup(ctx, name, out)
+	if name == "volatile" {
+		out.SetEntryTimeout(5 * time.Millisecond)
+	}
+	return ch, errno
+}
+
+func TestPerNodeTimeout(t *testing.T) {
+	hour := time.Hour
+	rawFS := NewNodeFS(&timeoutRoot{}, &Options{
+		AttrTimeout:  &hour,
+		EntryTimeout: &hour,
+	})
+
+	for _, tc := range []struct {
+		name string
+		ino  uint64
+		want time.Duration
+	}{
+		{"volatile", 2, 5 * time.Millisecond},
+		{"stable", 3, hour},
+	} {
+		var attrOut fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: tc.ino}}, &attrOut); !st.Ok() {
+			t.Fatalf("GetAttr(%s): %v", tc.name, st)
+		}
+		if got := attrOut.Timeout(); got != tc.want {
+			t.Errorf("%s: got attr timeout %v, want %v", tc.name, got, tc.want)
+		}
+
+		var entryOut fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, tc.name, &entryOut); !st.Ok() {
+			t.Fatalf("Lookup(%s): %v", tc.name, st)
+		}
+		if got := entryOut.EntryTimeout(); got != tc.want {
+			t.Errorf("%s: got entry timeout %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestInodeSetTimeout(t *testing.T) {
+	root := &OperationStubs{}
+	hour := time.Hour
+	rawFS := NewNodeFS(root, &Options{
+		AttrTimeout:  &hour,
+		EntryTimeout: &hour,
+	})
+
+	ctx := context.Background()
+	sensor := root.Inode().NewPersistentChild(ctx, "sensor", &OperationStubs{}, NodeAttr{Ino: 2})
+	sensor.SetAttrTimeout(0)
+	sensor.SetEntryTimeout(0)
+	file := root.Inode().NewPersistentChild(ctx, "file", &OperationStubs{}, NodeAttr{Ino: 3})
+	file.SetAttrTimeout(24 * hour)
+	root.Inode().NewPersistentChild(ctx, "default", &OperationStubs{}, NodeAttr{Ino: 4})
+
+	for _, tc := range []struct {
+		name        string
+		ino         uint64
+		attr, entry time.Duration
+	}{
+		{"sensor", 2, 0, 0},
+		{"file", 3, 24 * hour, hour},
+		{"default", 4, hour, hour},
+	} {
+		var attrOut fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: tc.ino}}, &attrOut); !st.Ok() {
+			t.Fatalf("GetAttr(%s): %v", tc.name, st)
+		}
+		if got := attrOut.Timeout(); got != tc.attr {
+			t.Errorf("%s: got attr timeout %v, want %v", tc.name, got, tc.attr)
+		}
+
+		var entryOut fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, tc.name, &entryOut); !st.Ok() {
+			t.Fatalf("Lookup(%s): %v", tc.name, st)
+		}
+		if got := entryOut.AttrTimeout(); got != tc.attr {
+			t.Errorf("%s: got entry attr timeout %v, want %v", tc.name, got, tc.attr)
+		}
+		if got := entryOut.EntryTimeout(); got != tc.entry {
+			t.Errorf("%s: got entry timeout %v, want %v", tc.name, got, tc.entry)
+		}
+	}
+}
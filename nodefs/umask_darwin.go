@@ -0,0 +1,17 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import "github.com/hanwen/go-fuse/fuse"
+
+// OSXFUSE does not send the umask for CREATE and MKNOD.
+
+func createUmask(in *fuse.CreateIn) (uint32, bool) {
+	return 0, false
+}
+
+func mknodUmask(in *fuse.MknodIn) (uint32, bool) {
+	return 0, false
+}
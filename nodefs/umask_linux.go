@@ -0,0 +1,15 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import "github.com/hanwen/go-fuse/fuse"
+
+func createUmask(in *fuse.CreateIn) (uint32, bool) {
+	return in.Umask, true
+}
+
+func mknodUmask(in *fuse.MknodIn) (uint32, bool) {
+	return in.Umask, true
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodefs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/internal/testutil"
+)
+
+// halfWriteFile accepts only half of each write.
+type halfWriteFile struct {
+	OperationStubs
+}
+
+func (f *halfWriteFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	return OK
+}
+
+func (f *halfWriteFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (f *halfWriteFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	return uint32(len(data) / 2), OK
+}
+
+func (f *halfWriteFile) Flush(ctx context.Context, fh FileHandle) syscall.Errno {
+	return OK
+}
+
+type halfWriteRoot struct {
+	OperationStubs
+}
+
+func (r *halfWriteRoot) OnAdd(ctx context.Context) {
+	r.Inode().NewPersistentChild(ctx, "file", &halfWriteFile{}, NodeAttr{Ino: 2})
+}
+
+func TestShortWrite(t *testing.T) {
+	rawFS := NewNodeFS(&halfWriteRoot{}, &Options{})
+
+	hdr := fuse.InHeader{NodeId: 2}
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr, Flags: syscall.O_WRONLY}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	data := make([]byte, 100)
+	n, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: hdr, Fh: openOut.Fh, Size: uint32(len(data))}, data)
+	if !st.Ok() || n != 50 {
+		t.Errorf("got %d, %v, want 50, OK", n, st)
+	}
+}
+
+func TestShortWriteMount(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+
+	opts := &Options{}
+	opts.Debug = testutil.VerboseTest()
+	server, err := Mount(mntDir, &halfWriteRoot{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	// os.File.Write retries short writes, so use the system call.
+	n, err := syscall.Write(fd, make([]byte, 100))
+	if err != nil || n != 50 {
+		t.Errorf("got %d, %v, want a short write of 50 bytes", n, err)
+	}
+}
+
+func TestLoopbackWritebackWrite(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entryOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entryOut); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+
+	// A page flushed from the writeback cache, without file handle.
+	in := &fuse.WriteIn{
+		InHeader:   fuse.InHeader{NodeId: entryOut.NodeId},
+		Offset:     6,
+		Size:       5,
+		WriteFlags: fuse.WRITE_CACHE,
+	}
+	if n, st := rawFS.Write(nil, in, []byte("there")); !st.Ok() || n != 5 {
+		t.Fatalf("Write: %d, %v", n, st)
+	}
+	if got, err := ioutil.ReadFile(dir + "/file"); err != nil || string(got) != "hello there" {
+		t.Errorf("got %q, %v, want %q", got, err, "hello there")
+	}
+}
+
+func TestWriteFromWriteback(t *testing.T) {
+	var got []bool
+	root := &OperationStubs{}
+	rawFS := NewNodeFS(root, &Options{})
+	root.Inode().NewPersistentChild(context.Background(), "file", &writeFlagsFile{got: &got}, NodeAttr{Ino: 2})
+
+	for _, flags := range []uint32{0, fuse.WRITE_CACHE} {
+		rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: 2}, WriteFlags: flags}, nil)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type writeFlagsFile struct {
+	OperationStubs
+	got *[]bool
+}
+
+func (f *writeFlagsFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	*f.got = append(*f.got, WriteFromWriteback(ctx))
+	return uint32(len(data)), OK
+}
+
+// mmapWriteEnv names the file that TestMmapWriteHelper writes
+// through a shared mapping.
+const mmapWriteEnv = "NODEFS_TEST_MMAP_WRITE"
+
+// TestMmapWriteHelper runs in a subprocess of TestMmapWriteback. Page
+// faults on a FUSE file that is served by the faulting process can
+// deadlock, so the mapping must live in a different process.
+func TestMmapWriteHelper(t *testing.T) {
+	name := os.Getenv(mmapWriteEnv)
+	if name == "" {
+		t.Skip("only run as a subprocess of TestMmapWriteback")
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mem, err := syscall.Mmap(int(f.Fd()), 0, 4096, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatalf("Mmap: %v", err)
+	}
+	defer syscall.Munmap(mem)
+
+	copy(mem[100:], "mmapped")
+	if _, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), syscall.MS_SYNC); errno != 0 {
+		t.Fatalf("msync: %v", errno)
+	}
+}
+
+func TestMmapWriteback(t *testing.T) {
+	mntDir := testutil.TempDir()
+	defer os.RemoveAll(mntDir)
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	if err := ioutil.WriteFile(origDir+"/file", make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{}
+	opts.Debug = testutil.VerboseTest()
+	opts.EnableWriteback = true
+	server, err := Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestMmapWriteHelper$")
+	cmd.Env = append(os.Environ(), mmapWriteEnv+"="+mntDir+"/file")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("helper: %v\n%s", err, out)
+	}
+
+	got, err := ioutil.ReadFile(origDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[100:107]) != "mmapped" {
+		t.Errorf("backing file has %q at 100, want %q", got[100:107], "mmapped")
+	}
+}
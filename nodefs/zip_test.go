@@ -177,14 +177,12 @@ func (zr *zipRoot) OnAdd(ctx context.Context) {
 			}
 			ch := p.GetChild(component)
 			if ch == nil {
-				ch = p.NewPersistentInode(ctx, &OperationStubs{},
+				ch = p.NewPersistentChild(ctx, component, &OperationStubs{},
 					NodeAttr{Mode: fuse.S_IFDIR})
-				p.AddChild(component, ch, true)
 			}
 
 			p = ch
 		}
-		ch := p.NewPersistentInode(ctx, &zipFile{file: f}, NodeAttr{})
-		p.AddChild(base, ch, true)
+		p.NewPersistentChild(ctx, base, &zipFile{file: f}, NodeAttr{})
 	}
 }